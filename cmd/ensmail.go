@@ -1,37 +1,225 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"runtime/trace"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
-	"github.com/emersion/go-smtp"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/royalfork/ensmail/pkg/ensmail"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var version = "dev"
 
 func main() {
 	var (
-		ENSRegistry       common.Address
-		Web3RTCURL        string
-		LMTPServerSocket  string
-		LMTPForwardSocket string
+		ENSRegistry        common.Address
+		Web3RTCURL         string
+		LMTPServerSocket   string
+		LMTPForwardSocket  string
+		ForwardSocketFile  string
+		LMTPForwardAddr    string
+		ForwardLocalAddr   string
+		ForwardTLS         string
+		ForwardTLSCA       string
+		ForwardTLSCert     string
+		ForwardTLSKey      string
+		ForwardTLSName     string
+		ForwardDialTimeout time.Duration
+		ForwardWebhook     string
+		ForwardRoutes      string
+		StartupRetries     int
+		StartupBackoff     time.Duration
+		ForwardRetries     int
+		ForwardBackoff     time.Duration
+		DataConcurrency    int
+		DataReadTimeout    time.Duration
+		StatusTimeout      time.Duration
+		ResolveTimeout     time.Duration
+		ShutdownTimeout    time.Duration
+		RateLimitRetry     time.Duration
+		SaturatedRetry     time.Duration
+		ForwardDownRetry   time.Duration
+		SanitizeReceived   string
+		TrustedReceived    int
+		LMTPTLSAddr        string
+		LMTPTLSCert        string
+		LMTPTLSKey         string
+		LMTPTLSClientCA    string
+		LMTPTLSAuthFile    string
+		LMTPTLSProxy       string
+		AllowedDomains     string
+		SubdomainBase      string
+		LogHeaders         string
+		DomainRateLimit    int
+		SourceNameLimit    int
+		SourceRcptLimit    int
+		SourceRcptWindow   time.Duration
+		MetricsAddr        string
+		HealthInterval     time.Duration
+		MetricsStrict      bool
+		QueueDir           string
+		QueueBackoff       time.Duration
+		QueueMaxAttempts   int
+		QueueExpiry        time.Duration
+		AdminToken         string
+		CacheTTL           time.Duration
+		DedupResolves      bool
+		CallCacheTTL       time.Duration
+		ReverseCacheTTL    time.Duration
+		WarmNames          string
+		OverridesFile      string
+		AuditLog           string
+		MaxRcpts           int
+		FanInThreshold     int
+		ErrorCodes         string
+		MessageID          string
+		StripBcc           bool
+		FullFailureError   bool
+		VERPReturnPath     string
+		VERPConcurrency    int
+		MaxInMemory        int64
+		SignKey            string
+		MaxLineLen         int
+		NormalizeCRLF      bool
+		MaxCalls           int
+		SubgraphURL        string
+		SubgraphFirst      bool
 
 		ensRegistry string
+		ensOwners   string
+		aliasDepth  int
+		maxDepth    int
+		jitter      time.Duration
+		defaultFwd  string
+		emailReg    string
+		registrar   string
+		expiryGrace time.Duration
+		mailto      bool
+		lenient     bool
+		disabledKey string
+		allowedKey  string
+		resHeaders  bool
+		tlds        string
+		resolverFn  string
 	)
 
 	flag.StringVar(&ensRegistry, "ens", "0x00000000000C2E074eC69A0dFb2997BA6C7d2e1e", "ENS Registry address")
+	flag.StringVar(&emailReg, "email-registry", "", "Resolve names from the email(bytes32) method of the contract at this address, instead of from ENS text records; unsupported with -owners, -expiry-registrar and -tlds (disabled if empty)")
+	flag.StringVar(&registrar, "expiry-registrar", "", `Reject names whose registration at this .eth registrar (mainnet: "0x57f1887a8BF19b14fC0dF6Fd9B2acc9Af147eA85") has expired (disabled if empty)`)
+	flag.DurationVar(&expiryGrace, "expiry-grace", 0, "Names expired for less than this still resolve, with -expiry-registrar")
+	flag.BoolVar(&mailto, "decode-mailto", false, `Accept "mailto:" URIs in email text records, forwarding to their address`)
+	flag.StringVar(&disabledKey, "disabled-record", "", `Reject names whose text record of this key (conventionally "ensmail.disabled") is "true", with 5.2.1 (disabled if empty)`)
+	flag.StringVar(&allowedKey, "forward-domains-record", "", `Reject names whose text record of this key (conventionally "ensmail.allowed"), if set, doesn't list their email's domain (comma separated), with 5.7.1 (disabled if empty)`)
+	flag.BoolVar(&resHeaders, "resolution-headers", false, "Add the namehash, resolver, and chain ID of each recipient's resolution to forwarded messages' X-ENSMail- headers")
+	flag.BoolVar(&lenient, "lenient-names", false, `Resolve names with ASCII symbols (such as "_"), which ENS normalization otherwise rejects`)
+	flag.StringVar(&resolverFn, "resolver-method", "", `Read email records from this resolver method, which takes only the name's node, such as "emailOf(bytes32)", instead of from ENS text records, which are still read from resolvers without the method (disabled if empty)`)
+	flag.StringVar(&tlds, "tlds", "eth", "Comma separated ENS TLDs which names are resolved under, tried in order (unsupported with -email-registry and -subgraph)")
+	flag.StringVar(&ensOwners, "owners", "", "Comma separated ENS owner addresses; if set, only names owned by these addresses are resolved")
+	flag.StringVar(&defaultFwd, "default-forward", "", "Forward address for names without a resolver or email record (rejected if empty)")
+	flag.DurationVar(&jitter, "resolve-jitter", 0, "Delay each ENS resolution by a random duration up to this, to smooth bursts (disabled if 0)")
+	flag.IntVar(&maxDepth, "max-resolve-depth", 0, "Maximum references (such as aliases) followed per resolution, by every feature combined (unlimited if 0)")
+	flag.IntVar(&aliasDepth, "alias-depth", 0, `Maximum chain of "ensmail.alias" text records followed (aliases are ignored if 0)`)
 	flag.StringVar(&Web3RTCURL, "web3", "", "WebRTC URL for web3 (overwrites HTTP_WEB3_PROVIDER env var)")
 	flag.StringVar(&LMTPServerSocket, "s", "/run/ensmail/ensmail.sock", "LMTP server listens on this socket")
 	flag.StringVar(&LMTPForwardSocket, "f", "/run/ensmail/forward.sock", "LMTP forwards mail to this socket")
+	flag.StringVar(&ForwardSocketFile, "forward-socket-file", "", "File containing the socket path LMTP forwards mail to, instead of -f, which is re-read on SIGHUP so new sessions follow a moved forwarding server (disabled if empty)")
+	flag.StringVar(&LMTPForwardAddr, "forward-addr", "", "LMTP forwards mail to this TCP address, instead of -f")
+	flag.StringVar(&ForwardWebhook, "forward-webhook", "", "Forward mail by POSTing it to this HTTP URL, instead of over LMTP")
+	flag.StringVar(&ForwardRoutes, "forward-routes", "", `Comma separated routes of resolved domains to other LMTP servers (such as "gmail.com=smarthost:24,example.com=/run/example.sock"), with -forward-tls; other domains are forwarded as usual`)
+	flag.StringVar(&ForwardLocalAddr, "forward-local-addr", "", "-forward-addr connections originate from this local IP")
+	flag.StringVar(&ForwardTLS, "forward-tls", "", `-forward-addr connections are secured with implicit "tls" or "starttls" (disabled if empty)`)
+	flag.StringVar(&ForwardTLSCA, "forward-tls-ca", "", "CA file which verifies the -forward-addr server certificate (system roots if empty)")
+	flag.StringVar(&ForwardTLSCert, "forward-tls-cert", "", "Client certificate file presented to -forward-addr")
+	flag.StringVar(&ForwardTLSKey, "forward-tls-key", "", "Client key file for -forward-tls-cert")
+	flag.StringVar(&ForwardTLSName, "forward-tls-server-name", "", "Server name verified for -forward-addr (host of -forward-addr if empty)")
+	flag.StringVar(&LMTPTLSAddr, "tls-addr", "", "LMTP server also listens on this TCP address over TLS (disabled if empty)")
+	flag.StringVar(&LMTPTLSCert, "tls-cert", "", "TLS certificate file for -tls-addr")
+	flag.StringVar(&LMTPTLSKey, "tls-key", "", "TLS key file for -tls-addr")
+	flag.StringVar(&LMTPTLSClientCA, "tls-client-ca", "", "CA file which -tls-addr clients' certificates must be signed by (client certificates aren't required if empty, which requires -tls-auth-file)")
+	flag.StringVar(&LMTPTLSProxy, "tls-proxy-trusted", "", "Comma separated CIDRs of load balancers which prefix -tls-addr connections with a PROXY protocol (v1 or v2) header (disabled if empty)")
+	flag.StringVar(&LMTPTLSAuthFile, "tls-auth-file", "", `File of "username:bcrypt-hash" lines; -tls-addr clients must AUTH PLAIN with one of these credentials before sending mail (disabled if empty)`)
+	flag.StringVar(&SubdomainBase, "subdomain-names", "", `Resolve recipients at subdomains of this domain by their subdomain, ignoring the local-part, so "x@alice.<domain>" resolves alice.eth (disabled if empty)`)
+	flag.StringVar(&LogHeaders, "log-headers", "", `Comma separated header fields (such as "From,To,Subject,Message-ID") of each message to log for debugging; bodies are never logged (disabled if empty)`)
+	flag.StringVar(&AllowedDomains, "allowed-domains", "", "Comma separated domains which resolved addresses are restricted to (unrestricted if empty)")
+	flag.IntVar(&DomainRateLimit, "domain-rate", 0, "Maximum forwards per resolved domain per minute (0 is unlimited)")
+	flag.IntVar(&SourceNameLimit, "source-names", 0, "Maximum distinct ENS names per sender per hour (0 is unlimited)")
+	flag.IntVar(&SourceRcptLimit, "source-rcpts", 0, "Maximum recipients forwarded per sender across all of its messages, per -source-rcpts-window, except bounces (from <>); advisory, as MAIL FROM is easily forged (0 is unlimited)")
+	flag.DurationVar(&SourceRcptWindow, "source-rcpts-window", time.Hour, "Rolling window of -source-rcpts")
+	flag.StringVar(&MetricsAddr, "metrics", "", "Serve prometheus metrics (/metrics) and admin endpoints (/admin/) on this TCP address (disabled if empty)")
+	flag.DurationVar(&HealthInterval, "health-interval", 0, "Probe web3 reachability at this interval, and serve the latest result on -metrics' /healthz (disabled if 0)")
+	flag.BoolVar(&MetricsStrict, "metrics-strict", false, "Exit if the -metrics address can't be listened on (by default, the LMTP server runs without metrics)")
+	flag.StringVar(&AdminToken, "admin-token", "", `Bearer token required by the admin endpoints (/admin/config and /admin/warm-cache on -metrics), which are disabled if empty`)
+	flag.StringVar(&SubgraphURL, "subgraph", "", "ENS subgraph GraphQL URL, used when on-chain resolution is unavailable (disabled if empty)")
+	flag.BoolVar(&SubgraphFirst, "subgraph-first", false, "Resolve from -subgraph first, falling back to on-chain resolution when it is unavailable")
+	flag.IntVar(&MaxCalls, "max-concurrent-calls", 0, "Maximum concurrent web3 contract calls, made by resolutions and other lookups; further calls queue (0 is unlimited)")
+	flag.DurationVar(&CacheTTL, "cache-ttl", 0, "Cache successful resolutions, and name policy lookups, for this long (disabled if 0)")
+	flag.BoolVar(&DedupResolves, "dedup-resolves", false, "Share one resolution between concurrent resolutions of the same name")
+	flag.DurationVar(&CallCacheTTL, "call-cache-ttl", 0, "Cache successful web3 contract call results for this long (disabled if 0)")
+	flag.StringVar(&OverridesFile, "overrides", "", `JSON file of names' emergency resolutions ("name": "email" or "name": "reject"), which take precedence over ENS and the -cache-ttl cache, and are reloaded on SIGHUP (disabled if empty)`)
+	flag.StringVar(&WarmNames, "warm-names", "", "File of ENS names (one per line) resolved into the -cache-ttl cache at startup")
+	flag.DurationVar(&ForwardDialTimeout, "forward-dial-timeout", 5*time.Second, "Timeout connecting to the forward socket (or of each -forward-webhook request)")
+	flag.IntVar(&StartupRetries, "startup-retries", 0, "Retries of the web3 provider dial and ENS registry validation at startup, to ride out brief provider outages")
+	flag.DurationVar(&StartupBackoff, "startup-retry-backoff", time.Second, "Wait before the first -startup-retries retry (doubled for each retry)")
+	flag.IntVar(&ForwardRetries, "forward-retries", 0, "Retries of forwards which fail with a transient (4xx) status")
+	flag.DurationVar(&ForwardBackoff, "forward-retry-backoff", time.Second, "Wait before the first -forward-retries retry (doubled for each retry)")
+	flag.StringVar(&QueueDir, "queue-dir", "", "Queue messages whose forward fails transiently in this directory, and report them delivered; ensmail then retries their delivery (disabled if empty)")
+	flag.DurationVar(&QueueBackoff, "queue-backoff", time.Minute, "Wait before the first retry of a -queue-dir message (doubled for each retry)")
+	flag.IntVar(&QueueMaxAttempts, "queue-max-attempts", 10, "Drop -queue-dir messages after this many delivery attempts")
+	flag.DurationVar(&QueueExpiry, "queue-expiry", 72*time.Hour, "Drop -queue-dir messages queued for longer than this")
+	flag.IntVar(&MaxRcpts, "max-rcpts", 0, "Maximum recipients per transaction; further recipients are deferred (0 is unlimited)")
+	flag.IntVar(&FanInThreshold, "fanin-threshold", 0, "Warn when more than this many distinct ENS names resolve to one address per hour (disabled if 0)")
+	flag.StringVar(&ErrorCodes, "error-codes", "", `Comma separated SMTP reply overrides for resolution errors, as "error=code x.y.z" (errors: no-resolver, no-email, invalid-label, empty-name, unauthorized, invalid-resolved, invalid-resolver, expired, timeout, rejected, disabled, disallowed-domain, depth-exceeded)`)
+	flag.IntVar(&DataConcurrency, "data-concurrency", 0, "Maximum concurrent forward DATA operations (0 is unlimited)")
+	flag.DurationVar(&DataReadTimeout, "data-read-timeout", 0, "Reject messages whose content takes longer than this to receive, and close their connection (disabled if 0)")
+	flag.DurationVar(&StatusTimeout, "forward-status-timeout", 5*time.Second, "Temporarily fail recipients whose forward DATA status takes longer than this after the previous status")
+	flag.DurationVar(&ResolveTimeout, "resolve-timeout", 0, "Temporarily fail recipients whose resolution takes longer than this (disabled if 0)")
+	flag.DurationVar(&ShutdownTimeout, "shutdown-timeout", 30*time.Second, "On shutdown, reject new messages, and wait this long for open transactions (from MAIL until the message is forwarded, or the transaction reset) to complete before closing connections")
+	flag.DurationVar(&RateLimitRetry, "rate-limit-retry-after", 0, "Retry interval suggested in -domain-rate and -source-names rejections (none if 0)")
+	flag.DurationVar(&SaturatedRetry, "data-concurrency-retry-after", 0, "Retry interval suggested in -data-concurrency rejections (none if 0)")
+	flag.DurationVar(&ForwardDownRetry, "forward-down-retry-after", 0, "Retry interval suggested in rejections while the forwarding server is unavailable (none if 0)")
+	flag.StringVar(&AuditLog, "audit-log", "", "Append a JSON audit record of every transaction to this file, which is reopened on SIGHUP (after it's rotated)")
+	flag.StringVar(&VERPReturnPath, "verp", "", "Forward each recipient separately, from this return path with the recipient VERP encoded (disabled if empty)")
+	flag.IntVar(&VERPConcurrency, "verp-concurrency", 1, "Maximum -verp recipients of a message forwarded at once")
+	flag.Int64Var(&MaxInMemory, "max-in-memory-bytes", 0, "Messages held for retries, filtering, or -verp beyond this size are held in a temporary file (0 is unlimited)")
+	flag.StringVar(&SignKey, "sign-key", "", "PEM (PKCS #8) Ed25519 key file which signs X-ENSMail-Resolved headers of forwarded messages (disabled if empty)")
+	flag.IntVar(&MaxLineLen, "max-line-length", 0, "Reject messages with lines longer than this many bytes (0 is unlimited)")
+	flag.BoolVar(&NormalizeCRLF, "normalize-crlf", false, "Convert bare LF line endings of forwarded messages to CRLF (LMTP forwarding already does, so only -forward-webhook needs this)")
+	flag.BoolVar(&FullFailureError, "full-failure-error", false, "Record messages which fail for every recipient as failed transactions (eg: in -audit-log)")
+	flag.BoolVar(&StripBcc, "strip-bcc", false, "Remove Bcc and Resent-Bcc headers from forwarded messages")
+	flag.StringVar(&MessageID, "message-id", "preserve", `Message-ID headers are "preserve"d, "add"ed if missing, or "regenerate"d`)
+	flag.StringVar(&SanitizeReceived, "sanitize-received", "", `Untrusted Received headers are "strip"ped or "mark"ed (disabled if empty)`)
+	flag.IntVar(&TrustedReceived, "trusted-received", 1, "Number of leading Received headers which are trusted by -sanitize-received")
+	namePolicy := flag.Bool("name-policy", false, `enforce the policy set in each recipient name's "ensmail.policy" text record`)
+	resolveAtData := flag.Bool("resolve-at-data", false, "resolve recipients at DATA, rather than at RCPT")
+	debug := flag.Bool("debug", false, "log the primary ENS name of the address each resolved name resolves to")
+	flag.DurationVar(&ReverseCacheTTL, "reverse-cache-ttl", time.Hour, "Cache the primary ENS names (or their absence) logged by -debug for this long")
 	v := flag.Bool("v", false, "print version")
 	flag.Parse()
 
@@ -49,27 +237,475 @@ func main() {
 	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
 	logger.Log("ens", ENSRegistry, "serveSocket", LMTPServerSocket, "fowardSocket", LMTPForwardSocket)
 
-	client, err := ethclient.Dial(Web3RTCURL)
+	// Execution tracing, for profiling sessions with "go tool trace",
+	// is only enabled by the environment, as it's never left on.
+	if file := os.Getenv("ENSMAIL_TRACE"); file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			logger.Log("call", "os.Create", "err", err)
+			os.Exit(1)
+		}
+		if err := trace.Start(f); err != nil {
+			logger.Log("call", "trace.Start", "err", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		defer trace.Stop()
+		logger.Log("trace", file)
+	}
+
+	var client *ethclient.Client
+	err := retryStartup(log.With(logger, "call", "ethclient.Dial"), StartupRetries, StartupBackoff, func() (err error) {
+		client, err = ethclient.Dial(Web3RTCURL)
+		return err
+	})
 	if err != nil {
 		logger.Log("call", "ethclient.Dial", "err", err)
 		os.Exit(1)
 	}
 
-	resolver, err := ensmail.NewENSResolver(ENSRegistry, client)
+	resolverOpts := []ensmail.ENSResolverOption{
+		ensmail.WithResolverLogger(log.With(logger, "app", "ensmail", "component", "resolver")),
+	}
+	if ensOwners != "" {
+		var owners []common.Address
+		for _, owner := range strings.Split(ensOwners, ",") {
+			if !common.IsHexAddress(owner) {
+				logger.Log("flag", "owners", "err", "invalid address", "addr", owner)
+				os.Exit(1)
+			}
+			owners = append(owners, common.HexToAddress(owner))
+		}
+		resolverOpts = append(resolverOpts, ensmail.WithAllowedOwners(owners...))
+	}
+	if defaultFwd != "" {
+		resolverOpts = append(resolverOpts, ensmail.WithDefaultForward(defaultFwd))
+	}
+	if aliasDepth > 0 {
+		resolverOpts = append(resolverOpts, ensmail.WithAliases(aliasDepth))
+	}
+	if maxDepth > 0 {
+		resolverOpts = append(resolverOpts, ensmail.WithMaxResolveDepth(maxDepth))
+	}
+	if jitter > 0 {
+		resolverOpts = append(resolverOpts, ensmail.WithResolveJitter(jitter))
+	}
+	if tlds != "eth" {
+		resolverOpts = append(resolverOpts, ensmail.WithTLDs(strings.Split(tlds, ",")...))
+	}
+	if mailto {
+		resolverOpts = append(resolverOpts, ensmail.WithTextDecoder(ensmail.DecodeMailto))
+	}
+	if disabledKey != "" {
+		resolverOpts = append(resolverOpts, ensmail.WithDisabledRecord(disabledKey))
+	}
+	if allowedKey != "" {
+		resolverOpts = append(resolverOpts, ensmail.WithForwardDomainRecord(allowedKey))
+	}
+	if lenient {
+		resolverOpts = append(resolverOpts, ensmail.WithNameNormalization(ensmail.NormalizeLenient))
+	}
+	if resolverFn != "" {
+		spec, err := ensmail.NewResolverCallSpec(resolverFn)
+		if err != nil {
+			logger.Log("flag", "resolver-method", "err", err)
+			os.Exit(1)
+		}
+		resolverOpts = append(resolverOpts, ensmail.WithResolverCallSpec(spec))
+	}
+	if registrar != "" {
+		if !common.IsHexAddress(registrar) {
+			logger.Log("flag", "expiry-registrar", "err", "invalid address", "addr", registrar)
+			os.Exit(1)
+		}
+		resolverOpts = append(resolverOpts, ensmail.WithExpiryCheck(common.HexToAddress(registrar), expiryGrace))
+	}
+	if resHeaders {
+		var chainID *big.Int
+		err := retryStartup(log.With(logger, "call", "client.ChainID"), StartupRetries, StartupBackoff, func() (err error) {
+			chainCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			chainID, err = client.ChainID(chainCtx)
+			return err
+		})
+		if err != nil {
+			logger.Log("call", "client.ChainID", "err", err)
+			os.Exit(1)
+		}
+		resolverOpts = append(resolverOpts, ensmail.WithChainID(chainID))
+	}
+	if *debug {
+		resolverOpts = append(resolverOpts, ensmail.WithReverseLogging(log.With(logger, "debug", "reverse"), ReverseCacheTTL))
+	}
+
+	var caller bind.ContractCaller = client
+	if MaxCalls > 0 {
+		caller = ensmail.NewLimitingCaller(caller, MaxCalls)
+	}
+	if CallCacheTTL > 0 {
+		caller = ensmail.NewCachingCaller(caller, CallCacheTTL)
+	}
+	resolver, err := ensmail.NewENSResolver(ENSRegistry, caller, resolverOpts...)
 	if err != nil {
 		logger.Log("call", "ensmail.NewENSResolver", "err", err)
 		os.Exit(1)
 	}
+	err = retryStartup(log.With(logger, "call", "resolver.Validate"), StartupRetries, StartupBackoff, func() error {
+		validateCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return resolver.Validate(validateCtx)
+	})
+	if err != nil {
+		logger.Log("call", "resolver.Validate", "registry", ENSRegistry, "err", err)
+		os.Exit(1)
+	}
 
-	newForwarderClient := func() (ensmail.ForwarderClient, error) {
-		conn, err := net.Dial("unix", LMTPForwardSocket)
+	forwarder := ensmail.LMTPDialer{
+		Network: "unix",
+		Addr:    LMTPForwardSocket,
+		Host:    "ensmail.local",
+		Timeout: ForwardDialTimeout,
+	}
+	if LMTPForwardAddr != "" {
+		forwarder.Network, forwarder.Addr = "tcp", LMTPForwardAddr
+	} else if ForwardSocketFile != "" {
+		sock, err := readSocketPath(ForwardSocketFile)
 		if err != nil {
-			return nil, err
+			logger.Log("call", "readSocketPath", "err", err)
+			os.Exit(1)
+		}
+		var forwardSocket atomic.Value
+		forwardSocket.Store(sock)
+		forwarder.AddrFunc = func() string { return forwardSocket.Load().(string) }
+		logger.Log("forwardSocket", sock)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				// Sessions already forwarding keep their
+				// connection, only new sessions dial the new path.
+				sock, err := readSocketPath(ForwardSocketFile)
+				if err != nil {
+					logger.Log("call", "readSocketPath", "err", err)
+					continue
+				}
+				if old := forwardSocket.Load().(string); sock != old {
+					forwardSocket.Store(sock)
+					logger.Log("forwardSocket", sock, "old", old)
+				}
+			}
+		}()
+	}
+	if ForwardLocalAddr != "" {
+		if forwarder.LocalAddr = net.ParseIP(ForwardLocalAddr); forwarder.LocalAddr == nil {
+			logger.Log("flag", "forward-local-addr", "err", "invalid IP", "addr", ForwardLocalAddr)
+			os.Exit(1)
+		}
+	}
+	switch ForwardTLS {
+	case "":
+	case "tls", "starttls":
+		tlsConfig, err := forwardTLSConfig(ForwardTLSCA, ForwardTLSCert, ForwardTLSKey, ForwardTLSName)
+		if err != nil {
+			logger.Log("call", "forwardTLSConfig", "err", err)
+			os.Exit(1)
 		}
-		return smtp.NewClientLMTP(conn, "ensmail.local")
+		forwarder.TLSConfig = tlsConfig
+		forwarder.StartTLS = ForwardTLS == "starttls"
+	default:
+		logger.Log("flag", "forward-tls", "err", "invalid mode", "mode", ForwardTLS)
+		os.Exit(1)
 	}
 
-	s, err := ensmail.NewLMTPServer(logger, resolver.Email, newForwarderClient)
+	var serverOpts []ensmail.LMTPServerOption
+	if DataConcurrency > 0 {
+		serverOpts = append(serverOpts, ensmail.WithDataConcurrency(DataConcurrency))
+	}
+	if DataReadTimeout > 0 {
+		serverOpts = append(serverOpts, ensmail.WithDataReadTimeout(DataReadTimeout))
+	}
+	if StatusTimeout > 0 {
+		serverOpts = append(serverOpts, ensmail.WithForwardStatusTimeout(StatusTimeout))
+	}
+	if ResolveTimeout > 0 {
+		serverOpts = append(serverOpts, ensmail.WithResolveTimeout(ResolveTimeout))
+	}
+	if RateLimitRetry > 0 {
+		serverOpts = append(serverOpts, ensmail.WithRetryAfter(ensmail.TempfailRateLimit, RateLimitRetry))
+	}
+	if SaturatedRetry > 0 {
+		serverOpts = append(serverOpts, ensmail.WithRetryAfter(ensmail.TempfailBackpressure, SaturatedRetry))
+	}
+	if ForwardDownRetry > 0 {
+		serverOpts = append(serverOpts, ensmail.WithRetryAfter(ensmail.TempfailForwarderDown, ForwardDownRetry))
+	}
+	if MaxRcpts > 0 {
+		serverOpts = append(serverOpts, ensmail.WithMaxRecipients(MaxRcpts))
+	}
+	if FanInThreshold > 0 {
+		serverOpts = append(serverOpts, ensmail.WithFanInAlert(FanInThreshold, time.Hour))
+	}
+	if ErrorCodes != "" {
+		codes, err := parseErrorCodes(ErrorCodes)
+		if err != nil {
+			logger.Log("flag", "error-codes", "err", err)
+			os.Exit(1)
+		}
+		serverOpts = append(serverOpts, ensmail.WithErrorCodes(codes))
+	}
+	if ForwardRetries > 0 {
+		serverOpts = append(serverOpts, ensmail.WithForwardRetry(ForwardRetries, ForwardBackoff))
+	}
+	if AllowedDomains != "" || DomainRateLimit > 0 || SourceNameLimit > 0 || SourceRcptLimit > 0 {
+		policy := &ensmail.RelayPolicy{
+			DomainRateLimit:  DomainRateLimit,
+			DomainRateWindow: time.Minute,
+			SourceNameLimit:  SourceNameLimit,
+			SourceNameWindow: time.Hour,
+			SourceRcptLimit:  SourceRcptLimit,
+			SourceRcptWindow: SourceRcptWindow,
+		}
+		if AllowedDomains != "" {
+			policy.AllowedDomains = strings.Split(AllowedDomains, ",")
+		}
+		serverOpts = append(serverOpts, ensmail.WithRelayPolicy(policy))
+	}
+	if *namePolicy {
+		policies := resolver.Policy
+		if CacheTTL > 0 {
+			policies = ensmail.CachePolicies(policies, CacheTTL)
+		}
+		serverOpts = append(serverOpts, ensmail.WithNamePolicy(policies))
+	}
+	if *resolveAtData {
+		serverOpts = append(serverOpts, ensmail.WithResolveAtData())
+	}
+	if AuditLog != "" {
+		f, err := openAppendFile(AuditLog)
+		if err != nil {
+			logger.Log("call", "openAppendFile", "err", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		serverOpts = append(serverOpts, ensmail.WithAuditLog(f))
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				// On failure, records are still appended to
+				// the previous file.
+				if err := f.Reopen(); err != nil {
+					logger.Log("call", "f.Reopen", "err", err)
+					continue
+				}
+				logger.Log("auditLog", "reopened")
+			}
+		}()
+	}
+	if VERPReturnPath != "" {
+		serverOpts = append(serverOpts, ensmail.WithVERP(VERPReturnPath), ensmail.WithForwardConcurrency(VERPConcurrency))
+	}
+	if MaxInMemory > 0 {
+		serverOpts = append(serverOpts, ensmail.WithMaxInMemory(MaxInMemory))
+	}
+	if SignKey != "" {
+		key, err := readSigningKey(SignKey)
+		if err != nil {
+			logger.Log("call", "readSigningKey", "err", err)
+			os.Exit(1)
+		}
+		serverOpts = append(serverOpts, ensmail.WithResolutionSigning(key))
+	}
+	if LMTPTLSProxy != "" {
+		var trusted []*net.IPNet
+		for _, cidr := range strings.Split(LMTPTLSProxy, ",") {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				logger.Log("flag", "tls-proxy-trusted", "err", err)
+				os.Exit(1)
+			}
+			trusted = append(trusted, n)
+		}
+		serverOpts = append(serverOpts, ensmail.WithProxyProtocol(trusted...))
+	}
+	if LMTPTLSAuthFile != "" {
+		auth, err := readCredentials(LMTPTLSAuthFile)
+		if err != nil {
+			logger.Log("call", "readCredentials", "err", err)
+			os.Exit(1)
+		}
+		serverOpts = append(serverOpts, ensmail.WithAuth(auth))
+	}
+	if MaxLineLen > 0 {
+		serverOpts = append(serverOpts, ensmail.WithMaxLineLength(MaxLineLen))
+	}
+	if NormalizeCRLF {
+		serverOpts = append(serverOpts, ensmail.WithCRLFNormalization())
+	}
+	if StripBcc {
+		serverOpts = append(serverOpts, ensmail.WithStripBcc())
+	}
+	if FullFailureError {
+		serverOpts = append(serverOpts, ensmail.WithFullFailureError())
+	}
+	switch MessageID {
+	case "preserve":
+	case "add":
+		serverOpts = append(serverOpts, ensmail.WithMessageID(ensmail.MessageIDAddIfMissing))
+	case "regenerate":
+		serverOpts = append(serverOpts, ensmail.WithMessageID(ensmail.MessageIDRegenerate))
+	default:
+		logger.Log("flag", "message-id", "err", "invalid mode", "mode", MessageID)
+		os.Exit(1)
+	}
+	switch SanitizeReceived {
+	case "":
+	case "strip":
+		serverOpts = append(serverOpts, ensmail.WithReceivedSanitizer(ensmail.ReceivedStrip, TrustedReceived))
+	case "mark":
+		serverOpts = append(serverOpts, ensmail.WithReceivedSanitizer(ensmail.ReceivedMark, TrustedReceived))
+	default:
+		logger.Log("flag", "sanitize-received", "err", "invalid mode", "mode", SanitizeReceived)
+		os.Exit(1)
+	}
+
+	// Only the ENS resolver resolves names under -tlds.
+	if tlds != "eth" && (emailReg != "" || SubgraphURL != "") {
+		logger.Log("flag", "tlds", "err", "unsupported by -email-registry and -subgraph")
+		os.Exit(1)
+	}
+	// The contract resolver doesn't check owners or registrations.
+	if emailReg != "" && (ensOwners != "" || registrar != "") {
+		logger.Log("flag", "email-registry", "err", "unsupported with -owners and -expiry-registrar")
+		os.Exit(1)
+	}
+
+	resolve := resolver.Email
+	if emailReg != "" {
+		contract, err := ensmail.NewContractResolver(common.HexToAddress(emailReg), caller)
+		if err != nil {
+			logger.Log("call", "ensmail.NewContractResolver", "err", err)
+			os.Exit(1)
+		}
+		resolve = contract.Email
+	}
+	if SubgraphURL != "" {
+		subgraph := ensmail.NewSubgraphResolver(SubgraphURL, &http.Client{Timeout: 10 * time.Second})
+		if SubgraphFirst {
+			resolve = ensmail.Fallback(subgraph.Email, resolve)
+		} else {
+			resolve = ensmail.Fallback(resolve, subgraph.Email)
+		}
+	}
+	if DedupResolves {
+		resolve = ensmail.Deduplicate(resolve)
+	}
+	var cache *ensmail.CachingResolver
+	if CacheTTL > 0 {
+		cache = ensmail.NewCachingResolver(resolve, CacheTTL)
+		resolve = cache.Resolve
+
+		if WarmNames != "" {
+			names, err := readNames(WarmNames)
+			if err != nil {
+				logger.Log("call", "readNames", "err", err)
+				os.Exit(1)
+			}
+			go func() {
+				res := cache.WarmCache(context.Background(), names)
+				logger.Log("warm", "cache", "resolved", res.Resolved, "failed", len(res.Failed))
+			}()
+		}
+	}
+	if OverridesFile != "" {
+		var overrides ensmail.Overrides
+		if err := loadOverrides(&overrides, OverridesFile); err != nil {
+			logger.Log("call", "loadOverrides", "err", err)
+			os.Exit(1)
+		}
+		logger.Log("overrides", "loaded", "names", overrides.Len())
+		resolve = overrides.Resolve(resolve)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				// Invalid files are logged, and the current
+				// overrides kept.
+				if err := loadOverrides(&overrides, OverridesFile); err != nil {
+					logger.Log("call", "loadOverrides", "err", err)
+					continue
+				}
+				logger.Log("overrides", "reloaded", "names", overrides.Len())
+			}
+		}()
+	}
+
+	var health *ensmail.HealthProber
+	if HealthInterval > 0 {
+		health = ensmail.NewHealthProber(resolver.Validate, HealthInterval)
+	}
+
+	if MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		if health != nil {
+			mux.Handle("/healthz", health)
+		}
+		// Admin endpoints are only served with a token, so
+		// they're never open to anyone reaching -metrics.
+		if AdminToken != "" {
+			mux.Handle("/admin/config", requireToken(AdminToken, configHandler()))
+			if cache != nil {
+				mux.Handle("/admin/warm-cache", requireToken(AdminToken, warmCacheHandler(cache)))
+			}
+		}
+		if err := serveHTTP(logger, MetricsAddr, mux); err != nil {
+			logger.Log("call", "serveHTTP", "err", err, "metrics", "disabled")
+			if MetricsStrict {
+				os.Exit(1)
+			}
+		}
+	}
+
+	newForwarder := forwarder.NewForwarderClient
+	if ForwardWebhook != "" {
+		webhookClient := &http.Client{Timeout: ForwardDialTimeout}
+		newForwarder = func() (ensmail.ForwarderClient, error) {
+			return ensmail.NewHTTPForwarder(ForwardWebhook, webhookClient), nil
+		}
+	}
+	if ForwardRoutes != "" {
+		routes, err := parseForwardRoutes(ForwardRoutes, forwarder)
+		if err != nil {
+			logger.Log("flag", "forward-routes", "err", err)
+			os.Exit(1)
+		}
+		newForwarder = ensmail.RouteByDomain(routes, newForwarder)
+	}
+
+	var queue *ensmail.RetryQueue
+	if QueueDir != "" {
+		queue, err = ensmail.NewRetryQueue(log.With(logger, "app", "ensmail"), QueueDir, newForwarder, QueueBackoff, QueueMaxAttempts, QueueExpiry)
+		if err != nil {
+			logger.Log("call", "ensmail.NewRetryQueue", "err", err)
+			os.Exit(1)
+		}
+		serverOpts = append(serverOpts, ensmail.WithRetryQueue(queue))
+	}
+	if resHeaders {
+		serverOpts = append(serverOpts, ensmail.WithResolutionHeaders())
+	}
+	if SubdomainBase != "" {
+		serverOpts = append(serverOpts, ensmail.WithSubdomainNames(SubdomainBase))
+	}
+	if LogHeaders != "" {
+		serverOpts = append(serverOpts, ensmail.WithHeaderLogging(log.With(logger, "app", "ensmail", "debug", "headers"), strings.Split(LogHeaders, ",")...))
+	}
+
+	s, err := ensmail.NewLMTPServer(logger, resolve, newForwarder, serverOpts...)
 	if err != nil {
 		logger.Log("call", "ensmail.NewLMTPServer", "err", err)
 		os.Exit(1)
@@ -80,22 +716,517 @@ func main() {
 		logger.Log("call", "new.Listen", "err", err)
 		os.Exit(1)
 	}
-	defer l.Close()
 
+	// Listeners are closed by serveSupervised.
+	done := make(chan struct{})
 	var wg sync.WaitGroup
+	if queue != nil {
+		go queue.Run(done)
+	}
+	if health != nil {
+		go health.Run(done)
+	}
 	wg.Add(1)
 	go func() {
-		if err := s.Serve(l); err != nil {
+		listen := func() (net.Listener, error) { return net.Listen("unix", LMTPServerSocket) }
+		if err := serveSupervised(log.With(logger, "listener", "unix"), l, listen, s.Serve, done); err != nil {
 			logger.Log("call", "s.Serve", "err", err)
 			os.Exit(1)
 		}
 		wg.Done()
 	}()
 
+	if LMTPTLSAddr != "" {
+		if LMTPTLSClientCA == "" && LMTPTLSAuthFile == "" {
+			logger.Log("err", "-tls-addr requires -tls-client-ca or -tls-auth-file")
+			os.Exit(1)
+		}
+		tlsConfig, err := serverTLSConfig(LMTPTLSCert, LMTPTLSKey, LMTPTLSClientCA)
+		if err != nil {
+			logger.Log("call", "serverTLSConfig", "err", err)
+			os.Exit(1)
+		}
+
+		tl, err := net.Listen("tcp", LMTPTLSAddr)
+		if err != nil {
+			logger.Log("call", "net.Listen", "err", err)
+			os.Exit(1)
+		}
+
+		wg.Add(1)
+		go func() {
+			listen := func() (net.Listener, error) { return net.Listen("tcp", LMTPTLSAddr) }
+			serve := func(l net.Listener) error { return s.ServeTLS(l, tlsConfig) }
+			if err := serveSupervised(log.With(logger, "listener", "tls"), tl, listen, serve, done); err != nil {
+				logger.Log("call", "s.ServeTLS", "err", err)
+				os.Exit(1)
+			}
+			wg.Done()
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
 	<-c
 
-	s.Close()
+	close(done)
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Log("call", "s.Shutdown", "err", err)
+	}
+	cancel()
 	wg.Wait()
 }
+
+// serveHTTP listens on the TCP address addr, and serves handler in
+// the background.  Listen errors (such as addr already in use) are
+// returned, so callers can decide whether they're fatal.  Serve
+// errors after a successful listen are only logged.
+func serveHTTP(logger log.Logger, addr string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logger.Log("serve", "http://"+l.Addr().String())
+	go func() {
+		if err := http.Serve(l, handler); err != nil {
+			logger.Log("call", "http.Serve", "err", err)
+		}
+	}()
+	return nil
+}
+
+// serveSupervised calls serve with l until serve returns nil (the
+// server was closed).  If serve fails, l is replaced by a new
+// listener from listen, after an exponential backoff.  Permission
+// errors are fatal, and returned.  Once done is closed, the current
+// listener is closed, and serveSupervised returns.
+func serveSupervised(logger log.Logger, l net.Listener, listen func() (net.Listener, error), serve func(net.Listener) error, done <-chan struct{}) error {
+	const (
+		minBackoff = 100 * time.Millisecond
+		maxBackoff = time.Minute
+	)
+	backoff := minBackoff
+
+	for {
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-done:
+				l.Close()
+			case <-stop:
+			}
+		}()
+		err := serve(l)
+		close(stop)
+		l.Close()
+		if err == nil {
+			return nil
+		}
+		logger.Log("call", "serve", "err", err)
+
+		for {
+			if errors.Is(err, os.ErrPermission) {
+				return err
+			}
+
+			select {
+			case <-done:
+				return nil
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+
+			if l, err = listen(); err == nil {
+				logger.Log("relisten", "success")
+				break
+			}
+			logger.Log("call", "listen", "err", err, "backoff", backoff)
+		}
+	}
+}
+
+// serverTLSConfig returns a TLS config which serves certFile/keyFile,
+// and requires client certificates signed by the CA in clientCAFile.
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if clientCAFile == "" {
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, nil
+	}
+
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %s", clientCAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// readSigningKey reads a PEM encoded PKCS #8 Ed25519 private key
+// from path.
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// forwardTLSConfig returns a TLS config for forwarder connections,
+// which verifies the server with the CA in caFile (or system roots),
+// and, if certFile is set, presents a client certificate.
+func forwardTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// readCredentials returns an AuthFunc which accepts the credentials
+// of file, whose non-empty lines are "username:bcrypt-hash" (as
+// written by "htpasswd -nB").
+func readCredentials(file string) (ensmail.AuthFunc, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return scanCredentials(f)
+}
+
+func scanCredentials(r io.Reader) (ensmail.AuthFunc, error) {
+	hashes := make(map[string][]byte)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("line %d: missing username", n)
+		}
+		username, hash := line[:i], []byte(line[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		hashes[username] = hash
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return func(username, password string) error {
+		hash, ok := hashes[username]
+		if !ok {
+			return errors.New("unknown user")
+		}
+		return bcrypt.CompareHashAndPassword(hash, []byte(password))
+	}, nil
+}
+
+// retryStartup calls fn, retrying up to retries times while it fails,
+// after backoff (doubled for each retry).  Each failure is logged.
+// The last failure is returned.
+func retryStartup(logger log.Logger, retries int, backoff time.Duration, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == retries {
+			return err
+		}
+		logger.Log("err", err, "retry", attempt+1, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// appendFile is a file opened for appending, which can be reopened
+// (such as after it's rotated) while it's written.
+type appendFile struct {
+	name string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// openAppendFile opens name for appending, creating it if needed.
+func openAppendFile(name string) (*appendFile, error) {
+	a := &appendFile{name: name}
+	var err error
+	if a.f, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *appendFile) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Write(p)
+}
+
+// Reopen opens a's name again, so subsequent writes go to the file
+// now at that name, and closes the previous file.
+func (a *appendFile) Reopen() error {
+	f, err := os.OpenFile(a.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	old := a.f
+	a.f = f
+	a.mu.Unlock()
+	return old.Close()
+}
+
+func (a *appendFile) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// loadOverrides loads the overrides of file into o.
+func loadOverrides(o *ensmail.Overrides, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return o.Load(f)
+}
+
+// readSocketPath returns the socket path in file, which is its only
+// (non-empty) line.
+func readSocketPath(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	sock := strings.TrimSpace(string(b))
+	if sock == "" || strings.ContainsAny(sock, "\r\n") {
+		return "", fmt.Errorf("%s: want a single socket path", file)
+	}
+	return sock, nil
+}
+
+// readNames returns the non-empty lines of file.
+func readNames(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return scanNames(f)
+}
+
+func scanNames(r io.Reader) ([]string, error) {
+	var names []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if name := strings.TrimSpace(sc.Text()); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, sc.Err()
+}
+
+// warmCacheHandler warms cache with the names (one per line) POSTed
+// in the request body, and responds with a JSON summary.
+func warmCacheHandler(cache *ensmail.CachingResolver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		names, err := scanNames(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res := cache.WarmCache(r.Context(), names)
+		failed := make(map[string]string, len(res.Failed))
+		for name, err := range res.Failed {
+			failed[name] = err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Resolved int               `json:"resolved"`
+			Failed   map[string]string `json:"failed"`
+		}{res.Resolved, failed})
+	})
+}
+
+// requireToken wraps h, so requests without a bearer token of token
+// are unauthorized.  If token is empty, every request is.
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+var (
+	// secretFlags are never exposed by /admin/config.
+	secretFlags = map[string]bool{"admin-token": true}
+
+	// urlFlags are only exposed by /admin/config as their scheme and
+	// host, as provider URLs often contain API keys.
+	urlFlags = map[string]bool{"web3": true, "forward-webhook": true, "subgraph": true}
+)
+
+// configHandler serves the effective value of every flag (after
+// environment variables are applied) as JSON, with secrets redacted.
+func configHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		config := make(map[string]string)
+		flag.VisitAll(func(f *flag.Flag) {
+			val := f.Value.String()
+			switch {
+			case val == "":
+			case secretFlags[f.Name]:
+				val = "REDACTED"
+			case urlFlags[f.Name]:
+				if u, err := url.Parse(val); err == nil {
+					val = u.Scheme + "://" + u.Host
+				} else {
+					val = "REDACTED"
+				}
+			}
+			config[f.Name] = val
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Version string            `json:"version"`
+			Flags   map[string]string `json:"flags"`
+		}{version, config})
+	})
+}
+
+// errorCodeNames are the -error-codes names of resolution errors.
+var errorCodeNames = map[string]error{
+	"no-resolver":       ensmail.ErrNoResolver,
+	"no-email":          ensmail.ErrNoEmail,
+	"invalid-label":     ensmail.ErrInvalidLabel,
+	"empty-name":        ensmail.ErrEmptyName,
+	"unauthorized":      ensmail.ErrUnauthorizedName,
+	"invalid-resolved":  ensmail.ErrInvalidResolved,
+	"expired":           ensmail.ErrNameExpired,
+	"invalid-resolver":  ensmail.ErrInvalidResolver,
+	"timeout":           context.DeadlineExceeded,
+	"rejected":          ensmail.ErrNameRejected,
+	"disabled":          ensmail.ErrForwardingDisabled,
+	"disallowed-domain": ensmail.ErrDisallowedForwardDomain,
+	"depth-exceeded":    ensmail.ErrResolveDepthExceeded,
+}
+
+// parseErrorCodes parses comma separated "error=code x.y.z" reply
+// overrides.  The default reply message is kept.
+func parseErrorCodes(s string) (ensmail.ErrorCodeMap, error) {
+	codes := make(ensmail.ErrorCodeMap)
+	for _, override := range strings.Split(s, ",") {
+		name, reply := override, ""
+		if i := strings.Index(override, "="); i >= 0 {
+			name, reply = override[:i], override[i+1:]
+		}
+		target, ok := errorCodeNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown error: %q", name)
+		}
+
+		serr := *ensmail.DefaultErrorCodes[target]
+		if _, err := fmt.Sscanf(reply, "%d %d.%d.%d", &serr.Code, &serr.EnhancedCode[0], &serr.EnhancedCode[1], &serr.EnhancedCode[2]); err != nil {
+			return nil, fmt.Errorf("invalid reply for %s: %q", name, reply)
+		}
+		codes[target] = &serr
+	}
+	return codes, nil
+}
+
+// parseForwardRoutes parses comma separated "domain=addr" routes, to
+// LMTP servers at the TCP address, or unix socket path (if addr is
+// absolute), addr.  Routes are dialed as base, whose TLS config (if
+// any) verifies the host of each route's addr.
+func parseForwardRoutes(s string, base ensmail.LMTPDialer) (map[string]ensmail.NewForwarderClient, error) {
+	routes := make(map[string]ensmail.NewForwarderClient)
+	for _, route := range strings.Split(s, ",") {
+		i := strings.Index(route, "=")
+		if i <= 0 || i == len(route)-1 {
+			return nil, fmt.Errorf("invalid route: %q", route)
+		}
+		domain, addr := strings.TrimSpace(route[:i]), strings.TrimSpace(route[i+1:])
+
+		d := base
+		d.AddrFunc = nil
+		d.Network, d.Addr = "tcp", addr
+		if strings.HasPrefix(addr, "/") {
+			d.Network = "unix"
+		}
+		if d.TLSConfig != nil {
+			d.TLSConfig = d.TLSConfig.Clone()
+			d.TLSConfig.ServerName = ""
+		}
+		routes[domain] = d.NewForwarderClient
+	}
+	return routes, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestServeHTTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	if err := serveHTTP(log.NewNopLogger(), addr, handler); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	// The address is in use, which is returned rather than fatal.
+	if err := serveHTTP(log.NewNopLogger(), addr, handler); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("want err: %v, got: %v", syscall.EADDRINUSE, err)
+	}
+
+	// The first server keeps serving.
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "ok" {
+		t.Errorf("want body: ok, got: %q, %v", body, err)
+	}
+}
+
+func TestScanCredentials(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := scanCredentials(strings.NewReader("\nalice:" + string(hash) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+	} {
+		if err := auth(test.username, test.password); (err == nil) != test.ok {
+			t.Errorf("%s:%s: want ok: %v, got: %v", test.username, test.password, test.ok, err)
+		}
+	}
+
+	for _, invalid := range []string{"alice", ":" + string(hash), "alice:secret"} {
+		if _, err := scanCredentials(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%q: want err", invalid)
+		}
+	}
+}
+
+func TestRetryStartup(t *testing.T) {
+	errDown := errors.New("connection refused")
+
+	// dialer returns a dial which fails its first fails calls.
+	dialer := func(fails int) (func() error, *int) {
+		var calls int
+		return func() error {
+			calls++
+			if calls <= fails {
+				return errDown
+			}
+			return nil
+		}, &calls
+	}
+
+	for _, test := range []struct {
+		retries, fails int
+		err            error
+		calls          int
+	}{
+		{0, 0, nil, 1},
+		{0, 1, errDown, 1},
+		{2, 2, nil, 3},
+		{2, 3, errDown, 3},
+	} {
+		var logs bytes.Buffer
+		dial, calls := dialer(test.fails)
+		if err := retryStartup(log.NewLogfmtLogger(&logs), test.retries, time.Millisecond, dial); err != test.err {
+			t.Errorf("%d retries, %d fails: want err: %v, got: %v", test.retries, test.fails, test.err, err)
+		}
+		if *calls != test.calls {
+			t.Errorf("%d retries, %d fails: want calls: %d, got: %d", test.retries, test.fails, test.calls, *calls)
+		}
+		// Each retry is logged.
+		if n := strings.Count(logs.String(), "retry="); n != test.calls-1 {
+			t.Errorf("%d retries, %d fails: want %d logged retries, got: %d", test.retries, test.fails, test.calls-1, n)
+		}
+	}
+}
+
+func TestAppendFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	f, err := openAppendFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("one\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// After rotation, writes go to the rotated file until reopened.
+	rotated := name + ".1"
+	if err := os.Rename(name, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("two\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("three\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, want := range map[string]string{rotated: "one\ntwo\n", name: "three\n"} {
+		if got, err := os.ReadFile(file); err != nil {
+			t.Fatal(err)
+		} else if string(got) != want {
+			t.Errorf("%s: want %q, got %q", file, want, got)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, test := range []struct {
+		token, auth string
+		code        int
+	}{
+		{"secret", "Bearer secret", http.StatusOK},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/admin/config", nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		rec := httptest.NewRecorder()
+		requireToken(test.token, ok).ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("token %q, auth %q: want code: %d, got: %d", test.token, test.auth, test.code, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.5.0;
+
+// BaseRegistrar is the subset of the .eth registrar
+// (BaseRegistrarImplementation) read by ensmail.
+interface BaseRegistrar {
+    function nameExpires(uint256 id) external view returns (uint256);
+}
@@ -0,0 +1,8 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.5.0;
+
+// EmailRegistry maps ENS nodes directly to forward email addresses,
+// without the registry -> resolver -> text record indirection.
+interface EmailRegistry {
+    function email(bytes32 node) external view returns (string memory);
+}
@@ -1,6 +1,7 @@
 package ens
 
 import (
+	"encoding/hex"
 	"errors"
 	"strings"
 
@@ -12,6 +13,16 @@ import (
 // Implementation of
 // https://docs.ens.domains/ens-improvement-proposals/ensip-1-ens#namehash-algorithm
 func NameHash(name string) ([32]byte, error) {
+	return nameHash(name, LabelHash)
+}
+
+// LenientNameHash is like NameHash, but normalizes labels as by
+// LenientLabelHash.
+func LenientNameHash(name string) ([32]byte, error) {
+	return nameHash(name, LenientLabelHash)
+}
+
+func nameHash(name string, labelHash func(string) ([32]byte, error)) ([32]byte, error) {
 	var node common.Hash
 
 	// Because strings.Split("", ".") returns slice of len 1, must
@@ -22,12 +33,12 @@ func NameHash(name string) ([32]byte, error) {
 
 	labels := strings.Split(name, ".")
 	for i := len(labels) - 1; i >= 0; i-- {
-		labelHash, err := LabelHash(labels[i])
+		lh, err := labelHash(labels[i])
 		if err != nil {
 			return node, err
 		}
 
-		node = crypto.Keccak256Hash(node[:], labelHash[:])
+		node = crypto.Keccak256Hash(node[:], lh[:])
 	}
 
 	return node, nil
@@ -38,7 +49,22 @@ func NameHash(name string) ([32]byte, error) {
 // with the options transitional=false and useSTD3AsciiRules=true
 var ensProfile = idna.New(idna.Transitional(false), idna.StrictDomainName(true), idna.MapForLookup())
 
+// lenientProfile is ensProfile without the STD3 ASCII rules, so
+// labels may contain ASCII symbols (such as "_"), which names
+// registered outside of the ENS app may contain.
+var lenientProfile = idna.New(idna.MapForLookup(), idna.Transitional(false), idna.StrictDomainName(false))
+
 func LabelHash(label string) ([32]byte, error) {
+	return labelHash(label, ensProfile)
+}
+
+// LenientLabelHash is like LabelHash, but allows ASCII symbols (such
+// as "_") in label, which are otherwise disallowed.
+func LenientLabelHash(label string) ([32]byte, error) {
+	return labelHash(label, lenientProfile)
+}
+
+func labelHash(label string, profile *idna.Profile) ([32]byte, error) {
 	// By definition, labelhash of "" is 0x0
 	if label == "" {
 		return [32]byte{}, nil
@@ -48,10 +74,43 @@ func LabelHash(label string) ([32]byte, error) {
 		return [32]byte{}, errors.New("label contains period")
 	}
 
-	normalizedLabel, err := ensProfile.ToUnicode(label)
+	normalizedLabel, err := profile.ToUnicode(label)
 	if err != nil {
 		return [32]byte{}, err
 	}
 
 	return crypto.Keccak256Hash([]byte(normalizedLabel)), nil
 }
+
+// Normalize returns name with each of its labels normalized as by
+// LabelHash, so names with the same node (such as "Alice" and
+// "alice") are equal.
+func Normalize(name string) (string, error) {
+	return normalize(name, ensProfile)
+}
+
+// LenientNormalize is like Normalize, but normalizes labels as by
+// LenientLabelHash.  Names which Normalize accepts are normalized
+// the same by both.
+func LenientNormalize(name string) (string, error) {
+	return normalize(name, lenientProfile)
+}
+
+func normalize(name string, profile *idna.Profile) (string, error) {
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		normalized, err := profile.ToUnicode(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = normalized
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// ReverseName returns the ENS reverse record name for addr, as
+// defined in
+// https://docs.ens.domains/ens-improvement-proposals/ensip-3-reverse-resolution
+func ReverseName(addr common.Address) string {
+	return hex.EncodeToString(addr[:]) + ".addr.reverse"
+}
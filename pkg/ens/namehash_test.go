@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 func TestNameHash(t *testing.T) {
@@ -15,6 +16,9 @@ func TestNameHash(t *testing.T) {
 		{"eth", "93cdeb708b7545dc668eb9280176169d1c33cfd8ed6f04690a0bcc88a93fc4ae"},
 		{"foo.eth", "de9b09fd7c5f901e23a3f19fecc54828e9c848539801e86591bd9801b019f84f"},
 		{"FoO.eTh", "de9b09fd7c5f901e23a3f19fecc54828e9c848539801e86591bd9801b019f84f"},
+		{"ünïcödé.eth", "5b719e9048fc5a52778826fc9fe8cb847960588b4fdaf319521b7ed561f6db9e"},
+		{"ÜNÏCÖDÉ.eth", "5b719e9048fc5a52778826fc9fe8cb847960588b4fdaf319521b7ed561f6db9e"},
+		{"🦊.eth", "44639fcabf2f26d9e3160578dbda00cbd963f15cfed2add60b0f870ca8aa0da2"},
 	} {
 		t.Run(test.input, func(t *testing.T) {
 			out, err := NameHash(test.input)
@@ -28,3 +32,63 @@ func TestNameHash(t *testing.T) {
 		})
 	}
 }
+
+func TestReverseName(t *testing.T) {
+	addr := common.HexToAddress("0x314159265dD8dbb310642f98f50C066173C1259b")
+	if exp, got := "314159265dd8dbb310642f98f50c066173c1259b.addr.reverse", ReverseName(addr); got != exp {
+		t.Errorf("want: %s, got: %s", exp, got)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for input, exp := range map[string]string{
+		"alice":       "alice",
+		"ALICE":       "alice",
+		"Alice.eTh":   "alice.eth",
+		"ÜNÏCÖDÉ.eth": "ünïcödé.eth",
+	} {
+		if got, err := Normalize(input); err != nil || got != exp {
+			t.Errorf("%s: want: %s, got: %s, %v", input, exp, got, err)
+		}
+	}
+	if _, err := Normalize("bad_label"); err == nil {
+		t.Error("want err")
+	}
+}
+
+func TestLenientNormalize(t *testing.T) {
+	for input, exp := range map[string]string{
+		"Alice.eTh":       "alice.eth",
+		"ÜNÏCÖDÉ.eth":     "ünïcödé.eth",
+		"Under_Score.ETH": "under_score.eth",
+	} {
+		if got, err := LenientNormalize(input); err != nil || got != exp {
+			t.Errorf("%s: want: %s, got: %s, %v", input, exp, got, err)
+		}
+	}
+	if _, err := LenientNormalize("⒈x.eth"); err == nil {
+		t.Error("want err")
+	}
+}
+
+func TestLenientNameHash(t *testing.T) {
+	if _, err := NameHash("under_score.eth"); err == nil {
+		t.Error("want err")
+	}
+	exp, err := NameHash("eth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lh := crypto.Keccak256Hash([]byte("under_score"))
+	exp = crypto.Keccak256Hash(exp[:], lh[:])
+
+	// Labels are still normalized.
+	for _, name := range []string{"under_score.eth", "Under_Score.ETH"} {
+		if got, err := LenientNameHash(name); err != nil || got != exp {
+			t.Errorf("%s: want: %x, got: %x, %v", name, exp, got, err)
+		}
+	}
+	if _, err := LenientNameHash("⒈x.eth"); err == nil {
+		t.Error("want err")
+	}
+}
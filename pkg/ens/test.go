@@ -2,8 +2,10 @@ package ens
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/royalfork/soltest"
 )
 
@@ -71,3 +73,40 @@ func (t Test) Register(owner common.Address, label string) ([32]byte, error) {
 	}
 	return NameHash(label + ".eth")
 }
+
+// SetReverseName sets the reverse record of owner's address to name,
+// creating the "addr.reverse" node if necessary.
+func (t Test) SetReverseName(owner soltest.TestAccount, name string) error {
+	parent := [32]byte{}
+	for _, label := range []string{"reverse", "addr"} {
+		lh, err := LabelHash(label)
+		if err != nil {
+			return err
+		}
+		if !t.Chain.Succeed(t.Registry.SetSubnodeOwner(t.Accts[0].Auth, parent, lh, t.Accts[0].Addr)) {
+			return errors.New("unable to create reverse node")
+		}
+		parent = crypto.Keccak256Hash(parent[:], lh[:])
+	}
+
+	reverse := ReverseName(owner.Addr)
+	lh, err := LabelHash(strings.TrimSuffix(reverse, ".addr.reverse"))
+	if err != nil {
+		return err
+	}
+	if !t.Chain.Succeed(t.Registry.SetSubnodeOwner(t.Accts[0].Auth, parent, lh, owner.Addr)) {
+		return errors.New("unable to register reverse label")
+	}
+
+	node, err := NameHash(reverse)
+	if err != nil {
+		return err
+	}
+	if !t.Chain.Succeed(t.Registry.SetResolver(owner.Auth, node, t.ResolverAddr)) {
+		return errors.New("unable to set reverse resolver")
+	}
+	if !t.Chain.Succeed(t.Resolver.SetName(owner.Auth, node, name)) {
+		return errors.New("unable to set reverse name")
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package ensmail
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/go-kit/log"
+)
+
+// auditQueueLen is the number of audit records which may be queued
+// before the delivery path waits on the audit log writer.
+const auditQueueLen = 1024
+
+// auditRecord is the audit log entry of one transaction.
+type auditRecord struct {
+	Time      time.Time   `json:"time"`
+	SessionID string      `json:"sessid"`
+	MsgID     string      `json:"msgid"`
+	From      string      `json:"from"`
+	Rcpts     []auditRcpt `json:"rcpts"`
+	Bytes     int64       `json:"bytes,omitempty"`
+	Err       string      `json:"err,omitempty"`
+}
+
+// auditRcpt is the outcome of one recipient of a transaction.
+type auditRcpt struct {
+	To        string `json:"to"`
+	Resolved  string `json:"resolved,omitempty"`
+	Stage     string `json:"stage"` // "RCPT" or "DATA"
+	Delivered bool   `json:"delivered"`
+	Code      int    `json:"code,omitempty"`
+	Err       string `json:"err,omitempty"`
+}
+
+func newAuditRcpt(to, resolved, stage string, err error) auditRcpt {
+	r := auditRcpt{To: to, Resolved: resolved, Stage: stage, Delivered: err == nil}
+	if err != nil {
+		r.Err = err.Error()
+		var serr *smtp.SMTPError
+		if errors.As(err, &serr) {
+			r.Code = serr.Code
+		}
+	}
+	return r
+}
+
+// auditLog writes audit records to w, as JSON lines, from a single
+// goroutine, so records are never interleaved, and slow writes don't
+// delay delivery (unless auditQueueLen records are queued).
+type auditLog struct {
+	logger  log.Logger
+	records chan auditRecord
+	done    chan struct{} // closed once records are written
+
+	mu      sync.RWMutex // guards closed, and sends on records
+	closed  bool
+	writeMu sync.Mutex // guards enc
+	enc     *json.Encoder
+}
+
+func newAuditLog(w io.Writer, logger log.Logger) *auditLog {
+	a := &auditLog{
+		logger:  logger,
+		records: make(chan auditRecord, auditQueueLen),
+		done:    make(chan struct{}),
+		enc:     json.NewEncoder(w),
+	}
+	go func() {
+		defer close(a.done)
+		for r := range a.records {
+			a.write(r)
+		}
+	}()
+	return a
+}
+
+func (a *auditLog) log(r auditRecord) {
+	a.mu.RLock()
+	if !a.closed {
+		a.records <- r
+		a.mu.RUnlock()
+		return
+	}
+	a.mu.RUnlock()
+
+	// Transactions which end after close (such as those of sessions
+	// logged out by closing the server) are written synchronously.
+	<-a.done
+	a.write(r)
+}
+
+func (a *auditLog) write(r auditRecord) {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	if err := a.enc.Encode(r); err != nil {
+		a.logger.Log("call", "enc.Encode", "audit", r.MsgID, "err", err)
+	}
+}
+
+// close waits until every queued record is written.
+func (a *auditLog) close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.records)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+// auditStatus records each DATA status of s in its audit record, before
+// passing it to the wrapped StatusCollector.
+type auditStatus struct {
+	smtp.StatusCollector
+	s *session
+}
+
+func (a auditStatus) SetStatus(to string, err error) {
+	a.s.audit.Rcpts = append(a.s.audit.Rcpts, newAuditRcpt(to, a.s.resolvedOf(to), "DATA", err))
+	a.StatusCollector.SetStatus(to, err)
+}
@@ -0,0 +1,40 @@
+package ensmail
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+func TestAuditLog(t *testing.T) {
+	var buf syncBuffer
+	slow := writerFunc(func(p []byte) (int, error) {
+		time.Sleep(20 * time.Millisecond)
+		return buf.Write(p)
+	})
+	a := newAuditLog(slow, log.NewNopLogger())
+	for _, id := range []string{"a", "b", "c"} {
+		a.log(auditRecord{MsgID: id})
+	}
+
+	// close waits for queued records.
+	a.close()
+	if got := strings.Count(buf.String(), "\n"); got != 3 {
+		t.Errorf("want 3 records after close, got: %d", got)
+	}
+
+	// Records logged after close are written synchronously.
+	a.log(auditRecord{MsgID: "d"})
+	if got := buf.String(); !strings.Contains(got, `"msgid":"d"`) {
+		t.Errorf("record logged after close not written: %s", got)
+	}
+	a.close()
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,67 @@
+package ensmail
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache is a concurrency safe key/value cache whose entries expire
+// ttl after they are set.  Expired entries are removed when they are
+// next read, and by a sweep of the whole cache at most once per ttl
+// (when an entry is set), so entries which are never read again don't
+// accumulate.
+type ttlCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]cacheEntry
+	nextSweep time.Time
+}
+
+type cacheEntry struct {
+	val     interface{}
+	expires time.Time
+}
+
+func newTTLCache(ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// get returns the unexpired value for key, if one exists.
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	} else if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.val, true
+}
+
+func (c *ttlCache) set(key string, val interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if !now.Before(c.nextSweep) {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(c.ttl)
+	}
+	c.entries[key] = cacheEntry{
+		val:     val,
+		expires: now.Add(c.ttl),
+	}
+}
@@ -0,0 +1,37 @@
+package ensmail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCache(t *testing.T) {
+	now := time.Now()
+	c := newTTLCache(time.Minute)
+	c.now = func() time.Time { return now }
+
+	if _, ok := c.get("key"); ok {
+		t.Fatal("unexpected entry in empty cache")
+	}
+
+	c.set("key", "val")
+	if got, ok := c.get("key"); !ok || got != "val" {
+		t.Errorf("want: val, got: %v (ok: %t)", got, ok)
+	}
+
+	now = now.Add(time.Minute)
+	if got, ok := c.get("key"); ok {
+		t.Errorf("want expired entry, got: %v", got)
+	}
+
+	// Entries which are never read again are swept when others are
+	// set.
+	for _, key := range []string{"a", "b"} {
+		c.set(key, "val")
+	}
+	now = now.Add(time.Minute)
+	c.set("c", "val")
+	if len(c.entries) != 1 {
+		t.Errorf("want 1 entry after sweep, got: %d", len(c.entries))
+	}
+}
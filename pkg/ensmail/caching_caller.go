@@ -0,0 +1,60 @@
+package ensmail
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// CachingCaller is a bind.ContractCaller which caches the successful
+// contract call (eth_call) results of another caller for a fixed
+// ttl, to reduce the load on its backend (a third-party RPC provider,
+// or a local node such as geth or erigon).  Results are cached by the
+// call's contract, calldata, and block, so resolutions of the same
+// name share entries.  The caller (From) of calls isn't part of the
+// key, as the ENS contracts' view methods don't depend on it.  Failed
+// calls are never cached, and CodeAt isn't cached.
+type CachingCaller struct {
+	bind.ContractCaller
+	cache *ttlCache
+}
+
+func NewCachingCaller(caller bind.ContractCaller, ttl time.Duration) *CachingCaller {
+	return &CachingCaller{
+		ContractCaller: caller,
+		cache:          newTTLCache(ttl),
+	}
+}
+
+// CallContract implements bind.ContractCaller.
+func (c *CachingCaller) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	if call.To == nil {
+		return c.ContractCaller.CallContract(ctx, call, blockNumber)
+	}
+	key := callKey(*call.To, call.Data, blockNumber)
+	if out, ok := c.cache.get(key); ok {
+		return common.CopyBytes(out.([]byte)), nil
+	}
+
+	out, err := c.ContractCaller.CallContract(ctx, call, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.set(key, common.CopyBytes(out))
+	return out, nil
+}
+
+// callKey returns the cache key of a call of to with data at
+// blockNumber (nil for the latest block).
+func callKey(to common.Address, data []byte, blockNumber *big.Int) string {
+	block := "latest"
+	if blockNumber != nil {
+		block = blockNumber.String()
+	}
+	return fmt.Sprintf("%s:%x@%s", to.Hex(), data, block)
+}
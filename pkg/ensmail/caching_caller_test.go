@@ -0,0 +1,87 @@
+package ensmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// countingCaller is a bind.ContractCaller which counts its calls, and
+// returns the calldata of each call as its result.
+type countingCaller struct {
+	calls int
+	err   error
+}
+
+func (c *countingCaller) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	return []byte{0x60}, nil
+}
+
+func (c *countingCaller) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return append([]byte(nil), call.Data...), nil
+}
+
+func TestCachingCaller(t *testing.T) {
+	backend := new(countingCaller)
+	c := NewCachingCaller(backend, time.Minute)
+	now := time.Now()
+	c.cache.now = func() time.Time { return now }
+
+	to := common.HexToAddress("0x314159265dD8dbb310642f98f50C066173C1259b")
+	other := common.HexToAddress("0x00000000000C2E074eC69A0dFb2997BA6C7d2e1e")
+	call := func(to common.Address, data string, block *big.Int) []byte {
+		out, err := c.CallContract(context.Background(), ethereum.CallMsg{To: &to, Data: []byte(data)}, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	// Repeated calls are cached, and results can't be modified
+	// through the cache.
+	out := call(to, "one", nil)
+	out[0] = 'X'
+	if out := call(to, "one", nil); !bytes.Equal(out, []byte("one")) {
+		t.Errorf("want: one, got: %s", out)
+	}
+	if backend.calls != 1 {
+		t.Errorf("want calls: 1, got: %d", backend.calls)
+	}
+
+	// Calls of other contracts, calldata, or blocks aren't shared.
+	call(other, "one", nil)
+	call(to, "two", nil)
+	call(to, "one", big.NewInt(100))
+	call(to, "one", big.NewInt(100))
+	if backend.calls != 4 {
+		t.Errorf("want calls: 4, got: %d", backend.calls)
+	}
+
+	// Entries expire after ttl.
+	now = now.Add(time.Minute)
+	call(to, "one", nil)
+	if backend.calls != 5 {
+		t.Errorf("want calls: 5, got: %d", backend.calls)
+	}
+
+	// Failures aren't cached.
+	backend.err = errors.New("execution reverted")
+	for i := 0; i < 2; i++ {
+		if _, err := c.CallContract(context.Background(), ethereum.CallMsg{To: &to, Data: []byte("three")}, nil); err != backend.err {
+			t.Errorf("want err: %v, got: %v", backend.err, err)
+		}
+	}
+	if backend.calls != 7 {
+		t.Errorf("want calls: 7, got: %d", backend.calls)
+	}
+}
@@ -0,0 +1,99 @@
+package ensmail
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// warmWorkers bounds the number of concurrent resolutions made by
+// CachingResolver.WarmCache.
+const warmWorkers = 8
+
+// CachingResolver caches successful resolutions of a ResolveFunc for
+// a fixed ttl.  Failed resolutions are never cached.  Resolutions are
+// cached by normalized name, so names which only differ in case share
+// an entry.  The ResolveResult of each resolution is cached with it,
+// so ResolveDetailed reports it for cache hits.
+type CachingResolver struct {
+	resolve ResolveFunc
+	cache   *ttlCache
+}
+
+func NewCachingResolver(resolve ResolveFunc, ttl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		resolve: resolve,
+		cache:   newTTLCache(ttl),
+	}
+}
+
+// Resolve implements ResolveFunc.
+// Names which can't be normalized are resolved uncached (and likely
+// fail with ErrInvalidLabel).
+func (c *CachingResolver) Resolve(ctx context.Context, name string) (string, error) {
+	start := time.Now()
+	key, err := nameKey(name)
+	if err != nil {
+		return c.resolve(ctx, name)
+	}
+	if cached, ok := c.cache.get(key); ok {
+		observeResolve(backendCache, start)
+		res := cached.(ResolveResult)
+		reportResult(ctx, res)
+		return res.Email, nil
+	}
+
+	res, err := ResolveDetailed(ctx, c.resolve, name)
+	if err != nil {
+		return "", err
+	}
+	c.cache.set(key, res)
+	reportResult(ctx, res)
+	return res.Email, nil
+}
+
+// WarmResult summarizes a WarmCache call.
+type WarmResult struct {
+	Resolved int
+	Failed   map[string]error // k: name
+}
+
+// WarmCache resolves each of names, bypassing (and refreshing) cached
+// results, so the first message to each name doesn't wait on
+// resolution.  Names are resolved concurrently, by a bounded number
+// of workers.
+func (c *CachingResolver) WarmCache(ctx context.Context, names []string) WarmResult {
+	res := WarmResult{Failed: make(map[string]error)}
+	var mu sync.Mutex
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < warmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				resolved, err := ResolveDetailed(ctx, c.resolve, name)
+				if key, nerr := nameKey(name); err == nil && nerr == nil {
+					c.cache.set(key, resolved)
+				}
+
+				mu.Lock()
+				if err != nil {
+					res.Failed[name] = err
+				} else {
+					res.Resolved++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, name := range names {
+		work <- name
+	}
+	close(work)
+	wg.Wait()
+
+	return res
+}
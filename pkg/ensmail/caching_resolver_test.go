@@ -0,0 +1,128 @@
+package ensmail
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestCachingResolver(t *testing.T) {
+	errBadName := errors.New("bad name")
+
+	var (
+		mu    sync.Mutex
+		calls = make(map[string]int)
+	)
+	c := NewCachingResolver(func(ctx context.Context, name string) (string, error) {
+		mu.Lock()
+		calls[name]++
+		mu.Unlock()
+		if name == "bad" {
+			return "", errBadName
+		}
+		return name + "@resolved.test", nil
+	}, time.Minute)
+
+	res := c.WarmCache(context.Background(), []string{"one", "two", "three", "bad"})
+	if res.Resolved != 3 {
+		t.Errorf("want resolved: 3, got: %d", res.Resolved)
+	}
+	if len(res.Failed) != 1 || res.Failed["bad"] != errBadName {
+		t.Errorf("want failed: bad, got: %v", res.Failed)
+	}
+
+	// Warmed names are resolved from the cache, failures are not
+	// cached.
+	for _, name := range []string{"one", "two", "three", "bad"} {
+		got, err := c.Resolve(context.Background(), name)
+		if name == "bad" {
+			if err != errBadName {
+				t.Errorf("want err: %v, got: %v", errBadName, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal("unexpected err:", err)
+		} else if got != name+"@resolved.test" {
+			t.Errorf("want: %s@resolved.test, got: %s", name, got)
+		}
+	}
+
+	for name, exp := range map[string]int{"one": 1, "two": 1, "three": 1, "bad": 2} {
+		if calls[name] != exp {
+			t.Errorf("%s: want calls: %d, got: %d", name, exp, calls[name])
+		}
+	}
+}
+
+func TestCachingResolverNormalized(t *testing.T) {
+	var calls int
+	c := NewCachingResolver(func(ctx context.Context, name string) (string, error) {
+		calls++
+		return "alice@resolved.test", nil
+	}, time.Minute)
+
+	// Names with the same node share one entry.
+	for _, name := range []string{"Alice", "alice", "ALICE"} {
+		if got, err := c.Resolve(context.Background(), name); err != nil || got != "alice@resolved.test" {
+			t.Errorf("%s: want: alice@resolved.test, got: %s, %v", name, got, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("want calls: 1, got: %d", calls)
+	}
+
+	// Names which only normalize leniently (see NormalizeLenient)
+	// share an entry too.
+	for _, name := range []string{"under_score", "Under_Score"} {
+		c.Resolve(context.Background(), name)
+	}
+	if calls != 2 {
+		t.Errorf("want calls: 2, got: %d", calls)
+	}
+
+	// Names which can't be normalized aren't cached.
+	for i := 0; i < 2; i++ {
+		c.Resolve(context.Background(), "⒈x")
+	}
+	if calls != 4 {
+		t.Errorf("want calls: 4, got: %d", calls)
+	}
+}
+
+func TestResolveSecondsBackend(t *testing.T) {
+	static, err := NewStaticENSResolver(strings.NewReader(`{"alice": {"email": "alice@example.com"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCachingResolver(static.Email, time.Minute)
+
+	count := func(backend string) uint64 {
+		var m dto.Metric
+		if err := resolveSeconds.WithLabelValues(backend).(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	staticBefore, cacheBefore := count(backendStatic), count(backendCache)
+
+	// The miss is observed by the static backend, and the hits by
+	// the cache.
+	for i := 0; i < 3; i++ {
+		if _, err := c.Resolve(context.Background(), "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := count(backendStatic) - staticBefore; got != 1 {
+		t.Errorf("want static observations: 1, got: %d", got)
+	}
+	if got := count(backendCache) - cacheBefore; got != 2 {
+		t.Errorf("want cache observations: 2, got: %d", got)
+	}
+}
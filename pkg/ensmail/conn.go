@@ -0,0 +1,82 @@
+package ensmail
+
+import (
+	"io"
+	"net"
+)
+
+// sessionListener wraps the connections accepted by a listener, so
+// sessions can set deadlines on their own connection (see connOf).
+// go-smtp gives NewSession an smtp.ConnectionState, which holds only
+// the connection's addresses and TLS state, and it doesn't expose its
+// smtp.Conn to backends, so the remote address is the only value that
+// can carry the connection to the session.
+type sessionListener struct {
+	net.Listener
+}
+
+func (l sessionListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sessionConn{c}, nil
+}
+
+// sessionConn is a connection whose remote address carries the
+// connection itself.
+type sessionConn struct {
+	net.Conn
+}
+
+func (c *sessionConn) RemoteAddr() net.Addr {
+	return sessionAddr{addr: c.Conn.RemoteAddr(), conn: c.Conn}
+}
+
+// sessionAddr is a sessionConn's remote address.  addr is nil for
+// unnamed unix socket peers.
+type sessionAddr struct {
+	addr net.Addr
+	conn net.Conn
+}
+
+func (a sessionAddr) Network() string {
+	if a.addr == nil {
+		return ""
+	}
+	return a.addr.Network()
+}
+
+func (a sessionAddr) String() string {
+	if a.addr == nil {
+		return ""
+	}
+	return a.addr.String()
+}
+
+// connOf returns the connection of the remote address addr, or nil if
+// the connection wasn't accepted by a sessionListener.
+func connOf(addr net.Addr) net.Conn {
+	if a, ok := addr.(sessionAddr); ok {
+		return a.conn
+	}
+	return nil
+}
+
+// dataReader records the size of a message's content read from the
+// sender, and the last error reading it, so it can be told apart from
+// forwarding errors.
+type dataReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.n += int64(n)
+	if err != nil && err != io.EOF {
+		d.err = err
+	}
+	return n, err
+}
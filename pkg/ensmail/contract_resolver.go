@@ -0,0 +1,51 @@
+package ensmail
+
+import (
+	"context"
+	"net/mail"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/royalfork/ensmail/pkg/ens"
+)
+
+// ContractResolver resolves names from a purpose-built contract which
+// maps nodes directly to email addresses (see
+// ens/contracts/EmailRegistry.sol), rather than from the email text
+// record of the name's resolver.
+type ContractResolver struct {
+	registry *ens.EmailRegistryCaller
+}
+
+// NewContractResolver returns a ContractResolver which calls the
+// EmailRegistry contract deployed at addr.
+func NewContractResolver(addr common.Address, caller bind.ContractCaller) (*ContractResolver, error) {
+	registry, err := ens.NewEmailRegistryCaller(addr, caller)
+	if err != nil {
+		return nil, err
+	}
+	return &ContractResolver{registry: registry}, nil
+}
+
+// Email returns the email address the contract maps name's node to,
+// with the ".eth" suffix added.  As the contract has no notion of a
+// resolver, names without an address fail with ErrNoEmail.
+func (r *ContractResolver) Email(ctx context.Context, name string) (string, error) {
+	defer observeResolve(backendContract, time.Now())
+
+	node, err := nameHash(name)
+	if err != nil {
+		return "", err
+	}
+
+	email, err := r.registry.Email(&bind.CallOpts{Context: ctx}, node)
+	if err != nil {
+		return "", err
+	} else if email == "" {
+		return "", ErrNoEmail
+	} else if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return "", ErrInvalidResolved
+	}
+	return email, nil
+}
@@ -0,0 +1,126 @@
+package ensmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/royalfork/ensmail/pkg/ens"
+)
+
+func TestContractResolver(t *testing.T) {
+	testENS, err := ens.NewTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emails := make(map[[32]byte]interface{})
+	for name, email := range map[string]string{
+		"alice":   "alice@example.com",
+		"invalid": "Alice <alice@example.com>",
+	} {
+		node, err := nameHash(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		emails[node] = email
+	}
+	registry, err := ens.EmailRegistryMetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller := newViewCaller(t, testENS.Chain, *registry, "email", emails, "")
+
+	r, err := NewContractResolver(caller.addr, caller)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		email string
+		err   error
+	}{
+		{"alice", "alice@example.com", nil},
+		{"ALICE", "alice@example.com", nil},
+		{"noemail", "", ErrNoEmail},
+		{"invalid", "", ErrInvalidResolved},
+		{"bad_label", "", ErrInvalidLabel},
+	} {
+		if got, err := r.Email(context.Background(), test.name); !errors.Is(err, test.err) {
+			t.Errorf("%s: want err: %v, got: %v", test.name, test.err, err)
+		} else if got != test.email {
+			t.Errorf("%s: want email: %s, got: %s", test.name, test.email, got)
+		}
+	}
+
+	// An address without code can't answer calls at all.
+	noCode, err := NewContractResolver(testENS.Accts[1].Addr, testENS.Chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := noCode.Email(context.Background(), "alice"); err == nil || errors.Is(err, ErrNoEmail) {
+		t.Errorf("want call err, got: %v", err)
+	}
+}
+
+// viewCaller is a bind.ContractCaller which answers calls of method
+// to addr, a contract whose view method takes one 32 byte argument,
+// with the entry of results for the argument, or fallback for other
+// arguments.  Calls of other methods to addr revert, and calls to other
+// contracts are made with the wrapped caller.
+type viewCaller struct {
+	bind.ContractCaller
+	addr     common.Address
+	method   abi.Method
+	results  map[[32]byte]interface{}
+	fallback interface{}
+}
+
+// newViewCaller returns a viewCaller of method of contract, at an
+// address without code on caller's chain.
+func newViewCaller(t *testing.T, caller bind.ContractCaller, contract abi.ABI, method string, results map[[32]byte]interface{}, fallback interface{}) *viewCaller {
+	t.Helper()
+
+	m, ok := contract.Methods[method]
+	if !ok {
+		t.Fatalf("no method: %s", method)
+	}
+	return &viewCaller{
+		ContractCaller: caller,
+		addr:           common.HexToAddress("0x000000000000000000000000000000000000e1e1"),
+		method:         m,
+		results:        results,
+		fallback:       fallback,
+	}
+}
+
+func (c *viewCaller) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	if contract == c.addr {
+		return []byte{0xfe}, nil
+	}
+	return c.ContractCaller.CodeAt(ctx, contract, blockNumber)
+}
+
+func (c *viewCaller) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	if call.To == nil || *call.To != c.addr {
+		return c.ContractCaller.CallContract(ctx, call, blockNumber)
+	}
+	if len(call.Data) < 4 || !bytes.Equal(call.Data[:4], c.method.ID) {
+		return nil, vm.ErrExecutionReverted
+	}
+	var key [32]byte
+	copy(key[:], call.Data[4:])
+	result, ok := c.results[key]
+	if !ok {
+		result = c.fallback
+	}
+	return c.method.Outputs.Pack(result)
+}
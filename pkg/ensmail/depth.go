@@ -0,0 +1,50 @@
+package ensmail
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrResolveDepthExceeded is returned by resolutions which follow
+// more references (such as aliases) than allowed.  Errors of each
+// kind of reference (such as ErrAliasLoop) wrap it.
+var ErrResolveDepthExceeded = errors.New("resolution depth exceeded")
+
+// WithMaxResolveDepth bounds the references (such as aliases)
+// followed by a resolution to max, whichever features follow them,
+// so no feature can cause unbounded calls.  References are counted
+// through the resolution's context, so resolutions nested in it
+// (such as of a referenced name) share its depth.  Resolutions which
+// exceed max fail with ErrResolveDepthExceeded.  Each feature's own
+// limit (such as WithAliases' maxDepth) still applies.
+func WithMaxResolveDepth(max int) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.maxDepth = max
+	}
+}
+
+type resolveDepthKey struct{}
+
+// withResolveDepth returns ctx with a reference counter, unless ctx
+// already has one (as it's a nested resolution).
+func withResolveDepth(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(resolveDepthKey{}).(*int32); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, resolveDepthKey{}, new(int32))
+}
+
+// followReference counts a reference followed by the resolution of
+// ctx, and fails with ErrResolveDepthExceeded if more than max have
+// been followed.  A max of 0 is unlimited.
+func followReference(ctx context.Context, max int) error {
+	depth, ok := ctx.Value(resolveDepthKey{}).(*int32)
+	if !ok || max <= 0 {
+		return nil
+	}
+	if int(atomic.AddInt32(depth, 1)) > max {
+		return ErrResolveDepthExceeded
+	}
+	return nil
+}
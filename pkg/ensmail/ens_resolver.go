@@ -2,45 +2,990 @@ package ensmail
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/go-kit/log"
 	"github.com/royalfork/ensmail/pkg/ens"
 )
 
 var (
-	ErrNoResolver = errors.New("no resolver set")
-	ErrNoEmail    = errors.New("no email set")
+	ErrNoResolver         = errors.New("no resolver set")
+	ErrNoEmail            = errors.New("no email set")
+	ErrUnauthorizedName   = errors.New("name owner not allowed")
+	ErrNoReverseName      = errors.New("no reverse name set")
+	ErrInvalidLabel       = errors.New("invalid ENS label")
+	ErrEmptyName          = errors.New("empty name")
+	ErrInvalidResolved    = errors.New("email record is not a valid address")
+	ErrAliasLoop          = fmt.Errorf("alias chain too long: %w", ErrResolveDepthExceeded)
+	ErrNoRegistryCode     = errors.New("no contract deployed at registry address")
+	ErrNameExpired        = errors.New("name registration expired")
+	ErrNoAddress          = errors.New("no address set")
+	ErrInvalidResolver    = errors.New("resolver is not a resolver contract")
+	ErrForwardingDisabled = errors.New("forwarding disabled by name owner")
+
+	ErrDisallowedForwardDomain = errors.New("email domain not allowed by name owner")
 )
 
 type ENSResolver struct {
-	caller   bind.ContractCaller
-	registry *ens.ENSCaller
+	caller       bind.ContractCaller
+	registryAddr common.Address
+	registry     *ens.ENSCaller
+	owners       map[common.Address]bool
+	logger       log.Logger
+
+	// If set, returned by Email for names without a resolver or
+	// email text record.
+	defaultForward string
+
+	// If set, successful resolutions are logged with the primary
+	// ENS name of the resolved name's address.
+	reverseLogger log.Logger
+	reverseCache  *ttlCache
+	reverseSem    chan struct{} // bounds the reverse lookups in progress
+
+	// If non-zero, alias records are followed by Email, up to
+	// maxAliasDepth times.
+	maxAliasDepth int
+
+	// If set, bounds the references followed by each resolution,
+	// see WithMaxResolveDepth.
+	maxDepth int
+
+	// If non-zero, resolutions are delayed by a random duration
+	// less than jitter.
+	jitter time.Duration
+
+	// If registrarAddr is set, Email fails with ErrNameExpired for
+	// names whose .eth registration expired more than expiryGrace
+	// ago.
+	registrarAddr common.Address
+	registrar     *ens.BaseRegistrarCaller
+	expiryGrace   time.Duration
+
+	// Transforms email text records into forward addresses.
+	decoder TextDecoder
+
+	// If set, email records are read with callSpec, rather than
+	// from the email text record.
+	callSpec *ResolverCallSpec
+
+	// If set, Email tries names under each TLD, in order, rather
+	// than only under defaultTLD.
+	tlds []string
+
+	// How names which can't be normalized are handled.
+	normalization NameNormalization
+
+	// If set, Email fails with ErrForwardingDisabled for names whose
+	// disabledKey text record is "true".
+	disabledKey string
+
+	// If set, Email fails with ErrDisallowedForwardDomain for names
+	// whose email domain isn't listed in their allowedKey text
+	// record, if set.
+	allowedKey string
+
+	// Chain ID reported in ResolveResults, if set.
+	chainID *big.Int
+}
+
+// ENSResolverOption configures optional ENSResolver behavior.
+type ENSResolverOption func(*ENSResolver)
+
+// WithAllowedOwners limits resolution to names whose registry owner
+// is one of owners.  Names owned by any other address fail with
+// ErrUnauthorizedName.
+//
+// The registry owner of a wrapped name is the NameWrapper contract,
+// not the name's actual owner (which only the NameWrapper records), so
+// wrapped names are only resolved if the NameWrapper is one of owners.
+func WithAllowedOwners(owners ...common.Address) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.owners = make(map[common.Address]bool, len(owners))
+		for _, owner := range owners {
+			r.owners[owner] = true
+		}
+	}
+}
+
+// WithReverseLogging logs each successful resolution to logger,
+// annotated with the primary ENS name (reverse record) of the address
+// the resolved name resolves to (its addr record).  Reverse lookups
+// are performed asynchronously, so they never delay resolution, by at
+// most reverseWorkers at once (resolutions beyond that are logged
+// without one).  Their results, including addresses without a primary
+// name, are cached for ttl.
+func WithReverseLogging(logger log.Logger, ttl time.Duration) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.reverseLogger = logger
+		r.reverseCache = newTTLCache(ttl)
+		r.reverseSem = make(chan struct{}, reverseWorkers)
+	}
+}
+
+// reverseWorkers bounds the reverse lookups made at once for
+// WithReverseLogging.
+const reverseWorkers = 8
+
+// WithResolverLogger sets the logger used by ENSResolver.
+func WithResolverLogger(logger log.Logger) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.logger = logger
+	}
+}
+
+// WithDefaultForward sets a catch-all forward address, which Email
+// returns (instead of ErrNoResolver or ErrNoEmail) for names without
+// a resolver or email text record.
+func WithDefaultForward(addr string) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.defaultForward = addr
+	}
+}
+
+// WithAliases makes Email follow "ensmail.alias" text records: a
+// name whose alias record is set (to another full ENS name, such as
+// "newname.eth") resolves as that name instead.  Alias targets are
+// normalized (see WithNameNormalization) and checked for expiry (see
+// WithExpiryCheck) as queried names are.  Chains of more than
+// maxDepth aliases (including alias loops) fail with ErrAliasLoop.
+func WithAliases(maxDepth int) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.maxAliasDepth = maxDepth
+	}
+}
+
+// WithResolveJitter delays each resolution by a random duration of
+// less than max, which spreads bursts of resolutions (such as when
+// many sessions start at once) over time, for web3 providers with
+// strict rate limits.  Delayed resolutions fail with ctx's error if
+// ctx is done before they're made.
+func WithResolveJitter(max time.Duration) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.jitter = max
+	}
+}
+
+// TextDecoder transforms the raw value of an email text record into
+// a forward email address, for records in richer formats than a bare
+// address.
+type TextDecoder func(record string) (string, error)
+
+// WithTextDecoder makes Email decode email text records with decoder
+// before they're validated.  By default, records are used verbatim.
+// Decoder errors fail resolution with ErrInvalidResolved.
+func WithTextDecoder(decoder TextDecoder) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.decoder = decoder
+	}
 }
 
-func NewENSResolver(registryAddr common.Address, caller bind.ContractCaller) (*ENSResolver, error) {
+// WithResolverCallSpec makes Email read email records with spec,
+// rather than from the ENSIP-5 text record ("text(node, "email")"),
+// for deployments whose resolvers expose email with a non-standard
+// method.  Alias records (see WithAliases) are still read from text
+// records, as are email records of resolvers without the method (whose
+// calls revert), so names whose resolver is the public resolver still
+// resolve.
+func WithResolverCallSpec(spec *ResolverCallSpec) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.callSpec = spec
+	}
+}
+
+// NameNormalization is how Email handles names which can't be
+// normalized as ENS names (see WithNameNormalization).
+type NameNormalization int
+
+const (
+	// NormalizeStrict fails names which UTS-46 normalization (with
+	// the STD3 ASCII rules of ENSIP-1) rejects with ErrInvalidLabel,
+	// which senders are replied to with 553 5.1.3.
+	NormalizeStrict NameNormalization = iota
+	// NormalizeLenient normalizes names which NormalizeStrict
+	// rejects without the STD3 ASCII rules (see ens.LenientNameHash),
+	// so names containing ASCII symbols such as "_" resolve.  Names
+	// which still can't be normalized fail with ErrInvalidLabel.
+	NormalizeLenient
+)
+
+// nameKey returns the normalized name by which resolutions of name
+// are keyed (such as by CachingResolver and Overrides).  Names are
+// normalized as by NormalizeLenient, which normalizes every name
+// NormalizeStrict accepts the same, so names share a key whichever
+// normalization resolves them.
+func nameKey(name string) (string, error) {
+	return ens.LenientNormalize(name)
+}
+
+// WithNameNormalization sets how Email (and the other lookups of
+// names, such as Policy) handle names which can't be normalized
+// (NormalizeStrict by default).
+func WithNameNormalization(mode NameNormalization) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.normalization = mode
+	}
+}
+
+// WithDisabledRecord makes Email fail with ErrForwardingDisabled for
+// names whose key text record (or "ensmail.disabled", if key is
+// empty) is "true", so owners can stop forwarding temporarily (such
+// as while migrating their mailbox) without unsetting their email
+// record.  Each name of an alias chain (see WithAliases) is checked,
+// from the queried name on, so a disabled name stays disabled while
+// aliased, and so does an alias to one.
+func WithDisabledRecord(key string) ENSResolverOption {
+	return func(r *ENSResolver) {
+		if key == "" {
+			key = textDisabledKey
+		}
+		r.disabledKey = key
+	}
+}
+
+// WithForwardDomainRecord pins names' forward domains: Email fails
+// with ErrDisallowedForwardDomain for names whose key text record (or
+// "ensmail.allowed", if key is empty) is a comma separated list of
+// domains which doesn't include their email's domain, so a redirected
+// email record (such as by a compromised resolver manager) can't
+// forward mail to another domain.  Names without the record may
+// forward to any domain.  Each name of an alias chain (see
+// WithAliases) is checked, from the queried name on, so aliasing a
+// name elsewhere doesn't lift its pinned domains.
+func WithForwardDomainRecord(key string) ENSResolverOption {
+	return func(r *ENSResolver) {
+		if key == "" {
+			key = textAllowedKey
+		}
+		r.allowedKey = key
+	}
+}
+
+// WithChainID sets the chain ID reported with resolutions (see
+// ResolveDetailed), which should be the chain ID of the resolver's
+// backend.
+func WithChainID(id *big.Int) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.chainID = id
+	}
+}
+
+// DecodeMailto is a TextDecoder for records which are "mailto:" URIs
+// (RFC 6068), such as "mailto:alice@example.com".  The URI's
+// query (headers, such as subject) is ignored.  Records without the
+// mailto scheme are returned unchanged.
+func DecodeMailto(record string) (string, error) {
+	if len(record) < len("mailto:") || !strings.EqualFold(record[:len("mailto:")], "mailto:") {
+		return record, nil
+	}
+	u, err := url.Parse(record)
+	if err != nil {
+		return "", err
+	}
+	return url.PathUnescape(u.Opaque)
+}
+
+// WithTLDs makes Email try name under each of tlds (such as "eth"
+// and "box", without a leading dot), in order, and return the email
+// of the first with a resolver and email text record.  A name without
+// either under every TLD fails with the error of the last TLD (or
+// resolves to the default forward address).  Any other error,
+// including a name with an invalid email record, ends the search.
+// The WithExpiryCheck registrar only records ".eth" names, so other
+// TLDs aren't checked for expiry.  Name's other records (such as its
+// Policy) are read under the TLD whose email Email returns.
+func WithTLDs(tlds ...string) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.tlds = tlds
+	}
+}
+
+// WithExpiryCheck makes Email read the expiry of names from the .eth
+// registrar at registrar (nameExpires of the name's ".eth" label, so
+// subnames expire with their parent), and fail with ErrNameExpired
+// once a name has been expired for longer than grace.  The registry
+// may still return the resolver of an expired name, whose email
+// record is then likely stale.  EmailByNode, which has no name, isn't
+// checked.
+func WithExpiryCheck(registrar common.Address, grace time.Duration) ENSResolverOption {
+	return func(r *ENSResolver) {
+		r.registrarAddr = registrar
+		r.expiryGrace = grace
+	}
+}
+
+func NewENSResolver(registryAddr common.Address, caller bind.ContractCaller, opts ...ENSResolverOption) (*ENSResolver, error) {
 	registry, err := ens.NewENSCaller(registryAddr, caller)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ENSResolver{
-		caller:   caller,
-		registry: registry,
-	}, nil
+	r := &ENSResolver{
+		caller:       caller,
+		registryAddr: registryAddr,
+		registry:     registry,
+		logger:       log.NewNopLogger(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.registrarAddr != (common.Address{}) {
+		if r.registrar, err = ens.NewBaseRegistrarCaller(r.registrarAddr, caller); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Validate checks that a contract is deployed at the registry
+// address, and returns ErrNoRegistryCode if not.  Without a registry
+// contract (for example, if the registry address is mistyped, or is
+// on another chain), every resolution fails.
+func (r *ENSResolver) Validate(ctx context.Context) error {
+	code, err := r.caller.CodeAt(ctx, r.registryAddr, nil)
+	if err != nil {
+		return err
+	}
+	if len(code) == 0 {
+		return ErrNoRegistryCode
+	}
+	return nil
+}
+
+const (
+	defaultTLD = "eth"
+
+	// Defined by https://docs.ens.domains/ens-improvement-proposals/ensip-5-text-records
+	textEmailKey   = "email"
+	textDisplayKey = "display"
+	textAvatarKey  = "avatar"
+	// Not defined by ENSIP-5, see NamePolicy.
+	textPolicyKey = "ensmail.policy"
+	// Not defined by ENSIP-5, see WithAliases.
+	textAliasKey = "ensmail.alias"
+	// Not defined by ENSIP-5, see WithDisabledRecord.
+	textDisabledKey = "ensmail.disabled"
+	// Not defined by ENSIP-5, see WithForwardDomainRecord.
+	textAllowedKey = "ensmail.allowed"
+	// Not defined by ENSIP-5, but commonly used in place of "display".
+	textNameKey = "name"
+)
+
+// nameHash returns the node of name, with the ".eth" suffix added.
+// Names which can't be normalized fail with ErrInvalidLabel.
+func nameHash(name string) ([32]byte, error) {
+	node, err := ens.NameHash(name + "." + defaultTLD)
+	if err != nil {
+		return node, fmt.Errorf("%w: %v", ErrInvalidLabel, err)
+	}
+	return node, nil
+}
+
+// textResolver returns the node of name (with the tld suffix added,
+// and normalized as by Email), and the text resolver set for that
+// node.  The resolver is always read from the registry, so wrapped
+// names (whose registry owner is the NameWrapper) resolve like any
+// other name.
+func (r *ENSResolver) textResolver(callOpts *bind.CallOpts, name, tld string) ([32]byte, *ens.TextResolverCaller, error) {
+	node, err := r.normalizedHash(ens.NameHash, ens.LenientNameHash, name+"."+tld)
+	if err != nil {
+		return node, nil, err
+	}
+
+	resolver, err := r.nodeTextResolver(callOpts, node)
+	return node, resolver, err
+}
+
+// nodeTextResolver returns the text resolver set for node.
+func (r *ENSResolver) nodeTextResolver(callOpts *bind.CallOpts, node [32]byte) (*ens.TextResolverCaller, error) {
+	resolverAddr, err := r.nodeResolverAddr(callOpts, node)
+	if err != nil {
+		return nil, err
+	}
+	return ens.NewTextResolverCaller(resolverAddr, r.caller)
+}
+
+// nodeResolverAddr returns the address of the resolver set for node,
+// after checking node's owner is allowed.
+func (r *ENSResolver) nodeResolverAddr(callOpts *bind.CallOpts, node [32]byte) (common.Address, error) {
+	if r.owners != nil {
+		owner, err := r.registry.Owner(callOpts, node)
+		if err != nil {
+			return common.Address{}, err
+		} else if !r.owners[owner] {
+			return common.Address{}, ErrUnauthorizedName
+		}
+	}
+
+	resolverAddr, err := r.registry.Resolver(callOpts, node)
+	if err != nil {
+		return common.Address{}, err
+	} else if resolverAddr == (common.Address{}) {
+		return common.Address{}, ErrNoResolver
+	} else if resolverAddr == r.registryAddr {
+		// A common misconfiguration, whose calls revert.
+		return common.Address{}, ErrInvalidResolver
+	}
+	return resolverAddr, nil
+}
+
+// resolverCallErr returns ErrInvalidResolver (wrapping err) if err is
+// the error of a resolver call which reverted, or of a call to an
+// address without code, as the resolver doesn't implement the called
+// interface.  Other errors are returned unchanged.
+func resolverCallErr(err error) error {
+	if errors.Is(err, vm.ErrExecutionReverted) || errors.Is(err, bind.ErrNoCode) ||
+		// Reverts of calls over JSON-RPC are only identified by
+		// their message.
+		(err != nil && strings.Contains(err.Error(), vm.ErrExecutionReverted.Error())) {
+		return fmt.Errorf("%w: %v", ErrInvalidResolver, err)
+	}
+	return err
+}
+
+// addrResolver returns the node of name (with the tld suffix added,
+// and normalized as by Email), and the addr resolver set for that
+// node.
+func (r *ENSResolver) addrResolver(callOpts *bind.CallOpts, name, tld string) ([32]byte, *ens.AddrResolverCaller, error) {
+	node, err := r.normalizedHash(ens.NameHash, ens.LenientNameHash, name+"."+tld)
+	if err != nil {
+		return node, nil, err
+	}
+
+	resolverAddr, err := r.nodeResolverAddr(callOpts, node)
+	if err != nil {
+		return node, nil, err
+	}
+	resolver, err := ens.NewAddrResolverCaller(resolverAddr, r.caller)
+	return node, resolver, err
+}
+
+// CoinTypeETH is the ENSIP-9 coin type of ether addresses, which are
+// also returned by Address.
+const CoinTypeETH = 60
+
+// CoinTypeForChain returns the ENSIP-11 coin type of addresses on the
+// EVM chain with chainID.  Ethereum mainnet uses CoinTypeETH instead.
+func CoinTypeForChain(chainID uint64) uint64 {
+	return 0x80000000 | chainID
+}
+
+// Address returns the ethereum address record (addr(node)) of name,
+// with the ".eth" suffix (or each suffix set by WithTLDs, as by Email)
+// added.  Names without a resolver fail with ErrNoResolver, and names
+// without an address record with ErrNoAddress.
+func (r *ENSResolver) Address(ctx context.Context, name string) (common.Address, error) {
+	callOpts := &bind.CallOpts{Context: ctx}
+
+	var addr common.Address
+	err := r.underTLDs(func(tld string) error {
+		node, resolver, err := r.addrResolver(callOpts, name, tld)
+		if err != nil {
+			return err
+		}
+		if addr, err = resolver.Addr(callOpts, node); err != nil {
+			return resolverCallErr(err)
+		} else if addr == (common.Address{}) {
+			return ErrNoAddress
+		}
+		return nil
+	}, ErrNoResolver, ErrNoAddress)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return addr, nil
+}
+
+// AddressForCoin is like Address, but returns the multicoin address
+// record (ENSIP-9) of name for coinType, in the coin's binary
+// encoding.  Addresses on EVM chains are the 20 byte address, with
+// coinType from CoinTypeForChain (ENSIP-11).
+func (r *ENSResolver) AddressForCoin(ctx context.Context, name string, coinType uint64) ([]byte, error) {
+	callOpts := &bind.CallOpts{Context: ctx}
+
+	var addr []byte
+	err := r.underTLDs(func(tld string) error {
+		node, resolver, err := r.addrResolver(callOpts, name, tld)
+		if err != nil {
+			return err
+		}
+		if addr, err = resolver.Addr0(callOpts, node, new(big.Int).SetUint64(coinType)); err != nil {
+			return resolverCallErr(err)
+		} else if len(addr) == 0 {
+			return ErrNoAddress
+		}
+		return nil
+	}, ErrNoResolver, ErrNoAddress)
+	if err != nil {
+		return nil, err
+	}
+	return addr, nil
 }
 
 // Email returns the email text record for the given name.  Before
-// querying the ENS registry, the ".eth" suffix is added to name.
+// querying the ENS registry, the ".eth" suffix (or each suffix set by
+// WithTLDs) is added to name.  If a default forward address is set,
+// it is returned for names without a resolver or email text record.
+// name is normalized (so lookups are case-insensitive), but the
+// record is returned verbatim, as its local-part may be
+// case-sensitive.  An empty name fails with ErrEmptyName, rather than
+// resolving the TLD itself.
 func (r *ENSResolver) Email(ctx context.Context, name string) (string, error) {
-	const (
-		TLDSuffix = ".eth"
-		// Defined by https://docs.ens.domains/ens-improvement-proposals/ensip-5-text-records
-		TextEmailKey = "email"
-	)
+	defer observeResolve(backendENS, time.Now())
+
+	if name == "" {
+		return "", ErrEmptyName
+	}
 
-	node, err := ens.NameHash(name + TLDSuffix)
+	// Each TLD is a separate resolution, so references followed under
+	// one don't count against the next (unless nested in another).
+	var email string
+	err := r.underTLDs(func(tld string) (err error) {
+		email, err = r.emailUnder(withResolveDepth(ctx), name, tld)
+		return err
+	}, ErrNoResolver, ErrNoEmail)
+	if err == ErrNoResolver || err == ErrNoEmail {
+		return r.defaultForwardFor(name, err)
+	}
+	return email, err
+}
+
+// underTLDs calls lookup with each of r's TLDs (see WithTLDs), in
+// order, until it returns nil or an error other than next, and
+// returns the error of the last call.
+func (r *ENSResolver) underTLDs(lookup func(tld string) error, next ...error) error {
+	tlds := r.tlds
+	if len(tlds) == 0 {
+		tlds = []string{defaultTLD}
+	}
+
+	var err error
+search:
+	for _, tld := range tlds {
+		err = lookup(tld)
+		for _, n := range next {
+			if err == n {
+				continue search
+			}
+		}
+		return err
+	}
+	return err
+}
+
+// emailUnder returns the email text record of name under tld.
+func (r *ENSResolver) emailUnder(ctx context.Context, name, tld string) (string, error) {
+	node, err := r.normalizedHash(ens.NameHash, ens.LenientNameHash, name+"."+tld)
+	if err != nil {
+		return "", err
+	}
+	if r.registrar != nil && tld == defaultTLD {
+		if err := r.checkExpiry(ctx, name); err != nil {
+			return "", err
+		}
+	}
+	return r.email(ctx, node, name)
+}
+
+// normalizedHash returns the hash of s, which hashes as by strict,
+// or by lenient if strict fails and r.normalization allows.  Names
+// which can't be normalized fail with ErrInvalidLabel.
+func (r *ENSResolver) normalizedHash(strict, lenient func(string) ([32]byte, error), s string) ([32]byte, error) {
+	h, err := strict(s)
+	if err != nil && r.normalization == NormalizeLenient {
+		h, err = lenient(s)
+	}
+	if err != nil {
+		return h, fmt.Errorf("%w: %v", ErrInvalidLabel, err)
+	}
+	return h, nil
+}
+
+// checkExpiry fails with ErrNameExpired if the registration of
+// name's ".eth" label (the last label of name) expired more than
+// r.expiryGrace ago.  Names never registered with the registrar have
+// an expiry of 0, so also fail.
+func (r *ENSResolver) checkExpiry(ctx context.Context, name string) error {
+	label := name[strings.LastIndex(name, ".")+1:]
+	lh, err := r.normalizedHash(ens.LabelHash, ens.LenientLabelHash, label)
+	if err != nil {
+		return err
+	}
+
+	expires, err := r.registrar.NameExpires(&bind.CallOpts{Context: ctx}, new(big.Int).SetBytes(lh[:]))
+	if err != nil {
+		return err
+	}
+	if !expires.IsInt64() || time.Now().Before(time.Unix(expires.Int64(), 0).Add(r.expiryGrace)) {
+		return nil
+	}
+	return ErrNameExpired
+}
+
+// EmailByNode is like Email, but resolves the email text record of a
+// namehash computed by the caller (for example, from indexed ENS
+// events), rather than of a name.
+func (r *ENSResolver) EmailByNode(ctx context.Context, node [32]byte) (string, error) {
+	return r.emailByNode(ctx, node, common.Hash(node).Hex())
+}
+
+// EmailByOwner returns the email text record of the primary ENS
+// name of addr (see ReverseName), for tools which start from a wallet
+// address.  Addresses without a primary name (which resolves back to
+// addr) fail with ErrNoReverseName.  Names without an email record
+// fail with ErrNoEmail: the default forward address isn't the owner's
+// address.
+func (r *ENSResolver) EmailByOwner(ctx context.Context, addr common.Address) (string, error) {
+	name, err := r.ReverseName(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+	node, err := ens.NameHash(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidLabel, err)
+	}
+	if r.registrar != nil && strings.HasSuffix(name, "."+defaultTLD) {
+		if err := r.checkExpiry(ctx, strings.TrimSuffix(name, "."+defaultTLD)); err != nil {
+			return "", err
+		}
+	}
+	return r.email(ctx, node, name)
+}
+
+// emailByNode returns the email text record of node, or the default
+// forward address.  name is only used for logging.
+func (r *ENSResolver) emailByNode(ctx context.Context, node [32]byte, name string) (string, error) {
+	email, err := r.email(ctx, node, name)
+	if err == ErrNoResolver || err == ErrNoEmail {
+		return r.defaultForwardFor(name, err)
+	}
+	return email, err
+}
+
+// defaultForwardFor returns the default forward address for name,
+// which failed to resolve with err, or err if there's none.
+func (r *ENSResolver) defaultForwardFor(name string, err error) (string, error) {
+	if r.defaultForward == "" {
+		return "", err
+	}
+	r.logger.Log("name", name, "err", err, "resolved", r.defaultForward, "default", true)
+	return r.defaultForward, nil
+}
+
+func (r *ENSResolver) email(ctx context.Context, node [32]byte, name string) (string, error) {
+	ctx = withResolveDepth(ctx)
+	if r.jitter > 0 {
+		delay := time.NewTimer(time.Duration(rand.Int63n(int64(r.jitter))))
+		select {
+		case <-delay.C:
+		case <-ctx.Done():
+			delay.Stop()
+			return "", ctx.Err()
+		}
+	}
+
+	callOpts := &bind.CallOpts{Context: ctx}
+
+	resolverAddr, err := r.nodeResolverAddr(callOpts, node)
+	if err != nil {
+		return "", err
+	}
+	if err := r.checkDisabled(callOpts, resolverAddr, node); err != nil {
+		return "", err
+	}
+	// The forward domains of each name of the alias chain apply to
+	// the final email, so a compromised resolver can't escape a
+	// name's pinned domains by aliasing it elsewhere.
+	var allowed []string
+	if allowed, err = r.appendAllowed(allowed, callOpts, resolverAddr, node); err != nil {
+		return "", err
+	}
+
+	for depth := 0; r.maxAliasDepth > 0; depth++ {
+		resolver, err := ens.NewTextResolverCaller(resolverAddr, r.caller)
+		if err != nil {
+			return "", err
+		}
+		alias, err := resolver.Text(callOpts, node, textAliasKey)
+		if err != nil {
+			return "", resolverCallErr(err)
+		} else if alias == "" {
+			break
+		} else if depth == r.maxAliasDepth {
+			return "", ErrAliasLoop
+		}
+		if err := followReference(ctx, r.maxDepth); err != nil {
+			return "", err
+		}
+
+		if node, err = r.normalizedHash(ens.NameHash, ens.LenientNameHash, alias); err != nil {
+			return "", err
+		}
+		if r.registrar != nil && strings.HasSuffix(alias, "."+defaultTLD) {
+			if err := r.checkExpiry(ctx, strings.TrimSuffix(alias, "."+defaultTLD)); err != nil {
+				return "", err
+			}
+		}
+		name = alias
+		if resolverAddr, err = r.nodeResolverAddr(callOpts, node); err != nil {
+			return "", err
+		}
+		if err := r.checkDisabled(callOpts, resolverAddr, node); err != nil {
+			return "", err
+		}
+		if allowed, err = r.appendAllowed(allowed, callOpts, resolverAddr, node); err != nil {
+			return "", err
+		}
+	}
+
+	email, err := r.emailRecord(callOpts, resolverAddr, node)
+	if err != nil {
+		return "", resolverCallErr(err)
+	} else if email == "" {
+		return "", ErrNoEmail
+	}
+	if r.decoder != nil {
+		if email, err = r.decoder(email); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidResolved, err)
+		}
+	}
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return "", ErrInvalidResolved
+	}
+
+	for _, list := range allowed {
+		if !domainListed(list, email[strings.LastIndex(email, "@")+1:]) {
+			return "", ErrDisallowedForwardDomain
+		}
+	}
+
+	if r.reverseLogger != nil {
+		select {
+		case r.reverseSem <- struct{}{}:
+			go func() {
+				defer func() { <-r.reverseSem }()
+				r.logReverse(resolverAddr, node, name, email)
+			}()
+		default:
+			r.reverseLogger.Log("name", name, "resolved", email, "err", "reverse lookups saturated")
+		}
+	}
+
+	reportResult(ctx, ResolveResult{Email: email, Node: node, Resolver: resolverAddr, ChainID: r.chainID})
+	return email, nil
+}
+
+// checkDisabled fails with ErrForwardingDisabled if the disabled
+// record (see WithDisabledRecord) of node, read from the resolver at
+// resolverAddr, is "true".
+func (r *ENSResolver) checkDisabled(callOpts *bind.CallOpts, resolverAddr common.Address, node [32]byte) error {
+	if r.disabledKey == "" {
+		return nil
+	}
+	resolver, err := ens.NewTextResolverCaller(resolverAddr, r.caller)
+	if err != nil {
+		return err
+	}
+	disabled, err := resolver.Text(callOpts, node, r.disabledKey)
+	if err != nil {
+		return resolverCallErr(err)
+	} else if strings.EqualFold(strings.TrimSpace(disabled), "true") {
+		return ErrForwardingDisabled
+	}
+	return nil
+}
+
+// appendAllowed appends the forward domain record (see
+// WithForwardDomainRecord) of node, read from the resolver at
+// resolverAddr, to allowed, if it's set.
+func (r *ENSResolver) appendAllowed(allowed []string, callOpts *bind.CallOpts, resolverAddr common.Address, node [32]byte) ([]string, error) {
+	if r.allowedKey == "" {
+		return allowed, nil
+	}
+	resolver, err := ens.NewTextResolverCaller(resolverAddr, r.caller)
+	if err != nil {
+		return allowed, err
+	}
+	list, err := resolver.Text(callOpts, node, r.allowedKey)
+	if err != nil {
+		return allowed, resolverCallErr(err)
+	} else if list != "" {
+		allowed = append(allowed, list)
+	}
+	return allowed, nil
+}
+
+// domainListed reports whether domain is in the comma separated list
+// of domains.
+func domainListed(list, domain string) bool {
+	for _, d := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(d), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// emailRecord reads the email record of node from the resolver at
+// resolverAddr.
+func (r *ENSResolver) emailRecord(callOpts *bind.CallOpts, resolverAddr common.Address, node [32]byte) (string, error) {
+	if r.callSpec != nil {
+		email, err := r.callSpec.call(callOpts, r.caller, resolverAddr, node)
+		if !errors.Is(resolverCallErr(err), ErrInvalidResolver) {
+			return email, err
+		}
+		// Resolvers without the method (such as the public resolver)
+		// are read as usual.
+	}
+	resolver, err := ens.NewTextResolverCaller(resolverAddr, r.caller)
+	if err != nil {
+		return "", err
+	}
+	return resolver.Text(callOpts, node, textEmailKey)
+}
+
+// Profile is the set of text records which describe an ENS name's
+// mail identity.
+type Profile struct {
+	Email       string
+	DisplayName string
+	Avatar      string
+}
+
+// Profile returns the email, display name, and avatar text records
+// for the given name, using a single resolver lookup.  The display
+// name is read from the "display" text record, or the "name" text
+// record if "display" is unset.  Like Email, name is tried under each
+// TLD (see WithTLDs), and ErrNoEmail is returned if the email text
+// record is unset.
+func (r *ENSResolver) Profile(ctx context.Context, name string) (Profile, error) {
+	callOpts := &bind.CallOpts{Context: ctx}
+
+	var p Profile
+	err := r.underTLDs(func(tld string) (err error) {
+		p, err = r.profileUnder(callOpts, name, tld)
+		return err
+	}, ErrNoResolver, ErrNoEmail)
+	return p, err
+}
+
+// profileUnder returns the Profile of name under tld.
+func (r *ENSResolver) profileUnder(callOpts *bind.CallOpts, name, tld string) (Profile, error) {
+	node, resolver, err := r.textResolver(callOpts, name, tld)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	var p Profile
+	for _, rec := range []struct {
+		key string
+		val *string
+	}{
+		{textEmailKey, &p.Email},
+		{textDisplayKey, &p.DisplayName},
+		{textAvatarKey, &p.Avatar},
+	} {
+		if *rec.val, err = resolver.Text(callOpts, node, rec.key); err != nil {
+			return Profile{}, resolverCallErr(err)
+		}
+	}
+
+	if p.Email == "" {
+		return Profile{}, ErrNoEmail
+	}
+
+	if p.DisplayName == "" {
+		if p.DisplayName, err = resolver.Text(callOpts, node, textNameKey); err != nil {
+			return Profile{}, resolverCallErr(err)
+		}
+	}
+
+	return p, nil
+}
+
+// Policy returns the NamePolicy set in the "ensmail.policy" text
+// record of name, under the TLD Email resolves it under (see
+// WithTLDs).  Names without a resolver, or with a missing or
+// malformed policy record, have no policy (the zero NamePolicy).
+func (r *ENSResolver) Policy(ctx context.Context, name string) (NamePolicy, error) {
+	tld := defaultTLD
+	if len(r.tlds) > 0 {
+		tld = r.tlds[0]
+	}
+	// With several TLDs, the policy is read under the TLD whose email
+	// Email returns.
+	if len(r.tlds) > 1 {
+		err := r.underTLDs(func(t string) error {
+			tld = t
+			_, err := r.emailUnder(withResolveDepth(ctx), name, t)
+			return err
+		}, ErrNoResolver, ErrNoEmail)
+		if err == ErrNoResolver || err == ErrNoEmail {
+			return NamePolicy{}, nil
+		} else if err != nil {
+			return NamePolicy{}, err
+		}
+	}
+
+	callOpts := &bind.CallOpts{Context: ctx}
+	node, resolver, err := r.textResolver(callOpts, name, tld)
+	if err == ErrNoResolver {
+		return NamePolicy{}, nil
+	} else if err != nil {
+		return NamePolicy{}, err
+	}
+
+	rec, err := resolver.Text(callOpts, node, textPolicyKey)
+	if err != nil {
+		return NamePolicy{}, err
+	}
+
+	var p NamePolicy
+	if rec != "" {
+		if err := json.Unmarshal([]byte(rec), &p); err != nil {
+			r.logger.Log("name", name, "call", "json.Unmarshal", "err", err)
+			return NamePolicy{}, nil
+		}
+	}
+	return p, nil
+}
+
+// ReverseName returns the primary ENS name of addr.  The primary name
+// is only returned if it resolves back to addr.  With
+// WithReverseLogging, results (including ErrNoReverseName) are cached.
+func (r *ENSResolver) ReverseName(ctx context.Context, addr common.Address) (string, error) {
+	if r.reverseCache == nil {
+		return r.reverseName(ctx, addr)
+	}
+	if name, ok := r.reverseCache.get(addr.Hex()); ok {
+		if name == "" {
+			return "", ErrNoReverseName
+		}
+		return name.(string), nil
+	}
+
+	name, err := r.reverseName(ctx, addr)
+	if err != nil && err != ErrNoReverseName {
+		return "", err
+	}
+	r.reverseCache.set(addr.Hex(), name)
+	return name, err
+}
+
+func (r *ENSResolver) reverseName(ctx context.Context, addr common.Address) (string, error) {
+	node, err := ens.NameHash(ens.ReverseName(addr))
 	if err != nil {
 		return "", err
 	}
@@ -51,20 +996,79 @@ func (r *ENSResolver) Email(ctx context.Context, name string) (string, error) {
 	if err != nil {
 		return "", err
 	} else if resolverAddr == (common.Address{}) {
-		return "", ErrNoResolver
+		return "", ErrNoReverseName
 	}
 
-	resolver, err := ens.NewTextResolverCaller(resolverAddr, r.caller)
+	nameResolver, err := ens.NewNameResolverCaller(resolverAddr, r.caller)
 	if err != nil {
 		return "", err
 	}
 
-	email, err := resolver.Text(callOpts, node, TextEmailKey)
+	name, err := nameResolver.Name(callOpts, node)
 	if err != nil {
 		return "", err
-	} else if email == "" {
-		return "", ErrNoEmail
+	} else if name == "" {
+		return "", ErrNoReverseName
 	}
 
-	return email, nil
+	// Verify that name resolves back to addr, otherwise anyone could
+	// claim any name as their primary name.
+	nameNode, err := ens.NameHash(name)
+	if err != nil {
+		return "", err
+	}
+
+	resolverAddr, err = r.registry.Resolver(callOpts, nameNode)
+	if err != nil {
+		return "", err
+	} else if resolverAddr == (common.Address{}) {
+		return "", ErrNoReverseName
+	}
+
+	addrResolver, err := ens.NewAddrResolverCaller(resolverAddr, r.caller)
+	if err != nil {
+		return "", err
+	}
+
+	if fwdAddr, err := addrResolver.Addr(callOpts, nameNode); err != nil {
+		return "", err
+	} else if fwdAddr != addr {
+		return "", ErrNoReverseName
+	}
+	return name, nil
+}
+
+// logReverse logs the resolution of name to email, along with the
+// primary name of the address node resolves to, read from its
+// resolver at resolverAddr.
+func (r *ENSResolver) logReverse(resolverAddr common.Address, node [32]byte, name, email string) {
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	callOpts := &bind.CallOpts{Context: ctx}
+
+	logger := log.With(r.reverseLogger, "name", name, "resolved", email)
+
+	resolver, err := ens.NewAddrResolverCaller(resolverAddr, r.caller)
+	if err != nil {
+		logger.Log("call", "ens.NewAddrResolverCaller", "err", err)
+		return
+	}
+	addr, err := resolver.Addr(callOpts, node)
+	if err != nil {
+		logger.Log("call", "resolver.Addr", "err", err)
+		return
+	} else if addr == (common.Address{}) {
+		logger.Log("err", ErrNoAddress)
+		return
+	}
+	logger = log.With(logger, "addr", addr)
+
+	primary, err := r.ReverseName(ctx, addr)
+	if err != nil {
+		logger.Log("call", "r.ReverseName", "err", err)
+		return
+	}
+
+	logger.Log("primary", primary)
 }
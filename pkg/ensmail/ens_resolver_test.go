@@ -2,9 +2,17 @@ package ensmail
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/go-kit/log"
+	"github.com/google/go-cmp/cmp"
 	"github.com/royalfork/ensmail/pkg/ens"
 )
 
@@ -21,12 +29,39 @@ func TestResolveEmail(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	t.Run("validate", func(t *testing.T) {
+		if err := r.Validate(context.Background()); err != nil {
+			t.Error("unexpected err:", err)
+		}
+
+		noCode, err := NewENSResolver(testENS.Accts[1].Addr, testENS.Chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := noCode.Validate(context.Background()); err != ErrNoRegistryCode {
+			t.Errorf("want err: %v, got: %v", ErrNoRegistryCode, err)
+		}
+	})
+
 	t.Run("nameNotRegistered", func(t *testing.T) {
 		if _, err := r.Email(context.Background(), "noexist"); err != ErrNoResolver {
 			t.Errorf("want err: %s, got: %s", ErrNoResolver, err)
 		}
 	})
 
+	// Empty names aren't looked up, even with a default forward.
+	t.Run("emptyName", func(t *testing.T) {
+		withDefault, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithDefaultForward("default@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range []*ENSResolver{r, withDefault} {
+			if _, err := r.Email(context.Background(), ""); err != ErrEmptyName {
+				t.Errorf("want err: %s, got: %s", ErrEmptyName, err)
+			}
+		}
+	})
+
 	t.Run("noResolver", func(t *testing.T) {
 		label := "noresolver"
 
@@ -51,8 +86,24 @@ func TestResolveEmail(t *testing.T) {
 			t.Fatal("unable to set resolver")
 		}
 
-		if _, err := r.Email(context.Background(), label); err != vm.ErrExecutionReverted {
-			t.Errorf("want err: %s, got: %s", vm.ErrExecutionReverted, err)
+		if _, err := r.Email(context.Background(), label); err != ErrInvalidResolver {
+			t.Errorf("want err: %s, got: %s", ErrInvalidResolver, err)
+		}
+
+		// Other contracts, whose text calls revert, and addresses
+		// without code are reported the same way.
+		otherRegistry, _, _, err := ens.DeployENSRegistry(testENS.Accts[0].Auth, testENS.Chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testENS.Chain.Commit()
+		for _, resolverAddr := range []common.Address{otherRegistry, testENS.Accts[2].Addr} {
+			if !testENS.Chain.Succeed(testENS.Registry.SetResolver(testENS.Accts[1].Auth, node, resolverAddr)) {
+				t.Fatal("unable to set resolver")
+			}
+			if _, err := r.Email(context.Background(), label); !errors.Is(err, ErrInvalidResolver) {
+				t.Errorf("%s: want err: %s, got: %s", resolverAddr, ErrInvalidResolver, err)
+			}
 		}
 	})
 
@@ -96,4 +147,1218 @@ func TestResolveEmail(t *testing.T) {
 			t.Errorf("want email: %s, got: %s", email, got)
 		}
 	})
+
+	t.Run("allowedOwners", func(t *testing.T) {
+		email := "test@example.com"
+
+		ownedR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithAllowedOwners(testENS.Accts[1].Addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			label string
+			owner int
+			err   error
+		}{
+			{"allowedowner", 1, nil},
+			{"disallowedowner", 2, ErrUnauthorizedName},
+		} {
+			owner := testENS.Accts[test.owner]
+			node, err := testENS.Register(owner.Addr, test.label)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+				t.Fatal("unable to set resolver")
+			}
+
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", email)) {
+				t.Fatal("unable to set resolver")
+			}
+
+			if got, err := ownedR.Email(context.Background(), test.label); err != test.err {
+				t.Errorf("%s: want err: %v, got: %v", test.label, test.err, err)
+			} else if err == nil && got != email {
+				t.Errorf("%s: want email: %s, got: %s", test.label, email, got)
+			}
+		}
+
+		if _, err := ownedR.Email(context.Background(), "noexist"); err != ErrUnauthorizedName {
+			t.Errorf("want err: %s, got: %s", ErrUnauthorizedName, err)
+		}
+	})
+
+	t.Run("reverseName", func(t *testing.T) {
+		owner := testENS.Accts[3]
+		label := "primary"
+
+		if _, err := r.ReverseName(context.Background(), owner.Addr); err != ErrNoReverseName {
+			t.Errorf("want err: %s, got: %v", ErrNoReverseName, err)
+		}
+
+		// Reverse name which doesn't resolve back to owner.
+		if err := testENS.SetReverseName(owner, "hasemail.eth"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReverseName(context.Background(), owner.Addr); err != ErrNoReverseName {
+			t.Errorf("want err: %s, got: %v", ErrNoReverseName, err)
+		}
+
+		node, err := testENS.Register(owner.Addr, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetAddr0(owner.Auth, node, owner.Addr)) {
+			t.Fatal("unable to set addr")
+		}
+		if err := testENS.SetReverseName(owner, label+".eth"); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := r.ReverseName(context.Background(), owner.Addr); err != nil {
+			t.Error("unexpected err:", err)
+		} else if got != label+".eth" {
+			t.Errorf("want name: %s.eth, got: %s", label, got)
+		}
+	})
+
+	// Resolutions are logged with the primary name of the address
+	// the name resolves to (set by reverseName), rather than of its
+	// owner, and addresses without one are cached too.
+	t.Run("reverseLogging", func(t *testing.T) {
+		var logs syncBuffer
+		rl, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithReverseLogging(log.NewLogfmtLogger(&logs), time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		owner := testENS.Accts[1]
+		for label, addr := range map[string]common.Address{
+			"reversetarget": testENS.Accts[3].Addr,
+			"reversenone":   testENS.Accts[2].Addr,
+		} {
+			node, err := testENS.Register(owner.Addr, label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+				t.Fatal("unable to set resolver")
+			}
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", label+"@example.com")) {
+				t.Fatal("unable to set text")
+			}
+			if !testENS.Chain.Succeed(testENS.Resolver.SetAddr0(owner.Auth, node, addr)) {
+				t.Fatal("unable to set addr")
+			}
+			if _, err := rl.Email(context.Background(), label); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		exp := []string{
+			fmt.Sprintf("name=reversetarget resolved=reversetarget@example.com addr=%s primary=primary.eth", strings.ToLower(testENS.Accts[3].Addr.Hex())),
+			fmt.Sprintf("name=reversenone resolved=reversenone@example.com addr=%s call=r.ReverseName err=%q", strings.ToLower(testENS.Accts[2].Addr.Hex()), ErrNoReverseName),
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for _, line := range exp {
+			for !strings.Contains(logs.String(), line) {
+				if time.Now().After(deadline) {
+					t.Fatalf("want log: %s, got: %s", line, logs.String())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if name, ok := rl.reverseCache.get(testENS.Accts[2].Addr.Hex()); !ok || name != "" {
+			t.Errorf("want cached miss, got: %v, %t", name, ok)
+		}
+	})
+
+	t.Run("profile", func(t *testing.T) {
+		owner := testENS.Accts[1]
+
+		node, err := testENS.Register(owner.Addr, "hasprofile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+
+		exp := Profile{
+			Email:       "profile@example.com",
+			DisplayName: "Profile Name",
+			Avatar:      "https://example.com/avatar.png",
+		}
+		for key, val := range map[string]string{
+			"email":  exp.Email,
+			"name":   exp.DisplayName,
+			"avatar": exp.Avatar,
+		} {
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, key, val)) {
+				t.Fatal("unable to set text", key)
+			}
+		}
+
+		if got, err := r.Profile(context.Background(), "hasprofile"); err != nil {
+			t.Error("unexpected err:", err)
+		} else if got != exp {
+			t.Errorf("want profile: %+v, got: %+v", exp, got)
+		}
+
+		// "display" takes precedence over "name".
+		exp.DisplayName = "Display Name"
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "display", exp.DisplayName)) {
+			t.Fatal("unable to set text display")
+		}
+		if got, err := r.Profile(context.Background(), "hasprofile"); err != nil {
+			t.Error("unexpected err:", err)
+		} else if got != exp {
+			t.Errorf("want profile: %+v, got: %+v", exp, got)
+		}
+
+		if _, err := r.Profile(context.Background(), "noemailtext"); err != ErrNoEmail {
+			t.Errorf("want err: %s, got: %v", ErrNoEmail, err)
+		}
+	})
+
+	t.Run("internationalized", func(t *testing.T) {
+		owner := testENS.Accts[1]
+		email := "intl@example.com"
+
+		for _, test := range []struct {
+			label, local string
+		}{
+			{"🦊", "🦊"},
+			// Local-parts are normalized like ENS labels.
+			{"ünïcödé", "ÜNÏCÖDÉ"},
+		} {
+			node, err := testENS.Register(owner.Addr, test.label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+				t.Fatal("unable to set resolver")
+			}
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", email)) {
+				t.Fatal("unable to set text")
+			}
+
+			if got, err := r.Email(context.Background(), test.local); err != nil {
+				t.Errorf("%s: unexpected err: %s", test.local, err)
+			} else if got != email {
+				t.Errorf("%s: want email: %s, got: %s", test.local, email, got)
+			}
+		}
+	})
+
+	t.Run("casePreserved", func(t *testing.T) {
+		owner := testENS.Accts[1]
+		email := "Alice.Doe@Example.com"
+
+		node, err := testENS.Register(owner.Addr, "alicedoe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", email)) {
+			t.Fatal("unable to set text")
+		}
+
+		for _, name := range []string{"alicedoe", "AliceDoe", "ALICEDOE"} {
+			if got, err := r.Email(context.Background(), name); err != nil {
+				t.Errorf("%s: unexpected err: %s", name, err)
+			} else if got != email {
+				t.Errorf("%s: want email: %s, got: %s", name, email, got)
+			}
+		}
+	})
+
+	t.Run("defaultForward", func(t *testing.T) {
+		const defaultForward = "catchall@example.com"
+
+		defaultR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithDefaultForward(defaultForward))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Names without a resolver or email use the default, other
+		// names resolve as usual.
+		for label, exp := range map[string]string{
+			"noexist":     defaultForward,
+			"noresolver":  defaultForward,
+			"noemailtext": defaultForward,
+			"hasemail":    "test@example.com",
+		} {
+			if got, err := defaultR.Email(context.Background(), label); err != nil {
+				t.Errorf("%s: unexpected err: %s", label, err)
+			} else if got != exp {
+				t.Errorf("%s: want email: %s, got: %s", label, exp, got)
+			}
+		}
+
+		// Other errors are not replaced by the default.
+		if _, err := defaultR.Email(context.Background(), "badresolver"); !errors.Is(err, ErrInvalidResolver) {
+			t.Errorf("want err: %s, got: %v", ErrInvalidResolver, err)
+		}
+	})
+
+	t.Run("emailByNode", func(t *testing.T) {
+		for label, exp := range map[string]error{
+			"hasemail":    nil,
+			"noemailtext": ErrNoEmail,
+			"noexist":     ErrNoResolver,
+		} {
+			node, err := ens.NameHash(label + ".eth")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, wantErr := r.Email(context.Background(), label)
+			if wantErr != exp {
+				t.Fatalf("%s: want err: %v, got: %v", label, exp, wantErr)
+			}
+			if got, err := r.EmailByNode(context.Background(), node); err != wantErr {
+				t.Errorf("%s: want err: %v, got: %v", label, wantErr, err)
+			} else if got != want {
+				t.Errorf("%s: want email: %s, got: %s", label, want, got)
+			}
+		}
+	})
+
+	// A wrapped name's registry owner is the NameWrapper, but its
+	// resolver is still set in the registry.
+	t.Run("wrappedName", func(t *testing.T) {
+		label := "wrapped"
+		email := "wrapped@example.com"
+		owner := testENS.Accts[1]
+		// Stands in for the NameWrapper contract.
+		wrapper := testENS.Accts[3].Addr
+
+		node, err := testENS.Register(owner.Addr, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", email)) {
+			t.Fatal("unable to set text")
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetOwner(owner.Auth, node, wrapper)) {
+			t.Fatal("unable to wrap name")
+		}
+
+		if got, err := r.Email(context.Background(), label); err != nil {
+			t.Error("unexpected err:", err)
+		} else if got != email {
+			t.Errorf("want email: %s, got: %s", email, got)
+		}
+
+		// Known limitation: allowed owners are checked against the
+		// registry owner, not the wrapped name's owner.
+		ownedR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithAllowedOwners(owner.Addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ownedR.Email(context.Background(), label); err != ErrUnauthorizedName {
+			t.Errorf("want err: %s, got: %v", ErrUnauthorizedName, err)
+		}
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		owner := testENS.Accts[1]
+		for label, rec := range map[string]string{
+			"validpolicy":     `{"maxSize": 1024, "allowedSenders": ["@public.test"]}`,
+			"malformedpolicy": `{"maxSize": "big"`,
+		} {
+			node, err := testENS.Register(owner.Addr, label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+				t.Fatal("unable to set resolver")
+			}
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "ensmail.policy", rec)) {
+				t.Fatal("unable to set text")
+			}
+		}
+
+		for label, exp := range map[string]NamePolicy{
+			"validpolicy":     {MaxSize: 1024, AllowedSenders: []string{"@public.test"}},
+			"malformedpolicy": {},
+			"hasemail":        {},
+			"noexist":         {},
+		} {
+			if got, err := r.Policy(context.Background(), label); err != nil {
+				t.Errorf("%s: unexpected err: %v", label, err)
+			} else if !cmp.Equal(got, exp) {
+				t.Errorf("%s: policy (-want, +got) %s", label, cmp.Diff(exp, got))
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := r.Email(context.Background(), "bad_label"); !errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("want err: %v, got: %v", ErrInvalidLabel, err)
+		}
+
+		label := "bademail"
+		owner := testENS.Accts[1]
+		node, err := testENS.Register(owner.Addr, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", "Name <name@example.com>")) {
+			t.Fatal("unable to set text")
+		}
+		if _, err := r.Email(context.Background(), label); err != ErrInvalidResolved {
+			t.Errorf("want err: %v, got: %v", ErrInvalidResolved, err)
+		}
+	})
+
+	t.Run("alias", func(t *testing.T) {
+		owner := testENS.Accts[1]
+		for label, alias := range map[string]string{
+			"oldname": "hasemail.eth",
+			"cyclea":  "cycleb.eth",
+			"cycleb":  "cyclea.eth",
+		} {
+			node, err := testENS.Register(owner.Addr, label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+				t.Fatal("unable to set resolver")
+			}
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "ensmail.alias", alias)) {
+				t.Fatal("unable to set text")
+			}
+		}
+
+		aliasR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithAliases(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := aliasR.Email(context.Background(), "oldname"); err != nil {
+			t.Error("unexpected err:", err)
+		} else if got != "test@example.com" {
+			t.Errorf("want email: test@example.com, got: %s", got)
+		}
+
+		if _, err := aliasR.Email(context.Background(), "cyclea"); err != ErrAliasLoop {
+			t.Errorf("want err: %v, got: %v", ErrAliasLoop, err)
+		}
+
+		// Aliases are ignored unless enabled.
+		if _, err := r.Email(context.Background(), "oldname"); err != ErrNoEmail {
+			t.Errorf("want err: %v, got: %v", ErrNoEmail, err)
+		}
+	})
+
+	t.Run("jitter", func(t *testing.T) {
+		jitterR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithResolveJitter(10*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := jitterR.Email(context.Background(), "hasemail"); err != nil {
+			t.Error("unexpected err:", err)
+		} else if got != "test@example.com" {
+			t.Errorf("want email: test@example.com, got: %s", got)
+		}
+
+		// Delays are cut short by ctx.
+		jitterR, err = NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithResolveJitter(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := jitterR.Email(ctx, "hasemail"); err != context.DeadlineExceeded {
+			t.Errorf("want err: %v, got: %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		lh, err := ens.LabelHash("hasemail")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// "oldname" is aliased to "hasemail.eth" (see alias).
+		aliasLH, err := ens.LabelHash("oldname")
+		if err != nil {
+			t.Fatal(err)
+		}
+		registrarABI, err := ens.BaseRegistrarMetaData.GetAbi()
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+
+		for _, test := range []struct {
+			name    string
+			expires int64
+			grace   time.Duration
+			err     error
+		}{
+			{"unexpired", now.Add(365 * 24 * time.Hour).Unix(), 0, nil},
+			{"expired", now.Add(-48 * time.Hour).Unix(), 24 * time.Hour, ErrNameExpired},
+			{"inGrace", now.Add(-time.Hour).Unix(), 24 * time.Hour, nil},
+			{"unregistered", 0, 24 * time.Hour, ErrNameExpired},
+		} {
+			registrar := newViewCaller(t, testENS.Chain, *registrarABI, "nameExpires", map[[32]byte]interface{}{
+				lh:      big.NewInt(test.expires),
+				aliasLH: big.NewInt(now.Add(365 * 24 * time.Hour).Unix()),
+			}, big.NewInt(0))
+
+			expiryR, err := NewENSResolver(testENS.RegistryAddr, registrar, WithExpiryCheck(registrar.addr, test.grace))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := expiryR.Email(context.Background(), "hasemail"); err != test.err {
+				t.Errorf("%s: want err: %v, got: %v", test.name, test.err, err)
+			}
+
+			// Alias targets are checked too.
+			aliasR, err := NewENSResolver(testENS.RegistryAddr, registrar, WithExpiryCheck(registrar.addr, test.grace), WithAliases(3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := aliasR.Email(context.Background(), "oldname"); err != test.err {
+				t.Errorf("%s: alias: want err: %v, got: %v", test.name, test.err, err)
+			}
+		}
+	})
+
+	t.Run("address", func(t *testing.T) {
+		label := "hasaddr"
+		addr := testENS.Accts[2].Addr
+		// A Base (chain id 8453) address, stored in binary form.
+		baseCoin := CoinTypeForChain(8453)
+		baseAddr := testENS.Accts[3].Addr
+
+		node, err := testENS.Register(testENS.Accts[1].Addr, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(testENS.Accts[1].Auth, node, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+
+		if _, err := r.Address(context.Background(), label); err != ErrNoAddress {
+			t.Errorf("want err: %v, got: %v", ErrNoAddress, err)
+		}
+		if _, err := r.AddressForCoin(context.Background(), label, baseCoin); err != ErrNoAddress {
+			t.Errorf("want err: %v, got: %v", ErrNoAddress, err)
+		}
+
+		if !testENS.Chain.Succeed(testENS.Resolver.SetAddr0(testENS.Accts[1].Auth, node, addr)) {
+			t.Fatal("unable to set addr")
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetAddr(testENS.Accts[1].Auth, node, new(big.Int).SetUint64(baseCoin), baseAddr.Bytes())) {
+			t.Fatal("unable to set coin addr")
+		}
+
+		if got, err := r.Address(context.Background(), label); err != nil {
+			t.Error("unexpected err:", err)
+		} else if got != addr {
+			t.Errorf("want addr: %s, got: %s", addr, got)
+		}
+		// The addr record is the CoinTypeETH multicoin record.
+		if got, err := r.AddressForCoin(context.Background(), label, CoinTypeETH); err != nil {
+			t.Error("unexpected err:", err)
+		} else if common.BytesToAddress(got) != addr {
+			t.Errorf("want ETH addr: %s, got: %x", addr, got)
+		}
+		if got, err := r.AddressForCoin(context.Background(), label, baseCoin); err != nil {
+			t.Error("unexpected err:", err)
+		} else if common.BytesToAddress(got) != baseAddr {
+			t.Errorf("want Base addr: %s, got: %x", baseAddr, got)
+		}
+
+		if _, err := r.Address(context.Background(), "noexist"); err != ErrNoResolver {
+			t.Errorf("want err: %v, got: %v", ErrNoResolver, err)
+		}
+	})
+
+	t.Run("textDecoder", func(t *testing.T) {
+		label := "hasmailto"
+
+		node, err := testENS.Register(testENS.Accts[1].Addr, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(testENS.Accts[1].Auth, node, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(testENS.Accts[1].Auth, node, "email", "mailto:alice@example.com?subject=hi")) {
+			t.Fatal("unable to set text")
+		}
+
+		// Without a decoder, the record isn't an address.
+		if _, err := r.Email(context.Background(), label); err != ErrInvalidResolved {
+			t.Errorf("want err: %v, got: %v", ErrInvalidResolved, err)
+		}
+
+		mailtoR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithTextDecoder(DecodeMailto))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			name  string
+			email string
+		}{
+			{label, "alice@example.com"},
+			{"hasemail", "test@example.com"},
+		} {
+			if got, err := mailtoR.Email(context.Background(), test.name); err != nil {
+				t.Errorf("%s: unexpected err: %v", test.name, err)
+			} else if got != test.email {
+				t.Errorf("%s: want email: %s, got: %s", test.name, test.email, got)
+			}
+		}
+
+		failR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithTextDecoder(func(string) (string, error) {
+			return "", errors.New("undecodable")
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := failR.Email(context.Background(), label); !errors.Is(err, ErrInvalidResolved) {
+			t.Errorf("want err: %v, got: %v", ErrInvalidResolved, err)
+		}
+
+		for in, exp := range map[string]string{
+			"mailto:bob@example.com":   "bob@example.com",
+			"MAILTO:bob%40example.com": "bob@example.com",
+			"bob@example.com":          "bob@example.com",
+			"mail":                     "mail",
+		} {
+			if got, err := DecodeMailto(in); err != nil || got != exp {
+				t.Errorf("%s: want: %s, got: %s, %v", in, exp, got, err)
+			}
+		}
+	})
+
+	t.Run("tlds", func(t *testing.T) {
+		// Create the "box" TLD, and register names under it.
+		boxLabel, err := ens.LabelHash("box")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetSubnodeOwner(testENS.Accts[0].Auth, [32]byte{}, boxLabel, testENS.Accts[0].Addr)) {
+			t.Fatal("unable to create box tld")
+		}
+		boxNode, err := ens.NameHash("box")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for label, email := range map[string]string{
+			"onlybox":  "box@example.com",
+			"hasemail": "hasemail-box@example.com",
+		} {
+			lh, err := ens.LabelHash(label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testENS.Chain.Succeed(testENS.Registry.SetSubnodeOwner(testENS.Accts[0].Auth, boxNode, lh, testENS.Accts[1].Addr)) {
+				t.Fatal("unable to register box name")
+			}
+			node, err := ens.NameHash(label + ".box")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testENS.Chain.Succeed(testENS.Registry.SetResolver(testENS.Accts[1].Auth, node, testENS.ResolverAddr)) {
+				t.Fatal("unable to set resolver")
+			}
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(testENS.Accts[1].Auth, node, "email", email)) {
+				t.Fatal("unable to set text")
+			}
+		}
+
+		// Only ".eth" is tried by default.
+		if _, err := r.Email(context.Background(), "onlybox"); err != ErrNoResolver {
+			t.Errorf("want err: %v, got: %v", ErrNoResolver, err)
+		}
+
+		for _, test := range []struct {
+			tlds  []string
+			name  string
+			email string
+			err   error
+		}{
+			{[]string{"eth", "box"}, "onlybox", "box@example.com", nil},
+			{[]string{"eth", "box"}, "hasemail", "test@example.com", nil},
+			{[]string{"box", "eth"}, "hasemail", "hasemail-box@example.com", nil},
+			{[]string{"eth", "box"}, "noexist", "", ErrNoResolver},
+			{[]string{"eth", "box"}, "noemailtext", "", ErrNoResolver},
+		} {
+			tldR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithTLDs(test.tlds...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := tldR.Email(context.Background(), test.name); err != test.err {
+				t.Errorf("%v %s: want err: %v, got: %v", test.tlds, test.name, test.err, err)
+			} else if got != test.email {
+				t.Errorf("%v %s: want email: %s, got: %s", test.tlds, test.name, test.email, got)
+			}
+		}
+
+		// Other records are read under the TLD Email resolves under.
+		onlyBox, err := ens.NameHash("onlybox.box")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ownerAddr := testENS.Accts[2].Addr
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(testENS.Accts[1].Auth, onlyBox, "ensmail.policy", `{"maxSize": 10}`)) {
+			t.Fatal("unable to set text")
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetAddr0(testENS.Accts[1].Auth, onlyBox, ownerAddr)) {
+			t.Fatal("unable to set addr")
+		}
+		tldR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithTLDs("eth", "box"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, err := tldR.Profile(context.Background(), "onlybox"); err != nil || p.Email != "box@example.com" {
+			t.Errorf("profile: want email: box@example.com, got: %+v, %v", p, err)
+		}
+		if p, err := tldR.Policy(context.Background(), "onlybox"); err != nil || p.MaxSize != 10 {
+			t.Errorf("policy: want max size: 10, got: %+v, %v", p, err)
+		}
+		if addr, err := tldR.Address(context.Background(), "onlybox"); err != nil || addr != ownerAddr {
+			t.Errorf("address: want: %s, got: %s, %v", ownerAddr, addr, err)
+		}
+		// hasemail.eth's email is returned, so its policy is read
+		// there too, rather than from hasemail.box.
+		hasEmailBox, err := ens.NameHash("hasemail.box")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(testENS.Accts[1].Auth, hasEmailBox, "ensmail.policy", `{"maxSize": 10}`)) {
+			t.Fatal("unable to set text")
+		}
+		if p, err := tldR.Policy(context.Background(), "hasemail"); err != nil || p.MaxSize != 0 {
+			t.Errorf("policy: want no max size, got: %+v, %v", p, err)
+		}
+
+		// Each TLD counts its own resolution depth: depthtld.eth's
+		// alias (to a name without a resolver) isn't counted against
+		// depthtld.box's.
+		for _, tld := range []string{"eth", "box"} {
+			alias := "noexist.eth"
+			if tld == "box" {
+				alias = "hasemail.eth"
+			}
+			tldNode, err := ens.NameHash(tld)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lh, err := ens.LabelHash("depthtld")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testENS.Chain.Succeed(testENS.Registry.SetSubnodeOwner(testENS.Accts[0].Auth, tldNode, lh, testENS.Accts[1].Addr)) {
+				t.Fatal("unable to register depthtld")
+			}
+			node, err := ens.NameHash("depthtld." + tld)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testENS.Chain.Succeed(testENS.Registry.SetResolver(testENS.Accts[1].Auth, node, testENS.ResolverAddr)) {
+				t.Fatal("unable to set resolver")
+			}
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(testENS.Accts[1].Auth, node, "ensmail.alias", alias)) {
+				t.Fatal("unable to set text")
+			}
+		}
+		depthR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithTLDs("eth", "box"), WithAliases(10), WithMaxResolveDepth(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := depthR.Email(context.Background(), "depthtld"); err != nil || got != "test@example.com" {
+			t.Errorf("depth per tld: want email: test@example.com, got: %s, %v", got, err)
+		}
+	})
+
+	t.Run("callSpec", func(t *testing.T) {
+		spec, err := NewResolverCallSpec("emailOf(bytes32)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		label := "customresolver"
+		node, err := testENS.Register(testENS.Accts[1].Addr, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caller := newViewCaller(t, testENS.Chain, spec.contract, spec.method, map[[32]byte]interface{}{node: "custom@example.com"}, "")
+		custom := caller.addr
+		noEmail, err := testENS.Register(testENS.Accts[1].Addr, "customnoemail")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, node := range [][32]byte{node, noEmail} {
+			if !testENS.Chain.Succeed(testENS.Registry.SetResolver(testENS.Accts[1].Auth, node, custom)) {
+				t.Fatal("unable to set resolver")
+			}
+		}
+
+		standard, err := NewResolverCallSpec("text(bytes32,string)", "email")
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherKey, err := NewResolverCallSpec("text(bytes32,string)", "other")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			spec  *ResolverCallSpec
+			name  string
+			email string
+			err   error
+		}{
+			{spec, label, "custom@example.com", nil},
+			{spec, "customnoemail", "", ErrNoEmail},
+			// The standard resolver doesn't implement the method,
+			// so its text record is read.
+			{spec, "hasemail", "test@example.com", nil},
+			{standard, "hasemail", "test@example.com", nil},
+			{otherKey, "hasemail", "", ErrNoEmail},
+		} {
+			r, err := NewENSResolver(testENS.RegistryAddr, caller, WithResolverCallSpec(test.spec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := r.Email(context.Background(), test.name); !errors.Is(err, test.err) {
+				t.Errorf("%s %s: want err: %v, got: %v", test.spec, test.name, test.err, err)
+			} else if got != test.email {
+				t.Errorf("%s %s: want email: %s, got: %s", test.spec, test.name, test.email, got)
+			}
+		}
+
+		for _, test := range []struct {
+			signature string
+			args      []interface{}
+		}{
+			{"emailOf", nil},
+			{"emailOf()", nil},
+			{"emailOf(uint256)", nil},
+			{"emailOf(bytes32,string)", nil},
+			{"emailOf(bytes32,string)", []interface{}{1}},
+			{"emailOf(bytes32,notatype)", []interface{}{"email"}},
+		} {
+			if _, err := NewResolverCallSpec(test.signature, test.args...); err == nil {
+				t.Errorf("%s %v: want err", test.signature, test.args)
+			}
+		}
+	})
+
+	t.Run("emailByOwner", func(t *testing.T) {
+		// The primary name of Accts[3] is "primary.eth" (see
+		// reverseName), which has no email record.
+		owner := testENS.Accts[3]
+		withDefault, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithDefaultForward("default@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range []*ENSResolver{r, withDefault} {
+			if _, err := r.EmailByOwner(context.Background(), owner.Addr); err != ErrNoEmail {
+				t.Errorf("want err: %v, got: %v", ErrNoEmail, err)
+			}
+		}
+
+		node, err := ens.NameHash("primary.eth")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", "primary@example.com")) {
+			t.Fatal("unable to set text")
+		}
+		if got, err := r.EmailByOwner(context.Background(), owner.Addr); err != nil {
+			t.Error("unexpected err:", err)
+		} else if got != "primary@example.com" {
+			t.Errorf("want email: primary@example.com, got: %s", got)
+		}
+
+		if _, err := r.EmailByOwner(context.Background(), testENS.Accts[2].Addr); err != ErrNoReverseName {
+			t.Errorf("want err: %v, got: %v", ErrNoReverseName, err)
+		}
+	})
+
+	t.Run("normalization", func(t *testing.T) {
+		owner := testENS.Accts[1]
+		lenient, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithNameNormalization(NormalizeLenient))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Labels with "_" can't be registered by Register, which
+		// hashes strictly.
+		ethNode, err := ens.NameHash("eth")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lh, err := ens.LenientLabelHash("under_score")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetSubnodeOwner(testENS.Accts[0].Auth, ethNode, lh, owner.Addr)) {
+			t.Fatal("unable to register label")
+		}
+		underscore, err := ens.LenientNameHash("under_score.eth")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Latin "p", "y", "p", "l", and Cyrillic "а"s.
+		mixed, err := testENS.Register(owner.Addr, "pаypаl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, node := range [][32]byte{underscore, mixed} {
+			if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+				t.Fatal("unable to set resolver")
+			}
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", "norm@example.com")) {
+				t.Fatal("unable to set text")
+			}
+		}
+
+		for _, test := range []struct {
+			name   string
+			r      *ENSResolver
+			local  string
+			expErr error
+		}{
+			{"strict", r, "Under_Score", ErrInvalidLabel},
+			{"lenient", lenient, "Under_Score", nil},
+			// UTS-46 doesn't restrict scripts, so mixed-script
+			// names resolve either way.
+			{"strict", r, "pаypаl", nil},
+			{"lenient", lenient, "pаypаl", nil},
+			// Runes which are disallowed regardless of STD3
+			// rules fail either way.
+			{"strict", r, "⒈x", ErrInvalidLabel},
+			{"lenient", lenient, "⒈x", ErrInvalidLabel},
+		} {
+			got, err := test.r.Email(context.Background(), test.local)
+			if test.expErr != nil {
+				if !errors.Is(err, test.expErr) {
+					t.Errorf("%s %s: want err: %v, got: %v", test.name, test.local, test.expErr, err)
+				}
+			} else if err != nil || got != "norm@example.com" {
+				t.Errorf("%s %s: want email: norm@example.com, got: %s, %v", test.name, test.local, got, err)
+			}
+		}
+		// Other lookups normalize names as Email does.
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, underscore, "ensmail.policy", `{"maxSize": 10}`)) {
+			t.Fatal("unable to set text")
+		}
+		if p, err := lenient.Policy(context.Background(), "Under_Score"); err != nil || p.MaxSize != 10 {
+			t.Errorf("lenient policy: want max size: 10, got: %+v, %v", p, err)
+		}
+		if _, err := r.Policy(context.Background(), "Under_Score"); !errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("strict policy: want err: %v, got: %v", ErrInvalidLabel, err)
+		}
+
+		// Alias targets are normalized as Email normalizes names.
+		toScore, err := testENS.Register(owner.Addr, "toscore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, toScore, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, toScore, "ensmail.alias", "Under_Score.eth")) {
+			t.Fatal("unable to set text")
+		}
+		lenientAlias, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithNameNormalization(NormalizeLenient), WithAliases(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := lenientAlias.Email(context.Background(), "toscore"); err != nil || got != "norm@example.com" {
+			t.Errorf("lenient alias: want email: norm@example.com, got: %s, %v", got, err)
+		}
+		strictAlias, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithAliases(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := strictAlias.Email(context.Background(), "toscore"); !errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("strict alias: want err: %v, got: %v", ErrInvalidLabel, err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		owner := testENS.Accts[1]
+		label := "vacation"
+		email := "vacation@example.com"
+
+		node, err := testENS.Register(owner.Addr, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", email)) {
+			t.Fatal("unable to set text")
+		}
+
+		checked, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithDisabledRecord(""), WithDefaultForward("default@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			disabled string
+			err      error
+		}{
+			{"", nil},
+			{"true", ErrForwardingDisabled},
+			{"TRUE", ErrForwardingDisabled},
+			{"false", nil},
+		} {
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "ensmail.disabled", test.disabled)) {
+				t.Fatal("unable to set text")
+			}
+			got, err := checked.Email(context.Background(), label)
+			if err != test.err {
+				t.Errorf("%q: want err: %v, got: %v", test.disabled, test.err, err)
+			} else if err == nil && got != email {
+				t.Errorf("%q: want email: %s, got: %s", test.disabled, email, got)
+			}
+
+			// The record is ignored unless checked.
+			if got, err := r.Email(context.Background(), label); err != nil || got != email {
+				t.Errorf("%q: unchecked: want email: %s, got: %s, %v", test.disabled, email, got, err)
+			}
+		}
+
+		// Disabled names stay disabled while aliased, and so do
+		// aliases to them.
+		aliasChecked, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithDisabledRecord(""), WithAliases(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		moved, err := testENS.Register(owner.Addr, "movedvacation")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, moved, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+		for _, set := range []struct {
+			node       [32]byte
+			key, value string
+		}{
+			{node, "ensmail.disabled", ""},
+			{node, "ensmail.alias", "movedvacation.eth"},
+			{moved, "ensmail.alias", "hasemail.eth"},
+			{moved, "ensmail.disabled", "true"},
+		} {
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, set.node, set.key, set.value)) {
+				t.Fatal("unable to set text")
+			}
+		}
+		if _, err := aliasChecked.Email(context.Background(), "movedvacation"); err != ErrForwardingDisabled {
+			t.Errorf("aliased: want err: %v, got: %v", ErrForwardingDisabled, err)
+		}
+		if _, err := aliasChecked.Email(context.Background(), label); err != ErrForwardingDisabled {
+			t.Errorf("alias to disabled: want err: %v, got: %v", ErrForwardingDisabled, err)
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, moved, "ensmail.disabled", "")) {
+			t.Fatal("unable to set text")
+		}
+		if got, err := aliasChecked.Email(context.Background(), label); err != nil || got != "test@example.com" {
+			t.Errorf("enabled alias: want email: test@example.com, got: %s, %v", got, err)
+		}
+	})
+
+	t.Run("detailed", func(t *testing.T) {
+		owner := testENS.Accts[1]
+		label := "detailed"
+		email := "detailed@example.com"
+
+		node, err := testENS.Register(owner.Addr, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", email)) {
+			t.Fatal("unable to set text")
+		}
+
+		chainID := big.NewInt(1337)
+		detailed, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithChainID(chainID), WithDefaultForward("default@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ResolveResult{Email: email, Node: node, Resolver: testENS.ResolverAddr, ChainID: chainID}
+
+		// Results pass through wrappers, and are cached with
+		// their resolution.
+		cache := NewCachingResolver(Deduplicate(detailed.Email), time.Minute)
+		for i := 0; i < 2; i++ {
+			got, err := ResolveDetailed(context.Background(), cache.Resolve, label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%d: want result: %+v, got: %+v", i, want, got)
+			}
+		}
+
+		// The default forward isn't resolved on-chain.
+		got, err := ResolveDetailed(context.Background(), detailed.Email, "nonexistent-detailed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (ResolveResult{Email: "default@example.com"}); !reflect.DeepEqual(got, want) {
+			t.Errorf("default: want result: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("forwardDomains", func(t *testing.T) {
+		owner := testENS.Accts[1]
+		label := "pinned"
+
+		node, err := testENS.Register(owner.Addr, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+
+		pinned, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithForwardDomainRecord(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			allowed, email string
+			err            error
+		}{
+			{"", "pinned@attacker.test", nil},
+			{"example.com, mail.example.com", "pinned@example.com", nil},
+			{"example.com, mail.example.com", "pinned@MAIL.example.com", nil},
+			{"example.com", "pinned@attacker.test", ErrDisallowedForwardDomain},
+			{"example.com", "pinned@sub.example.com", ErrDisallowedForwardDomain},
+		} {
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "ensmail.allowed", test.allowed)) {
+				t.Fatal("unable to set text")
+			}
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", test.email)) {
+				t.Fatal("unable to set text")
+			}
+			got, err := pinned.Email(context.Background(), label)
+			if err != test.err {
+				t.Errorf("%q, %s: want err: %v, got: %v", test.allowed, test.email, test.err, err)
+			} else if err == nil && got != test.email {
+				t.Errorf("%q, %s: want email: %s, got: %s", test.allowed, test.email, test.email, got)
+			}
+
+			// The record is ignored unless checked.
+			if got, err := r.Email(context.Background(), label); err != nil || got != test.email {
+				t.Errorf("%q, %s: unchecked: want email: %s, got: %s, %v", test.allowed, test.email, test.email, got, err)
+			}
+		}
+
+		// A pinned name aliased elsewhere is still pinned.
+		aliasPinned, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithForwardDomainRecord(""), WithAliases(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			allowed string
+			err     error
+		}{
+			{"attacker.test", ErrDisallowedForwardDomain},
+			{"example.com", nil},
+		} {
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "ensmail.allowed", test.allowed)) {
+				t.Fatal("unable to set text")
+			}
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "ensmail.alias", "hasemail.eth")) {
+				t.Fatal("unable to set text")
+			}
+			got, err := aliasPinned.Email(context.Background(), label)
+			if err != test.err {
+				t.Errorf("alias, %q: want err: %v, got: %v", test.allowed, test.err, err)
+			} else if err == nil && got != "test@example.com" {
+				t.Errorf("alias, %q: want email: test@example.com, got: %s", test.allowed, got)
+			}
+		}
+	})
+
+	t.Run("maxResolveDepth", func(t *testing.T) {
+		owner := testENS.Accts[1]
+		for label, alias := range map[string]string{
+			"deptha": "depthb.eth",
+			"depthb": "hasemail.eth",
+		} {
+			node, err := testENS.Register(owner.Addr, label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+				t.Fatal("unable to set resolver")
+			}
+			if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "ensmail.alias", alias)) {
+				t.Fatal("unable to set text")
+			}
+		}
+
+		// deptha follows 2 aliases, and depthb 1.
+		for _, test := range []struct {
+			name     string
+			maxDepth int
+			err      error
+		}{
+			{"deptha", 0, nil},
+			{"deptha", 2, nil},
+			{"deptha", 1, ErrResolveDepthExceeded},
+			{"depthb", 1, nil},
+			{"hasemail", 1, nil},
+		} {
+			depthR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithAliases(10), WithMaxResolveDepth(test.maxDepth))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := depthR.Email(context.Background(), test.name)
+			if err != test.err {
+				t.Errorf("%s, %d: want err: %v, got: %v", test.name, test.maxDepth, test.err, err)
+			} else if err == nil && got != "test@example.com" {
+				t.Errorf("%s, %d: want email: test@example.com, got: %s", test.name, test.maxDepth, got)
+			}
+		}
+
+		// Nested resolutions share their context's depth.
+		depthR, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain, WithAliases(10), WithMaxResolveDepth(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := withResolveDepth(context.Background())
+		if _, err := depthR.Email(ctx, "depthb"); err != nil {
+			t.Error("unexpected err:", err)
+		}
+		if _, err := depthR.Email(ctx, "deptha"); err != ErrResolveDepthExceeded {
+			t.Errorf("nested: want err: %v, got: %v", ErrResolveDepthExceeded, err)
+		}
+
+		// Each feature's limit is a depth limit.
+		if !errors.Is(ErrAliasLoop, ErrResolveDepthExceeded) {
+			t.Errorf("%v doesn't wrap %v", ErrAliasLoop, ErrResolveDepthExceeded)
+		}
+	})
 }
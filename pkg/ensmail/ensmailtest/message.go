@@ -0,0 +1,48 @@
+package ensmailtest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// Prepended returns msg with the header fields prepended, in order.
+// Each field is a complete header field ("Name: value", which may be
+// folded), without its terminating CRLF.
+func Prepended(msg []byte, fields ...string) []byte {
+	var b bytes.Buffer
+	for _, field := range fields {
+		b.WriteString(field)
+		b.WriteString("\r\n")
+	}
+	b.Write(msg)
+	return b.Bytes()
+}
+
+// CheckPrepended reports a test error unless the forwarded message
+// got is byte-for-byte the original message orig with exactly the
+// header fields prepended (see Prepended), so header injection (by
+// one or more features) is checked to have left the rest of the
+// message, including its line endings, unmodified.  The error
+// distinguishes a modified original from unexpected prepended fields,
+// and diffs the messages line by line, with line endings visible.
+func CheckPrepended(t testing.TB, got, orig []byte, fields ...string) {
+	t.Helper()
+	want := Prepended(orig, fields...)
+	if bytes.Equal(got, want) {
+		return
+	}
+
+	problem := "unexpected prepended header fields"
+	if !bytes.HasSuffix(got, orig) {
+		problem = "original message modified"
+	}
+	t.Errorf("forwarded message: %s (-want, +got) %s", problem, cmp.Diff(lines(want), lines(got)))
+}
+
+// lines splits msg after each LF, so each line keeps its ending.
+func lines(msg []byte) []string {
+	return strings.SplitAfter(string(msg), "\n")
+}
@@ -0,0 +1,50 @@
+package ensmailtest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// errorRecorder is a testing.TB which records its errors.
+type errorRecorder struct {
+	testing.TB
+	errs []string
+}
+
+func (r *errorRecorder) Helper() {}
+
+func (r *errorRecorder) Errorf(format string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func TestCheckPrepended(t *testing.T) {
+	orig := []byte("Subject: hi\r\n\r\nbody\r\n")
+	fields := []string{
+		"X-Test-One: 1",
+		"X-Test-Two: folded\r\n value",
+	}
+
+	for _, test := range []struct {
+		name string
+		got  string
+		err  string // substring of the error, if any
+	}{
+		{"exact", "X-Test-One: 1\r\nX-Test-Two: folded\r\n value\r\nSubject: hi\r\n\r\nbody\r\n", ""},
+		{"bareLF", "X-Test-One: 1\nX-Test-Two: folded\r\n value\r\nSubject: hi\r\n\r\nbody\r\n", "unexpected prepended header fields"},
+		{"missingField", "X-Test-One: 1\r\nSubject: hi\r\n\r\nbody\r\n", "unexpected prepended header fields"},
+		{"reordered", "X-Test-Two: folded\r\n value\r\nX-Test-One: 1\r\nSubject: hi\r\n\r\nbody\r\n", "unexpected prepended header fields"},
+		{"extraBoundary", "X-Test-One: 1\r\nX-Test-Two: folded\r\n value\r\n\r\nSubject: hi\r\n\r\nbody\r\n", "unexpected prepended header fields"},
+		{"bodyModified", "X-Test-One: 1\r\nX-Test-Two: folded\r\n value\r\nSubject: hi\r\n\r\nbody\n", "original message modified"},
+		{"headerModified", "X-Test-One: 1\r\nX-Test-Two: folded\r\n value\r\nSubject: hi\r\nBcc: x@example.test\r\n\r\nbody\r\n", "original message modified"},
+	} {
+		var r errorRecorder
+		CheckPrepended(&r, []byte(test.got), orig, fields...)
+		switch {
+		case test.err == "" && len(r.errs) != 0:
+			t.Errorf("%s: unexpected errors: %q", test.name, r.errs)
+		case test.err != "" && (len(r.errs) != 1 || !strings.Contains(r.errs[0], test.err)):
+			t.Errorf("%s: want error: %q, got: %q", test.name, test.err, r.errs)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Package ensmailtest provides utilities for testing ensmail.
+package ensmailtest
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Call is a single forwarder client method call, and its arguments.
+type Call struct {
+	Method   string // "Mail", "Rcpt", "LMTPData", "Reset", or "Close"
+	Arg      string // from of Mail, or to of Rcpt
+	MailOpts *smtp.MailOptions
+	Data     []byte // message written to LMTPData
+}
+
+// Recorder creates forwarder clients (see ensmail.ForwarderClient)
+// which record every call made to them.
+type Recorder struct {
+	// If set, Status returns the LMTPData status of rcpt.
+	// Otherwise, every recipient succeeds.
+	Status func(rcpt string) *smtp.SMTPError
+
+	// If set, Extension reports whether ext is supported.
+	// Otherwise, every extension is supported.
+	Extension func(ext string) bool
+
+	mu      sync.Mutex
+	clients []*Client
+}
+
+// NewClient returns a new recording client.  It can be adapted to
+// ensmail.NewForwarderClient with:
+//
+//	func() (ensmail.ForwarderClient, error) { return r.NewClient(), nil }
+func (r *Recorder) NewClient() *Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := &Client{r: r}
+	r.clients = append(r.clients, c)
+	return c
+}
+
+// Clients returns every client created by r, in creation order.
+func (r *Recorder) Clients() []*Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Client(nil), r.clients...)
+}
+
+// Client is a forwarder client which records every call made to it.
+type Client struct {
+	r *Recorder
+
+	mu    sync.Mutex
+	calls []Call
+	rcpts []string // of current transaction
+}
+
+func (c *Client) record(call Call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, call)
+}
+
+func (c *Client) Mail(from string, opts *smtp.MailOptions) error {
+	c.record(Call{Method: "Mail", Arg: from, MailOpts: opts})
+	return nil
+}
+
+func (c *Client) Rcpt(to string) error {
+	c.record(Call{Method: "Rcpt", Arg: to})
+	c.mu.Lock()
+	c.rcpts = append(c.rcpts, to)
+	c.mu.Unlock()
+	return nil
+}
+
+// LMTPData records the message written to the returned writer once
+// it's closed, and returns the status of each recipient.
+func (c *Client) LMTPData(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+	return &dataWriter{c: c, statusCb: statusCb}, nil
+}
+
+func (c *Client) Reset() error {
+	c.record(Call{Method: "Reset"})
+	c.mu.Lock()
+	c.rcpts = nil
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) Close() error {
+	c.record(Call{Method: "Close"})
+	return nil
+}
+
+func (c *Client) Extension(ext string) (bool, string) {
+	if c.r.Extension != nil {
+		return c.r.Extension(ext), ""
+	}
+	return true, ""
+}
+
+// Transcript returns every call made to c, in order.
+func (c *Client) Transcript() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Call(nil), c.calls...)
+}
+
+// CheckTranscript reports a test error if c's transcript differs
+// from want.
+func (c *Client) CheckTranscript(t testing.TB, want []Call) {
+	t.Helper()
+	if diff := cmp.Diff(want, c.Transcript()); diff != "" {
+		t.Errorf("forwarder transcript (-want, +got) %s", diff)
+	}
+}
+
+type dataWriter struct {
+	bytes.Buffer
+	c        *Client
+	statusCb func(rcpt string, status *smtp.SMTPError)
+}
+
+func (w *dataWriter) Close() error {
+	w.c.record(Call{Method: "LMTPData", Data: w.Bytes()})
+
+	w.c.mu.Lock()
+	rcpts := w.c.rcpts
+	w.c.mu.Unlock()
+
+	for _, rcpt := range rcpts {
+		var status *smtp.SMTPError
+		if w.c.r.Status != nil {
+			status = w.c.r.Status(rcpt)
+		}
+		w.statusCb(rcpt, status)
+	}
+	return nil
+}
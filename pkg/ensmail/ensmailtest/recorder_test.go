@@ -0,0 +1,55 @@
+package ensmailtest
+
+import (
+	"io"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestRecorder(t *testing.T) {
+	errTest := &smtp.SMTPError{Code: 550, Message: "test fail"}
+	r := Recorder{
+		Status: func(rcpt string) *smtp.SMTPError {
+			if rcpt == "bad@example.test" {
+				return errTest
+			}
+			return nil
+		},
+	}
+
+	c := r.NewClient()
+	opts := &smtp.MailOptions{Body: smtp.Body8BitMIME}
+	c.Mail("sender@example.test", opts)
+	c.Rcpt("good@example.test")
+	c.Rcpt("bad@example.test")
+
+	statuses := make(map[string]*smtp.SMTPError)
+	w, err := c.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "message")
+	w.Close()
+	c.Reset()
+	c.Close()
+
+	if len(statuses) != 2 || statuses["good@example.test"] != nil || statuses["bad@example.test"] != errTest {
+		t.Errorf("unexpected statuses: %v", statuses)
+	}
+
+	c.CheckTranscript(t, []Call{
+		{Method: "Mail", Arg: "sender@example.test", MailOpts: opts},
+		{Method: "Rcpt", Arg: "good@example.test"},
+		{Method: "Rcpt", Arg: "bad@example.test"},
+		{Method: "LMTPData", Data: []byte("message")},
+		{Method: "Reset"},
+		{Method: "Close"},
+	})
+
+	if clients := r.Clients(); len(clients) != 1 || clients[0] != c {
+		t.Errorf("want clients: [%p], got: %v", c, clients)
+	}
+}
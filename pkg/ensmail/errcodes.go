@@ -0,0 +1,145 @@
+package ensmail
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ErrorCodeMap maps well-known resolution errors to the SMTP replies
+// returned to senders for them.  Errors are matched with errors.Is,
+// most specific first: if several mapped errors match (such as
+// ErrAliasLoop, and ErrResolveDepthExceeded, which it wraps), the one
+// found first unwrapping the error applies.
+type ErrorCodeMap map[error]*smtp.SMTPError
+
+// DefaultErrorCodes are the SMTP replies returned for well-known
+// resolution errors, unless overridden with WithErrorCodes.
+var DefaultErrorCodes = ErrorCodeMap{
+	ErrNoResolver: {
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "No such ENS name",
+	},
+	ErrNoEmail: {
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "ENS name has no email record",
+	},
+	ErrInvalidLabel: {
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+		Message:      "Invalid recipient name, not a valid ENS name",
+	},
+	ErrEmptyName: {
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+		Message:      "Invalid recipient, empty name",
+	},
+	ErrUnauthorizedName: {
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "ENS name is not served",
+	},
+	ErrInvalidResolver: {
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "ENS name's resolver is invalid",
+	},
+	ErrNameExpired: {
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "ENS name has expired",
+	},
+	ErrInvalidResolved: {
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+		Message:      "ENS name's email record is invalid",
+	},
+	ErrForwardingDisabled: {
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 2, 1},
+		Message:      "Mailbox disabled, not accepting messages",
+	},
+	ErrDisallowedForwardDomain: {
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "ENS name's email domain is not allowed by its owner",
+	},
+	ErrResolveDepthExceeded: {
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 4, 6},
+		Message:      "ENS name's references loop or are too deep",
+	},
+	ErrNameRejected: {
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Mail for this ENS name is not accepted",
+	},
+	context.DeadlineExceeded: {
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+		Message:      "ENS resolution timed out, try again later",
+	},
+}
+
+// reply returns the SMTP reply mapped to err, or err if it isn't
+// mapped.
+func (m ErrorCodeMap) reply(err error) error {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if reflect.TypeOf(e).Comparable() {
+			if reply, ok := m[e]; ok {
+				return reply
+			}
+		}
+	}
+
+	// Errors may still match mapped errors through their Is
+	// methods, which are tried in a fixed order.
+	targets := make([]error, 0, len(m))
+	for target := range m {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Error() < targets[j].Error() })
+	for _, target := range targets {
+		if errors.Is(err, target) {
+			return m[target]
+		}
+	}
+	return err
+}
+
+// userFaults are the resolution errors caused by a name's
+// configuration (or a sender's recipient), rather than by ensmail or
+// its Ethereum provider.
+var userFaults = []error{
+	ErrNoResolver,
+	ErrNoEmail,
+	ErrInvalidLabel,
+	ErrEmptyName,
+	ErrUnauthorizedName,
+	ErrInvalidResolver,
+	ErrNameExpired,
+	ErrInvalidResolved,
+	ErrAliasLoop,
+	ErrResolveDepthExceeded,
+	ErrForwardingDisabled,
+	ErrDisallowedForwardDomain,
+	ErrNameRejected,
+}
+
+// IsUserFault reports whether the resolution error err is caused by a
+// name's configuration, such as a name without an email record.
+// Other errors (such as RPC errors and timeouts) are system faults,
+// which, when frequent, indicate a provider or chain problem.
+func IsUserFault(err error) bool {
+	for _, target := range userFaults {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package ensmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestErrorCodeMap(t *testing.T) {
+	errOther := errors.New("other")
+	for _, test := range []struct {
+		err error
+		exp error
+	}{
+		{ErrNoEmail, DefaultErrorCodes[ErrNoEmail]},
+		{ErrForwardingDisabled, DefaultErrorCodes[ErrForwardingDisabled]},
+		{ErrAliasLoop, DefaultErrorCodes[ErrResolveDepthExceeded]},
+		{fmt.Errorf("%w: bad label", ErrInvalidLabel), DefaultErrorCodes[ErrInvalidLabel]},
+		{fmt.Errorf("call: %w", context.DeadlineExceeded), DefaultErrorCodes[context.DeadlineExceeded]},
+		{errOther, errOther},
+	} {
+		if got := DefaultErrorCodes.reply(test.err); got != test.exp {
+			t.Errorf("%v: want reply: %v, got: %v", test.err, test.exp, got)
+		}
+	}
+
+	// If several mapped errors match, the most specific applies.
+	aliasLoop := &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 4, 6}, Message: "Alias loop"}
+	codes := ErrorCodeMap{
+		ErrAliasLoop:            aliasLoop,
+		ErrResolveDepthExceeded: DefaultErrorCodes[ErrResolveDepthExceeded],
+	}
+	for i := 0; i < 100; i++ {
+		for _, test := range []struct {
+			err error
+			exp error
+		}{
+			{ErrAliasLoop, aliasLoop},
+			{fmt.Errorf("resolve: %w", ErrAliasLoop), aliasLoop},
+			{ErrResolveDepthExceeded, DefaultErrorCodes[ErrResolveDepthExceeded]},
+		} {
+			if got := codes.reply(test.err); got != test.exp {
+				t.Fatalf("%v: want reply: %v, got: %v", test.err, test.exp, got)
+			}
+		}
+	}
+}
+
+func TestIsUserFault(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		user bool
+	}{
+		{ErrNoResolver, true},
+		{ErrForwardingDisabled, true},
+		{ErrDisallowedForwardDomain, true},
+		{ErrNoEmail, true},
+		{ErrEmptyName, true},
+		{fmt.Errorf("%w: reverted", ErrInvalidResolver), true},
+		{fmt.Errorf("call: %w", context.DeadlineExceeded), false},
+		{errors.New("dial tcp: connection refused"), false},
+		{nil, false},
+	} {
+		if got := IsUserFault(test.err); got != test.user {
+			t.Errorf("%v: want user fault: %v, got: %v", test.err, test.user, got)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package ensmail
+
+import (
+	"context"
+)
+
+// Fallback returns a ResolveFunc which calls each resolver in order,
+// until one succeeds or fails with a user fault (see IsUserFault),
+// such as ErrUnauthorizedName, which the next resolver mustn't
+// override.  Resolvers are only skipped for system faults (such as
+// an unavailable SubgraphResolver).  If every resolver fails, the
+// last resolver's error is returned.
+func Fallback(resolvers ...ResolveFunc) ResolveFunc {
+	return func(ctx context.Context, name string) (string, error) {
+		var err error
+		for _, resolve := range resolvers {
+			var email string
+			if email, err = resolve(ctx, name); err == nil || IsUserFault(err) {
+				return email, err
+			}
+		}
+		return "", err
+	}
+}
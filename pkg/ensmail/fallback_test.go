@@ -0,0 +1,55 @@
+package ensmail
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFallback(t *testing.T) {
+	errUnavailable := errors.New("unavailable")
+	indexer := func(ctx context.Context, name string) (string, error) {
+		switch name {
+		case "indexed":
+			return "indexed@example.com", nil
+		case "unindexed":
+			return "", ErrNoEmail
+		case "unauthorized":
+			return "", ErrUnauthorizedName
+		}
+		return "", errUnavailable
+	}
+	var chainCalls []string
+	chain := func(ctx context.Context, name string) (string, error) {
+		chainCalls = append(chainCalls, name)
+		switch name {
+		case "indexed", "unindexed", "unauthorized", "unavailable":
+			return name + "@chain.example.com", nil
+		}
+		return "", ErrNoResolver
+	}
+
+	resolve := Fallback(indexer, chain)
+	for _, test := range []struct {
+		name     string
+		email    string
+		err      error
+		fellBack bool
+	}{
+		{"indexed", "indexed@example.com", nil, false},
+		{"unindexed", "", ErrNoEmail, false},
+		{"unauthorized", "", ErrUnauthorizedName, false},
+		{"unavailable", "unavailable@chain.example.com", nil, true},
+		{"noexist", "", ErrNoResolver, true},
+	} {
+		chainCalls = nil
+		if got, err := resolve(context.Background(), test.name); err != test.err {
+			t.Errorf("%s: want err: %v, got: %v", test.name, test.err, err)
+		} else if got != test.email {
+			t.Errorf("%s: want email: %s, got: %s", test.name, test.email, got)
+		}
+		if fellBack := len(chainCalls) > 0; fellBack != test.fellBack {
+			t.Errorf("%s: want fallback: %v, got: %v", test.name, test.fellBack, fellBack)
+		}
+	}
+}
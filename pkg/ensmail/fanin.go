@@ -0,0 +1,90 @@
+package ensmail
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// fanInMonitor warns when a single resolved address is the target of
+// an unusual number of distinct ENS names (which may indicate abuse,
+// or a hijacked resolver).  Names are counted over a sliding window.
+type fanInMonitor struct {
+	threshold int
+	window    time.Duration
+	logger    log.Logger
+	now       func() time.Time
+
+	mu      sync.Mutex
+	pruned  time.Time
+	targets map[string]map[string]time.Time // k: resolved, v: name last seen
+	flagged map[string]bool                 // resolved addrs over threshold
+}
+
+func newFanInMonitor(threshold int, window time.Duration, logger log.Logger) *fanInMonitor {
+	return &fanInMonitor{
+		threshold: threshold,
+		window:    window,
+		logger:    logger,
+		now:       time.Now,
+		targets:   make(map[string]map[string]time.Time),
+		flagged:   make(map[string]bool),
+	}
+}
+
+// observe records the resolution of name to resolved.  The first
+// time more than threshold distinct names resolve to resolved within
+// window, a warning is logged, and the anomaly metric is incremented.
+func (m *fanInMonitor) observe(name, resolved string) {
+	resolved = strings.ToLower(resolved)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.prune(now)
+
+	names := m.targets[resolved]
+	if names == nil {
+		names = make(map[string]time.Time)
+		m.targets[resolved] = names
+	}
+	names[name] = now
+	for n, seen := range names {
+		if now.Sub(seen) >= m.window {
+			delete(names, n)
+		}
+	}
+
+	if len(names) <= m.threshold {
+		delete(m.flagged, resolved)
+		return
+	}
+	if !m.flagged[resolved] {
+		m.flagged[resolved] = true
+		fanInAnomalies.Inc()
+		m.logger.Log("warn", "resolved fan-in", "resolved", resolved, "names", len(names), "window", m.window)
+	}
+}
+
+// prune removes names outside the window, at most once per minute.
+func (m *fanInMonitor) prune(now time.Time) {
+	if now.Sub(m.pruned) < time.Minute {
+		return
+	}
+	m.pruned = now
+
+	for resolved, names := range m.targets {
+		for n, seen := range names {
+			if now.Sub(seen) >= m.window {
+				delete(names, n)
+			}
+		}
+		if len(names) == 0 {
+			delete(m.targets, resolved)
+			delete(m.flagged, resolved)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package ensmail
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFanInMonitor(t *testing.T) {
+	var warnings int
+	logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+		warnings++
+		return nil
+	})
+
+	now := time.Now()
+	m := newFanInMonitor(2, time.Hour, logger)
+	m.now = func() time.Time { return now }
+	before := testutil.ToFloat64(fanInAnomalies)
+
+	// Repeated names, and names of other addresses, don't count.
+	for _, name := range []string{"one", "two", "one", "two"} {
+		m.observe(name, "target@resolved.test")
+	}
+	m.observe("three", "other@resolved.test")
+	if warnings != 0 {
+		t.Fatalf("want no warnings, got: %d", warnings)
+	}
+
+	// A third name exceeds the threshold, and is only flagged once.
+	m.observe("three", "TARGET@resolved.test")
+	m.observe("four", "target@resolved.test")
+	if warnings != 1 {
+		t.Errorf("want warnings: 1, got: %d", warnings)
+	}
+	if got := testutil.ToFloat64(fanInAnomalies) - before; got != 1 {
+		t.Errorf("want anomalies: 1, got: %v", got)
+	}
+
+	// Once earlier names leave the window, the address is under the
+	// threshold, and may be flagged again.
+	now = now.Add(time.Hour)
+	m.observe("five", "target@resolved.test")
+	if warnings != 1 {
+		t.Errorf("want warnings: 1, got: %d", warnings)
+	}
+	for i := 0; i < 2; i++ {
+		m.observe(fmt.Sprintf("name%d", i), "target@resolved.test")
+	}
+	if warnings != 2 {
+		t.Errorf("want warnings: 2, got: %d", warnings)
+	}
+}
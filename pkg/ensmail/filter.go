@@ -0,0 +1,81 @@
+package ensmail
+
+import (
+	"io"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// FilterAction is a MessageFilter's decision about a message.
+type FilterAction int
+
+const (
+	// FilterAccept forwards the message.
+	FilterAccept FilterAction = iota
+	// FilterReject permanently rejects the message (5.7.1).
+	FilterReject
+	// FilterDefer temporarily rejects the message (4.7.1), so the
+	// sender retries later.
+	FilterDefer
+)
+
+// FilterResult is the result of a MessageFilter.
+type FilterResult struct {
+	Action FilterAction
+
+	// Reason, if set, replaces the default message of reject and
+	// defer replies.
+	Reason string
+
+	// Headers are header fields (for example, "X-Spam-Score: 4.2")
+	// prepended to accepted messages.
+	Headers []string
+}
+
+// MessageFilter inspects a message (for example, with an external
+// spam scanner) before it is forwarded.  from is the envelope sender,
+// and msg is the message as it will be forwarded.  Filter errors
+// temporarily reject the message.
+type MessageFilter func(from string, msg io.Reader) (FilterResult, error)
+
+var (
+	errFilterReject = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected by filter",
+	}
+	errFilterDefer = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Message deferred by filter, try again later",
+	}
+)
+
+// reply returns the SMTP reply of a rejected or deferred result, or
+// nil if the message is accepted.
+func (fr FilterResult) reply() *smtp.SMTPError {
+	var reply smtp.SMTPError
+	switch fr.Action {
+	case FilterAccept:
+		return nil
+	case FilterReject:
+		reply = *errFilterReject
+	default:
+		reply = *errFilterDefer
+	}
+	if fr.Reason != "" {
+		reply.Message = fr.Reason
+	}
+	return &reply
+}
+
+// header returns the result's header fields, each terminated by CRLF.
+func (fr FilterResult) header() string {
+	var b strings.Builder
+	for _, h := range fr.Headers {
+		b.WriteString(strings.TrimRight(h, "\r\n"))
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,307 @@
+package ensmail
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errForwardUnavailable = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+	Message:      "Forwarding server not responding, try again later",
+}
+
+// ErrForwardNotLMTP is returned when the forwarding server does not
+// accept LHLO, which usually means the forward address points at an
+// SMTP server.
+var ErrForwardNotLMTP = errors.New("forward target is not an LMTP server")
+
+// LMTPDialer creates LMTP forwarder clients connected to Addr.
+type LMTPDialer struct {
+	// Network and Addr are passed to net.Dial.
+	Network string
+	Addr    string
+	// If set, AddrFunc is called by each dial, and its address is
+	// used instead of Addr, so new connections follow a forwarding
+	// server which moved (such as to a new socket path, on a
+	// configuration reload) without restarting.  Connections already
+	// established are unaffected.
+	AddrFunc func() string
+	// If set, TCP connections originate from LocalAddr.  LocalAddr is
+	// ignored for other networks.
+	LocalAddr net.IP
+	// Host is the forwarding server's name, passed to
+	// smtp.NewClientLMTP.
+	Host string
+	// Timeout bounds establishing the connection, receiving the
+	// forwarding server's greeting, and LHLO.  Zero means no
+	// timeout.
+	Timeout time.Duration
+	// If set, connections are secured with TLSConfig, either
+	// immediately (implicit TLS), or after the greeting with STARTTLS
+	// if StartTLS is set.  If TLSConfig.ServerName is empty, the host
+	// of Addr is verified.
+	TLSConfig *tls.Config
+	StartTLS  bool
+}
+
+// NewForwarderClient implements NewForwarderClient.  If the
+// forwarding server does not respond within d.Timeout, a 421 error
+// is returned.  If the forwarding server does not speak LMTP,
+// ErrForwardNotLMTP is returned.
+func (d LMTPDialer) NewForwarderClient() (fc ForwarderClient, err error) {
+	dialer := net.Dialer{Timeout: d.Timeout}
+	if d.LocalAddr != nil && strings.HasPrefix(d.Network, "tcp") {
+		dialer.LocalAddr = &net.TCPAddr{IP: d.LocalAddr}
+	}
+	addr := d.Addr
+	if d.AddrFunc != nil {
+		addr = d.AddrFunc()
+	}
+	conn, err := dialer.Dial(d.Network, addr)
+	if err != nil {
+		return nil, dialErr(err)
+	}
+
+	tlsConfig := d.TLSConfig
+	if tlsConfig != nil && tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			tlsConfig.ServerName = host
+		} else {
+			tlsConfig.ServerName = addr
+		}
+	}
+	if tlsConfig != nil && !d.StartTLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	// smtp.NewClientLMTP sets its own greeting deadline, so the
+	// greeting timeout is enforced by closing conn.
+	if d.Timeout != 0 {
+		timer := time.AfterFunc(d.Timeout, func() { conn.Close() })
+		defer func() {
+			if !timer.Stop() {
+				fc, err = nil, errForwardUnavailable
+			}
+		}()
+	}
+
+	cl, err := smtp.NewClientLMTP(conn, d.Host)
+	if err != nil {
+		conn.Close()
+		return nil, dialErr(err)
+	}
+
+	if tlsConfig != nil && d.StartTLS {
+		if err := cl.StartTLS(tlsConfig); err != nil {
+			cl.Close()
+			return nil, dialErr(err)
+		}
+	}
+
+	// If LHLO is rejected, the client falls back to HELO, which
+	// succeeds on SMTP servers, but advertises no extensions.  LMTP
+	// servers must support PIPELINING (RFC 2033, section 5).
+	if ok, _ := cl.Extension("PIPELINING"); !ok {
+		cl.Close()
+		return nil, ErrForwardNotLMTP
+	}
+	return &lmtpClient{Client: cl, conn: conn}, nil
+}
+
+// lmtpClient is an smtp.Client which reports recipients' successful
+// DATA replies to LMTPData's statusCb, rather than nil.
+type lmtpClient struct {
+	*smtp.Client
+	conn  net.Conn
+	rcpts []string // recipients of the current transaction
+}
+
+// Mail is like smtp.Client.Mail, but encodes the AUTH parameter as
+// RFC 4954 specifies: an xtext addr-spec, or "<>".  go-smtp's client
+// (v0.15) garbles it, so it's only used for MAIL without AUTH.  As
+// with smtp.Client.Mail, AUTH is discarded if the forwarding server
+// doesn't support it.
+func (c *lmtpClient) Mail(from string, opts *smtp.MailOptions) error {
+	if opts == nil || opts.Auth == nil {
+		return c.Client.Mail(from, opts)
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		noAuth := *opts
+		noAuth.Auth = nil
+		return c.Client.Mail(from, &noAuth)
+	}
+	if strings.ContainsAny(from, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+
+	cmd := "MAIL FROM:<" + from + ">"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SIZE"); ok && opts.Size != 0 {
+		cmd += " SIZE=" + strconv.Itoa(opts.Size)
+	}
+	if opts.RequireTLS {
+		if ok, _ := c.Extension("REQUIRETLS"); !ok {
+			return errors.New("smtp: server does not support REQUIRETLS")
+		}
+		cmd += " REQUIRETLS"
+	}
+	if opts.UTF8 {
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			return errors.New("smtp: server does not support SMTPUTF8")
+		}
+		cmd += " SMTPUTF8"
+	}
+	auth := *opts.Auth
+	if auth == "" {
+		auth = "<>"
+	}
+	cmd += " AUTH=" + encodeXtext(auth)
+
+	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	id, err := c.Text.Cmd("%s", cmd)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	if _, _, err := c.Text.ReadResponse(250); err != nil {
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			return replyStatus(protoErr.Code, protoErr.Msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *lmtpClient) Rcpt(to string) error {
+	if err := c.Client.Rcpt(to); err != nil {
+		return err
+	}
+	c.rcpts = append(c.rcpts, to)
+	return nil
+}
+
+func (c *lmtpClient) Reset() error {
+	c.rcpts = nil
+	return c.Client.Reset()
+}
+
+// LMTPData is like smtp.Client.LMTPData, but each recipient's status
+// is its reply, including successful (2xx) replies.
+func (c *lmtpClient) LMTPData(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return nil, err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	if _, _, err := c.Text.ReadResponse(354); err != nil {
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			return nil, replyStatus(protoErr.Code, protoErr.Msg)
+		}
+		return nil, err
+	}
+	return &lmtpDataCloser{WriteCloser: c.Text.DotWriter(), c: c, statusCb: statusCb}, nil
+}
+
+type lmtpDataCloser struct {
+	io.WriteCloser
+	c        *lmtpClient
+	statusCb func(rcpt string, status *smtp.SMTPError)
+}
+
+// Close ends the message, and calls statusCb with each recipient's
+// reply.  Close only returns an error if the connection fails.
+func (d *lmtpDataCloser) Close() error {
+	if err := d.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	d.c.conn.SetDeadline(time.Now().Add(d.c.SubmissionTimeout))
+	defer d.c.conn.SetDeadline(time.Time{})
+
+	for _, rcpt := range d.c.rcpts {
+		code, msg, err := d.c.Text.ReadResponse(250)
+		var protoErr *textproto.Error
+		switch {
+		case errors.As(err, &protoErr):
+			code, msg = protoErr.Code, protoErr.Msg
+		case err != nil:
+			return err
+		}
+		if d.statusCb != nil {
+			d.statusCb(rcpt, replyStatus(code, msg))
+		}
+	}
+	return nil
+}
+
+// replyStatus returns the SMTPError of a reply, whose message may
+// begin with an enhanced status code.
+func replyStatus(code int, msg string) *smtp.SMTPError {
+	status := &smtp.SMTPError{Code: code, EnhancedCode: smtp.NoEnhancedCode, Message: msg}
+
+	parts := strings.SplitN(msg, " ", 2)
+	if len(parts) != 2 {
+		return status
+	}
+	codes := strings.Split(parts[0], ".")
+	if len(codes) != 3 {
+		return status
+	}
+	var enhanced smtp.EnhancedCode
+	for i, s := range codes {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return status
+		}
+		enhanced[i] = n
+	}
+	status.EnhancedCode = enhanced
+	status.Message = parts[1]
+	return status
+}
+
+// encodeXtext encodes s as xtext (RFC 3461, section 4): printable
+// ASCII other than "+" and "=" is unchanged, and other bytes are
+// encoded as "+" and their hex value.
+func encodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= '!' && c <= '~' && c != '+' && c != '=' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "+%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// dialErr maps timeouts to errForwardUnavailable.
+func dialErr(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errForwardUnavailable
+	}
+	return err
+}
@@ -0,0 +1,479 @@
+package ensmail
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/google/go-cmp/cmp"
+)
+
+type nopBackend struct{}
+
+func (nopBackend) NewSession(c smtp.ConnectionState, hostname string) (smtp.Session, error) {
+	return nopSession{}, nil
+}
+
+type nopSession struct{}
+
+func (nopSession) Reset()                                    {}
+func (nopSession) Logout() error                             { return nil }
+func (nopSession) AuthPlain(username, password string) error { return smtp.ErrAuthUnsupported }
+func (nopSession) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+func (nopSession) Rcpt(to string) error   { return nil }
+func (nopSession) Data(r io.Reader) error { return nil }
+
+// statusBackend is an LMTP backend which accepts recipients whose
+// local-part is "ok", and rejects others at DATA.
+type statusBackend struct{}
+
+func (statusBackend) NewSession(c smtp.ConnectionState, hostname string) (smtp.Session, error) {
+	return &statusSession{}, nil
+}
+
+type statusSession struct {
+	nopSession
+	rcpts []string
+}
+
+func (s *statusSession) Rcpt(to string) error {
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+func (s *statusSession) Reset() {
+	s.rcpts = nil
+}
+
+func (s *statusSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	io.Copy(io.Discard, r)
+	for _, rcpt := range s.rcpts {
+		if strings.HasPrefix(rcpt, "ok@") {
+			status.SetStatus(rcpt, &smtp.SMTPError{Code: 250, EnhancedCode: smtp.EnhancedCode{2, 0, 0}, Message: "Queued as ok"})
+		} else {
+			status.SetStatus(rcpt, &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"})
+		}
+	}
+	return nil
+}
+
+func TestLMTPDialer(t *testing.T) {
+	// Forwarding server socket exists, but never accepts or greets.
+	t.Run("timeout", func(t *testing.T) {
+		sock := filepath.Join(t.TempDir(), "forward.sock")
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		d := LMTPDialer{
+			Network: "unix",
+			Addr:    sock,
+			Host:    "ensmail.test",
+			Timeout: 100 * time.Millisecond,
+		}
+
+		done := make(chan error)
+		go func() {
+			_, err := d.NewForwarderClient()
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if err != errForwardUnavailable {
+				t.Errorf("want err: %s, got: %v", errForwardUnavailable, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("dial did not time out")
+		}
+	})
+
+	t.Run("noSocket", func(t *testing.T) {
+		d := LMTPDialer{
+			Network: "unix",
+			Addr:    filepath.Join(t.TempDir(), "noexist.sock"),
+			Timeout: time.Second,
+		}
+		if _, err := d.NewForwarderClient(); err == nil || err == errForwardUnavailable {
+			t.Errorf("want dial err, got: %v", err)
+		}
+	})
+
+	// Forwarder connections are only established with LMTP servers.
+	for _, test := range []struct {
+		name string
+		lmtp bool
+		err  error
+	}{
+		{"lmtpTarget", true, nil},
+		{"smtpTarget", false, ErrForwardNotLMTP},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sock := filepath.Join(t.TempDir(), "forward.sock")
+			l, err := net.Listen("unix", sock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			srv := smtp.NewServer(nopBackend{})
+			srv.LMTP = test.lmtp
+			go srv.Serve(l)
+			defer srv.Close()
+
+			d := LMTPDialer{
+				Network: "unix",
+				Addr:    sock,
+				Timeout: time.Second,
+			}
+			fc, err := d.NewForwarderClient()
+			if err != test.err {
+				t.Fatalf("want err: %v, got: %v", test.err, err)
+			}
+			if fc != nil {
+				fc.Close()
+			}
+		})
+	}
+
+	// Forwarder connections to TCP servers may be secured with
+	// implicit TLS or STARTTLS.
+	for _, test := range []struct {
+		name     string
+		startTLS bool
+	}{
+		{"implicitTLS", false},
+		{"startTLS", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			serverTLS, clientTLS := testTLSConfigs(t)
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			srv := smtp.NewServer(nopBackend{})
+			srv.LMTP = true
+			if test.startTLS {
+				srv.TLSConfig = serverTLS
+				go srv.Serve(l)
+			} else {
+				go srv.Serve(tls.NewListener(l, serverTLS))
+			}
+			defer srv.Close()
+
+			d := LMTPDialer{
+				Network:   "tcp",
+				Addr:      l.Addr().String(),
+				Host:      "ensmail.test",
+				Timeout:   time.Second,
+				TLSConfig: clientTLS,
+				StartTLS:  test.startTLS,
+			}
+			fc, err := d.NewForwarderClient()
+			if err != nil {
+				t.Fatal("unexpected err:", err)
+			}
+			defer fc.Close()
+
+			if state, ok := fc.(*lmtpClient).TLSConnectionState(); !ok || !state.HandshakeComplete {
+				t.Error("forwarder connection is not TLS")
+			}
+
+			// A client which doesn't trust the server fails.
+			d.TLSConfig = &tls.Config{}
+			if fc, err := d.NewForwarderClient(); err == nil {
+				fc.Close()
+				t.Error("want TLS verification err")
+			}
+		})
+	}
+
+	// TCP forwarder connections originate from LocalAddr, which is
+	// ignored for unix sockets.
+	t.Run("localAddr", func(t *testing.T) {
+		localAddr := net.IPv4(127, 0, 0, 2)
+
+		for _, network := range []string{"tcp", "unix"} {
+			var l net.Listener
+			var err error
+			if network == "tcp" {
+				l, err = net.Listen("tcp", "127.0.0.1:0")
+			} else {
+				l, err = net.Listen("unix", filepath.Join(t.TempDir(), "forward.sock"))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			accepted := make(chan net.Addr, 1)
+			srv := smtp.NewServer(nopBackend{})
+			srv.LMTP = true
+			go srv.Serve(acceptRecorder{l, accepted})
+			defer srv.Close()
+
+			d := LMTPDialer{
+				Network:   network,
+				Addr:      l.Addr().String(),
+				LocalAddr: localAddr,
+				Timeout:   time.Second,
+			}
+			fc, err := d.NewForwarderClient()
+			if err != nil {
+				t.Fatalf("%s: unexpected err: %v", network, err)
+			}
+			fc.Close()
+
+			if addr, ok := (<-accepted).(*net.TCPAddr); network == "tcp" && (!ok || !addr.IP.Equal(localAddr)) {
+				t.Errorf("want connection from: %s, got: %v", localAddr, addr)
+			}
+		}
+	})
+
+	// Each recipient's reply, including success replies, is its
+	// status.
+	t.Run("dataReplies", func(t *testing.T) {
+		sock := filepath.Join(t.TempDir(), "forward.sock")
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		srv := smtp.NewServer(statusBackend{})
+		srv.LMTP = true
+		go srv.Serve(l)
+		defer srv.Close()
+
+		d := LMTPDialer{Network: "unix", Addr: sock, Timeout: time.Second}
+		fc, err := d.NewForwarderClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fc.Close()
+
+		if err := fc.Mail("sender@public.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, to := range []string{"ok@resolved.test", "fail@resolved.test"} {
+			if err := fc.Rcpt(to); err != nil {
+				t.Fatal(err)
+			}
+		}
+		statuses := make(map[string]*smtp.SMTPError)
+		w, err := fc.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+			statuses[rcpt] = status
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, "Subject: hi\r\n\r\nbody\r\n")
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		exp := map[string]*smtp.SMTPError{
+			"ok@resolved.test":   {Code: 250, EnhancedCode: smtp.EnhancedCode{2, 0, 0}, Message: "<ok@resolved.test> Queued as ok"},
+			"fail@resolved.test": {Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "<fail@resolved.test> No such user"},
+		}
+		if diff := cmp.Diff(exp, statuses); diff != "" {
+			t.Errorf("statuses (-want, +got) %s", diff)
+		}
+
+		// Transactions after Reset only report their own recipients.
+		if err := fc.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		fc.Mail("sender@public.com", nil)
+		fc.Rcpt("ok@resolved.test")
+		statuses = make(map[string]*smtp.SMTPError)
+		w, err = fc.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+			statuses[rcpt] = status
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, "Subject: hi\r\n\r\nbody\r\n")
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != 1 || statuses["ok@resolved.test"].Code != 250 {
+			t.Errorf("unexpected statuses: %v", statuses)
+		}
+	})
+
+	// Each dial connects to the current address of AddrFunc, and
+	// earlier connections are kept when it changes.
+	t.Run("addrFunc", func(t *testing.T) {
+		var socks []string
+		var accepted []chan net.Addr
+		for _, name := range []string{"old.sock", "new.sock"} {
+			sock := filepath.Join(t.TempDir(), name)
+			l, err := net.Listen("unix", sock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			addrs := make(chan net.Addr, 1)
+			srv := smtp.NewServer(nopBackend{})
+			srv.LMTP = true
+			go srv.Serve(acceptRecorder{l, addrs})
+			defer srv.Close()
+
+			socks = append(socks, sock)
+			accepted = append(accepted, addrs)
+		}
+
+		sock := socks[0]
+		d := LMTPDialer{
+			Network:  "unix",
+			AddrFunc: func() string { return sock },
+			Timeout:  time.Second,
+		}
+		old, err := d.NewForwarderClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer old.Close()
+		<-accepted[0]
+
+		sock = socks[1]
+		fc, err := d.NewForwarderClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fc.Close()
+		select {
+		case <-accepted[1]:
+		case <-accepted[0]:
+			t.Fatal("dialed old address")
+		}
+
+		if err := old.Mail("sender@public.com", nil); err != nil {
+			t.Errorf("old connection: unexpected err: %v", err)
+		}
+	})
+
+	// MAIL parameters are forwarded, with AUTH encoded as RFC 4954
+	// specifies, or discarded if the server doesn't support AUTH.
+	t.Run("mailParams", func(t *testing.T) {
+		auth, nullAuth := "sender+tag@public.com", ""
+		for _, test := range []struct {
+			exts []string
+			opts *smtp.MailOptions
+			exp  string
+		}{
+			{
+				[]string{"8BITMIME", "SMTPUTF8", "AUTH"},
+				&smtp.MailOptions{UTF8: true, Auth: &auth},
+				"MAIL FROM:<sender@public.com> BODY=8BITMIME SMTPUTF8 AUTH=sender+2Btag@public.com",
+			},
+			{
+				[]string{"AUTH"},
+				&smtp.MailOptions{Auth: &nullAuth},
+				"MAIL FROM:<sender@public.com> AUTH=<>",
+			},
+			{
+				[]string{"8BITMIME"},
+				&smtp.MailOptions{Auth: &auth},
+				"MAIL FROM:<sender@public.com> BODY=8BITMIME",
+			},
+			{
+				[]string{"SMTPUTF8", "AUTH"},
+				&smtp.MailOptions{UTF8: true},
+				"MAIL FROM:<sender@public.com> SMTPUTF8",
+			},
+		} {
+			sock := filepath.Join(t.TempDir(), "forward.sock")
+			l, err := net.Listen("unix", sock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			cmds := mailCmdServer(l, test.exts...)
+
+			d := LMTPDialer{Network: "unix", Addr: sock, Timeout: time.Second}
+			fc, err := d.NewForwarderClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fc.Close()
+
+			if err := fc.Mail("sender@public.com", test.opts); err != nil {
+				t.Fatalf("%v: unexpected err: %v", test.exts, err)
+			}
+			if cmd := <-cmds; cmd != test.exp {
+				t.Errorf("%v: want: %q, got: %q", test.exts, test.exp, cmd)
+			}
+		}
+	})
+}
+
+// acceptRecorder is a net.Listener which sends the remote address of
+// each accepted connection to addrs.
+type acceptRecorder struct {
+	net.Listener
+	addrs chan<- net.Addr
+}
+
+func (l acceptRecorder) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.addrs <- conn.RemoteAddr()
+	}
+	return conn, err
+}
+
+// mailCmdServer serves LMTP on l, advertising PIPELINING and exts,
+// and sends each MAIL command received to the returned channel.  All
+// other commands are accepted.
+func mailCmdServer(l net.Listener, exts ...string) <-chan string {
+	cmds := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 localhost LMTP ready")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "LHLO "):
+				tc.PrintfLine("250-localhost")
+				for _, ext := range exts {
+					tc.PrintfLine("250-%s", ext)
+				}
+				tc.PrintfLine("250 PIPELINING")
+			case strings.HasPrefix(line, "MAIL "):
+				cmds <- line
+				tc.PrintfLine("250 2.0.0 OK")
+			case line == "QUIT":
+				tc.PrintfLine("221 2.0.0 Bye")
+				return
+			default:
+				tc.PrintfLine("250 2.0.0 OK")
+			}
+		}
+	}()
+	return cmds
+}
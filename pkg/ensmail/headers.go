@@ -0,0 +1,160 @@
+package ensmail
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// headerField is a single, possibly folded, message header field.
+// raw contains the field exactly as read, including its line endings.
+type headerField struct {
+	name string
+	raw  []byte
+}
+
+// readHeader reads the message header from br, up to and including
+// the blank line which separates the header from the body.  The
+// blank line is returned as sep, and is empty if the message has no
+// body.
+func readHeader(br *bufio.Reader) (fields []headerField, sep []byte, err error) {
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+
+		switch {
+		case len(line) == 0:
+			return fields, nil, nil
+		case bytes.Equal(line, []byte("\r\n")) || bytes.Equal(line, []byte("\n")):
+			return fields, line, nil
+		case (line[0] == ' ' || line[0] == '\t') && len(fields) > 0:
+			// Folded continuation of previous field.
+			last := &fields[len(fields)-1]
+			last.raw = append(last.raw, line...)
+		default:
+			var name string
+			if colon := bytes.IndexByte(line, ':'); colon > 0 {
+				name = strings.TrimSpace(string(line[:colon]))
+			}
+			fields = append(fields, headerField{name: name, raw: line})
+		}
+
+		if err == io.EOF {
+			return fields, nil, nil
+		}
+	}
+}
+
+// maxLoggedHeaderLen bounds the length of header values logged by
+// headerKeyvals.
+const maxLoggedHeaderLen = 256
+
+// headerKeyvals returns the unfolded value of each field of fields
+// named one of names, as log keyvals keyed by the field's name.
+// Values longer than maxLoggedHeaderLen are truncated.
+func headerKeyvals(fields []headerField, names []string) []interface{} {
+	var keyvals []interface{}
+	for _, f := range fields {
+		for _, name := range names {
+			if !strings.EqualFold(f.name, name) {
+				continue
+			}
+			v := string(f.raw[bytes.IndexByte(f.raw, ':')+1:])
+			v = strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(v))
+			if len(v) > maxLoggedHeaderLen {
+				v = v[:maxLoggedHeaderLen] + "..."
+			}
+			keyvals = append(keyvals, name, v)
+			break
+		}
+	}
+	return keyvals
+}
+
+// hasHeader reports whether fields contains a field named name.
+func hasHeader(fields []headerField, name string) bool {
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReceivedSanitizeMode determines how untrusted trace headers are
+// handled before a message is forwarded.
+type ReceivedSanitizeMode int
+
+const (
+	// ReceivedStrip removes untrusted Received headers.
+	ReceivedStrip ReceivedSanitizeMode = iota + 1
+	// ReceivedMark renames untrusted Received headers to
+	// X-Untrusted-Received.
+	ReceivedMark
+)
+
+// ensmailHeaderPrefix is reserved for headers added by ensmail.
+const ensmailHeaderPrefix = "X-ENSMail-"
+
+// receivedSanitizer removes or marks all but the first trusted
+// Received headers of a message, and removes all X-ENSMail headers,
+// which can only be legitimately set by ensmail itself.
+type receivedSanitizer struct {
+	mode    ReceivedSanitizeMode
+	trusted int
+}
+
+func (rs receivedSanitizer) sanitize(fields []headerField) []headerField {
+	var (
+		sanitized []headerField
+		received  int
+	)
+	for _, f := range fields {
+		if len(f.name) >= len(ensmailHeaderPrefix) && strings.EqualFold(f.name[:len(ensmailHeaderPrefix)], ensmailHeaderPrefix) {
+			continue
+		}
+
+		if strings.EqualFold(f.name, "Received") {
+			received++
+			if received > rs.trusted {
+				if rs.mode == ReceivedStrip {
+					continue
+				}
+				f.raw = append([]byte("X-Untrusted-Received"), f.raw[bytes.IndexByte(f.raw, ':'):]...)
+				f.name = "X-Untrusted-Received"
+			}
+		}
+		sanitized = append(sanitized, f)
+	}
+	return sanitized
+}
+
+// MessageIDMode selects how forwarded messages' Message-ID headers
+// are handled.
+type MessageIDMode int
+
+const (
+	// MessageIDPreserve forwards Message-ID headers unmodified, and
+	// doesn't add one to messages without one.
+	MessageIDPreserve MessageIDMode = iota
+	// MessageIDAddIfMissing adds a Message-ID header, generated from
+	// the transaction's message id, to messages without one.
+	MessageIDAddIfMissing
+	// MessageIDRegenerate replaces any Message-ID header with one
+	// generated from the transaction's message id.
+	MessageIDRegenerate
+)
+
+// removeHeader returns fields without any field named name.
+func removeHeader(fields []headerField, name string) []headerField {
+	kept := fields[:0]
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, name) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
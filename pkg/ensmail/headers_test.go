@@ -0,0 +1,163 @@
+package ensmail
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReceivedSanitizer(t *testing.T) {
+	msg := "Received: from mx.trusted.test\r\n" +
+		" by mx.maddy.test; Fri, 25 Feb 2022 16:39:27 -0500\r\n" +
+		"Received: from forged.test by mx.bank.test; Fri, 25 Feb 2022 16:39:27 -0500\r\n" +
+		"X-ENSMail-Resolved: forged\r\n" +
+		"To: recipient@example.net\r\n" +
+		"received: from forged2.test\r\n" +
+		"Message-Id: <forged@mx.trusted.test>\r\n" +
+		"\r\n" +
+		"Received: body text is not a header\r\n"
+
+	for _, test := range []struct {
+		name string
+		mode ReceivedSanitizeMode
+		exp  string
+	}{
+		{
+			name: "strip",
+			mode: ReceivedStrip,
+			exp: "Received: from mx.trusted.test\r\n" +
+				" by mx.maddy.test; Fri, 25 Feb 2022 16:39:27 -0500\r\n" +
+				"To: recipient@example.net\r\n" +
+				"Message-Id: <forged@mx.trusted.test>\r\n" +
+				"\r\n" +
+				"Received: body text is not a header\r\n",
+		},
+		{
+			name: "mark",
+			mode: ReceivedMark,
+			exp: "Received: from mx.trusted.test\r\n" +
+				" by mx.maddy.test; Fri, 25 Feb 2022 16:39:27 -0500\r\n" +
+				"X-Untrusted-Received: from forged.test by mx.bank.test; Fri, 25 Feb 2022 16:39:27 -0500\r\n" +
+				"To: recipient@example.net\r\n" +
+				"X-Untrusted-Received: from forged2.test\r\n" +
+				"Message-Id: <forged@mx.trusted.test>\r\n" +
+				"\r\n" +
+				"Received: body text is not a header\r\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := session{
+				msgID:     "testid",
+				sanitizer: &receivedSanitizer{mode: test.mode, trusted: 1},
+			}
+
+			var out bytes.Buffer
+			n, err := s.copyMessage(&out, strings.NewReader(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(out.Len()) {
+				t.Errorf("want n: %d, got: %d", out.Len(), n)
+			}
+
+			// Strip ensmail's own (timestamped) Received header.
+			const ownPrefix = "Received: by ensmail with LMTP id testid;\r\n "
+			got := out.String()
+			if !strings.HasPrefix(got, ownPrefix) {
+				t.Fatalf("missing ensmail Received header: %q", got)
+			}
+			got = got[strings.Index(got, "\r\n"+" ")+2:]
+			got = got[strings.Index(got, "\r\n")+2:]
+
+			if got != test.exp {
+				t.Errorf("want:\n%q\ngot:\n%q", test.exp, got)
+			}
+		})
+	}
+
+	t.Run("noBody", func(t *testing.T) {
+		s := session{msgID: "testid", sanitizer: &receivedSanitizer{mode: ReceivedStrip}, msgIDMode: MessageIDAddIfMissing}
+
+		var out bytes.Buffer
+		if _, err := s.copyMessage(&out, strings.NewReader("Received: forged\r\nSubject: hi\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if got := out.String(); !strings.HasSuffix(got, "\r\nMessage-ID: <testid@ensmail.local>\r\nSubject: hi\r\n") || strings.Contains(got, "forged") {
+			t.Errorf("unexpected message: %q", got)
+		}
+	})
+}
+
+func TestMessageID(t *testing.T) {
+	const (
+		absent  = "Subject: hi\r\n\r\nbody\r\n"
+		present = "Subject: hi\r\nMESSAGE-ID: <orig@example.com>\r\n\r\nbody\r\n"
+		added   = "Message-ID: <testid@ensmail.local>\r\nSubject: hi\r\n\r\nbody\r\n"
+	)
+
+	for _, test := range []struct {
+		name     string
+		mode     MessageIDMode
+		msg, exp string
+	}{
+		{"preserveAbsent", MessageIDPreserve, absent, absent},
+		{"preservePresent", MessageIDPreserve, present, present},
+		{"addIfMissingAbsent", MessageIDAddIfMissing, absent, added},
+		{"addIfMissingPresent", MessageIDAddIfMissing, present, present},
+		{"regenerateAbsent", MessageIDRegenerate, absent, added},
+		{"regeneratePresent", MessageIDRegenerate, present, added},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := session{msgID: "testid", msgIDMode: test.mode}
+
+			var out bytes.Buffer
+			if _, err := s.copyMessage(&out, strings.NewReader(test.msg)); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != test.exp {
+				t.Errorf("want:\n%q\ngot:\n%q", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestStripBcc(t *testing.T) {
+	const (
+		msg = "From: a@example.com\r\n" +
+			"bcc: hidden@example.com,\r\n" +
+			"\tother@example.com\r\n" +
+			"Subject: folded\r\n" +
+			" subject\r\n" +
+			"Resent-Bcc: resent@example.com\r\n" +
+			"X-Bcc: kept\r\n" +
+			"\r\n" +
+			"Bcc: in body\r\n"
+		exp = "From: a@example.com\r\n" +
+			"Subject: folded\r\n" +
+			" subject\r\n" +
+			"X-Bcc: kept\r\n" +
+			"\r\n" +
+			"Bcc: in body\r\n"
+	)
+
+	for _, test := range []struct {
+		name     string
+		stripBcc bool
+		exp      string
+	}{
+		{"strip", true, exp},
+		{"keep", false, msg},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := session{msgID: "testid", stripBcc: test.stripBcc}
+
+			var out bytes.Buffer
+			if _, err := s.copyMessage(&out, strings.NewReader(msg)); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != test.exp {
+				t.Errorf("want:\n%q\ngot:\n%q", test.exp, got)
+			}
+		})
+	}
+}
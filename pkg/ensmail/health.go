@@ -0,0 +1,99 @@
+package ensmail
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNotProbed is the health of a HealthProber before its first
+// probe completes.
+var ErrNotProbed = errors.New("health not probed yet")
+
+// HealthProber probes the reachability of a web3 provider at a fixed
+// interval, and caches the result, so health checks (and load
+// balancers polling them) are answered from the latest probe rather
+// than by calling the provider.
+type HealthProber struct {
+	probe    func(context.Context) error
+	interval time.Duration
+
+	mu      sync.RWMutex
+	err     error
+	checked time.Time // of the latest probe
+}
+
+// NewHealthProber returns a HealthProber which calls probe every
+// interval, once Run.  probe should be a cheap call, such as
+// ENSResolver.Validate (a single eth_getCode), and is cancelled if it
+// takes longer than interval.
+func NewHealthProber(probe func(context.Context) error, interval time.Duration) *HealthProber {
+	return &HealthProber{
+		probe:    probe,
+		interval: interval,
+		err:      ErrNotProbed,
+	}
+}
+
+// Run probes immediately, then every interval, until done is closed.
+// A probe in progress when done is closed is cancelled.
+func (p *HealthProber) Run(done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.probeOnce(ctx)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeOnce probes, and caches the result.
+func (p *HealthProber) probeOnce(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+	err := p.probe(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err, p.checked = err, time.Now()
+}
+
+// Healthy returns the error of the latest probe, which is nil if the
+// provider was reachable.
+func (p *HealthProber) Healthy() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.err
+}
+
+// ServeHTTP serves the latest probe's result, as 200 if healthy, or
+// 503 with its error otherwise.
+func (p *HealthProber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	err, checked := p.err, p.checked
+	p.mu.RUnlock()
+
+	if !checked.IsZero() {
+		w.Header().Set("Last-Modified", checked.UTC().Format(http.TimeFormat))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,95 @@
+package ensmail
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthProber(t *testing.T) {
+	errDown := errors.New("connection refused")
+	var (
+		down   int32
+		probes int32
+	)
+	probe := func(ctx context.Context) error {
+		atomic.AddInt32(&probes, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			return errDown
+		}
+		return nil
+	}
+	p := NewHealthProber(probe, time.Hour)
+
+	status := func() int {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rec.Code
+	}
+	if err := p.Healthy(); err != ErrNotProbed {
+		t.Errorf("want err: %v, got: %v", ErrNotProbed, err)
+	}
+	if code := status(); code != http.StatusServiceUnavailable {
+		t.Errorf("unprobed: want status: %d, got: %d", http.StatusServiceUnavailable, code)
+	}
+
+	// Health is toggled by probes, and served from the latest.
+	for _, test := range []struct {
+		down bool
+		err  error
+		code int
+	}{
+		{false, nil, http.StatusOK},
+		{true, errDown, http.StatusServiceUnavailable},
+		{false, nil, http.StatusOK},
+	} {
+		if test.down {
+			atomic.StoreInt32(&down, 1)
+		} else {
+			atomic.StoreInt32(&down, 0)
+		}
+		p.probeOnce(context.Background())
+		n := atomic.LoadInt32(&probes)
+		if err := p.Healthy(); err != test.err {
+			t.Errorf("down %t: want err: %v, got: %v", test.down, test.err, err)
+		}
+		if code := status(); code != test.code {
+			t.Errorf("down %t: want status: %d, got: %d", test.down, test.code, code)
+		}
+		if got := atomic.LoadInt32(&probes); got != n {
+			t.Errorf("down %t: health checks probed %d times", test.down, got-n)
+		}
+	}
+
+	// Run probes immediately, and returns once done is closed, even
+	// while a probe is in progress.
+	probing := make(chan struct{})
+	p = NewHealthProber(func(ctx context.Context) error {
+		select {
+		case probing <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}, time.Hour)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		p.Run(done)
+		close(stopped)
+	}()
+	<-probing
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't stop")
+	}
+	if err := p.Healthy(); err != context.Canceled {
+		t.Errorf("want err: %v, got: %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,154 @@
+package ensmail
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	errWebhookUnavailable = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+		Message:      "Webhook not responding, try again later",
+	}
+	errWebhookTempFail = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Webhook temporarily failed, try again later",
+	}
+	errWebhookTooBig = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Message too big for webhook",
+	}
+	errWebhookRejected = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Message rejected by webhook",
+	}
+)
+
+// HTTPForwarder is a ForwarderClient which delivers messages to an
+// HTTP webhook, rather than to an LMTP server.  For each recipient,
+// the message is POSTed to URL as multipart/form-data, with a
+// "metadata" part (JSON of the envelope's "from" and "to"), and a
+// "message" part (the raw RFC 5322 message).
+type HTTPForwarder struct {
+	URL    string
+	Client *http.Client
+
+	from  string
+	rcpts []string
+}
+
+// NewHTTPForwarder returns an HTTPForwarder which posts to url with
+// client (or http.DefaultClient, if nil).
+func NewHTTPForwarder(url string, client *http.Client) *HTTPForwarder {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPForwarder{URL: url, Client: client}
+}
+
+func (f *HTTPForwarder) Mail(from string, opts *smtp.MailOptions) error {
+	f.from = from
+	return nil
+}
+
+func (f *HTTPForwarder) Rcpt(to string) error {
+	f.rcpts = append(f.rcpts, to)
+	return nil
+}
+
+// LMTPData buffers the message, and posts it for each recipient once
+// the returned writer is closed.  A 2xx response is a successful
+// delivery.  Other responses are mapped to SMTP statuses: 413 is too
+// big, 429 and 5xx are temporary failures, and other responses are
+// rejections.
+func (f *HTTPForwarder) LMTPData(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+	return &webhookWriter{f: f, statusCb: statusCb}, nil
+}
+
+func (f *HTTPForwarder) Reset() error {
+	f.from = ""
+	f.rcpts = nil
+	return nil
+}
+
+func (f *HTTPForwarder) Close() error {
+	return nil
+}
+
+// Extension reports SMTPUTF8 and 8BITMIME as supported, as messages
+// are posted unmodified.
+func (f *HTTPForwarder) Extension(ext string) (bool, string) {
+	switch ext {
+	case "SMTPUTF8", "8BITMIME":
+		return true, ""
+	}
+	return false, ""
+}
+
+// post posts msg for rcpt, and returns its status.
+func (f *HTTPForwarder) post(rcpt string, msg []byte) *smtp.SMTPError {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	meta, err := mw.CreateFormField("metadata")
+	if err != nil {
+		return errWebhookUnavailable
+	}
+	if err := json.NewEncoder(meta).Encode(struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}{f.from, rcpt}); err != nil {
+		return errWebhookUnavailable
+	}
+
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Content-Disposition", `form-data; name="message"; filename="message.eml"`)
+	hdr.Set("Content-Type", "message/rfc822")
+	part, err := mw.CreatePart(hdr)
+	if err != nil {
+		return errWebhookUnavailable
+	}
+	part.Write(msg)
+	mw.Close()
+
+	rsp, err := f.Client.Post(f.URL, mw.FormDataContentType(), &body)
+	if err != nil {
+		return errWebhookUnavailable
+	}
+	io.Copy(io.Discard, rsp.Body)
+	rsp.Body.Close()
+
+	switch {
+	case rsp.StatusCode/100 == 2:
+		return nil
+	case rsp.StatusCode == http.StatusRequestEntityTooLarge:
+		return errWebhookTooBig
+	case rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode/100 == 5:
+		return errWebhookTempFail
+	default:
+		return errWebhookRejected
+	}
+}
+
+type webhookWriter struct {
+	bytes.Buffer
+	f        *HTTPForwarder
+	statusCb func(rcpt string, status *smtp.SMTPError)
+}
+
+func (w *webhookWriter) Close() error {
+	for _, rcpt := range w.f.rcpts {
+		w.statusCb(rcpt, w.f.post(rcpt, w.Bytes()))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package ensmail
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestHTTPForwarder(t *testing.T) {
+	const msg = "Subject: hi\r\n\r\nbody\r\n"
+
+	var (
+		mu       sync.Mutex
+		received = make(map[string]string) // k: to, v: message
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var meta struct{ From, To string }
+		if err := json.Unmarshal([]byte(r.FormValue("metadata")), &meta); err != nil {
+			t.Error("invalid metadata:", err)
+		}
+		if meta.From != "sender@public.com" {
+			t.Errorf("want from: sender@public.com, got: %s", meta.From)
+		}
+
+		f, _, err := r.FormFile("message")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, _ := io.ReadAll(f)
+		mu.Lock()
+		received[meta.To] = string(b)
+		mu.Unlock()
+
+		switch strings.Split(meta.To, "@")[0] {
+		case "ok":
+			w.WriteHeader(http.StatusAccepted)
+		case "big":
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		case "busy":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	f := NewHTTPForwarder(srv.URL, srv.Client())
+	f.Mail("sender@public.com", nil)
+	exp := map[string]*smtp.SMTPError{
+		"ok@resolved.test":      nil,
+		"big@resolved.test":     errWebhookTooBig,
+		"busy@resolved.test":    errWebhookTempFail,
+		"unknown@resolved.test": errWebhookRejected,
+	}
+	for to := range exp {
+		f.Rcpt(to)
+	}
+
+	statuses := make(map[string]*smtp.SMTPError)
+	w, err := f.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, msg)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for to, status := range exp {
+		if got, ok := statuses[to]; !ok || got != status {
+			t.Errorf("%s: want status: %v, got: %v", to, status, got)
+		}
+		if received[to] != msg {
+			t.Errorf("%s: want message: %q, got: %q", to, msg, received[to])
+		}
+	}
+
+	// Unreachable webhooks are a temporary failure.
+	srv.Close()
+	f.Reset()
+	f.Rcpt("ok@resolved.test")
+	w, _ = f.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	w.Close()
+	if statuses["ok@resolved.test"] != errWebhookUnavailable {
+		t.Errorf("want status: %v, got: %v", errWebhookUnavailable, statuses["ok@resolved.test"])
+	}
+}
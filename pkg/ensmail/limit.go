@@ -0,0 +1,156 @@
+package ensmail
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// LimitingCaller is a bind.ContractCaller which makes at most n
+// concurrent calls to another caller, so bursts of resolutions, and
+// of the other lookups made through it (such as policy and reverse
+// lookups), queue rather than flood the web3 provider.  Queued calls
+// fail with ctx's error if ctx is done before they're made.
+type LimitingCaller struct {
+	bind.ContractCaller
+	sem chan struct{}
+}
+
+func NewLimitingCaller(caller bind.ContractCaller, n int) *LimitingCaller {
+	return &LimitingCaller{
+		ContractCaller: caller,
+		sem:            make(chan struct{}, n),
+	}
+}
+
+// CodeAt implements bind.ContractCaller.
+func (c *LimitingCaller) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.release()
+	return c.ContractCaller.CodeAt(ctx, contract, blockNumber)
+}
+
+// CallContract implements bind.ContractCaller.
+func (c *LimitingCaller) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.release()
+	return c.ContractCaller.CallContract(ctx, call, blockNumber)
+}
+
+// acquire waits for a call slot, until ctx is done.
+func (c *LimitingCaller) acquire(ctx context.Context) error {
+	select {
+	case c.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *LimitingCaller) release() {
+	<-c.sem
+}
+
+// Deduplicate returns a ResolveFunc which shares one call to resolve
+// between concurrent resolutions of the same name (by normalized
+// name, so "Alice" and "alice" share a call), so bursts of mail to a
+// name whose cache entry is cold (see CachingResolver) make a single
+// set of RPC calls.  The shared call isn't bound to any one caller's
+// ctx: it's canceled once every caller waiting on it has stopped
+// waiting (each once its own ctx is done), so it runs for as long as
+// the longest waiter.  A panicking call fails each of its callers,
+// rather than leaving them waiting.
+func Deduplicate(resolve ResolveFunc) ResolveFunc {
+	var (
+		mu       sync.Mutex
+		inFlight = make(map[string]*dedupCall)
+	)
+	return func(ctx context.Context, name string) (string, error) {
+		key, err := nameKey(name)
+		if err != nil {
+			return resolve(ctx, name)
+		}
+
+		mu.Lock()
+		c, ok := inFlight[key]
+		if !ok {
+			callCtx, cancel := context.WithCancel(detachedContext{ctx})
+			c = &dedupCall{done: make(chan struct{}), cancel: cancel}
+			inFlight[key] = c
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						c.err = fmt.Errorf("resolve panicked: %v", r)
+					}
+					mu.Lock()
+					if inFlight[key] == c {
+						delete(inFlight, key)
+					}
+					mu.Unlock()
+					cancel()
+					close(c.done)
+				}()
+				c.res, c.err = ResolveDetailed(callCtx, resolve, name)
+			}()
+		}
+		c.waiters++
+		mu.Unlock()
+
+		select {
+		case <-c.done:
+			return c.result(ctx)
+		case <-ctx.Done():
+			mu.Lock()
+			// Later resolutions make a new call, rather than joining
+			// a canceled one.
+			if c.waiters--; c.waiters == 0 {
+				if inFlight[key] == c {
+					delete(inFlight, key)
+				}
+				c.cancel()
+			}
+			mu.Unlock()
+			return "", ctx.Err()
+		}
+	}
+}
+
+// dedupCall is a resolution shared by Deduplicate.
+type dedupCall struct {
+	done   chan struct{}
+	res    ResolveResult
+	err    error
+	cancel context.CancelFunc
+
+	waiters int // guarded by Deduplicate's mu
+}
+
+// detachedContext has the values of its Context, but not its
+// deadline or cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// result returns the resolution of c, once done, reporting its
+// ResolveResult to ctx.
+func (c *dedupCall) result(ctx context.Context) (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	reportResult(ctx, c.res)
+	return c.res.Email, nil
+}
@@ -0,0 +1,213 @@
+package ensmail
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// blockingCaller is a bind.ContractCaller whose calls signal started,
+// then wait on release, tracking the most calls made at once.
+type blockingCaller struct {
+	started chan struct{}
+	release chan struct{}
+
+	current, max int32
+}
+
+func (c *blockingCaller) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	return c.CallContract(ctx, ethereum.CallMsg{}, blockNumber)
+}
+
+func (c *blockingCaller) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	n := atomic.AddInt32(&c.current, 1)
+	defer atomic.AddInt32(&c.current, -1)
+	for {
+		m := atomic.LoadInt32(&c.max)
+		if n <= m || atomic.CompareAndSwapInt32(&c.max, m, n) {
+			break
+		}
+	}
+	c.started <- struct{}{}
+	<-c.release
+	return nil, nil
+}
+
+func TestLimitingCaller(t *testing.T) {
+	t.Run("limit", func(t *testing.T) {
+		const limit, calls = 3, 20
+		backend := &blockingCaller{started: make(chan struct{}), release: make(chan struct{})}
+		c := NewLimitingCaller(backend, limit)
+
+		var wg sync.WaitGroup
+		for i := 0; i < calls; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var err error
+				if i%2 == 0 {
+					_, err = c.CallContract(context.Background(), ethereum.CallMsg{}, nil)
+				} else {
+					_, err = c.CodeAt(context.Background(), common.Address{}, nil)
+				}
+				if err != nil {
+					t.Error("unexpected err:", err)
+				}
+			}(i)
+		}
+
+		// Each released call lets one queued call start.
+		for i := 0; i < limit; i++ {
+			<-backend.started
+		}
+		for i := limit; i < calls; i++ {
+			backend.release <- struct{}{}
+			<-backend.started
+		}
+		close(backend.release)
+		wg.Wait()
+
+		if backend.max != limit {
+			t.Errorf("want max concurrency: %d, got: %d", limit, backend.max)
+		}
+	})
+
+	// Queued calls give up once their context is done.
+	t.Run("deadline", func(t *testing.T) {
+		backend := &blockingCaller{started: make(chan struct{}), release: make(chan struct{})}
+		c := NewLimitingCaller(backend, 1)
+		defer close(backend.release)
+
+		go c.CallContract(context.Background(), ethereum.CallMsg{}, nil)
+		<-backend.started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := c.CallContract(ctx, ethereum.CallMsg{}, nil); err != context.DeadlineExceeded {
+			t.Errorf("want err: %v, got: %v", context.DeadlineExceeded, err)
+		}
+	})
+}
+
+func TestDeduplicate(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	resolve := Deduplicate(func(ctx context.Context, name string) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "alice@resolved.test", nil
+	})
+
+	const lookups = 50
+	var started, wg sync.WaitGroup
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		started.Add(1)
+		name := "alice"
+		if i%2 == 1 {
+			name = "ALICE"
+		}
+		go func() {
+			defer wg.Done()
+			started.Done()
+			if got, err := resolve(context.Background(), name); err != nil || got != "alice@resolved.test" {
+				t.Errorf("want: alice@resolved.test, got: %s, %v", got, err)
+			}
+		}()
+	}
+	started.Wait()
+	// Let every lookup join the in-flight call before it returns.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("want calls: 1, got: %d", calls)
+	}
+
+	// Once the call returns, later lookups make a new call.
+	if _, err := resolve(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("want calls: 2, got: %d", calls)
+	}
+
+	// The shared call outlives the caller which started it, while
+	// others still wait on it.
+	started2, canceled := make(chan struct{}), make(chan error, 1)
+	release = make(chan struct{})
+	resolve = Deduplicate(func(ctx context.Context, name string) (string, error) {
+		close(started2)
+		select {
+		case <-release:
+			return name + "@resolved.test", nil
+		case <-ctx.Done():
+			canceled <- ctx.Err()
+			return "", ctx.Err()
+		}
+	})
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := resolve(first, "bob")
+		firstErr <- err
+	}()
+	<-started2
+	second := make(chan string, 1)
+	go func() {
+		got, _ := resolve(context.Background(), "bob")
+		second <- got
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancelFirst()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("want err: %v, got: %v", context.Canceled, err)
+	}
+	close(release)
+	if got := <-second; got != "bob@resolved.test" {
+		t.Errorf("want: bob@resolved.test, got: %s", got)
+	}
+
+	// Once every caller stops waiting, the shared call is canceled.
+	started2, release = make(chan struct{}), make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started2
+		cancel()
+	}()
+	if _, err := resolve(ctx, "carol"); err != context.Canceled {
+		t.Errorf("want err: %v, got: %v", context.Canceled, err)
+	}
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Errorf("want call err: %v, got: %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("shared call not canceled")
+	}
+
+	// A panicking call fails its callers, and later lookups make a
+	// new call.
+	var panics int32
+	resolve = Deduplicate(func(ctx context.Context, name string) (string, error) {
+		if atomic.AddInt32(&panics, 1) == 1 {
+			panic("boom")
+		}
+		return name + "@resolved.test", nil
+	})
+	if _, err := resolve(context.Background(), "dave"); err == nil {
+		t.Error("want err")
+	}
+	if got, err := resolve(context.Background(), "dave"); err != nil || got != "dave@resolved.test" {
+		t.Errorf("want: dave@resolved.test, got: %s, %v", got, err)
+	}
+}
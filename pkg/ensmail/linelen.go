@@ -0,0 +1,74 @@
+package ensmail
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errLineTooLong = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+	Message:      "Message contains a line which is too long",
+}
+
+// lineWriter writes to w, converting bare LF line endings to CRLF if
+// crlf is set.  If max is non-zero, writing a line longer than max
+// bytes (excluding its line ending) fails with errLineTooLong.
+type lineWriter struct {
+	w    io.Writer
+	max  int
+	crlf bool
+
+	lineLen int  // bytes written of the current line
+	cr      bool // last byte written was CR
+}
+
+func (lw *lineWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if err := lw.writeLine(p); err != nil {
+				return n, err
+			}
+			return n + len(p), nil
+		}
+
+		if err := lw.writeLine(p[:i]); err != nil {
+			return n, err
+		}
+		lineLen, end := lw.lineLen, "\n"
+		if lw.cr {
+			lineLen--
+		} else if lw.crlf {
+			end = "\r\n"
+		}
+		if lw.max > 0 && lineLen > lw.max {
+			return n, errLineTooLong
+		}
+		if _, err := io.WriteString(lw.w, end); err != nil {
+			return n, err
+		}
+		lw.lineLen, lw.cr = 0, false
+		n += i + 1
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// writeLine writes b, which doesn't contain LF, as part of the
+// current line.
+func (lw *lineWriter) writeLine(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	lw.lineLen += len(b)
+	lw.cr = b[len(b)-1] == '\r'
+	// The last byte may be the CR of the line ending.
+	if lw.max > 0 && lw.lineLen > lw.max+1 {
+		return errLineTooLong
+	}
+	_, err := lw.w.Write(b)
+	return err
+}
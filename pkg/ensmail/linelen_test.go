@@ -0,0 +1,47 @@
+package ensmail
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		max  int
+		crlf bool
+		in   []string // written in parts
+		exp  string
+		err  error
+	}{
+		{"crlf", 0, true, []string{"a\r\nb\r\n"}, "a\r\nb\r\n", nil},
+		{"bareLF", 0, true, []string{"a\nb\n\nc"}, "a\r\nb\r\n\r\nc", nil},
+		{"mixed", 0, true, []string{"a\r\nb\nc\r\n"}, "a\r\nb\r\nc\r\n", nil},
+		{"mixedUnnormalized", 0, false, []string{"a\r\nb\nc\r\n"}, "a\r\nb\nc\r\n", nil},
+		{"splitCRLF", 0, true, []string{"a\r", "\nb\r", "c\n"}, "a\r\nb\rc\r\n", nil},
+		{"splitLines", 0, true, []string{"ab", "c\nd", "e\n"}, "abc\r\nde\r\n", nil},
+		{"maxLen", 3, true, []string{"abc\r\n", "de", "f\n"}, "abc\r\ndef\r\n", nil},
+		{"maxLenUnnormalized", 3, false, []string{"abc\r\n", "de", "f\n"}, "abc\r\ndef\n", nil},
+		{"tooLong", 3, false, []string{"abc\r\n", "ab", "cd\r\n"}, "abc\r\nab", errLineTooLong},
+		{"tooLongCR", 3, false, []string{"abc\r\r\n"}, "", errLineTooLong},
+		{"tooLongUnterminated", 3, false, []string{"abcdefgh"}, "", errLineTooLong},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			lw := &lineWriter{w: &out, max: test.max, crlf: test.crlf}
+
+			var err error
+			for _, part := range test.in {
+				if _, err = lw.Write([]byte(part)); err != nil {
+					break
+				}
+			}
+			if err != test.err {
+				t.Errorf("want err: %v, got: %v", test.err, err)
+			}
+			if got := out.String(); got != test.exp {
+				t.Errorf("want: %q, got: %q", test.exp, got)
+			}
+		})
+	}
+}
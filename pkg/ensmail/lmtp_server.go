@@ -1,13 +1,24 @@
 package ensmail
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"runtime/trace"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/emersion/go-smtp"
 	"github.com/go-kit/log"
@@ -23,121 +34,1147 @@ type ResolveFunc func(context.Context, string) (string, error)
 type NewForwarderClient func() (ForwarderClient, error)
 
 // ForwarderClient receives SMTP commands to forward emails.
+// LMTPData's statusCb is called with each recipient's status: nil, or
+// a 2xx status (whose reply is logged), on success.
 type ForwarderClient interface {
 	Mail(from string, opts *smtp.MailOptions) error
 	Rcpt(to string) error
 	LMTPData(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error)
 	Reset() error
 	Close() error
+	Extension(ext string) (bool, string)
 }
 
+// msgIDDomain is the right hand side of generated Message-IDs.
+const msgIDDomain = "ensmail.local"
+
 // LMTPResolveForwarder is an LMTP server which receives mail on a
 // unix socket, resolves all mail receipients of that mail to another
 // email address (recipients are based on the SMTP envelope "RCPT TO"
 // command), and forwards the mail, with newly resolved recipients,
 // over LMTP to a "Forwarder".
 type LMTPResolveForwarder struct {
-	logger       log.Logger
-	srv          *smtp.Server
-	resolver     ResolveFunc
-	newForwarder NewForwarderClient
+	logger        log.Logger
+	srv           *smtp.Server
+	resolver      ResolveFunc
+	newForwarder  NewForwarderClient
+	dataSem       chan struct{} // nil if forward DATA concurrency is unlimited
+	dataSemWait   time.Duration // wait for dataSem at DATA
+	sanitizer     *receivedSanitizer
+	resolveAtData bool
+	policy        *RelayPolicy
+	retry         forwardRetry
+	auditLog      *auditLog
+	namePolicy    NamePolicyFunc
+	maxRcpts      int
+	fanIn         *fanInMonitor
+	errCodes      ErrorCodeMap
+	msgIDMode     MessageIDMode
+	stripBcc      bool
+	filter        MessageFilter
+	verp          string
+	verpWorkers   int
+	maxInMemory   int64
+	signKey       ed25519.PrivateKey
+	maxLineLen    int
+	normalizeCRLF bool
+	queue         *RetryQueue
+	dataTimeout   time.Duration
+	statusTimeout time.Duration
+	failAll       bool
+	auth          AuthFunc
+	stats         *serverStats
+	onResolve     ResolveResultFunc
+	proxyTrusted  []*net.IPNet
+	retryAfter    retryHints
+
+	resolutionHeaders bool
+	subdomainBase     string
+	headerLogger      log.Logger
+	headerNames       []string
+	resolveTimeout    time.Duration
+
+	shutdown     chan struct{} // closed once Shutdown begins
+	shutdownOnce sync.Once
+	txActive     *int64 // open transactions, updated atomically (see session.beginTx)
+}
+
+// serverStats are the aggregate counts of a server's lifetime, which
+// are logged by Close.  Fields are updated atomically, as they're
+// shared by every session.
+type serverStats struct {
+	messages  int64 // DATA commands
+	resolved  int64 // recipients resolved
+	delivered int64 // recipient DATA statuses which succeeded
+	failed    int64 // recipients rejected at RCPT, or whose DATA status failed
+}
+
+func (st *serverStats) log(logger log.Logger) {
+	logger.Log("summary", "lifetime",
+		"messages", atomic.LoadInt64(&st.messages),
+		"resolved", atomic.LoadInt64(&st.resolved),
+		"delivered", atomic.LoadInt64(&st.delivered),
+		"failed", atomic.LoadInt64(&st.failed))
+}
+
+// maxRetryBackoff bounds the total time a message's forward retries
+// (see WithForwardRetry) wait.
+const maxRetryBackoff = 30 * time.Second
+
+// errRetryBackoffExceeded abandons retries which would wait longer
+// than maxRetryBackoff in total.
+var errRetryBackoffExceeded = errors.New("retry backoff exceeded")
+
+// forwardRetry configures retries of forwards which fail with a
+// transient status.
+type forwardRetry struct {
+	attempts int
+	backoff  time.Duration
+}
+
+// LMTPServerOption configures optional LMTPResolveForwarder behavior.
+type LMTPServerOption func(*LMTPResolveForwarder)
+
+// WithDataConcurrency limits the number of concurrent forward DATA
+// operations to n.  While n DATA operations are in-flight, new MAIL
+// commands are rejected with a temporary failure, so senders back off
+// rather than pile up waiting on a slow forwarder.  Transactions which
+// were accepted before the limit was reached wait for a DATA
+// operation to complete (for up to a minute) before they're
+// temporarily failed too.
+func WithDataConcurrency(n int) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.dataSem = make(chan struct{}, n)
+	}
+}
+
+// WithReceivedSanitizer strips (or marks, depending on mode) all
+// Received headers of forwarded messages, except the first trusted
+// headers (which are added by trusted upstream servers), and removes
+// any X-ENSMail headers.  A Received header documenting ensmail's own
+// hop is then prepended to the message.
+func WithReceivedSanitizer(mode ReceivedSanitizeMode, trusted int) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.sanitizer = &receivedSanitizer{mode: mode, trusted: trusted}
+	}
+}
+
+// WithResolveAtData defers recipient resolution from RCPT to DATA.
+// Every syntactically valid recipient is accepted at RCPT, and is
+// then resolved and forwarded once the message has been received,
+// with resolution failures reported as that recipient's DATA status.
+//
+// This trades early rejection for atomicity: a transient resolution
+// error no longer rejects a recipient before the sender has committed
+// to the message, but every message body is received even when no
+// recipient resolves, and senders learn of resolution failures only
+// after DATA.
+func WithResolveAtData() LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.resolveAtData = true
+	}
+}
+
+// WithRelayPolicy enforces p on every resolved recipient.
+// Recipients which violate p are rejected (at RCPT, or at DATA if
+// resolution is deferred).
+func WithRelayPolicy(p *RelayPolicy) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.policy = p
+	}
+}
+
+// WithForwardRetry retries forwarding a message, up to attempts
+// times, to recipients whose forward DATA status is a transient (4xx)
+// failure.  Each retry re-dials the forwarder and re-sends the
+// message, after waiting backoff (doubled after every retry).  Only
+// the final status is reported to the sender.  Permanent (5xx)
+// failures are never retried.  As the waits hold a DATA slot, retries
+// are abandoned (and the transient statuses reported, or queued, see
+// WithRetryQueue) once they'd wait more than 30s in total, or the
+// server is shutting down (see Shutdown).
+//
+// As messages must be re-sent, each message is held in memory while
+// it's forwarded.
+func WithForwardRetry(attempts int, backoff time.Duration) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.retry = forwardRetry{attempts: attempts, backoff: backoff}
+	}
+}
+
+// WithRetryQueue queues messages for recipients whose forward DATA
+// status is a transient (4xx) failure (after any WithForwardRetry
+// retries) in q, and reports them delivered to the sender, so ensmail
+// rather than the sender retries their delivery.  q must be Run for
+// queued messages to be retried.  Recipients are reported with their
+// transient status if the message can't be queued.
+//
+// Queued messages are re-forwarded with the MAIL parameters (such as
+// SMTPUTF8) of their original transaction.  Per-recipient (VERP)
+// forwards aren't queued.
+func WithRetryQueue(q *RetryQueue) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.queue = q
+	}
+}
+
+// WithAuditLog writes an audit record of every transaction (its
+// sender, and each recipient's resolution and final status) to w, as
+// one JSON object per line.  Records are written asynchronously, in
+// the order transactions complete, and Close waits until they're
+// written (so w may be closed after Close returns, though records of
+// transactions ending after Close are still written to it).
+func WithAuditLog(w io.Writer) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.auditLog = newAuditLog(w, l.logger)
+	}
+}
+
+// WithNamePolicy enforces the NamePolicy (returned by fn) of each
+// recipient's name.  Recipients whose policy the message violates are
+// rejected (at RCPT, or at DATA if resolution is deferred), and
+// recipients whose MaxSize the message read exceeds are rejected at
+// DATA.  See CachePolicies to cache fn's lookups.
+func WithNamePolicy(fn NamePolicyFunc) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.namePolicy = fn
+	}
+}
+
+// WithMaxRecipients accepts at most n recipients per transaction.
+// Further recipients are temporarily rejected, so the sender retries
+// them in a later transaction, while the accepted recipients are
+// forwarded as usual.
+func WithMaxRecipients(n int) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.maxRcpts = n
+	}
+}
+
+// WithFanInAlert logs a warning (and increments a metric) when more
+// than threshold distinct ENS names resolve to the same address
+// within window.
+func WithFanInAlert(threshold int, window time.Duration) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.fanIn = newFanInMonitor(threshold, window, l.logger)
+	}
+}
+
+// WithErrorCodes overrides the SMTP replies returned for resolution
+// errors (see DefaultErrorCodes) with those in m.
+func WithErrorCodes(m ErrorCodeMap) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		for err, reply := range m {
+			l.errCodes[err] = reply
+		}
+	}
+}
+
+// WithMessageID sets how forwarded messages' Message-ID headers are
+// handled.  By default, they are preserved.
+func WithMessageID(mode MessageIDMode) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.msgIDMode = mode
+	}
+}
+
+// WithStripBcc removes Bcc and Resent-Bcc headers from forwarded
+// messages, which would otherwise expose their blind recipients.
+func WithStripBcc() LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.stripBcc = true
+	}
+}
+
+// WithMessageFilter filters messages with f before they are
+// forwarded.  As f must read the whole message, messages are held in
+// memory while filtered.
+func WithMessageFilter(f MessageFilter) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.filter = f
+	}
+}
+
+// WithVERP forwards each recipient in its own transaction, whose
+// envelope sender is returnPath with the recipient's original (ENS)
+// address VERP encoded (see VERPEncode), so bounces identify the ENS
+// name which failed.  As each transaction re-sends the message,
+// messages are held in memory while forwarded.  Transient failures
+// aren't retried.
+func WithVERP(returnPath string) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.verp = returnPath
+	}
 }
 
-func NewLMTPServer(logger log.Logger, r ResolveFunc, nf NewForwarderClient) (*LMTPResolveForwarder, error) {
+// WithForwardConcurrency forwards up to n of a message's per-recipient
+// transactions (see WithVERP) at once, each over its own forwarder
+// connection.  By default, they are forwarded one at a time.
+func WithForwardConcurrency(n int) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.verpWorkers = n
+	}
+}
+
+// WithMaxInMemory limits messages held while forwarded (for retries,
+// filtering, or per-recipient transactions) to n bytes of memory.
+// Larger messages are held in a temporary file, which is removed once
+// the message is forwarded.  By default, messages are always held in
+// memory.
+func WithMaxInMemory(n int64) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.maxInMemory = n
+	}
+}
+
+// WithResolutionSigning adds an X-ENSMail-Resolved header, and an
+// X-ENSMail-Signature header signed with key, for each recipient of
+// forwarded messages, so the forwarding server can verify (see
+// VerifyResolution) that ensmail resolved the recipient.  Every
+// recipient of a forward transaction is sent the headers of all its
+// recipients, unless recipients are forwarded separately (see
+// WithVERP).
+func WithResolutionSigning(key ed25519.PrivateKey) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.signKey = key
+	}
+}
+
+// WithMaxLineLength rejects messages with a line longer than maxLen
+// bytes (RFC 5322 limits lines to 998).  As they must be rejected
+// before they're forwarded, messages are held (see WithMaxInMemory)
+// while forwarded.
+func WithMaxLineLength(maxLen int) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.maxLineLen = maxLen
+	}
+}
+
+// WithCRLFNormalization converts bare LF line endings of forwarded
+// messages to CRLF, for forwarders which pass messages on unchanged
+// (such as HTTPForwarder) to consumers which strictly require CRLF.
+// LMTP forwarders already convert them as they send the message.
+func WithCRLFNormalization() LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.normalizeCRLF = true
+	}
+}
+
+// WithDataReadTimeout limits the time taken to receive a message's
+// content to d.  Otherwise, a sender which trickles in its message
+// holds its session (and a forward DATA slot, see
+// WithDataConcurrency) indefinitely.  Unlike the forward status
+// timeout, which bounds the wait on the forwarder, d bounds the wait
+// on the sender: once it expires, the message is rejected with a
+// temporary failure, and the connection is closed.
+func WithDataReadTimeout(d time.Duration) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.dataTimeout = d
+	}
+}
+
+// WithForwardStatusTimeout limits the wait for each of the
+// forwarder's DATA statuses to d (5 seconds by default): the wait
+// for the first status starts once the message is forwarded, and
+// restarts with each status.  Recipients whose status hasn't arrived
+// once it expires are temporarily failed, as the message may or may
+// not have been delivered to them.
+func WithForwardStatusTimeout(d time.Duration) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.statusTimeout = d
+	}
+}
+
+// WithFullFailureError fails the DATA of messages which fail for
+// every recipient (at RCPT or DATA) with a transaction error, in
+// addition to the recipients' own statuses.  go-smtp has replied with
+// every recipient's status by then, so the replies are unchanged, but
+// the transaction is recorded as failed (eg: in the audit log, see
+// WithAuditLog).
+func WithFullFailureError() LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.failAll = true
+	}
+}
+
+// AuthFunc validates the AUTH PLAIN credentials of a sender.  A
+// non-nil error rejects the credentials.
+type AuthFunc func(username, password string) error
+
+// WithAuth requires senders connected over TLS (see ServeTLS) to
+// authenticate with credentials accepted by fn before MAIL.  Senders
+// on unix sockets (see Serve) remain unauthenticated: go-smtp only
+// allows AUTH over TLS.  Without WithAuth, AUTH is rejected.
+func WithAuth(fn AuthFunc) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.auth = fn
+	}
+}
+
+// ResolveResultFunc is called with the result of every recipient
+// resolution: the recipient's name, and its resolved address or
+// resolution error.  IsUserFault distinguishes errors caused by a
+// name's configuration from system faults.
+type ResolveResultFunc func(name, resolved string, err error)
+
+// WithOnResolveResult calls fn after every recipient resolution, so
+// operators can wire their own alerting or aggregation (for example,
+// on the rate of system faults).  fn is called synchronously by
+// sessions, so it must be fast, and safe for concurrent use.
+func WithOnResolveResult(fn ResolveResultFunc) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.onResolve = fn
+	}
+}
+
+// WithSubdomainNames resolves recipients at a subdomain of base by
+// the subdomain, rather than by their local-part, which is ignored:
+// with base "ensmail.test", "x@alice.ensmail.test" resolves the name
+// "alice" (so alice.eth).  Recipients at base itself, or at other
+// domains, are still resolved by their local-part.
+func WithSubdomainNames(base string) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.subdomainBase = strings.Trim(base, ".")
+	}
+}
+
+// WithHeaderLogging logs the header fields named names (such as
+// "From", "To", "Subject", and "Message-ID") of each message to
+// logger, for debugging deliverability.  Fields are logged as
+// received, before ensmail's own header changes.  Other fields, and
+// message bodies, are never logged.
+func WithHeaderLogging(logger log.Logger, names ...string) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.headerLogger = logger
+		l.headerNames = make([]string, len(names))
+		for i, name := range names {
+			l.headerNames[i] = strings.TrimSpace(name)
+		}
+	}
+}
+
+// WithResolveTimeout bounds each recipient's resolution (and policy
+// lookup, see WithNamePolicy) to d, so one hung lookup fails fast
+// (with context.DeadlineExceeded, see DefaultErrorCodes) rather than
+// holding up the session's other recipients.
+func WithResolveTimeout(d time.Duration) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.resolveTimeout = d
+	}
+}
+
+func NewLMTPServer(logger log.Logger, r ResolveFunc, nf NewForwarderClient, opts ...LMTPServerOption) (*LMTPResolveForwarder, error) {
 	l := LMTPResolveForwarder{
 		logger:       log.With(logger, "app", "ensmail"),
 		resolver:     r,
 		newForwarder: nf,
+		errCodes:     make(ErrorCodeMap, len(DefaultErrorCodes)),
+		stats:        new(serverStats),
+		shutdown:     make(chan struct{}),
+		txActive:     new(int64),
+		dataSemWait:  maxDataSemWait,
+	}
+	for err, reply := range DefaultErrorCodes {
+		l.errCodes[err] = reply
+	}
+	for _, opt := range opts {
+		opt(&l)
 	}
 	// TODO: set timeouts? set max bytes received?
 	l.srv = smtp.NewServer(&l)
 	l.srv.LMTP = true
+	// SMTPUTF8 is advertised, but only accepted for a message if the
+	// forwarder also supports it (see session.Mail).
+	l.srv.EnableSMTPUTF8 = true
 	return &l, nil
 }
 
 // Serve accepts incoming LMTP connections on the unix domain socket
-// listener l.  Serve blocks until Close is called.
+// listener l.  Serve blocks until Close is called.  Serve (and
+// ServeTLS) may be called concurrently with multiple listeners, which
+// share the server's resolver and forwarder.
 func (s *LMTPResolveForwarder) Serve(l net.Listener) error {
 	if l.Addr().Network() != "unix" {
 		return errors.New("not a unix domian socket listener")
 	}
 	s.logger.Log("serve", fmt.Sprintf("%s://%s", l.Addr().Network(), l.Addr().String()))
-	return s.srv.Serve(l)
+	return s.srv.Serve(sessionListener{l})
+}
+
+// ServeTLS accepts incoming LMTP connections on the TCP listener l,
+// over TLS configured by config.  Unless senders are required to
+// authenticate (see WithAuth), config should require and verify client
+// certificates.  Behind a load balancer, the client's address may be
+// read from PROXY protocol headers (see WithProxyProtocol).  ServeTLS
+// blocks until Close is called.
+func (s *LMTPResolveForwarder) ServeTLS(l net.Listener, config *tls.Config) error {
+	if l.Addr().Network() != "tcp" {
+		return errors.New("not a tcp listener")
+	}
+	s.logger.Log("serve", fmt.Sprintf("%s+tls://%s", l.Addr().Network(), l.Addr().String()))
+	if len(s.proxyTrusted) > 0 {
+		l = proxyListener{l, s.proxyTrusted}
+	}
+	return s.srv.Serve(tls.NewListener(sessionListener{l}, config))
 }
 
 // Close immediately closes all active server connections, and causes
-// Serve to return.
+// all Serve and ServeTLS calls to return, once queued audit records
+// (see WithAuditLog) are written.  A summary of the messages
+// and recipients handled over the server's lifetime is logged, as
+// metrics may not have been scraped since the last of them.
 func (s *LMTPResolveForwarder) Close() error {
 	s.logger.Log("serve", "close")
-	return s.srv.Close()
+	err := s.srv.Close()
+	if s.auditLog != nil {
+		s.auditLog.close()
+	}
+	s.stats.log(s.logger)
+	return err
+}
+
+// Shutdown gracefully closes the server: new transactions (MAIL) are
+// temporarily rejected with 421, open transactions, from an accepted
+// MAIL until the message is forwarded (and its audit record written),
+// or the transaction is reset or its session ends, are completed, and
+// the server is then closed, as by Close.  Callers should stop
+// accepting new connections (by closing the listeners of Serve and
+// ServeTLS) first.  If ctx is done before the open transactions
+// complete, the server is closed immediately, and ctx's error is
+// returned.
+func (s *LMTPResolveForwarder) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+	s.logger.Log("serve", "shutdown", "tx_active", atomic.LoadInt64(s.txActive))
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(s.txActive) > 0 {
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return s.Close()
 }
 
+// maxDataSemWait is the longest DATA waits for a forward DATA operation
+// to complete, when they're limited by WithDataConcurrency.
+const maxDataSemWait = time.Minute
+
+// shutdownPollInterval is the interval at which Shutdown checks
+// whether open transactions have completed.
+const shutdownPollInterval = 50 * time.Millisecond
+
 type session struct {
-	logger     log.Logger
-	resolver   ResolveFunc
-	unresolved map[string]string // k: resolved addr, v: unresolved addr
-	forwarder  ForwarderClient
+	id          string
+	hostname    string // from LHLO
+	remoteAddr  string
+	logger      log.Logger
+	msgID       string     // set by Mail for each transaction
+	txLogger    log.Logger // logger with msgID context
+	resolver    ResolveFunc
+	unresolved  map[string]string // k: resolved addr, v: unresolved addr
+	forwarder   ForwarderClient
+	newFwdr     NewForwarderClient
+	dataSem     chan struct{}
+	dataSemWait time.Duration
+	sanitizer   *receivedSanitizer
+	policy      *RelayPolicy
+	from        string // MAIL FROM of current transaction
+	mailOpts    *smtp.MailOptions
+	retry       forwardRetry
+	auditLog    *auditLog
+	audit       *auditRecord // audit record of current transaction
+	namePolicy  NamePolicyFunc
+	maxRcpts    int
+	rcpts       int // accepted rcpts of current transaction
+	fanIn       *fanInMonitor
+	errCodes    ErrorCodeMap
+	msgIDMode   MessageIDMode
+	stripBcc    bool
+	filter      MessageFilter
+	verp        string
+	verpWorkers int
+	maxInMemory int64
+	signKey     ed25519.PrivateKey
+	stages      stageTimes // of current transaction
+
+	maxLineLen    int
+	normalizeCRLF bool
+
+	resolveAtData bool
+	pending       []string // rcpts awaiting resolution at DATA
+
+	queue *RetryQueue
+
+	conn          net.Conn // nil if not accepted by Serve or ServeTLS
+	dataTimeout   time.Duration
+	statusTimeout time.Duration
+
+	failAll bool
+	outcome txOutcome // of current transaction
+
+	auth         AuthFunc
+	authRequired bool // set for TLS sessions if auth is set
+	authUser     string
+
+	stats     *serverStats
+	onResolve ResolveResultFunc
+
+	retryAfter retryHints
+
+	resolutionHeaders bool
+	resolutions       map[string]ResolveResult // k: resolved addr, of current transaction
+
+	// NamePolicy MaxSize of the current transaction's recipients
+	// which have one, enforced on the message read at DATA.
+	maxSizes map[string]int // k: resolved addr
+
+	subdomainBase string
+
+	headerLogger log.Logger
+	headerNames  []string
+
+	resolveTimeout time.Duration
+
+	shutdown <-chan struct{}
+	txActive *int64
+	txOpen   int32 // 1 from an accepted MAIL until Reset or Logout, updated atomically
+
+	// runtime/trace task of the current transaction, whose resolve
+	// and forward stages are traced as regions (see Mail).
+	traceTask *trace.Task
+	traceCtx  context.Context
+
+	// Held by LMTPData.  A chunked (BDAT) message is forwarded
+	// concurrently with the connection's commands, so Reset and
+	// Logout, which RSET or a disconnect may call mid-message, wait
+	// for its forward to stop.
+	dataMu sync.Mutex
 }
 
 // NewSession implements the smtp.Backend interface, and is called for
 // each new connection made to LMTP server.  A new forwarder client is
-// created for each new session.
+// created for each new session.  The client's LHLO hostname and
+// remote address are included in all of the session's logs.
 func (s *LMTPResolveForwarder) NewSession(c smtp.ConnectionState, hostname string) (smtp.Session, error) {
 	fwdr, err := s.newForwarder()
 	if err != nil {
 		s.logger.Log("call", "s.newForwarder", "err", err)
+		if errors.Is(err, errForwardUnavailable) {
+			err = s.retryAfter.reply(TempfailForwarderDown, errForwardUnavailable)
+		}
 		return nil, err
 	}
+	openForwarders.Inc()
+	activeSessions.Inc()
+
+	sessionsByClient.WithLabelValues(clientBucket(hostname)).Inc()
+
+	var remoteAddr string
+	if c.RemoteAddr != nil {
+		remoteAddr = c.RemoteAddr.String()
+	}
 
+	id := uuid.New().String()[:8]
+	logger := log.With(s.logger, "sessid", id, "lhlo", hostname, "remote", remoteAddr)
 	return &session{
-		logger:     log.With(s.logger, "sessid", uuid.New().String()[:8]),
-		resolver:   s.resolver,
-		forwarder:  fwdr,
-		unresolved: make(map[string]string),
+		id:          id,
+		hostname:    hostname,
+		remoteAddr:  remoteAddr,
+		logger:      logger,
+		txLogger:    logger,
+		resolver:    s.resolver,
+		forwarder:   fwdr,
+		newFwdr:     s.newForwarder,
+		unresolved:  make(map[string]string),
+		dataSem:     s.dataSem,
+		dataSemWait: s.dataSemWait,
+		sanitizer:   s.sanitizer,
+		policy:      s.policy,
+		retry:       s.retry,
+		auditLog:    s.auditLog,
+		namePolicy:  s.namePolicy,
+		maxRcpts:    s.maxRcpts,
+		fanIn:       s.fanIn,
+		errCodes:    s.errCodes,
+		msgIDMode:   s.msgIDMode,
+		stripBcc:    s.stripBcc,
+		filter:      s.filter,
+		verp:        s.verp,
+		verpWorkers: s.verpWorkers,
+		maxInMemory: s.maxInMemory,
+		signKey:     s.signKey,
+
+		maxLineLen:    s.maxLineLen,
+		normalizeCRLF: s.normalizeCRLF,
+
+		resolveAtData: s.resolveAtData,
+
+		queue: s.queue,
+
+		conn:          connOf(c.RemoteAddr),
+		dataTimeout:   s.dataTimeout,
+		statusTimeout: s.statusTimeout,
+
+		failAll: s.failAll,
+
+		auth:         s.auth,
+		authRequired: s.auth != nil && c.TLS.HandshakeComplete,
+
+		stats:     s.stats,
+		onResolve: s.onResolve,
+
+		retryAfter: s.retryAfter,
+
+		resolutionHeaders: s.resolutionHeaders,
+
+		subdomainBase: s.subdomainBase,
+
+		headerLogger: s.headerLogger,
+		headerNames:  s.headerNames,
+
+		resolveTimeout: s.resolveTimeout,
+
+		shutdown: s.shutdown,
+		txActive: s.txActive,
 	}, nil
 }
 
 func (s *session) Reset() {
+	s.dataMu.Lock()
+	defer s.dataMu.Unlock()
+
 	s.logger.Log("smtp", "RESET")
+	s.flushAudit()
+	s.flushOutcome()
+	s.endTx()
+	s.msgID = ""
+	s.from = ""
+	s.mailOpts = nil
+	s.rcpts = 0
+	s.stages = stageTimes{}
+	s.txLogger = s.logger
+	s.pending = nil
+	s.resolutions = nil
+	s.maxSizes = nil
+	s.endTrace()
 	s.forwarder.Reset()
 }
 
+// endTrace ends the runtime/trace task of the current transaction,
+// if any.
+func (s *session) endTrace() {
+	if s.traceTask != nil {
+		s.traceTask.End()
+		s.traceTask, s.traceCtx = nil, nil
+	}
+}
+
+// traceRegion starts a runtime/trace region of the current
+// transaction's task.  Regions are only recorded while tracing (see
+// runtime/trace.Start), and are otherwise nearly free.
+func (s *session) traceRegion(name string) *trace.Region {
+	ctx := s.traceCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return trace.StartRegion(ctx, name)
+}
+
+// AuthPlain validates username and password with the server's
+// AuthFunc (see WithAuth).  Once authenticated, the username is
+// included in all of the session's logs.
 func (s *session) AuthPlain(username, password string) error {
-	return smtp.ErrAuthUnsupported
+	if s.auth == nil {
+		return smtp.ErrAuthUnsupported
+	}
+	logger := log.With(s.logger, "smtp", "AUTH", "user", username)
+	if err := s.auth(username, password); err != nil {
+		logger.Log("err", err)
+		return errAuthInvalid
+	}
+	logger.Log("auth", "success")
+
+	s.authUser = username
+	s.logger = log.With(s.logger, "user", username)
+	s.txLogger = s.logger
+	return nil
 }
 
-func (s *session) Mail(from string, opts *smtp.MailOptions) error {
-	s.logger.Log("smtp", "MAIL", "from", from)
+// checkAuth returns errAuthRequired if the session must, but hasn't,
+// authenticated.
+func (s *session) checkAuth() error {
+	if s.authRequired && s.authUser == "" {
+		return errAuthRequired
+	}
+	return nil
+}
+
+var (
+	errForwardNoSMTPUTF8 = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+		Message:      "SMTPUTF8 not supported by forwarding server",
+	}
+	errForwardNo8BitMIME = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 3},
+		Message:      "8BITMIME not supported by forwarding server",
+	}
+	errForwardData = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 0},
+		Message:      "Forwarding server failed to accept message data, try again later",
+	}
+	errForwardIncomplete = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+		Message:      "Forwarding connection lost before delivery status",
+	}
+	errTooManyRcpts = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Too many recipients, send the rest in another transaction",
+	}
+	errShuttingDown = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Server shutting down, try again later",
+	}
+	errDataSaturated = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "System not accepting messages, try again later",
+	}
+	errAuthRequired = &smtp.SMTPError{
+		Code:         530,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Authentication required",
+	}
+	errAuthInvalid = &smtp.SMTPError{
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Authentication credentials invalid",
+	}
+	errMessageFailed = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+		Message:      "Message failed for every recipient",
+	}
+	errDataReadTimeout = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+		Message:      "Timeout receiving message data",
+	}
+	errForwardStatusTimeout = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+		Message:      "Timeout waiting for forwarding server delivery status",
+	}
+	errResolveFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+		Message:      "Failed to resolve recipient, try again later",
+	}
+	errNoRcpts = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "No valid recipients",
+	}
+)
+
+// Mail generates a message id for the new transaction, which is
+// included in all of the transaction's logs, and passes from and opts
+// to the forwarder.  If opts requires an extension (SMTPUTF8 or
+// BODY=8BITMIME) which the forwarder does not support, the message is
+// rejected, as its content can't be downgraded without modification.
+// Mail is temporarily rejected while forward DATA concurrency is
+// saturated or the server is shutting down (see Shutdown), and
+// rejected if the session must authenticate first (see WithAuth).
+//
+// TODO: DSN (RFC 3461) RET and ENVID parameters should be passed to
+// the forwarder too, so bounces reference the original envelope, but
+// go-smtp (v0.15) rejects them as unknown MAIL arguments, and
+// MailOptions has no fields for them.
+func (s *session) Mail(from string, opts *smtp.MailOptions) (err error) {
+	s.msgID = uuid.New().String()
+	s.txLogger = log.With(s.logger, "msgid", s.msgID)
+	s.endTrace()
+	s.traceCtx, s.traceTask = trace.NewTask(context.Background(), "ensmail.message")
+	trace.Log(s.traceCtx, "msgid", s.msgID)
+	s.outcome = txOutcome{}
+
+	s.from = from
+	s.mailOpts = opts
+	if s.auditLog != nil {
+		s.audit = &auditRecord{SessionID: s.id, MsgID: s.msgID, From: from}
+	}
+	s.txLogger.Log("smtp", "MAIL", "from", from)
+	logger := log.With(s.txLogger, "smtp", "MAIL", "from", from)
+
+	// The transaction is counted before checking for Shutdown, which
+	// then either waits on it, or it's rejected.
+	s.beginTx()
+	defer func() {
+		if err != nil {
+			s.endTx()
+		}
+	}()
+
+	select {
+	case <-s.shutdown:
+		logger.Log("err", errShuttingDown)
+		return errShuttingDown
+	default:
+	}
+
+	if err := s.checkAuth(); err != nil {
+		logger.Log("err", err)
+		return err
+	}
+
+	if s.dataSem != nil && len(s.dataSem) == cap(s.dataSem) {
+		logger.Log("err", errDataSaturated)
+		return s.retryAfter.reply(TempfailBackpressure, errDataSaturated)
+	}
+
+	if err := checkExtensions(s.forwarder, opts); err != nil {
+		logger.Log("err", err)
+		return err
+	}
+
 	return s.forwarder.Mail(from, opts)
 }
 
+// beginTx counts the session's transaction as open, for Shutdown to
+// wait on, until endTx.  A transaction is open from its accepted MAIL
+// until Reset (which follows DATA) or Logout, which write its audit
+// record.
+func (s *session) beginTx() {
+	if atomic.CompareAndSwapInt32(&s.txOpen, 0, 1) {
+		atomic.AddInt64(s.txActive, 1)
+	}
+}
+
+// endTx ends the session's open transaction, if any.
+func (s *session) endTx() {
+	if atomic.CompareAndSwapInt32(&s.txOpen, 1, 0) {
+		atomic.AddInt64(s.txActive, -1)
+	}
+}
+
 // Rcpt will resolve "to", and pass the resolved value to the
-// forwarder.
-func (s *session) Rcpt(to string) error {
-	logger := log.With(s.logger, "smtp", "RCPT", "to", to)
+// forwarder.  If resolution is deferred to DATA, "to" is only
+// validated and recorded.
+//
+// go-smtp advertises PIPELINING, and handles each connection's
+// commands one at a time, so replies stay in command order: a slow
+// resolution delays the replies to commands pipelined after it, but
+// never reorders them.  With WithResolveAtData, pipelined RCPTs don't
+// wait on resolution.
+func (s *session) Rcpt(to string) (err error) {
+	logger := log.With(s.txLogger, "smtp", "RCPT", "to", to)
+	defer func() {
+		// Recipients deferred to another transaction, or refused
+		// until the sender authenticates, haven't failed.
+		if err != nil && err != errTooManyRcpts && err != errAuthRequired {
+			s.outcome.add(err)
+			atomic.AddInt64(&s.stats.failed, 1)
+		}
+	}()
 
-	at := strings.LastIndex(to, "@")
-	if at <= 0 {
+	if err := s.checkAuth(); err != nil {
+		logger.Log("err", err)
+		return err
+	}
+
+	// Internationalized (RFC 6531) addresses are UTF-8, and their
+	// local-part is passed to the resolver unmodified.
+	if !strings.Contains(to, "@") || !utf8.ValidString(to) {
 		logger.Log("err", "invalid addr")
 		return fmt.Errorf("invalid recipient email: %s", to)
 	}
+	if _, ok := rcptName(to); !ok {
+		logger.Log("err", ErrEmptyName)
+		return s.errCodes.reply(ErrEmptyName)
+	}
+
+	// TODO: DSN (RFC 3461) ORCPT and NOTIFY parameters should be
+	// passed to the forwarder, with ORCPT set to the unresolved
+	// address, so bounces reference the address the sender used.
+	// go-smtp (v0.15) neither advertises DSN nor parses RCPT
+	// parameters (and its client Rcpt takes none), so this requires
+	// a go-smtp upgrade.
+	if s.maxRcpts > 0 && s.rcpts >= s.maxRcpts {
+		logger.Log("err", errTooManyRcpts)
+		return errTooManyRcpts
+	}
+
+	if s.resolveAtData {
+		s.pending = append(s.pending, to)
+		s.rcpts++
+		logger.Log("resolve", "deferred")
+		return nil
+	}
+
+	err = s.resolveRcpt(logger, to)
+	if err != nil && s.audit != nil {
+		s.audit.Rcpts = append(s.audit.Rcpts, newAuditRcpt(to, s.resolvedOf(to), "RCPT", err))
+	} else if err == nil {
+		s.rcpts++
+	}
+	return err
+}
+
+// rcptStatus returns the status at DATA of a recipient whose
+// resolution failed with err.  go-smtp replies to statuses other than
+// SMTPErrors with a permanent failure, whereas at RCPT it replies to
+// them with a temporary one, so they fail temporarily with
+// errResolveFailed instead.
+func rcptStatus(err error) error {
+	var serr *smtp.SMTPError
+	if errors.As(err, &serr) {
+		return serr
+	}
+	return errResolveFailed
+}
+
+// rcptName returns the name (local-part) of the recipient address to,
+// without the surrounding whitespace or trailing dots which some
+// clients erroneously add.  ok is false if to has no name.
+func rcptName(to string) (name string, ok bool) {
+	at := strings.LastIndex(to, "@")
+	if at < 0 {
+		return "", false
+	}
+	name = strings.TrimRightFunc(strings.TrimSpace(to[:at]), func(r rune) bool {
+		return r == '.' || unicode.IsSpace(r)
+	})
+	return name, name != ""
+}
+
+// subdomainName returns the name of the recipient address to, which
+// is its domain's subdomain of base, such as "alice" for
+// "x@alice.ensmail.test" under "ensmail.test".  ok is false if to
+// isn't at a subdomain of base.
+func subdomainName(to, base string) (name string, ok bool) {
+	domain := strings.TrimRight(strings.TrimSpace(to[strings.LastIndex(to, "@")+1:]), ".")
+	suffix := "." + base
+	if len(domain) <= len(suffix) || !strings.EqualFold(domain[len(domain)-len(suffix):], suffix) {
+		return "", false
+	}
+	return domain[:len(domain)-len(suffix)], true
+}
+
+// resolveRcpt resolves the name of "to" (which must be valid, see
+// rcptName), and passes the resolved value to the forwarder.
+func (s *session) resolveRcpt(logger log.Logger, to string) error {
+	name, _ := rcptName(to)
+	if s.subdomainBase != "" {
+		if sub, ok := subdomainName(to, s.subdomainBase); ok {
+			name = sub
+			logger = log.With(logger, "name", name)
+		}
+	}
 
-	// TODO: use proper context
-	resolved, err := s.resolver(context.Background(), to[:at])
+	// The resolution, and the name's policy lookup, share the
+	// resolve timeout.
+	ctx := context.Background()
+	if s.resolveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.resolveTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	region := s.traceRegion("ensmail.resolve")
+	var resolved string
+	var err error
+	if s.resolutionHeaders {
+		var res ResolveResult
+		if res, err = ResolveDetailed(ctx, s.resolver, name); err == nil {
+			if s.resolutions == nil {
+				s.resolutions = make(map[string]ResolveResult)
+			}
+			resolved = res.Email
+			s.resolutions[resolved] = res
+		}
+	} else {
+		resolved, err = s.resolver(ctx, name)
+	}
+	region.End()
+	s.stages.resolve += time.Since(start)
+	if s.onResolve != nil {
+		s.onResolve(name, resolved, err)
+	}
 	if err != nil {
 		logger.Log("call", "s.resolver", "err", err)
-		return err
+		return s.errCodes.reply(err)
 	}
+	atomic.AddInt64(&s.stats.resolved, 1)
 	logger = log.With(logger, "resolved", resolved)
 
+	if s.fanIn != nil {
+		s.fanIn.observe(name, resolved)
+	}
+
+	if s.namePolicy != nil {
+		p, err := s.namePolicy(ctx, name)
+		if err != nil {
+			logger.Log("call", "s.namePolicy", "err", err)
+			return s.errCodes.reply(err)
+		}
+		var size int
+		if s.mailOpts != nil {
+			size = s.mailOpts.Size
+		}
+		if err := p.check(s.from, size); err != nil {
+			logger.Log("call", "p.check", "err", err)
+			return err
+		}
+		if p.MaxSize > 0 {
+			if s.maxSizes == nil {
+				s.maxSizes = make(map[string]int)
+			}
+			if max, ok := s.maxSizes[resolved]; !ok || p.MaxSize < max {
+				s.maxSizes[resolved] = p.MaxSize
+			}
+		}
+	}
+
+	if s.policy != nil {
+		if err := s.policy.check(s.from, name, resolved); err != nil {
+			logger.Log("call", "s.policy.check", "err", err)
+			return s.retryAfter.reply(TempfailRateLimit, err)
+		}
+	}
+
 	// TODO: what happens if s.unresolved[resolved] != ""?
+	prev, dup := s.unresolved[resolved]
 	s.unresolved[resolved] = to
 
 	if err := s.forwarder.Rcpt(resolved); err != nil {
 		logger.Log("call", "s.forwarder.Rcpt", "err", err)
+		// The recipient isn't part of the transaction, so
+		// mustn't be counted at DATA.
+		if dup {
+			s.unresolved[resolved] = prev
+		} else {
+			delete(s.unresolved, resolved)
+		}
 		return err
 	}
+	if s.policy != nil {
+		s.policy.record(s.from, name, resolved)
+	}
 
+	// The resolution is only logged, never echoed in the RCPT reply:
+	// go-smtp replies to a nil error with its own fixed 250 message,
+	// and a 2xx *smtp.SMTPError would be written as the reply, but the
+	// recipient would then not be recorded for DATA.
 	logger.Log("forward", "success")
 	return nil
 }
@@ -149,12 +1186,313 @@ func (s *session) Data(r io.Reader) error {
 // LMTPData copies data from r into forwarder DATA, waits for return
 // status for every recipient.  It returns err only if forwarder DATA
 // call fails.
-func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) (err error) {
+	s.dataMu.Lock()
+	defer s.dataMu.Unlock()
+
+	logger := log.With(s.txLogger, "smtp", "DATA")
+	defer func() { s.stages.observe() }()
+	atomic.AddInt64(&s.stats.messages, 1)
+
+	status = outcomeStatus{status, s}
+	defer func() {
+		// errMessageFailed summarizes the outcome, so isn't one of
+		// its reasons.
+		if err != nil && err != errMessageFailed {
+			s.outcome.add(err)
+		}
+	}()
+
+	if s.audit != nil {
+		status = auditStatus{status, s}
+		defer func() {
+			if err != nil {
+				s.audit.Err = err.Error()
+			}
+		}()
+	}
+
+	if s.failAll {
+		defer func() {
+			if err == nil && s.outcome.failed() {
+				err = errMessageFailed
+			}
+		}()
+	}
+
+	if s.dataSem != nil {
+		wait := time.NewTimer(s.dataSemWait)
+		select {
+		case s.dataSem <- struct{}{}:
+			wait.Stop()
+			defer func() { <-s.dataSem }()
+		case <-wait.C:
+			logger.Log("err", errDataSaturated)
+			return s.retryAfter.reply(TempfailBackpressure, errDataSaturated)
+		}
+	}
+
+	if s.resolveAtData {
+		for _, to := range s.pending {
+			rcptLogger := log.With(logger, "to", to)
+			if err := s.resolveRcpt(rcptLogger, to); err != nil {
+				status.SetStatus(to, rcptStatus(err))
+			}
+		}
+		s.pending = nil
+	}
+
+	dr := &dataReader{r: r}
+	r = dr
+
+	// The sender's time to send the message starts only now: waiting
+	// for a DATA slot and resolving aren't its doing.
+	if s.dataTimeout > 0 && s.conn != nil {
+		if err := s.conn.SetReadDeadline(time.Now().Add(s.dataTimeout)); err != nil {
+			logger.Log("call", "SetReadDeadline", "err", err)
+		}
+		defer func() {
+			if errors.Is(dr.err, os.ErrDeadlineExceeded) {
+				// The deadline is left in place, so the rest
+				// of the message isn't waited for either, and
+				// the connection is closed after the reply.
+				logger.Log("err", errDataReadTimeout)
+				err = errDataReadTimeout
+				return
+			}
+			s.conn.SetReadDeadline(time.Time{})
+		}()
+	}
+
+	if len(s.unresolved) == 0 {
+		if s.resolveAtData {
+			// Without any forwarded recipient, forwarder DATA
+			// would fail, but the message must still be
+			// consumed.
+			_, err := io.Copy(io.Discard, r)
+			logger.Log("forward", "none")
+			return err
+		}
+		// go-smtp rejects DATA unless a RCPT was accepted, so
+		// this is only reached by other callers, but forwarding
+		// nothing must never be reported as delivered.
+		io.Copy(io.Discard, r)
+		logger.Log("err", errNoRcpts)
+		return errNoRcpts
+	}
+
+	copyMsg := func(w io.Writer) (int64, error) { return s.copyMessage(w, r) }
+	if s.retry.attempts > 0 || s.filter != nil || s.verp != "" || s.maxLineLen > 0 || s.queue != nil || len(s.maxSizes) > 0 {
+		// Hold the message, so it can be filtered and re-sent.
+		msg := &spool{max: s.maxInMemory}
+		defer msg.Close()
+		if _, err := s.copyMessage(msg, r); err != nil {
+			logger.Log("call", "s.copyMessage", "err", err)
+			return err
+		}
+
+		if err := s.checkMaxSizes(logger, dr.n, status); err != nil {
+			return err
+		}
+		if len(s.unresolved) == 0 {
+			return nil
+		}
+
+		var hdr string
+		if s.filter != nil {
+			res, err := s.filter(s.from, msg.reader())
+			if err != nil {
+				logger.Log("call", "s.filter", "err", err)
+				res = FilterResult{Action: FilterDefer}
+			}
+			if reply := res.reply(); reply != nil {
+				logger.Log("filter", "reject", "code", reply.Code)
+				for resolved, to := range s.unresolved {
+					status.SetStatus(to, reply)
+					delete(s.unresolved, resolved)
+				}
+				return nil
+			}
+			hdr = res.header()
+		}
+		copyMsg = func(w io.Writer) (int64, error) {
+			return io.Copy(w, io.MultiReader(strings.NewReader(hdr), msg.reader()))
+		}
+
+		if s.verp != "" {
+			region := s.traceRegion("ensmail.forward")
+			s.forwardEach(logger, copyMsg, status)
+			region.End()
+			n := int64(len(hdr)) + msg.Len()
+			logger.Log("forward", "done", "bytes", n)
+			if s.audit != nil {
+				s.audit.Bytes = n
+			}
+			return nil
+		}
+	}
+
+	// A copy shared by recipients mustn't disclose their resolutions
+	// to each other.
+	if s.resolutionHeaders && len(s.unresolved) == 1 {
+		plain := copyMsg
+		for resolved := range s.unresolved {
+			copyMsg = func(w io.Writer) (int64, error) {
+				return prependCopy(w, s.resolutionHeader(resolved), plain)
+			}
+		}
+	}
+
+	if s.signKey != nil {
+		unsigned := copyMsg
+		copyMsg = func(w io.Writer) (int64, error) {
+			resolved := make([]string, 0, len(s.unresolved))
+			for rcpt := range s.unresolved {
+				resolved = append(resolved, rcpt)
+			}
+			return s.signedCopy(w, unsigned, resolved...)
+		}
+	}
+
+	backoff, waited := s.retry.backoff, time.Duration(0)
+	for attempt := 0; ; attempt++ {
+		region := s.traceRegion("ensmail.forward")
+		statuses, n, err := s.forwardData(logger, copyMsg)
+		region.End()
+
+		// Transient failures are retried (or queued, once retries
+		// are exhausted), unless the forward itself failed, or its
+		// statuses timed out, as the message may have been delivered.
+		var retry, queued []string
+		for rcpt, rcptErr := range statuses {
+			serr, ok := rcptErr.(*smtp.SMTPError)
+			if ok && serr.Temporary() && err == nil && attempt < s.retry.attempts {
+				logger.Log("to", s.unresolved[rcpt], "err", rcptErr, "retry", attempt+1)
+				retry = append(retry, rcpt)
+				continue
+			}
+			if ok && serr.Temporary() && err == nil && s.queue != nil {
+				queued = append(queued, rcpt)
+				continue
+			}
+			if rcptErr != nil {
+				logger.Log("to", s.unresolved[rcpt], "err", rcptErr)
+			}
+			status.SetStatus(s.unresolved[rcpt], rcptErr)
+			delete(s.unresolved, rcpt)
+		}
+		if len(queued) > 0 {
+			s.enqueue(logger, copyMsg, queued, statuses, status)
+		}
+		if err != nil {
+			return err
+		}
+		if len(retry) == 0 {
+			logger.Log("forward", "success", "bytes", n)
+			if s.audit != nil {
+				s.audit.Bytes = n
+			}
+			return nil
+		}
+
+		// The wait holds the session's DATA slot, so it's bounded,
+		// and cut short by Shutdown.
+		wait := backoff
+		if waited+wait > maxRetryBackoff {
+			wait = maxRetryBackoff - waited
+		}
+		waited += wait
+		backoff *= 2
+		var retryErr error
+		if wait <= 0 {
+			retryErr = errRetryBackoffExceeded
+		} else {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+				retryErr = s.redial(logger, status)
+			case <-s.shutdown:
+				timer.Stop()
+				retryErr = errShuttingDown
+			}
+		}
+		if retryErr != nil {
+			logger.Log("retry", "abandoned", "err", retryErr)
+			if s.queue != nil {
+				s.enqueue(logger, copyMsg, retry, statuses, status)
+				return nil
+			}
+			// Report the transient statuses which couldn't be retried.
+			for _, rcpt := range retry {
+				status.SetStatus(s.unresolved[rcpt], statuses[rcpt])
+				delete(s.unresolved, rcpt)
+			}
+			return nil
+		}
+		if len(s.unresolved) == 0 {
+			return nil
+		}
+	}
+}
+
+// checkMaxSizes rejects the recipients whose NamePolicy MaxSize is
+// less than size, the size of the message read, as only its declared
+// size was checked at RCPT.  If any are rejected, the forward
+// transaction is restarted without them.
+func (s *session) checkMaxSizes(logger log.Logger, size int64, status smtp.StatusCollector) error {
+	var rejected bool
+	for resolved, max := range s.maxSizes {
+		to, ok := s.unresolved[resolved]
+		if !ok || size <= int64(max) {
+			continue
+		}
+		logger.Log("to", to, "err", errNamePolicySize, "bytes", size)
+		status.SetStatus(to, errNamePolicySize)
+		delete(s.unresolved, resolved)
+		rejected = true
+	}
+	if !rejected || len(s.unresolved) == 0 {
+		return nil
+	}
+	if err := s.redial(logger, status); err != nil {
+		return errForwardData
+	}
+	return nil
+}
+
+// enqueue queues the message written by copyMsg for rcpts (resolved
+// recipients whose forward failed transiently), and reports them
+// delivered.  If the message can't be queued, their transient
+// statuses are reported instead.
+func (s *session) enqueue(logger log.Logger, copyMsg func(io.Writer) (int64, error), rcpts []string, statuses map[string]error, status smtp.StatusCollector) {
+	id, err := s.queue.enqueue(s.from, s.mailOpts, rcpts, copyMsg)
+	if err != nil {
+		logger.Log("call", "s.queue.enqueue", "err", err)
+	}
+	for _, rcpt := range rcpts {
+		if err != nil {
+			status.SetStatus(s.unresolved[rcpt], statuses[rcpt])
+		} else {
+			logger.Log("to", s.unresolved[rcpt], "err", statuses[rcpt], "queued", id)
+			status.SetStatus(s.unresolved[rcpt], nil)
+		}
+		delete(s.unresolved, rcpt)
+	}
+}
+
+// forwardData calls forwarder DATA, writes the message with copyMsg,
+// and waits for the status of every recipient in s.unresolved.  The
+// returned statuses are keyed by resolved recipient.  err is non-nil
+// if forwarder DATA fails, or if a status isn't returned in time (in
+// which case the missing statuses are errForwardStatusTimeout, so
+// every recipient still gets a status).  If the forwarder fails
+// before returning every status, the missing statuses are a transient
+// failure.
+func (s *session) forwardData(logger log.Logger, copyMsg func(io.Writer) (int64, error)) (statuses map[string]error, n int64, err error) {
 	type statusRsp struct {
 		rcpt string
 		err  error
 	}
-	logger := log.With(s.logger, "smtp", "DATA")
 
 	// Collect data responses per recipient.
 	// TODO: this is subtly broken, because it's possible that Rcpt is
@@ -163,53 +1501,428 @@ func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
 	// each rcpt.
 	dataRsps := make(chan statusRsp, len(s.unresolved))
 
+	start := time.Now()
 	w, err := s.forwarder.LMTPData(func(rcpt string, serr *smtp.SMTPError) {
-		// Convert half-nil serr to full-nil err interface value
-		var err error
-		if serr != nil {
-			err = serr
-		}
-		dataRsps <- statusRsp{rcpt, err}
+		dataRsps <- statusRsp{rcpt, forwardStatus(logger, rcpt, serr)}
 	})
 	if err != nil {
 		logger.Log("call", "s.forwarder.LMTPData", "err", err)
-		return err
+		// The forwarder's own reply is passed on, but other errors
+		// (such as a lost connection) are transient, so senders
+		// retry rather than bounce.
+		if _, ok := err.(*smtp.SMTPError); !ok {
+			err = errForwardData
+		}
+		return nil, 0, err
 	}
 
-	// TODO add "Received:" header?  Or other header to document resolution?
-
 	// Copy received data to forwarding server.
-	n, err := io.Copy(w, r)
-	w.Close()
+	n, err = copyMsg(w)
+	forwarded := time.Now()
+	s.stages.forward += forwarded.Sub(start)
+	defer func() { s.stages.status += time.Since(forwarded) }()
+	closeErr := w.Close()
 	if err != nil {
 		logger.Log("call", "io.Copy", "err", err)
-		return err
+		if _, ok := err.(*smtp.SMTPError); !ok {
+			err = errForwardData
+		}
+		return nil, n, err
+	}
+
+	statuses = make(map[string]error, len(s.unresolved))
+
+	// Statuses are returned before Close returns, so if Close fails
+	// (ie: the forwarder closed the connection), no more statuses
+	// will arrive.
+	if closeErr != nil {
+		logger.Log("call", "w.Close", "err", closeErr)
+		for len(dataRsps) > 0 {
+			rsp := <-dataRsps
+			statuses[rsp.rcpt] = rsp.err
+		}
+		for rcpt := range s.unresolved {
+			if _, ok := statuses[rcpt]; !ok {
+				statuses[rcpt] = errForwardIncomplete
+			}
+		}
+		return statuses, n, nil
 	}
 
-	// Wait for all statuses to return, and call SetStatus appropriately.
-	for range s.unresolved {
+	// Wait for all statuses to return.
+	timeout := s.statusTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	// The timeout restarts with each status, so large transactions
+	// (whose statuses the forwarder delivers one at a time) aren't
+	// failed while statuses are still arriving.
+	expired := time.NewTimer(timeout)
+	defer expired.Stop()
+	for len(statuses) < len(s.unresolved) {
 		select {
 		case rsp := <-dataRsps:
-			status.SetStatus(s.unresolved[rsp.rcpt], rsp.err)
-			delete(s.unresolved, rsp.rcpt)
-		// TODO: This timeout should not be hardcoded.  What's a good
-		// value for this?
-		case <-time.After(5 * time.Second):
+			statuses[rsp.rcpt] = rsp.err
+			if !expired.Stop() {
+				<-expired.C
+			}
+			expired.Reset(timeout)
+		case <-expired.C:
 			var missingRcpt strings.Builder
-			for _, missing := range s.unresolved {
-				fmt.Fprintf(&missingRcpt, "%s, ", missing)
+			for rcpt, missing := range s.unresolved {
+				if _, ok := statuses[rcpt]; !ok {
+					fmt.Fprintf(&missingRcpt, "%s, ", missing)
+					statuses[rcpt] = errForwardStatusTimeout
+				}
 			}
 			err := fmt.Errorf("timeout waiting for forward LMTP status: %s", strings.TrimRight(missingRcpt.String(), ", "))
 			logger.Log("call", "<-dataRsps", "err", err)
-			return err
+			return statuses, n, err
 		}
 	}
+	return statuses, n, nil
+}
+
+// forwardEach forwards the message to each recipient in s.unresolved
+// in its own transaction, whose envelope sender is the VERP encoding
+// of the recipient's unresolved address, and reports each status.  Up
+// to s.verpWorkers transactions are forwarded at once, the first over
+// the session's forwarder, and the rest over new forwarders.
+func (s *session) forwardEach(logger log.Logger, copyMsg func(io.Writer) (int64, error), status smtp.StatusCollector) {
+	// Recipients were added to the session's transaction to validate
+	// them, which is replaced by per-recipient transactions.
+	s.forwarder.Reset()
+
+	// Concurrent transactions' forward and status stages overlap, so
+	// they're timed as a whole.
+	start := time.Now()
+	defer func() { s.stages.forward += time.Since(start) }()
+
+	type result struct {
+		resolved string
+		err      error
+	}
+	rcpts := make(chan string, len(s.unresolved))
+	for resolved := range s.unresolved {
+		rcpts <- resolved
+	}
+	close(rcpts)
+	results := make(chan result, len(s.unresolved))
+
+	workers := s.verpWorkers
+	if workers > len(s.unresolved) {
+		workers = len(s.unresolved)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		fwdr := s.forwarder
+		if i > 0 {
+			var err error
+			if fwdr, err = s.newFwdr(); err != nil {
+				// The remaining workers take this worker's share.
+				logger.Log("call", "s.newFwdr", "err", err)
+				break
+			}
+		}
+		go func(i int, fwdr ForwarderClient) {
+			if i > 0 {
+				openForwarders.Inc()
+				defer openForwarders.Dec()
+				defer fwdr.Close()
+			}
+			for resolved := range rcpts {
+				rcptCopyMsg := copyMsg
+				if s.resolutionHeaders {
+					rcptCopyMsg = func(w io.Writer) (int64, error) {
+						return prependCopy(w, s.resolutionHeader(resolved), copyMsg)
+					}
+				}
+				if s.signKey != nil {
+					plain := rcptCopyMsg
+					rcptCopyMsg = func(w io.Writer) (int64, error) { return s.signedCopy(w, plain, resolved) }
+				}
+				err := s.forwardOne(fwdr, VERPEncode(s.verp, s.unresolved[resolved]), resolved, rcptCopyMsg)
+				results <- result{resolved, err}
+			}
+		}(i, fwdr)
+	}
+
+	for n := len(s.unresolved); n > 0; n-- {
+		res := <-results
+		to := s.unresolved[res.resolved]
+		if res.err != nil {
+			logger.Log("to", to, "err", res.err)
+		}
+		status.SetStatus(to, res.err)
+	}
+	for resolved := range s.unresolved {
+		delete(s.unresolved, resolved)
+	}
+}
+
+// signedCopy writes the signed resolution headers of the resolved
+// recipients to w, followed by the message copied by copyMsg.
+func (s *session) signedCopy(w io.Writer, copyMsg func(io.Writer) (int64, error), resolved ...string) (int64, error) {
+	sort.Strings(resolved)
+	now := time.Now()
+
+	var hdr strings.Builder
+	for _, rcpt := range resolved {
+		hdr.WriteString(signResolution(s.signKey, Resolution{Original: s.unresolved[rcpt], Resolved: rcpt, Time: now}))
+	}
+	return prependCopy(w, hdr.String(), copyMsg)
+}
+
+// prependCopy writes hdr to w, followed by the message copied by
+// copyMsg.
+func prependCopy(w io.Writer, hdr string, copyMsg func(io.Writer) (int64, error)) (int64, error) {
+	n, err := io.WriteString(w, hdr)
+	if err != nil {
+		return int64(n), err
+	}
+	mn, err := copyMsg(w)
+	return int64(n) + mn, err
+}
+
+// forwardOne forwards the message to rcpt in a new transaction of
+// fwdr, from from, and returns rcpt's status.
+func (s *session) forwardOne(fwdr ForwarderClient, from, rcpt string, copyMsg func(io.Writer) (int64, error)) error {
+	defer fwdr.Reset()
 
-	logger.Log("forward", "success", "bytes", n)
+	if err := fwdr.Mail(from, s.mailOpts); err != nil {
+		return err
+	}
+	if err := fwdr.Rcpt(rcpt); err != nil {
+		return err
+	}
+
+	rsp := make(chan error, 1)
+	w, err := fwdr.LMTPData(func(_ string, serr *smtp.SMTPError) {
+		rsp <- forwardStatus(s.txLogger, rcpt, serr)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = copyMsg(w)
+	w.Close()
+	if err != nil {
+		return errForwardIncomplete
+	}
+
+	// Statuses are returned before Close returns.
+	select {
+	case err := <-rsp:
+		return err
+	default:
+		return errForwardIncomplete
+	}
+}
+
+// stageTimes are the cumulative times spent delivering a message in
+// each stage: resolving its recipients, forwarding it (including
+// retries), and waiting for its forwarder statuses.
+type stageTimes struct {
+	resolve, forward, status time.Duration
+}
+
+// observe records st in messageStageSeconds.
+func (st stageTimes) observe() {
+	messageStageSeconds.WithLabelValues("resolve").Observe(st.resolve.Seconds())
+	messageStageSeconds.WithLabelValues("forward").Observe(st.forward.Seconds())
+	messageStageSeconds.WithLabelValues("status").Observe(st.status.Seconds())
+}
+
+// forwardStatus returns the error of the forwarder status serr of the
+// resolved recipient rcpt.  Successful (2xx) statuses are logged, and
+// returned as nil.
+func forwardStatus(logger log.Logger, rcpt string, serr *smtp.SMTPError) error {
+	if serr == nil {
+		// Convert half-nil serr to full-nil err interface value
+		return nil
+	}
+	if serr.Code/100 == 2 {
+		logger.Log("resolved", rcpt, "reply", fmt.Sprintf("%d %d.%d.%d %s", serr.Code, serr.EnhancedCode[0], serr.EnhancedCode[1], serr.EnhancedCode[2], serr.Message))
+		return nil
+	}
+	return serr
+}
+
+// redial replaces the session's forwarder with a new connection, and
+// starts a new forward transaction for the recipients remaining in
+// s.unresolved.  Recipients rejected by the new forwarder are
+// reported to status, and removed from s.unresolved.  If err is
+// returned, the session's forwarder is unchanged.
+func (s *session) redial(logger log.Logger, status smtp.StatusCollector) error {
+	fwdr, err := s.newFwdr()
+	if err != nil {
+		logger.Log("call", "s.newFwdr", "err", err)
+		return err
+	}
+	if err := fwdr.Mail(s.from, s.mailOpts); err != nil {
+		logger.Log("call", "fwdr.Mail", "err", err)
+		fwdr.Close()
+		return err
+	}
+
+	s.forwarder.Close()
+	s.forwarder = fwdr
+
+	for rcpt, to := range s.unresolved {
+		if err := s.forwarder.Rcpt(rcpt); err != nil {
+			logger.Log("to", to, "call", "s.forwarder.Rcpt", "err", err)
+			status.SetStatus(to, err)
+			delete(s.unresolved, rcpt)
+		}
+	}
 	return nil
 }
 
+// copyMessage copies the message in r to w.  Depending on the
+// session's MessageIDMode, a Message-ID header generated from the
+// transaction's message id may be added.  If a received sanitizer is
+// configured, the message header is sanitized, and ensmail's own
+// Received header is prepended.  Bcc headers are removed if the
+// session strips them, bare LF line endings are converted to CRLF if
+// the session normalizes them, and lines longer than the session's
+// maximum line length fail with errLineTooLong.
+func (s *session) copyMessage(w io.Writer, r io.Reader) (int64, error) {
+	if s.maxLineLen > 0 || s.normalizeCRLF {
+		w = &lineWriter{w: w, max: s.maxLineLen, crlf: s.normalizeCRLF}
+	}
+
+	br := bufio.NewReader(r)
+	fields, sep, err := readHeader(br)
+	if err != nil {
+		return 0, err
+	}
+	if s.headerLogger != nil {
+		s.headerLogger.Log(append([]interface{}{"msgid", s.msgID}, headerKeyvals(fields, s.headerNames)...)...)
+	}
+
+	var hdr bytes.Buffer
+	if s.sanitizer != nil {
+		fmt.Fprintf(&hdr, "Received: by ensmail with LMTP id %s;\r\n %s\r\n", s.msgID, time.Now().Format(time.RFC1123Z))
+		fields = s.sanitizer.sanitize(fields)
+	}
+	if s.stripBcc {
+		fields = removeHeader(fields, "Bcc")
+		fields = removeHeader(fields, "Resent-Bcc")
+	}
+	switch s.msgIDMode {
+	case MessageIDAddIfMissing:
+		if !hasHeader(fields, "Message-ID") {
+			fmt.Fprintf(&hdr, "Message-ID: <%s@%s>\r\n", s.msgID, msgIDDomain)
+		}
+	case MessageIDRegenerate:
+		fields = removeHeader(fields, "Message-ID")
+		fmt.Fprintf(&hdr, "Message-ID: <%s@%s>\r\n", s.msgID, msgIDDomain)
+	}
+	for _, f := range fields {
+		hdr.Write(f.raw)
+	}
+	hdr.Write(sep)
+
+	n, err := hdr.WriteTo(w)
+	if err != nil {
+		return n, err
+	}
+	bn, err := io.Copy(w, br)
+	return n + bn, err
+}
+
+// resolvedOf returns the resolved address of the unresolved address
+// to, if to has been resolved and forwarded.
+func (s *session) resolvedOf(to string) string {
+	for resolved, unresolved := range s.unresolved {
+		if unresolved == to {
+			return resolved
+		}
+	}
+	return ""
+}
+
+// flushAudit logs the audit record of the current transaction, if
+// one exists.
+func (s *session) flushAudit() {
+	if s.audit == nil {
+		return
+	}
+	s.audit.Time = time.Now()
+	s.auditLog.log(*s.audit)
+	s.audit = nil
+}
+
+// outcomeStatus adds each DATA status to s.outcome and s.stats, before
+// passing it to the wrapped StatusCollector.
+type outcomeStatus struct {
+	smtp.StatusCollector
+	s *session
+}
+
+func (d outcomeStatus) SetStatus(to string, err error) {
+	if err != nil {
+		atomic.AddInt64(&d.s.stats.failed, 1)
+	} else {
+		atomic.AddInt64(&d.s.stats.delivered, 1)
+	}
+	d.s.outcome.add(err)
+	d.StatusCollector.SetStatus(to, err)
+}
+
+// txOutcome tallies the recipient outcomes of a transaction.
+type txOutcome struct {
+	delivered bool     // to any recipient
+	reasons   []string // distinct failure reasons, in order
+}
+
+func (o *txOutcome) add(err error) {
+	if err == nil {
+		o.delivered = true
+		return
+	}
+	reason := err.Error()
+	for _, r := range o.reasons {
+		if r == reason {
+			return
+		}
+	}
+	o.reasons = append(o.reasons, reason)
+}
+
+// failed reports whether every recipient of the transaction failed.
+func (o txOutcome) failed() bool {
+	return !o.delivered && len(o.reasons) > 0
+}
+
+// flushOutcome logs an aggregate event for a transaction which failed
+// for every recipient, as its per-recipient replies don't show that the
+// whole message was lost.
+func (s *session) flushOutcome() {
+	if s.outcome.failed() {
+		s.txLogger.Log("err", "message fully failed", "reasons", strings.Join(s.outcome.reasons, "; "))
+	}
+	s.outcome = txOutcome{}
+}
+
+// Logout closes the session's forwarder.  A close error is logged
+// and returned, but go-smtp ignores Logout's error, so it can't
+// affect the replies already sent.
 func (s *session) Logout() error {
+	s.dataMu.Lock()
+	defer s.dataMu.Unlock()
+
 	s.logger.Log("smtp", "LOGOUT")
-	return s.forwarder.Close()
+	s.flushAudit()
+	s.flushOutcome()
+	s.endTx()
+	s.endTrace()
+	activeSessions.Dec()
+	openForwarders.Dec()
+	if err := s.forwarder.Close(); err != nil {
+		s.logger.Log("call", "s.forwarder.Close", "err", err)
+		return err
+	}
+	return nil
 }
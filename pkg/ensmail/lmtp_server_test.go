@@ -3,19 +3,42 @@ package ensmail
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
+	"net/textproto"
+	"os"
 	"path/filepath"
+	"reflect"
+	"runtime/trace"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/go-kit/log"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/royalfork/ensmail/pkg/ens"
+	"github.com/royalfork/ensmail/pkg/ensmail/ensmailtest"
 )
 
 type mockForwarder struct {
@@ -24,6 +47,7 @@ type mockForwarder struct {
 	dataFunc  func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error)
 	resetFunc func() error
 	closeFunc func() error
+	extFunc   func(ext string) (bool, string)
 }
 
 func (m mockForwarder) Mail(from string, opts *smtp.MailOptions) error {
@@ -61,6 +85,15 @@ func (m mockForwarder) Close() error {
 	return nil
 }
 
+// Extension reports all extensions as supported, unless extFunc is
+// set.
+func (m mockForwarder) Extension(ext string) (bool, string) {
+	if m.extFunc != nil {
+		return m.extFunc(ext)
+	}
+	return true, ""
+}
+
 type sessionRecorder struct {
 	sessions []*testSession
 }
@@ -128,20 +161,49 @@ var testMsg = []byte("Received: from localhost (localhost [127.0.0.1]) by mx.mad
 	" Feb 2022 16:39:27 -0500\r\n" +
 	"To: recipient@example.net\r\n" +
 	"Subject: discount Gophers!\r\n" +
+	"Message-ID: <e6fa8a02@mx.maddy.test>\r\n" +
 	"\r\n" +
 	"This is the email body.\r\n")
 
+// serveTest serves srv on a unix socket in a temporary directory,
+// returning the socket's path.  The listener is closed once the test
+// finishes, but srv isn't.
+func serveTest(t *testing.T, srv *LMTPResolveForwarder) string {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "lmtp.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go srv.Serve(l)
+	return sock
+}
+
+// testResolver resolves every name to an address at resolved.test.
+func testResolver(ctx context.Context, in string) (string, error) {
+	return in + "@resolved.test", nil
+}
+
 func sendMail(sock string, from string, to []string, data []byte) error {
+	return sendMailOpts(sock, from, nil, to, data)
+}
+
+func sendMailOpts(sock string, from string, opts *smtp.MailOptions, to []string, data []byte) error {
 	conn, err := net.Dial("unix", sock)
 	if err != nil {
 		return err
 	}
+	return sendMailConn(conn, from, opts, to, data)
+}
+
+func sendMailConn(conn net.Conn, from string, opts *smtp.MailOptions, to []string, data []byte) error {
 	cl, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
 	if err != nil {
 		return err
 	}
 
-	if err := cl.Mail(from, nil); err != nil {
+	if err := cl.Mail(from, opts); err != nil {
 		return err
 	}
 
@@ -204,15 +266,7 @@ func TestLMTPServer(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		// Serve on unix socket
-		sock := filepath.Join(t.TempDir(), "lmtp.sock")
-		l, err := net.Listen("unix", sock)
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer l.Close()
-
-		go srv.Serve(l)
+		sock := serveTest(t, srv)
 
 		if err := sendMail(sock, "sender@public.com", []string{"rcpt1@ensmail.org"}, testMsg); err == nil {
 			// The SMTP conversation is as follows:
@@ -238,48 +292,52 @@ func TestLMTPServer(t *testing.T) {
 	t.Run("errForwardData", func(t *testing.T) {
 		resolver := func(ctx context.Context, in string) (string, error) { return in, nil }
 
-		errBadForward := errors.New("bad forward")
-		srv, err := NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
-			return mockForwarder{
-				dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
-					return nil, errBadForward
-				},
-			}, nil
-		})
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		// Serve on unix socket
-		sock := filepath.Join(t.TempDir(), "lmtp.sock")
-		l, err := net.Listen("unix", sock)
-		if err != nil {
-			t.Fatal(err)
+		errRejected := &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 0},
+			Message:      "Transaction failed",
 		}
-		defer l.Close()
-
-		closed := make(chan error)
-		go func() {
-			closed <- srv.Serve(l)
-		}()
-
-		if err := sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, testMsg); err == nil {
-			// 220  ESMTP Service Ready
-			// LHLO localhost
-			// 250-Hello localhost
-			// 250-PIPELINING
-			// 250-8BITMIME
-			// 250-ENHANCEDSTATUSCODES
-			// 250-CHUNKING
-			// 250 SIZE
-			// MAIL FROM:<sender@public.com> BODY=8BITMIME
-			// 250 2.0.0 Roger, accepting mail from <sender@public.com>
-			// RCPT TO:<rcpt@ensmail.org>
-			// 250 2.0.0 I'll make sure <rcpt@ensmail.org> gets this
+		for _, test := range []struct {
+			fwdErr  error
+			copyErr error // of writing the message to the forwarder
+			exp     *smtp.SMTPError
+		}{
+			// Errors other than the forwarder's reply are
+			// transient, so senders retry:
 			// DATA
 			// 354 2.0.0 Go ahead. End your data with <CR><LF>.<CR><LF>
-			// 554 5.0.0 <rcpt@ensmail.org> Error: transaction failed, blame it on the weather: bad forward
-			t.Fatal("unexpected err:", err)
+			// 451 4.4.0 Forwarding server failed to accept message data, try again later
+			{errors.New("bad forward"), nil, errForwardData},
+			{nil, errors.New("broken pipe"), errForwardData},
+			// The forwarder's reply is passed on.
+			{errRejected, nil, errRejected},
+			{nil, errRejected, errRejected},
+		} {
+			srv, err := NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
+				return mockForwarder{
+					dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+						if test.fwdErr != nil {
+							return nil, test.fwdErr
+						}
+						return Closer{
+							Writer:    writerFunc(func(p []byte) (int, error) { return 0, test.copyErr }),
+							closeFunc: func() error { return nil },
+						}, nil
+					},
+				}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sock := serveTest(t, srv)
+
+			err = sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, testMsg)
+			var serr *smtp.SMTPError
+			if !errors.As(err, &serr) || serr.Code != test.exp.Code || serr.EnhancedCode != test.exp.EnhancedCode {
+				t.Errorf("%v, %v: want err: %v, got: %v", test.fwdErr, test.copyErr, test.exp, err)
+			}
+			srv.Close()
 		}
 	})
 
@@ -459,3 +517,3207 @@ func TestLMTPServer(t *testing.T) {
 		})
 	})
 }
+
+// SMTPUTF8 messages are only forwarded if the forwarding server
+// also supports SMTPUTF8.
+func TestLMTPServerSMTPUTF8(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		return fmt.Sprintf("RESOLVED%s@resolved.test", in), nil
+	}
+
+	for _, test := range []struct {
+		name         string
+		fwdSupported bool
+	}{
+		{"supported", true},
+		{"unsupported", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var fwdOpts *smtp.MailOptions
+			srv, err := NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
+				return mockForwarder{
+					mailFunc: func(from string, opts *smtp.MailOptions) error {
+						fwdOpts = opts
+						return nil
+					},
+					extFunc: func(ext string) (bool, string) {
+						if ext == "SMTPUTF8" {
+							return test.fwdSupported, ""
+						}
+						return true, ""
+					},
+					dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+						return Closer{
+							Writer: io.Discard,
+							closeFunc: func() error {
+								statusCb("RESOLVEDrcpt@resolved.test", nil)
+								return nil
+							},
+						}, nil
+					},
+				}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sock := serveTest(t, srv)
+			defer srv.Close()
+
+			err = sendMailOpts(sock, "séndér@public.com", &smtp.MailOptions{UTF8: true}, []string{"rcpt@ensmail.org"}, testMsg)
+			if !test.fwdSupported {
+				var serr *smtp.SMTPError
+				if !errors.As(err, &serr) || serr.Code != errForwardNoSMTPUTF8.Code {
+					t.Fatalf("want err: %s, got: %v", errForwardNoSMTPUTF8, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal("unexpected err:", err)
+			}
+			if fwdOpts == nil || !fwdOpts.UTF8 {
+				t.Errorf("want forwarded UTF8 option, got: %+v", fwdOpts)
+			}
+		})
+	}
+}
+
+// While forward DATA concurrency is saturated, new mail is
+// rejected with a temporary failure.
+func TestLMTPServerDataConcurrency(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		return in, nil
+	}
+
+	inData := make(chan struct{})
+	release := make(chan struct{})
+	srv, err := NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
+		var rcpts []string
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpts = append(rcpts, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				inData <- struct{}{}
+				return Closer{
+					Writer: io.Discard,
+					closeFunc: func() error {
+						<-release
+						for _, rcpt := range rcpts {
+							statusCb(rcpt, nil)
+						}
+						return nil
+					},
+				}, nil
+			},
+		}, nil
+	}, WithDataConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	blocked := make(chan error)
+	go func() {
+		blocked <- sendMail(sock, "sender1@public.com", []string{"rcpt1@ensmail.org"}, testMsg)
+	}()
+	<-inData
+
+	err = sendMail(sock, "sender2@public.com", []string{"rcpt2@ensmail.org"}, testMsg)
+	var serr *smtp.SMTPError
+	if !errors.As(err, &serr) || serr.Code != errDataSaturated.Code {
+		t.Errorf("want err: %s, got: %v", errDataSaturated, err)
+	}
+
+	close(release)
+	if err := <-blocked; err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	// Once DATA completes, mail is accepted again.
+	for len(srv.dataSem) != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	go func() { <-inData }()
+	if err := sendMail(sock, "sender3@public.com", []string{"rcpt3@ensmail.org"}, testMsg); err != nil {
+		t.Error("unexpected err:", err)
+	}
+}
+
+// Internationalized local-parts are passed to the resolver
+// unmodified.
+func TestLMTPServerUTF8Rcpt(t *testing.T) {
+	var resolved []string
+	resolver := func(ctx context.Context, in string) (string, error) {
+		resolved = append(resolved, in)
+		return fmt.Sprintf("resolved%d@resolved.test", len(resolved)), nil
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	if err := sendMailOpts(sock, "sender@public.com", &smtp.MailOptions{UTF8: true}, []string{"🦊@ensmail.org", "ünïcödé@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	if exp := []string{"🦊", "ünïcödé"}; !cmp.Equal(exp, resolved) {
+		t.Errorf("resolved local-parts (-want, +got) %s", cmp.Diff(exp, resolved))
+	}
+}
+
+// When resolution is deferred to DATA, all recipients are
+// accepted at RCPT, and resolution failures are reported as DATA
+// statuses.
+func TestLMTPServerResolveAtData(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		if strings.HasPrefix(in, "BAD") {
+			return "", errors.New("invalid resolve input")
+		}
+		return fmt.Sprintf("RESOLVED%s@resolved.test", in), nil
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder, WithResolveAtData())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	rcpts := []string{"rcpt1@ensmail.org", "BADrcpt2@ensmail.org", "rcpt3@ensmail.org"}
+	for _, rcpt := range rcpts {
+		if err := cl.Rcpt(rcpt); err != nil {
+			t.Fatalf("want rcpt %s accepted, got: %s", rcpt, err)
+		}
+	}
+
+	// Resolution failures which aren't SMTPErrors fail
+	// temporarily, as they do at RCPT.
+	statuses := make(map[string]int)
+	w, err := cl.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		if status != nil {
+			statuses[rcpt] = status.Code
+		} else {
+			statuses[rcpt] = 250
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]int{
+		"rcpt1@ensmail.org":    250,
+		"BADrcpt2@ensmail.org": errResolveFailed.Code,
+		"rcpt3@ensmail.org":    250,
+	}
+	if !cmp.Equal(exp, statuses) {
+		t.Errorf("rcpt statuses (-want, +got) %s", cmp.Diff(exp, statuses))
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.check(t, []*testSession{
+		{
+			From: "sender@public.com",
+			To: []string{
+				"RESOLVEDrcpt1@resolved.test",
+				"RESOLVEDrcpt3@resolved.test",
+			},
+			Data: *bytes.NewBuffer(testMsg),
+		},
+	})
+}
+
+// A single server serves multiple unix and TLS listeners, and
+// Close stops all of them.
+func TestLMTPServerMultipleListeners(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		return fmt.Sprintf("RESOLVED%s@resolved.test", in), nil
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverTLS, clientTLS := testTLSConfigs(t)
+
+	var (
+		socks  []string
+		closed = make(chan error, 3)
+	)
+	for i := 0; i < 2; i++ {
+		sock := filepath.Join(t.TempDir(), "lmtp.sock")
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		socks = append(socks, sock)
+
+		go func() {
+			closed <- srv.Serve(l)
+		}()
+	}
+
+	tcpL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpL.Close()
+	go func() {
+		closed <- srv.ServeTLS(tcpL, serverTLS)
+	}()
+
+	// Non-tcp listeners can't be served over TLS.
+	unixL, err := net.Listen("unix", filepath.Join(t.TempDir(), "lmtp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixL.Close()
+	if err := srv.ServeTLS(unixL, serverTLS); err == nil {
+		t.Error("unexpected nil err serving TLS on unix listener")
+	}
+
+	for _, sock := range socks {
+		if err := sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, testMsg); err != nil {
+			t.Fatal("unexpected err:", err)
+		}
+	}
+
+	conn, err := tls.Dial("tcp", tcpL.Addr().String(), clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendMailConn(conn, "sender@public.com", nil, []string{"rcpt@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Error("unexpected serve err:", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("server shutdown timeout")
+		}
+	}
+
+	if len(recorder.sessions) != 3 {
+		t.Errorf("want sessions: 3, got: %d", len(recorder.sessions))
+	}
+}
+
+// Recipients which violate the relay policy are rejected.
+func TestLMTPServerRelayPolicy(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		return fmt.Sprintf("RESOLVED@%s.test", in), nil
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder, WithRelayPolicy(&RelayPolicy{
+		AllowedDomains: []string{"allowed.test"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+
+	if err := sendMail(sock, "sender@public.com", []string{"allowed@ensmail.org", "denied@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.check(t, []*testSession{
+		{
+			From: "sender@public.com",
+			To:   []string{"RESOLVED@allowed.test"},
+			Data: *bytes.NewBuffer(testMsg),
+		},
+	})
+
+	// Recipients the forwarder rejects aren't counted against
+	// the policy's limits.
+	rejected := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	srv, err = NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				if to == "RESOLVED@rejected.test" {
+					return rejected
+				}
+				return nil
+			},
+		}, nil
+	}, WithRelayPolicy(&RelayPolicy{SourceRcptLimit: 1, SourceRcptWindow: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := srv.NewSession(smtp.ConnectionState{}, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Logout()
+	if err := sess.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Rcpt("rejected@ensmail.org"); err != rejected {
+		t.Errorf("want err: %v, got: %v", rejected, err)
+	}
+	if err := sess.Rcpt("accepted@ensmail.org"); err != nil {
+		t.Error("unexpected err:", err)
+	}
+}
+
+// Active session and forwarder gauges track session lifetime.
+func TestLMTPServerGauges(t *testing.T) {
+	srv, err := NewLMTPServer(logger, nil, func() (ForwarderClient, error) {
+		return mockForwarder{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	waitGauges := func(exp float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			sessions, fwds := testutil.ToFloat64(activeSessions), testutil.ToFloat64(openForwarders)
+			if sessions == exp && fwds == exp {
+				return
+			} else if time.Now().After(deadline) {
+				t.Fatalf("want sessions and forwarders: %v, got: %v, %v", exp, sessions, fwds)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	before := testutil.ToFloat64(activeSessions)
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// LHLO creates the session.
+	if err := cl.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	waitGauges(before + 1)
+
+	if err := cl.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	waitGauges(before)
+}
+
+// Transient forward statuses are retried over a new forwarder,
+// permanent statuses are not.
+func TestLMTPServerForwardRetry(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		tempFails int // number of forwards "temp" fails
+		expDials  int
+		expCode   int // of "temp", or 0 if delivered
+	}{
+		{"recovers", 1, 2, 0},
+		{"exhausted", 5, 3, 451},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				mu    sync.Mutex
+				dials [][]string // rcpts of each dial
+			)
+			newForwarder := func() (ForwarderClient, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				dial := len(dials)
+				dials = append(dials, nil)
+				return mockForwarder{
+					rcptFunc: func(to string) error {
+						mu.Lock()
+						defer mu.Unlock()
+						dials[dial] = append(dials[dial], to)
+						return nil
+					},
+					dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+						return Closer{
+							Writer: io.Discard,
+							closeFunc: func() error {
+								mu.Lock()
+								rcpts := dials[dial]
+								mu.Unlock()
+								for _, rcpt := range rcpts {
+									switch {
+									case rcpt == "temp@resolved.test" && dial < test.tempFails:
+										statusCb(rcpt, &smtp.SMTPError{Code: 451, Message: "test temp fail"})
+									case rcpt == "perm@resolved.test":
+										statusCb(rcpt, &smtp.SMTPError{Code: 550, Message: "test perm fail"})
+									default:
+										statusCb(rcpt, nil)
+									}
+								}
+								return nil
+							},
+						}, nil
+					},
+				}, nil
+			}
+
+			srv, err := NewLMTPServer(logger, testResolver, newForwarder, WithForwardRetry(2, time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sock := serveTest(t, srv)
+
+			// Only the status of "temp" or "perm" can fail.
+			for _, to := range []string{"temp", "perm"} {
+				err := sendMail(sock, "sender@public.com", []string{"ok@ensmail.org", to + "@ensmail.org"}, testMsg)
+				var serr *smtp.SMTPError
+				if to == "perm" {
+					if !errors.As(err, &serr) || serr.Code != 550 {
+						t.Errorf("perm: want 550 err, got: %v", err)
+					}
+					continue
+				}
+				if test.expCode != 0 {
+					if !errors.As(err, &serr) || serr.Code != test.expCode {
+						t.Errorf("temp: want %d err, got: %v", test.expCode, err)
+					}
+				} else if err != nil {
+					t.Errorf("temp: unexpected err: %v", err)
+				}
+			}
+
+			if err := srv.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Each sendMail dials once, and only "temp" is
+			// re-dialed; "perm" (the final dial) is never
+			// retried.
+			mu.Lock()
+			defer mu.Unlock()
+			if len(dials) != test.expDials+1 {
+				t.Fatalf("want dials: %d, got: %d (%v)", test.expDials+1, len(dials), dials)
+			}
+			for _, rcpts := range dials[1:test.expDials] {
+				if !cmp.Equal(rcpts, []string{"temp@resolved.test"}) {
+					t.Errorf("want retry of temp only, got: %v", rcpts)
+				}
+			}
+		})
+	}
+
+	// Shutdown cuts a retry's backoff short, and the transient
+	// status is reported.
+	t.Run("shutdown", func(t *testing.T) {
+		forwarded := make(chan struct{}, 1)
+		srv, err := NewLMTPServer(logger, testResolver, func() (ForwarderClient, error) {
+			return mockForwarder{
+				dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+					return Closer{
+						Writer: io.Discard,
+						closeFunc: func() error {
+							statusCb("temp@resolved.test", &smtp.SMTPError{Code: 451, Message: "test temp fail"})
+							forwarded <- struct{}{}
+							return nil
+						},
+					}, nil
+				},
+			}, nil
+		}, WithForwardRetry(2, time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sock := serveTest(t, srv)
+
+		sent := make(chan error, 1)
+		go func() {
+			sent <- sendMail(sock, "sender@public.com", []string{"temp@ensmail.org"}, testMsg)
+		}()
+		<-forwarded
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Errorf("want shutdown, got: %v", err)
+		}
+		var serr *smtp.SMTPError
+		if err := <-sent; !errors.As(err, &serr) || serr.Code != 451 {
+			t.Errorf("want 451 err, got: %v", err)
+		}
+	})
+}
+
+// If the forwarder closes the connection before returning every
+// status, the missing statuses are failed immediately.
+func TestLMTPServerPartialStatus(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		return in, nil
+	}
+
+	srv, err := NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
+		rcpts := make([]string, 0)
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpts = append(rcpts, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				return Closer{
+					Writer: io.Discard,
+					closeFunc: func() error {
+						// Report half of rcpts, then "crash".
+						for _, rcpt := range rcpts[:len(rcpts)/2] {
+							statusCb(rcpt, nil)
+						}
+						return io.ErrUnexpectedEOF
+					},
+				}, nil
+			},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+
+	start := time.Now()
+	err = sendMail(sock, "sender@public.com", []string{"rcpt1@ensmail.org", "rcpt2@ensmail.org", "rcpt3@ensmail.org", "rcpt4@ensmail.org"}, testMsg)
+	var serr *smtp.SMTPError
+	if !errors.As(err, &serr) || serr.Code != errForwardIncomplete.Code {
+		t.Errorf("want err: %v, got: %v", errForwardIncomplete, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("statuses took %s", elapsed)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Each transaction's resolutions and statuses are audit logged.
+func TestLMTPServerAuditLog(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		if strings.HasPrefix(in, "BAD") {
+			return "", errors.New("invalid resolve input")
+		}
+		return fmt.Sprintf("RESOLVED%s@resolved.test", in), nil
+	}
+
+	var audit syncBuffer
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder, WithAuditLog(&audit))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt1@ensmail.org", "BADrcpt2@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	var line string
+	for deadline := time.Now().Add(5 * time.Second); line == ""; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no audit record")
+		}
+		line = audit.String()
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var rec auditRecord
+	if err := json.Unmarshal([]byte(line), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.MsgID == "" || rec.SessionID == "" || rec.Time.IsZero() {
+		t.Errorf("missing record ids or time: %+v", rec)
+	}
+
+	exp := auditRecord{
+		From: "sender@public.com",
+		Rcpts: []auditRcpt{
+			{To: "BADrcpt2@ensmail.org", Stage: "RCPT", Err: "invalid resolve input"},
+			{To: "rcpt1@ensmail.org", Resolved: "RESOLVEDrcpt1@resolved.test", Stage: "DATA", Delivered: true},
+		},
+		Bytes: int64(len(testMsg)),
+	}
+	if diff := cmp.Diff(exp, rec, cmpopts.IgnoreFields(auditRecord{}, "Time", "SessionID", "MsgID")); diff != "" {
+		t.Errorf("audit record (-want, +got) %s", diff)
+	}
+}
+
+// Recipients are rejected if the message violates their name's
+// policy.
+func TestLMTPServerNamePolicy(t *testing.T) {
+	policies := map[string]NamePolicy{
+		"restricted": {AllowedSenders: []string{"@allowed.test"}},
+		"small":      {MaxSize: 10},
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, testResolver, recorder.Forwarder, WithNamePolicy(func(ctx context.Context, name string) (NamePolicy, error) {
+		if name == "invalid" {
+			return NamePolicy{}, fmt.Errorf("%w: invalid policy name", ErrInvalidLabel)
+		}
+		return policies[name], nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+
+	rcpts := []string{"open@ensmail.org", "restricted@ensmail.org", "small@ensmail.org"}
+	if err := sendMailOpts(sock, "sender@public.com", &smtp.MailOptions{Size: len(testMsg)}, rcpts, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	if err := sendMail(sock, "sender@allowed.test", rcpts[:2], testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	// Without a declared size, MaxSize is enforced on the
+	// message read, and only fails its own recipient.
+	var serr *smtp.SMTPError
+	if err := sendMail(sock, "sender@allowed.test", []string{"open@ensmail.org", "small@ensmail.org"}, testMsg); !errors.As(err, &serr) || serr.Code != errNamePolicySize.Code {
+		t.Errorf("want %d, got: %v", errNamePolicySize.Code, err)
+	}
+
+	// Policy lookup errors are replied to like resolution errors.
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Rcpt("invalid@ensmail.org"); !errors.As(err, &serr) || serr.Code != 553 {
+		t.Errorf("want 553, got: %v", err)
+	}
+	cl.Close()
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.check(t, []*testSession{
+		{
+			From: "sender@public.com",
+			To:   []string{"open@resolved.test"},
+			Data: *bytes.NewBuffer(testMsg),
+		},
+		{
+			From: "sender@allowed.test",
+			To:   []string{"open@resolved.test", "restricted@resolved.test"},
+			Data: *bytes.NewBuffer(testMsg),
+		},
+		{
+			From: "sender@allowed.test",
+			To:   []string{"open@resolved.test", "small@resolved.test"},
+		},
+		{
+			From: "sender@allowed.test",
+			To:   []string{"open@resolved.test"},
+			Data: *bytes.NewBuffer(testMsg),
+		},
+		{
+			From: "sender@public.com",
+		},
+	})
+}
+
+// Forwarder calls, and MAIL options, follow the sender's
+// transaction.
+func TestLMTPServerTranscript(t *testing.T) {
+	var recorder ensmailtest.Recorder
+	srv, err := NewLMTPServer(logger, testResolver, func() (ForwarderClient, error) {
+		return recorder.NewClient(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+
+	opts := &smtp.MailOptions{Body: smtp.Body8BitMIME}
+	if err := sendMailOpts(sock, "sender@public.com", opts, []string{"rcpt1@ensmail.org", "rcpt2@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	clients := recorder.Clients()
+	if len(clients) != 1 {
+		t.Fatalf("want 1 forwarder client, got: %d", len(clients))
+	}
+	clients[0].CheckTranscript(t, []ensmailtest.Call{
+		{Method: "Mail", Arg: "sender@public.com", MailOpts: opts},
+		{Method: "Rcpt", Arg: "rcpt1@resolved.test"},
+		{Method: "Rcpt", Arg: "rcpt2@resolved.test"},
+		{Method: "LMTPData", Data: testMsg},
+		{Method: "Reset"},
+		{Method: "Close"},
+	})
+}
+
+// Recipients beyond the cap are deferred, the rest are forwarded.
+func TestLMTPServerMaxRecipients(t *testing.T) {
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, testResolver, recorder.Forwarder, WithMaxRecipients(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, to := range []string{"rcpt1@ensmail.org", "rcpt2@ensmail.org", "rcpt3@ensmail.org"} {
+		err := cl.Rcpt(to)
+		var serr *smtp.SMTPError
+		if i < 2 && err != nil {
+			t.Errorf("%s: unexpected err: %v", to, err)
+		} else if i >= 2 && (!errors.As(err, &serr) || serr.Code != errTooManyRcpts.Code) {
+			t.Errorf("%s: want err: %v, got: %v", to, errTooManyRcpts, err)
+		}
+	}
+	w, err := cl.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(testMsg)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deferred recipient is accepted in a later transaction.
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt3@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.check(t, []*testSession{
+		{
+			From: "sender@public.com",
+			To:   []string{"rcpt1@resolved.test", "rcpt2@resolved.test"},
+			Data: *bytes.NewBuffer(testMsg),
+		},
+		{
+			From: "sender@public.com",
+			To:   []string{"rcpt3@resolved.test"},
+			Data: *bytes.NewBuffer(testMsg),
+		},
+	})
+}
+
+// Resolution errors are replied with their mapped SMTP codes,
+// which may be overridden.
+func TestLMTPServerErrorCodes(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		switch in {
+		case "noresolver":
+			return "", ErrNoResolver
+		case "noemail":
+			return "", ErrNoEmail
+		}
+		return testResolver(ctx, in)
+	}
+
+	override := &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 1, 1},
+		Message:      "try again",
+	}
+	srv, err := NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
+		return mockForwarder{}, nil
+	}, WithErrorCodes(ErrorCodeMap{ErrNoEmail: override}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := cl.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for to, exp := range map[string]*smtp.SMTPError{
+		"noresolver@ensmail.org": DefaultErrorCodes[ErrNoResolver],
+		"noemail@ensmail.org":    override,
+	} {
+		var serr *smtp.SMTPError
+		if err := cl.Rcpt(to); !errors.As(err, &serr) || serr.Code != exp.Code || serr.EnhancedCode != exp.EnhancedCode {
+			t.Errorf("%s: want err: %v, got: %v", to, exp, err)
+		}
+	}
+}
+
+// Filtered messages are forwarded with the filter's headers,
+// or rejected with the filter's reply.
+func TestLMTPServerMessageFilter(t *testing.T) {
+	filter := func(from string, msg io.Reader) (FilterResult, error) {
+		b, err := io.ReadAll(msg)
+		if err != nil || !bytes.Equal(b, testMsg) {
+			return FilterResult{}, fmt.Errorf("unexpected message: %q (%v)", b, err)
+		}
+		switch from {
+		case "spam@public.com":
+			return FilterResult{Action: FilterReject, Reason: "Spam detected"}, nil
+		case "later@public.com":
+			return FilterResult{Action: FilterDefer}, nil
+		case "broken@public.com":
+			return FilterResult{}, errors.New("scanner unavailable")
+		}
+		return FilterResult{Headers: []string{"X-Spam-Score: 0.1"}}, nil
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, testResolver, recorder.Forwarder, WithMessageFilter(filter))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	for from, exp := range map[string]*smtp.SMTPError{
+		"spam@public.com":   {Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Spam detected"},
+		"later@public.com":  errFilterDefer,
+		"broken@public.com": errFilterDefer,
+	} {
+		var serr *smtp.SMTPError
+		if err := sendMail(sock, from, []string{"rcpt@ensmail.org"}, testMsg); !errors.As(err, &serr) || serr.Code != exp.Code || serr.EnhancedCode != exp.EnhancedCode || !strings.HasSuffix(serr.Message, exp.Message) {
+			t.Errorf("%s: want err: %v, got: %v", from, exp, err)
+		}
+	}
+	for _, ts := range recorder.sessions {
+		if ts.Data.Len() != 0 {
+			t.Errorf("%s: rejected message forwarded", ts.From)
+		}
+	}
+
+	recorder.sessions = nil
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	exp := &testSession{
+		From: "sender@public.com",
+		To:   []string{"rcpt@resolved.test"},
+	}
+	exp.Data.WriteString("X-Spam-Score: 0.1\r\n")
+	exp.Data.Write(testMsg)
+	recorder.check(t, []*testSession{exp})
+}
+
+// With VERP, each recipient is forwarded in its own transaction,
+// from a return path which encodes the recipient.
+func TestLMTPServerVERP(t *testing.T) {
+	type tx struct {
+		From string
+		To   []string
+		Data string
+	}
+	var (
+		mu  sync.Mutex
+		txs []tx
+	)
+	srv, err := NewLMTPServer(logger, testResolver, func() (ForwarderClient, error) {
+		var cur tx
+		var data bytes.Buffer
+		return mockForwarder{
+			mailFunc: func(from string, opts *smtp.MailOptions) error {
+				cur.From = from
+				return nil
+			},
+			rcptFunc: func(to string) error {
+				cur.To = append(cur.To, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				data.Reset()
+				return Closer{
+					Writer: &data,
+					closeFunc: func() error {
+						cur.Data = data.String()
+						mu.Lock()
+						txs = append(txs, cur)
+						mu.Unlock()
+						for _, rcpt := range cur.To {
+							if strings.HasPrefix(rcpt, "bounce") {
+								statusCb(rcpt, errForwardIncomplete)
+							} else {
+								statusCb(rcpt, nil)
+							}
+						}
+						return nil
+					},
+				}, nil
+			},
+			resetFunc: func() error {
+				cur = tx{}
+				return nil
+			},
+		}, nil
+	}, WithVERP("bounces@ensmail.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt1@ensmail.org", "rcpt2@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	var serr *smtp.SMTPError
+	if err := sendMail(sock, "sender@public.com", []string{"bounce@ensmail.org"}, testMsg); !errors.As(err, &serr) || serr.Code != errForwardIncomplete.Code {
+		t.Errorf("want err: %v, got: %v", errForwardIncomplete, err)
+	}
+
+	exp := []tx{
+		{From: "bounces+rcpt1=ensmail.org@ensmail.example", To: []string{"rcpt1@resolved.test"}, Data: string(testMsg)},
+		{From: "bounces+rcpt2=ensmail.org@ensmail.example", To: []string{"rcpt2@resolved.test"}, Data: string(testMsg)},
+		{From: "bounces+bounce=ensmail.org@ensmail.example", To: []string{"bounce@resolved.test"}, Data: string(testMsg)},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(exp, txs, cmpopts.SortSlices(func(a, b tx) bool { return a.From < b.From })); diff != "" {
+		t.Errorf("forwarded transactions (-want, +got) %s", diff)
+	}
+}
+
+// Per-recipient transactions are forwarded concurrently, and
+// each status is reported for its original recipient.
+func TestLMTPServerForwardConcurrency(t *testing.T) {
+	const limit = 3
+	var current, max, dialed int32
+	srv, err := NewLMTPServer(logger, testResolver, func() (ForwarderClient, error) {
+		atomic.AddInt32(&dialed, 1)
+		var rcpt string
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpt = to
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				n := atomic.AddInt32(&current, 1)
+				for {
+					m := atomic.LoadInt32(&max)
+					if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+						break
+					}
+				}
+				return Closer{
+					Writer: io.Discard,
+					closeFunc: func() error {
+						time.Sleep(5 * time.Millisecond)
+						atomic.AddInt32(&current, -1)
+						if strings.HasPrefix(rcpt, "fail") {
+							statusCb(rcpt, errForwardIncomplete)
+						} else {
+							statusCb(rcpt, nil)
+						}
+						return nil
+					},
+				}, nil
+			},
+		}, nil
+	}, WithVERP("bounces@ensmail.example"), WithForwardConcurrency(limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := cl.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	var rcpts []string
+	for i := 0; i < 20; i++ {
+		rcpt := fmt.Sprintf("ok%d@ensmail.org", i)
+		if i%3 == 0 {
+			rcpt = fmt.Sprintf("fail%d@ensmail.org", i)
+		}
+		if err := cl.Rcpt(rcpt); err != nil {
+			t.Fatal(err)
+		}
+		rcpts = append(rcpts, rcpt)
+	}
+
+	statuses := make(map[string]*smtp.SMTPError)
+	w, err := cl.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rcpt := range rcpts {
+		status, ok := statuses[rcpt]
+		if !ok {
+			t.Errorf("%s: missing status", rcpt)
+		} else if fail := strings.HasPrefix(rcpt, "fail"); fail != (status != nil) {
+			t.Errorf("%s: unexpected status: %v", rcpt, status)
+		}
+	}
+	if max := atomic.LoadInt32(&max); max > limit || max < 2 {
+		t.Errorf("want concurrency in [2, %d], got: %d", limit, max)
+	}
+	if dialed := atomic.LoadInt32(&dialed); dialed != limit {
+		t.Errorf("want forwarders: %d, got: %d", limit, dialed)
+	}
+}
+
+// Whitespace and trailing dots around recipient names are
+// ignored, and recipients without a name are rejected.
+func TestLMTPServerMalformedRcpt(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	resolver := func(ctx context.Context, in string) (string, error) {
+		mu.Lock()
+		names = append(names, in)
+		mu.Unlock()
+		return testResolver(ctx, in)
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := cl.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty names are rejected without a lookup.
+	for _, to := range []string{"...@ensmail.org", " . @ensmail.org", "@ensmail.org", "@ensmail.test"} {
+		if err := cl.Rcpt(to); !cmp.Equal(err, DefaultErrorCodes[ErrEmptyName]) {
+			t.Errorf("%q: want err: %v, got: %v", to, DefaultErrorCodes[ErrEmptyName], err)
+		}
+	}
+
+	valid := []string{"alice.@ensmail.org", "bob @ensmail.org", "carol\t.. @ensmail.org"}
+	for _, to := range valid {
+		if err := cl.Rcpt(to); err != nil {
+			t.Errorf("%q: unexpected err: %v", to, err)
+		}
+	}
+	statuses := make(map[string]*smtp.SMTPError)
+	w, err := cl.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, to := range valid {
+		if status, ok := statuses[to]; !ok || status != nil {
+			t.Errorf("%q: want success, got: %v (%t)", to, status, ok)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if exp := []string{"alice", "bob", "carol"}; !cmp.Equal(exp, names) {
+		t.Errorf("resolved names (-want, +got) %s", cmp.Diff(exp, names))
+	}
+}
+
+// Held messages larger than the in-memory limit are forwarded
+// from a temporary file, which is removed.
+func TestLMTPServerMaxInMemory(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	var spooled bool
+	filter := func(from string, msg io.Reader) (FilterResult, error) {
+		files, err := os.ReadDir(dir)
+		spooled = err == nil && len(files) == 1
+		return FilterResult{}, nil
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, testResolver, recorder.Forwarder, WithMessageFilter(filter), WithMaxInMemory(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	if !spooled {
+		t.Error("message not held in a temporary file")
+	}
+	// Statuses are returned before the file is removed.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		files, err := os.ReadDir(dir)
+		if err == nil && len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("temporary files not removed: %v (%v)", files, err)
+		}
+	}
+
+	exp := &testSession{
+		From: "sender@public.com",
+		To:   []string{"rcpt@resolved.test"},
+	}
+	exp.Data.Write(testMsg)
+	recorder.check(t, []*testSession{exp})
+}
+
+// Resolutions are signed in forwarded messages' headers.
+func TestLMTPServerResolutionSigning(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, testResolver, recorder.Forwarder, WithResolutionSigning(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	start := time.Now().Truncate(time.Second)
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt2@ensmail.org", "rcpt1@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	if len(recorder.sessions) != 1 {
+		t.Fatalf("want 1 session, got: %d", len(recorder.sessions))
+	}
+
+	data := recorder.sessions[0].Data.String()
+	if !strings.HasSuffix(data, string(testMsg)) {
+		t.Fatalf("message not forwarded: %q", data)
+	}
+	lines := strings.Split(strings.TrimSuffix(data, string(testMsg)), "\r\n")
+	if len(lines) != 5 {
+		t.Fatalf("want 4 header fields, got: %q", lines)
+	}
+	for i, exp := range []string{"rcpt1", "rcpt2"} {
+		res, err := VerifyResolution(pub, strings.TrimPrefix(lines[2*i], "X-ENSMail-Resolved:"), strings.TrimPrefix(lines[2*i+1], "X-ENSMail-Signature:"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Original != exp+"@ensmail.org" || res.Resolved != exp+"@resolved.test" || res.Time.Before(start) {
+			t.Errorf("unexpected resolution: %+v", res)
+		}
+	}
+}
+
+// Successful forwarder replies are logged, and reported upstream
+// as plain success.
+func TestLMTPServerSuccessReply(t *testing.T) {
+	var logs syncBuffer
+	srv, err := NewLMTPServer(log.NewLogfmtLogger(&logs), testResolver, func() (ForwarderClient, error) {
+		var rcpts []string
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpts = append(rcpts, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				return Closer{
+					Writer: io.Discard,
+					closeFunc: func() error {
+						for _, rcpt := range rcpts {
+							statusCb(rcpt, &smtp.SMTPError{Code: 250, EnhancedCode: smtp.EnhancedCode{2, 0, 0}, Message: "Queued as 4F2A"})
+						}
+						return nil
+					},
+				}, nil
+			},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	if exp := `resolved=rcpt@resolved.test reply="250 2.0.0 Queued as 4F2A"`; !strings.Contains(logs.String(), exp) {
+		t.Errorf("reply not logged: %s", logs.String())
+	}
+}
+
+// Each message's time in each delivery stage is observed.
+func TestLMTPServerStageMetrics(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		time.Sleep(20 * time.Millisecond)
+		return testResolver(ctx, in)
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	stages := []string{"resolve", "forward", "status"}
+	before := make(map[string]*dto.Histogram)
+	for _, stage := range stages {
+		before[stage] = stageHistogram(t, stage)
+	}
+
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt1@ensmail.org", "rcpt2@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	// Statuses are returned before the stages are observed.
+	for deadline := time.Now().Add(5 * time.Second); stageHistogram(t, "status").GetSampleCount() == before["status"].GetSampleCount(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("stages not observed")
+		}
+	}
+	for _, stage := range stages {
+		if n := stageHistogram(t, stage).GetSampleCount() - before[stage].GetSampleCount(); n != 1 {
+			t.Errorf("%s: want 1 observation, got: %d", stage, n)
+		}
+	}
+	if resolve := stageHistogram(t, "resolve").GetSampleSum() - before["resolve"].GetSampleSum(); resolve < 0.04 {
+		t.Errorf("want resolve time >= 40ms, got: %fs", resolve)
+	}
+}
+
+// Messages with overly long lines are rejected without being
+// forwarded.
+func TestLMTPServerMaxLineLength(t *testing.T) {
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, testResolver, recorder.Forwarder, WithMaxLineLength(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	msg := "Subject: hi\r\n\r\n" + strings.Repeat("x", 40) + "\r\n"
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	exp := &testSession{
+		From: "sender@public.com",
+		To:   []string{"rcpt@resolved.test"},
+	}
+	exp.Data.WriteString(msg)
+	recorder.check(t, []*testSession{exp})
+
+	recorder.sessions = nil
+	long := "Subject: hi\r\n\r\n" + strings.Repeat("x", 41) + "\r\n"
+	var serr *smtp.SMTPError
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, []byte(long)); !errors.As(err, &serr) || serr.Code != errLineTooLong.Code {
+		t.Errorf("want err: %v, got: %v", errLineTooLong, err)
+	}
+	if len(recorder.sessions) != 1 || recorder.sessions[0].Data.Len() != 0 {
+		t.Error("rejected message forwarded")
+	}
+}
+
+// Bare LF line endings of messages with mixed line endings are
+// normalized.
+func TestLMTPServerCRLFNormalization(t *testing.T) {
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, testResolver, recorder.Forwarder, WithCRLFNormalization())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	// go-smtp's client normalizes line endings, so bare LFs are
+	// sent over a raw connection.
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	for _, cmd := range []struct {
+		line string
+		code int
+	}{
+		{"", 220},
+		{"LHLO ensmail-testclient.local", 250},
+		{"MAIL FROM:<sender@public.com>", 250},
+		{"RCPT TO:<rcpt@ensmail.org>", 250},
+		{"DATA", 354},
+	} {
+		if cmd.line != "" {
+			if err := text.PrintfLine("%s", cmd.line); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := text.ReadResponse(cmd.code); err != nil {
+			t.Fatalf("%q: %v", cmd.line, err)
+		}
+	}
+	if _, err := io.WriteString(conn, "Subject: hi\nTo: rcpt@ensmail.org\r\n\nline one\r\nline two\n.\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	exp := &testSession{
+		From: "sender@public.com",
+		To:   []string{"rcpt@resolved.test"},
+	}
+	exp.Data.WriteString("Subject: hi\r\nTo: rcpt@ensmail.org\r\n\r\nline one\r\nline two\r\n")
+	recorder.check(t, []*testSession{exp})
+}
+
+// Session logs include the client's LHLO hostname and remote
+// address, which are only counted in metrics by hash bucket.
+func TestLMTPServerSessionContext(t *testing.T) {
+	var logs syncBuffer
+	srv, err := NewLMTPServer(log.NewLogfmtLogger(&logs), testResolver, func() (ForwarderClient, error) {
+		var rcpts []string
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpts = append(rcpts, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				return Closer{
+					Writer: io.Discard,
+					closeFunc: func() error {
+						for _, rcpt := range rcpts {
+							statusCb(rcpt, nil)
+						}
+						return nil
+					},
+				}, nil
+			},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	serverTLS, clientTLS := testTLSConfigs(t)
+	go srv.ServeTLS(l, serverTLS)
+	defer srv.Close()
+
+	bucket := sessionsByClient.WithLabelValues(clientBucket("localhost"))
+	before := testutil.ToFloat64(bucket)
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendMailConn(conn, "sender@public.com", nil, []string{"rcpt@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	exp := fmt.Sprintf("lhlo=localhost remote=%s", conn.LocalAddr())
+	var sessLines int
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if !strings.Contains(line, "sessid=") {
+			continue
+		}
+		sessLines++
+		if !strings.Contains(line, exp) {
+			t.Errorf("want %q in: %s", exp, line)
+		}
+	}
+	if sessLines == 0 {
+		t.Errorf("no session logs: %s", logs.String())
+	}
+
+	if got := testutil.ToFloat64(bucket); got != before+1 {
+		t.Errorf("want sessions: %v, got: %v", before+1, got)
+	}
+	for _, host := range []string{"a.example", "b.example", "LOCALHOST", strings.Repeat("x", 1000)} {
+		if n, err := strconv.Atoi(clientBucket(host)); err != nil || n < 0 || n >= clientBuckets {
+			t.Errorf("%s: bucket out of range: %s", host, clientBucket(host))
+		}
+	}
+}
+
+// A forwarder close error after a delivered transaction doesn't
+// affect the replies sent for it, and is logged.
+func TestLMTPServerCloseErr(t *testing.T) {
+	var logs syncBuffer
+	srv, err := NewLMTPServer(log.NewLogfmtLogger(&logs), testResolver, func() (ForwarderClient, error) {
+		var rcpts []string
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpts = append(rcpts, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				return Closer{
+					Writer: io.Discard,
+					closeFunc: func() error {
+						for _, rcpt := range rcpts {
+							statusCb(rcpt, nil)
+						}
+						return nil
+					},
+				}, nil
+			},
+			closeFunc: func() error { return errors.New("close failed") },
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	rcpts := []string{"rcpt1@ensmail.org", "rcpt2@ensmail.org"}
+	for _, rcpt := range rcpts {
+		if err := cl.Rcpt(rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statuses := make(map[string]*smtp.SMTPError)
+	w, err := cl.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rcpt := range rcpts {
+		if status, ok := statuses[rcpt]; !ok || status != nil {
+			t.Errorf("%s: want status: 250, got: %v (%t)", rcpt, status, ok)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(logs.String(), `call=s.forwarder.Close err="close failed"`); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("close err not logged: %s", logs.String())
+		}
+	}
+}
+
+// Pipelined commands are replied to in order, even when an
+// earlier recipient's resolution is slow or fails.
+func TestLMTPServerPipelining(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		switch in {
+		case "slow":
+			time.Sleep(100 * time.Millisecond)
+		case "noemail":
+			return "", ErrNoEmail
+		}
+		return testResolver(ctx, in)
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if err := text.PrintfLine("LHLO ensmail-testclient.local"); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(msg, "PIPELINING") {
+		t.Fatalf("PIPELINING not advertised: %s", msg)
+	}
+
+	// Send the whole command group in one write.
+	if _, err := io.WriteString(conn, "MAIL FROM:<sender@public.com>\r\n"+
+		"RCPT TO:<slow@ensmail.org>\r\n"+
+		"RCPT TO:<noemail@ensmail.org>\r\n"+
+		"RCPT TO:<fast@ensmail.org>\r\n"+
+		"DATA\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	for _, exp := range []struct {
+		code int
+		msg  string
+	}{
+		{250, ""},
+		{250, ""},
+		{DefaultErrorCodes[ErrNoEmail].Code, DefaultErrorCodes[ErrNoEmail].Message},
+		{250, ""},
+		{354, ""},
+	} {
+		if _, msg, err := text.ReadResponse(exp.code); err != nil {
+			t.Fatal(err)
+		} else if !strings.Contains(msg, exp.msg) {
+			t.Errorf("want reply: %d %s, got: %s", exp.code, exp.msg, msg)
+		}
+	}
+
+	if _, err := io.WriteString(conn, string(testMsg)+".\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	// One status per accepted recipient.
+	for i := 0; i < 2; i++ {
+		if _, _, err := text.ReadResponse(250); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exp := &testSession{
+		From: "sender@public.com",
+		To:   []string{"slow@resolved.test", "fast@resolved.test"},
+	}
+	exp.Data.Write(testMsg)
+	recorder.check(t, []*testSession{exp})
+}
+
+// Transient forward failures are queued, and reported delivered.
+func TestLMTPServerRetryQueue(t *testing.T) {
+	replies := map[string]*smtp.SMTPError{
+		"busy@resolved.test": {Code: 451, EnhancedCode: smtp.EnhancedCode{4, 2, 1}, Message: "Mailbox busy"},
+	}
+	var delivered [][]string
+	nf := queueForwarder(replies, &delivered)
+
+	q, err := NewRetryQueue(logger, t.TempDir(), nf, time.Minute, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewLMTPServer(logger, testResolver, nf, WithRetryQueue(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	if err := sendMail(sock, "sender@public.com", []string{"busy@ensmail.org", "ok@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	if n, err := q.Len(); err != nil || n != 1 {
+		t.Fatalf("want queued: 1, got: %d, %v", n, err)
+	}
+
+	// Only the queued recipient is retried.
+	delete(replies, "busy@resolved.test")
+	q.process(time.Now().Add(time.Minute))
+	if exp := [][]string{{"busy@resolved.test", "ok@resolved.test"}, {"busy@resolved.test"}}; !reflect.DeepEqual(delivered, exp) {
+		t.Errorf("want forwarded: %v, got: %v", exp, delivered)
+	}
+	if n, err := q.Len(); err != nil || n != 0 {
+		t.Errorf("want queued: 0, got: %d, %v", n, err)
+	}
+}
+
+func TestLMTPServerDataReadTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, testResolver, recorder.Forwarder, WithDataReadTimeout(timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "lmtp.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go srv.Serve(l)
+	defer srv.Close()
+
+	// dial returns a connection, after LHLO, and sends cmds
+	// to it, expecting each of their reply codes.
+	dial := func() (net.Conn, *textproto.Conn, func(code int, cmd string)) {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := textproto.NewConn(conn)
+		if _, _, err := text.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		cmd := func(code int, cmd string) {
+			t.Helper()
+			if err := text.PrintfLine("%s", cmd); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := text.ReadResponse(code); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cmd(250, "LHLO ensmail-testclient.local")
+		return conn, text, cmd
+	}
+
+	// A message received in time is delivered, and the
+	// deadline doesn't outlive it.
+	conn, text, cmd := dial()
+	defer conn.Close()
+	cmd(250, "MAIL FROM:<sender@public.com>")
+	cmd(250, "RCPT TO:<alice@ensmail.org>")
+	cmd(354, "DATA")
+	if _, err := io.WriteString(conn, string(testMsg)+".\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * timeout)
+	cmd(250, "MAIL FROM:<sender@public.com>")
+
+	// A message trickled in slower than the timeout is
+	// rejected, and the connection closed.
+	conn, text, cmd = dial()
+	defer conn.Close()
+	cmd(250, "MAIL FROM:<sender@public.com>")
+	cmd(250, "RCPT TO:<alice@ensmail.org>")
+	cmd(354, "DATA")
+	start := time.Now()
+	go func() {
+		for _, line := range strings.SplitAfter(string(testMsg), "\n") {
+			if _, err := io.WriteString(conn, line); err != nil {
+				return
+			}
+			time.Sleep(timeout / 4)
+		}
+	}()
+	if _, msg, err := text.ReadResponse(errDataReadTimeout.Code); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(msg, errDataReadTimeout.Message) {
+		t.Errorf("want reply: %s, got: %s", errDataReadTimeout.Message, msg)
+	}
+	if elapsed := time.Since(start); elapsed > 4*timeout {
+		t.Errorf("rejected after %s, want about %s", elapsed, timeout)
+	}
+	if _, _, err := text.ReadResponse(221); err != nil {
+		t.Error(err)
+	}
+	if _, err := text.ReadLine(); err == nil {
+		t.Error("connection not closed")
+	}
+
+	// Resolving at DATA doesn't count against the sender's
+	// time to send the message.
+	slow := func(ctx context.Context, in string) (string, error) {
+		time.Sleep(2 * timeout)
+		return testResolver(ctx, in)
+	}
+	srv, err = NewLMTPServer(logger, slow, recorder.Forwarder, WithDataReadTimeout(timeout), WithResolveAtData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock = filepath.Join(t.TempDir(), "lmtp.sock")
+	l, err = net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+	defer srv.Close()
+	if err := sendMail(sock, "sender@public.com", []string{"alice@ensmail.org"}, testMsg); err != nil {
+		t.Error(err)
+	}
+}
+
+// Transactions which fail for every recipient are logged as a
+// whole, and optionally fail DATA.
+func TestLMTPServerFullyFailed(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		switch in {
+		case "noemail":
+			return "", ErrNoEmail
+		case "noresolver":
+			return "", ErrNoResolver
+		}
+		return testResolver(ctx, in)
+	}
+	const event = `err="message fully failed"`
+
+	for _, test := range []struct {
+		name    string
+		opts    []LMTPServerOption
+		rcpts   []string
+		failed  bool
+		dataErr error
+	}{
+		{"rcpt", nil, []string{"noemail@ensmail.org", "noresolver@ensmail.org"}, true, nil},
+		{"partial", nil, []string{"noemail@ensmail.org", "alice@ensmail.org"}, false, nil},
+		{"data", []LMTPServerOption{WithResolveAtData()}, []string{"noemail@ensmail.org", "noresolver@ensmail.org"}, true, nil},
+		{"dataErr", []LMTPServerOption{WithResolveAtData(), WithFullFailureError()}, []string{"noemail@ensmail.org", "noresolver@ensmail.org"}, true, errMessageFailed},
+		{"partialErr", []LMTPServerOption{WithResolveAtData(), WithFullFailureError()}, []string{"noemail@ensmail.org", "alice@ensmail.org"}, false, nil},
+	} {
+		var logs syncBuffer
+		var recorder sessionRecorder
+		srv, err := NewLMTPServer(log.NewLogfmtLogger(&logs), resolver, recorder.Forwarder, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sess, err := srv.NewSession(smtp.ConnectionState{}, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.Mail("sender@public.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		var accepted int
+		for _, rcpt := range test.rcpts {
+			if err := sess.Rcpt(rcpt); err == nil {
+				accepted++
+			}
+		}
+		if accepted > 0 {
+			statuses := make(statusMap)
+			if err := sess.(smtp.LMTPSession).LMTPData(bytes.NewReader(testMsg), statuses); err != test.dataErr {
+				t.Errorf("%s: want data err: %v, got: %v", test.name, test.dataErr, err)
+			}
+		}
+		sess.Reset()
+
+		var events []string
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, event) {
+				events = append(events, line)
+			}
+		}
+		if !test.failed {
+			if len(events) != 0 {
+				t.Errorf("%s: unexpected event: %v", test.name, events)
+			}
+			continue
+		}
+		if len(events) != 1 {
+			t.Fatalf("%s: want 1 event, got: %v", test.name, events)
+		}
+		for _, reason := range []error{ErrNoEmail, ErrNoResolver} {
+			if !strings.Contains(events[0], DefaultErrorCodes[reason].Message) {
+				t.Errorf("%s: want reason %q in: %s", test.name, DefaultErrorCodes[reason].Message, events[0])
+			}
+		}
+		if strings.Contains(events[0], errMessageFailed.Message) {
+			t.Errorf("%s: unexpected reason %q in: %s", test.name, errMessageFailed.Message, events[0])
+		}
+
+		// The event is logged once per transaction.
+		sess.Logout()
+		if n := strings.Count(logs.String(), event); n != 1 {
+			t.Errorf("%s: want 1 event after logout, got: %d", test.name, n)
+		}
+	}
+
+	// Recipients refused for the session's sake, rather than
+	// their own, aren't failures.
+	srv, err := NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
+		return mockForwarder{}, nil
+	}, WithMaxRecipients(1), WithAuth(func(username, password string) error { return nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := srv.NewSession(smtp.ConnectionState{}, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Logout()
+	if err := sess.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Rcpt("alice@ensmail.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Rcpt("bob@ensmail.org"); err != errTooManyRcpts {
+		t.Errorf("want err: %v, got: %v", errTooManyRcpts, err)
+	}
+	sess.(*session).authRequired = true
+	if err := sess.Rcpt("carol@ensmail.org"); err != errAuthRequired {
+		t.Errorf("want err: %v, got: %v", errAuthRequired, err)
+	}
+	if reasons := sess.(*session).outcome.reasons; len(reasons) != 0 {
+		t.Errorf("want no failure reasons, got: %v", reasons)
+	}
+	if n := atomic.LoadInt64(&srv.stats.failed); n != 0 {
+		t.Errorf("want failed: 0, got: %d", n)
+	}
+}
+
+// With WithAuth, TLS senders must authenticate before MAIL,
+// while unix socket senders remain unauthenticated.
+func TestLMTPServerAuth(t *testing.T) {
+	auth := func(username, password string) error {
+		if username != "alice" || password != "secret" {
+			return errors.New("bad credentials")
+		}
+		return nil
+	}
+
+	serve := func(opts ...LMTPServerOption) (sock, addr string, clientTLS *tls.Config) {
+		var recorder sessionRecorder
+		srv, err := NewLMTPServer(logger, testResolver, recorder.Forwarder, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { srv.Close() })
+
+		sock = filepath.Join(t.TempDir(), "lmtp.sock")
+		ul, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(ul)
+
+		tl, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverTLS, clientTLS := testTLSConfigs(t)
+		go srv.ServeTLS(tl, serverTLS)
+		return sock, tl.Addr().String(), clientTLS
+	}
+
+	// mail authenticates (unless username is empty) over TLS,
+	// and returns the error of the first failed command.
+	mail := func(addr string, clientTLS *tls.Config, username, password string) error {
+		conn, err := tls.Dial("tcp", addr, clientTLS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cl, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cl.Close()
+		if username != "" {
+			if err := cl.Auth(sasl.NewPlainClient("", username, password)); err != nil {
+				return err
+			}
+		}
+		if err := cl.Mail("sender@public.com", nil); err != nil {
+			return err
+		}
+		return cl.Rcpt("rcpt@ensmail.org")
+	}
+
+	t.Run("required", func(t *testing.T) {
+		sock, addr, clientTLS := serve(WithAuth(auth))
+
+		for _, test := range []struct {
+			name               string
+			username, password string
+			code               int
+		}{
+			{"none", "", "", errAuthRequired.Code},
+			{"invalid", "alice", "wrong", errAuthInvalid.Code},
+			{"valid", "alice", "secret", 0},
+		} {
+			err := mail(addr, clientTLS, test.username, test.password)
+			var serr *smtp.SMTPError
+			if test.code == 0 && err != nil {
+				t.Errorf("%s: unexpected err: %v", test.name, err)
+			} else if test.code != 0 && (!errors.As(err, &serr) || serr.Code != test.code) {
+				t.Errorf("%s: want code: %d, got: %v", test.name, test.code, err)
+			}
+		}
+
+		if err := sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, testMsg); err != nil {
+			t.Error("unix socket:", err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		sock, addr, clientTLS := serve()
+
+		if err := mail(addr, clientTLS, "alice", "secret"); err == nil {
+			t.Error("want auth err")
+		}
+		if err := mail(addr, clientTLS, "", ""); err != nil {
+			t.Error("unexpected err:", err)
+		}
+		if err := sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, testMsg); err != nil {
+			t.Error("unix socket:", err)
+		}
+	})
+}
+
+// Close logs a summary of the server's lifetime.
+func TestLMTPServerSummary(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		if in == "noemail" {
+			return "", ErrNoEmail
+		}
+		return testResolver(ctx, in)
+	}
+
+	var logs syncBuffer
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(log.NewLogfmtLogger(&logs), resolver, recorder.Forwarder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "lmtp.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	for i := 0; i < 2; i++ {
+		if err := sendMail(sock, "sender@public.com", []string{"alice@ensmail.org", "noemail@ensmail.org"}, testMsg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.Close()
+
+	exp := "summary=lifetime messages=2 resolved=2 delivered=2 failed=2"
+	if !strings.Contains(logs.String(), exp) {
+		t.Errorf("want %q in: %s", exp, logs.String())
+	}
+}
+
+func TestLMTPServerOnResolveResult(t *testing.T) {
+	errRPC := errors.New("dial tcp: connection refused")
+	resolver := func(ctx context.Context, in string) (string, error) {
+		switch in {
+		case "noemail":
+			return "", ErrNoEmail
+		case "rpcfail":
+			return "", errRPC
+		}
+		return testResolver(ctx, in)
+	}
+
+	type result struct {
+		name, resolved string
+		err            error
+		userFault      bool
+	}
+	var (
+		mu      sync.Mutex
+		results []result
+	)
+	onResolve := func(name, resolved string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, result{name, resolved, err, IsUserFault(err)})
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder, WithOnResolveResult(onResolve))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "lmtp.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+	defer srv.Close()
+
+	if err := sendMail(sock, "sender@public.com", []string{"alice@ensmail.org", "noemail@ensmail.org", "rpcfail@ensmail.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []result{
+		{"alice", "alice@resolved.test", nil, false},
+		{"noemail", "", ErrNoEmail, true},
+		{"rpcfail", "", errRPC, false},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(results, exp) {
+		t.Errorf("want results: %v, got: %v", exp, results)
+	}
+}
+
+// With WithProxyProtocol, the remote address of connections from
+// trusted upstreams is read from their PROXY protocol header.
+func TestLMTPServerProxyProtocol(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+
+	serve := func(trusted string) (addr string, logs *syncBuffer) {
+		_, n, err := net.ParseCIDR(trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs = new(syncBuffer)
+		var recorder sessionRecorder
+		srv, err := NewLMTPServer(log.NewLogfmtLogger(logs), testResolver, recorder.Forwarder, WithProxyProtocol(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { srv.Close() })
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.ServeTLS(l, serverTLS)
+		return l.Addr().String(), logs
+	}
+
+	addr, logs := serve("127.0.0.0/8")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, "PROXY TCP4 203.0.113.7 192.0.2.1 5555 25\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	proxiedTLS := clientTLS.Clone()
+	proxiedTLS.ServerName = "127.0.0.1"
+	if err := sendMailConn(tls.Client(conn, proxiedTLS), "sender@public.com", nil, []string{"rcpt@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	if !strings.Contains(logs.String(), "remote=203.0.113.7:5555") {
+		t.Errorf("proxied address not logged: %s", logs.String())
+	}
+
+	// Trusted upstreams must send a header.
+	if conn, err := tls.Dial("tcp", addr, clientTLS); err == nil {
+		conn.Close()
+		t.Error("want err without proxy header")
+	}
+
+	// Other clients are served directly.
+	addr, logs = serve("10.0.0.0/8")
+	conn, err = tls.Dial("tcp", addr, clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendMailConn(conn, "sender@public.com", nil, []string{"rcpt@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	if exp := "remote=" + conn.LocalAddr().String(); !strings.Contains(logs.String(), exp) {
+		t.Errorf("want %q in: %s", exp, logs.String())
+	}
+}
+
+// Recipients whose forward status never arrives are temporarily
+// failed once the status timeout expires, rather than left without
+// a status.
+func TestLMTPServerMissingStatus(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		return in, nil
+	}
+
+	srv, err := NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
+		var rcpts []string
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpts = append(rcpts, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				return Closer{
+					Writer: io.Discard,
+					closeFunc: func() error {
+						// The last recipient's status never arrives.
+						for _, rcpt := range rcpts[:len(rcpts)-1] {
+							statusCb(rcpt, nil)
+						}
+						return nil
+					},
+				}, nil
+			},
+		}, nil
+	}, WithForwardStatusTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := srv.NewSession(smtp.ConnectionState{}, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"rcpt1@ensmail.org", "rcpt2@ensmail.org"} {
+		if err := sess.Rcpt(rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statuses := make(statusMap)
+	sess.(smtp.LMTPSession).LMTPData(bytes.NewReader(testMsg), statuses)
+	if len(statuses) != 2 {
+		t.Fatalf("want 2 statuses, got: %v", statuses)
+	}
+	if err := statuses["rcpt1@ensmail.org"]; err != nil {
+		t.Errorf("want rcpt1 delivered, got: %v", err)
+	}
+	var serr *smtp.SMTPError
+	if err := statuses["rcpt2@ensmail.org"]; !errors.As(err, &serr) || !serr.Temporary() {
+		t.Errorf("want rcpt2 tempfail, got: %v", err)
+	}
+}
+
+// Temporary failures of configured scenarios suggest a retry
+// interval.
+func TestLMTPServerRetryAfter(t *testing.T) {
+	policy := &RelayPolicy{DomainRateLimit: 1, DomainRateWindow: time.Hour}
+	srv, err := NewLMTPServer(logger, testResolver, func() (ForwarderClient, error) {
+		return mockForwarder{}, nil
+	}, WithRelayPolicy(policy), WithRetryAfter(TempfailRateLimit, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := srv.NewSession(smtp.ConnectionState{}, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Rcpt("rcpt1@ensmail.org"); err != nil {
+		t.Fatal(err)
+	}
+	err = sess.Rcpt("rcpt2@ensmail.org")
+	var serr *smtp.SMTPError
+	if !errors.As(err, &serr) || serr.Code != errPolicyDomainRate.Code || !strings.HasSuffix(serr.Message, "(retry after 60 seconds)") {
+		t.Errorf("want hinted err: %v, got: %v", errPolicyDomainRate, err)
+	}
+}
+
+// Messages sent in BDAT chunks (RFC 3030 CHUNKING) are resolved,
+// forwarded, and replied to per recipient, like DATA.  An
+// aborted chunked transaction is reset once its forward stops.
+func TestLMTPServerChunking(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		if in == "noemail" {
+			return "", ErrNoEmail
+		}
+		return testResolver(ctx, in)
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	dial := func() (net.Conn, *textproto.Conn) {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := textproto.NewConn(conn)
+		if _, _, err := text.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		if err := text.PrintfLine("LHLO ensmail-testclient.local"); err != nil {
+			t.Fatal(err)
+		}
+		if _, msg, err := text.ReadResponse(250); err != nil {
+			t.Fatal(err)
+		} else if !strings.Contains(msg, "CHUNKING") {
+			t.Fatalf("CHUNKING not advertised: %s", msg)
+		}
+		return conn, text
+	}
+
+	conn, text := dial()
+	defer conn.Close()
+
+	for _, line := range []string{"MAIL FROM:<sender@public.com>", "RCPT TO:<rcpt1@ensmail.org>", "RCPT TO:<noemail@ensmail.org>", "RCPT TO:<rcpt2@ensmail.org>"} {
+		if err := text.PrintfLine("%s", line); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := text.ReadResponse(0); err != nil && !strings.Contains(line, "noemail") {
+			t.Fatal(err)
+		}
+	}
+
+	// Chunks needn't end at line boundaries.
+	split := len(testMsg) / 2
+	if _, err := fmt.Fprintf(conn, "BDAT %d\r\n%s", split, testMsg[:split]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(conn, "BDAT %d LAST\r\n%s", len(testMsg)-split, testMsg[split:]); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"rcpt1@ensmail.org", "rcpt2@ensmail.org"} {
+		if _, msg, err := text.ReadResponse(250); err != nil {
+			t.Fatal(err)
+		} else if !strings.Contains(msg, rcpt) {
+			t.Errorf("want status of %s, got: %s", rcpt, msg)
+		}
+	}
+	recorder.check(t, []*testSession{{
+		From: "sender@public.com",
+		To:   []string{"rcpt1@resolved.test", "rcpt2@resolved.test"},
+		Data: *bytes.NewBuffer(testMsg),
+	}})
+
+	// RSET between chunks aborts the transaction.
+	conn, text = dial()
+	defer conn.Close()
+	for _, line := range []string{"MAIL FROM:<sender@public.com>", "RCPT TO:<rcpt3@ensmail.org>"} {
+		if err := text.PrintfLine("%s", line); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := text.ReadResponse(250); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fmt.Fprintf(conn, "BDAT %d\r\n%s", split, testMsg[:split]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	if err := text.PrintfLine("RSET"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	if err := text.PrintfLine("QUIT"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := text.ReadResponse(221); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The ENS state of on-chain resolutions is added to forwarded
+// messages' headers.
+func TestLMTPServerResolutionHeaders(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		if in == "rcpt1" {
+			reportResult(ctx, ResolveResult{
+				Email:    in + "@resolved.test",
+				Node:     [32]byte{0xab},
+				Resolver: common.HexToAddress("0x231b0Ee14048e9dCcD1d247744d114a4EB5E8E63"),
+				ChainID:  big.NewInt(1),
+			})
+		}
+		return testResolver(ctx, in)
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder, WithResolutionHeaders())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt1@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	// rcpt2 isn't resolved on-chain, so has no headers.
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt2@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	// A copy shared by recipients has no headers, so doesn't
+	// disclose rcpt1's resolution to rcpt2.
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt2@ensmail.org", "rcpt1@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	if len(recorder.sessions) != 3 {
+		t.Fatalf("want 3 sessions, got: %d", len(recorder.sessions))
+	}
+
+	ensmailtest.CheckPrepended(t, recorder.sessions[0].Data.Bytes(), testMsg,
+		"X-ENSMail-Chain-Id: 1",
+		"X-ENSMail-Node: 0xab00000000000000000000000000000000000000000000000000000000000000; resolved=rcpt1@resolved.test",
+		"X-ENSMail-Resolver: 0x231b0Ee14048e9dCcD1d247744d114a4EB5E8E63; resolved=rcpt1@resolved.test",
+	)
+	ensmailtest.CheckPrepended(t, recorder.sessions[1].Data.Bytes(), testMsg)
+	ensmailtest.CheckPrepended(t, recorder.sessions[2].Data.Bytes(), testMsg)
+}
+
+// With subdomain names, recipients at a subdomain of the base
+// domain resolve by the subdomain, ignoring their local-part.
+func TestLMTPServerSubdomainNames(t *testing.T) {
+	testENS, err := ens.NewTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := testENS.Accts[1]
+	for label, email := range map[string]string{"alice": "alice@resolved.test", "x": "x@resolved.test"} {
+		node, err := testENS.Register(owner.Addr, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testENS.Chain.Succeed(testENS.Registry.SetResolver(owner.Auth, node, testENS.ResolverAddr)) {
+			t.Fatal("unable to set resolver")
+		}
+		if !testENS.Chain.Succeed(testENS.Resolver.SetText(owner.Auth, node, "email", email)) {
+			t.Fatal("unable to set text")
+		}
+	}
+	resolver, err := NewENSResolver(testENS.RegistryAddr, testENS.Chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		rcpt, resolved string
+	}{
+		{"x@alice.ensmail.test", "alice@resolved.test"},
+		{"x@Alice.ENSMail.test.", "alice@resolved.test"},
+		{"x@ensmail.test", "x@resolved.test"},
+		{"x@alice.other.test", "x@resolved.test"},
+	} {
+		var recorder sessionRecorder
+		srv, err := NewLMTPServer(logger, resolver.Email, recorder.Forwarder, WithSubdomainNames("ensmail.test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sock := filepath.Join(t.TempDir(), "lmtp.sock")
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(l)
+
+		if err := sendMail(sock, "sender@public.com", []string{test.rcpt}, testMsg); err != nil {
+			t.Errorf("%s: unexpected err: %v", test.rcpt, err)
+		} else if len(recorder.sessions) != 1 || !cmp.Equal(recorder.sessions[0].To, []string{test.resolved}) {
+			t.Errorf("%s: want forward to: %s, got: %+v", test.rcpt, test.resolved, recorder.sessions)
+		}
+		srv.Close()
+		l.Close()
+	}
+}
+
+// While tracing, each transaction's resolve and forward stages
+// are recorded as regions.
+func TestLMTPServerTrace(t *testing.T) {
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, testResolver, recorder.Forwarder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		t.Skip("tracing unavailable:", err)
+	}
+	err = sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, testMsg)
+	trace.Stop()
+	if err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	for _, name := range []string{"ensmail.message", "ensmail.resolve", "ensmail.forward"} {
+		if !bytes.Contains(buf.Bytes(), []byte(name)) {
+			t.Errorf("%s not traced", name)
+		}
+	}
+}
+
+// A message whose recipients all failed is never forwarded, or
+// reported as delivered.
+func TestLMTPServerNoResolvedRcpts(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		if in == "noexist" {
+			return "", ErrNoResolver
+		}
+		return testResolver(ctx, in)
+	}
+	var forwarded int32
+	srv, err := NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				if to == "full@resolved.test" {
+					return &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}, Message: "Mailbox full"}
+				}
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				atomic.AddInt32(&forwarded, 1)
+				return Closer{Writer: io.Discard}, nil
+			},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	// Rejected at RCPT by resolution, or by the forwarder.
+	if err := sendMail(sock, "sender@public.com", []string{"noexist@ensmail.org", "full@ensmail.org"}, testMsg); err == nil {
+		t.Error("want err")
+	}
+
+	// Sessions used without go-smtp's RCPT check fail DATA.
+	sess, err := srv.NewSession(smtp.ConnectionState{}, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Logout()
+	if err := sess.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Rcpt("full@ensmail.org"); err == nil {
+		t.Fatal("want rcpt err")
+	}
+	statuses := make(statusMap)
+	if err := sess.(smtp.LMTPSession).LMTPData(bytes.NewReader(testMsg), statuses); err != errNoRcpts {
+		t.Errorf("want err: %v, got: %v", errNoRcpts, err)
+	}
+	if len(statuses) != 0 {
+		t.Errorf("unexpected statuses: %v", statuses)
+	}
+
+	if n := atomic.LoadInt32(&forwarded); n != 0 {
+		t.Errorf("want no forwarded messages, got: %d", n)
+	}
+}
+
+// Only the allowlisted header fields of messages are logged, and
+// messages are forwarded unchanged.
+func TestLMTPServerHeaderLogging(t *testing.T) {
+	var logs syncBuffer
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, testResolver, recorder.Forwarder, WithHeaderLogging(log.NewLogfmtLogger(&logs), "Subject", " to", "Received"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	exp := &testSession{
+		From: "sender@public.com",
+		To:   []string{"rcpt@resolved.test"},
+	}
+	exp.Data.Write(testMsg)
+	recorder.check(t, []*testSession{exp})
+
+	got := logs.String()
+	for _, want := range []string{
+		`Subject="discount Gophers!"`,
+		"to=recipient@example.net",
+		// Folded fields are unfolded.
+		`Received="from localhost (localhost [127.0.0.1]) by mx.maddy.test (envelope-sender <sender@example.org>) with UTF8ESMTP id e6fa8a02; Fri, 25 Feb 2022 16:39:27 -0500"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log missing %s: %q", want, got)
+		}
+	}
+	for _, unwanted := range []string{"e6fa8a02@mx.maddy.test", "email body"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("log contains %q: %q", unwanted, got)
+		}
+	}
+}
+
+// Each recipient's resolution is bounded by the resolve timeout,
+// so a hung lookup doesn't hold up the session's other recipients.
+func TestLMTPServerResolveTimeout(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		if in == "hung" {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		return testResolver(ctx, in)
+	}
+	// The name's policy lookup shares the timeout.
+	policy := func(ctx context.Context, name string) (NamePolicy, error) {
+		if name == "hungpolicy" {
+			<-ctx.Done()
+			return NamePolicy{}, ctx.Err()
+		}
+		return NamePolicy{}, nil
+	}
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder, WithResolveTimeout(50*time.Millisecond), WithNamePolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := srv.NewSession(smtp.ConnectionState{}, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Logout()
+	if err := sess.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for _, to := range []string{"first@ensmail.org", "hung@ensmail.org", "hungpolicy@ensmail.org", "last@ensmail.org"} {
+		want := error(nil)
+		if strings.HasPrefix(to, "hung") {
+			want = DefaultErrorCodes[context.DeadlineExceeded]
+		}
+		if err := sess.Rcpt(to); !cmp.Equal(err, want) {
+			t.Errorf("%q: want err: %v, got: %v", to, want, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("resolutions took %v", elapsed)
+	}
+
+	statuses := make(statusMap)
+	if err := sess.(smtp.LMTPSession).LMTPData(bytes.NewReader(testMsg), statuses); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	exp := &testSession{
+		From: "sender@public.com",
+		To:   []string{"first@resolved.test", "last@resolved.test"},
+	}
+	exp.Data.Write(testMsg)
+	recorder.check(t, []*testSession{exp})
+}
+
+// The sender's MAIL parameters survive the hop to the forwarding
+// server.
+func TestLMTPServerMailParams(t *testing.T) {
+	fwdSock := filepath.Join(t.TempDir(), "forward.sock")
+	fl, err := net.Listen("unix", fwdSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+	cmds := mailCmdServer(fl, "8BITMIME", "SMTPUTF8", "AUTH")
+
+	d := LMTPDialer{Network: "unix", Addr: fwdSock, Timeout: time.Second}
+	srv, err := NewLMTPServer(logger, testResolver, d.NewForwarderClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := cl.Hello("ensmail-testclient.local"); err != nil {
+		t.Fatal(err)
+	}
+
+	// go-smtp's client only sends AUTH to servers which advertise
+	// it, so MAIL is sent directly.
+	id, err := cl.Text.Cmd("MAIL FROM:<sender@public.com> BODY=8BITMIME SMTPUTF8 AUTH=<sender+2Btag@public.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.Text.StartResponse(id)
+	_, _, err = cl.Text.ReadResponse(250)
+	cl.Text.EndResponse(id)
+	if err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+
+	exp := "MAIL FROM:<sender@public.com> BODY=8BITMIME SMTPUTF8 AUTH=sender+2Btag@public.com"
+	select {
+	case cmd := <-cmds:
+		if cmd != exp {
+			t.Errorf("want: %q, got: %q", exp, cmd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MAIL not forwarded")
+	}
+}
+
+// Once Shutdown begins, new transactions are rejected with 421,
+// and open transactions, including DATA in progress, complete
+// before the server closes.
+func TestLMTPServerShutdown(t *testing.T) {
+	forwarding, release := make(chan struct{}), make(chan struct{})
+	srv, err := NewLMTPServer(logger, testResolver, func() (ForwarderClient, error) {
+		var rcpts []string
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpts = append(rcpts, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				return Closer{
+					Writer: io.Discard,
+					closeFunc: func() error {
+						close(forwarding)
+						<-release
+						for _, rcpt := range rcpts {
+							statusCb(rcpt, nil)
+						}
+						return nil
+					},
+				}, nil
+			},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	if err := idle.Hello("ensmail-testclient.local"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err = net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := smtp.NewClientLMTP(conn, "ensmail-testclient.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	if err := open.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendMail(sock, "sender@public.com", []string{"rcpt@ensmail.org"}, testMsg)
+	}()
+	<-forwarding
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+	<-srv.shutdown
+
+	var smtpErr *smtp.SMTPError
+	if err := idle.Mail("sender@public.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != errShuttingDown.Code {
+		t.Errorf("want err: %v, got: %v", errShuttingDown, err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown before DATA completed: %v", err)
+	default:
+	}
+
+	close(release)
+	if err := <-sent; err != nil {
+		t.Error("unexpected err:", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown before open transaction ended: %v", err)
+	case <-time.After(2 * shutdownPollInterval):
+	}
+
+	if err := open.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error("unexpected err:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't complete")
+	}
+}
+
+// Header fields injected by several features together are
+// prepended to the message, which is otherwise forwarded
+// unmodified.
+func TestLMTPServerInjectedHeaders(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		if in == "rcpt1" {
+			reportResult(ctx, ResolveResult{
+				Email:    in + "@resolved.test",
+				Node:     [32]byte{0xab},
+				Resolver: common.HexToAddress("0x231b0Ee14048e9dCcD1d247744d114a4EB5E8E63"),
+				ChainID:  big.NewInt(1),
+			})
+		}
+		return testResolver(ctx, in)
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recorder sessionRecorder
+	srv, err := NewLMTPServer(logger, resolver, recorder.Forwarder, WithResolutionHeaders(), WithResolutionSigning(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := serveTest(t, srv)
+	defer srv.Close()
+
+	start := time.Now().Truncate(time.Second)
+	if err := sendMail(sock, "sender@public.com", []string{"rcpt1@ensmail.org"}, testMsg); err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+	end := time.Now()
+	if len(recorder.sessions) != 1 {
+		t.Fatalf("want 1 session, got: %d", len(recorder.sessions))
+	}
+	got := recorder.sessions[0].Data.Bytes()
+
+	// Signatures are of the time of forwarding, which is within
+	// the second of one of start...end.
+	fields := func(now time.Time) []string {
+		res := Resolution{Original: "rcpt1@ensmail.org", Resolved: "rcpt1@resolved.test", Time: now}
+		fields := strings.Split(strings.TrimSuffix(signResolution(key, res), "\r\n"), "\r\n")
+		return append(fields,
+			"X-ENSMail-Chain-Id: 1",
+			"X-ENSMail-Node: 0xab00000000000000000000000000000000000000000000000000000000000000; resolved=rcpt1@resolved.test",
+			"X-ENSMail-Resolver: 0x231b0Ee14048e9dCcD1d247744d114a4EB5E8E63; resolved=rcpt1@resolved.test",
+		)
+	}
+	now := start
+	for now.Add(time.Second).Before(end) && !bytes.Equal(got, ensmailtest.Prepended(testMsg, fields(now)...)) {
+		now = now.Add(time.Second)
+	}
+	ensmailtest.CheckPrepended(t, got, testMsg, fields(now)...)
+}
+
+// The status timeout restarts with each status, so statuses which
+// arrive steadily aren't failed, however long they take in total.
+func TestLMTPServerSlowStatuses(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		return in, nil
+	}
+
+	srv, err := NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
+		var rcpts []string
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpts = append(rcpts, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				return Closer{
+					Writer: io.Discard,
+					closeFunc: func() error {
+						go func() {
+							for _, rcpt := range rcpts {
+								time.Sleep(20 * time.Millisecond)
+								statusCb(rcpt, nil)
+							}
+						}()
+						return nil
+					},
+				}, nil
+			},
+		}, nil
+	}, WithForwardStatusTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := srv.NewSession(smtp.ConnectionState{}, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Mail("sender@public.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		if err := sess.Rcpt(fmt.Sprintf("rcpt%d@ensmail.org", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statuses := make(statusMap)
+	sess.(smtp.LMTPSession).LMTPData(bytes.NewReader(testMsg), statuses)
+	if len(statuses) != 8 {
+		t.Fatalf("want 8 statuses, got: %v", statuses)
+	}
+	for rcpt, err := range statuses {
+		if err != nil {
+			t.Errorf("%s: want delivered, got: %v", rcpt, err)
+		}
+	}
+}
+
+// Transactions accepted before forward DATA concurrency was
+// saturated wait for a DATA operation, and are temporarily failed
+// if none completes in time.
+func TestLMTPServerDataConcurrencyWait(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		return in, nil
+	}
+
+	inData := make(chan struct{})
+	release := make(chan struct{})
+	srv, err := NewLMTPServer(logger, resolver, func() (ForwarderClient, error) {
+		var rcpts []string
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpts = append(rcpts, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				inData <- struct{}{}
+				return Closer{
+					Writer: io.Discard,
+					closeFunc: func() error {
+						<-release
+						for _, rcpt := range rcpts {
+							statusCb(rcpt, nil)
+						}
+						return nil
+					},
+				}, nil
+			},
+		}, nil
+	}, WithDataConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.dataSemWait = 50 * time.Millisecond
+
+	// Both transactions are accepted before either's DATA.
+	var sessions []smtp.LMTPSession
+	for _, rcpt := range []string{"rcpt1@ensmail.org", "rcpt2@ensmail.org"} {
+		sess, err := srv.NewSession(smtp.ConnectionState{}, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.Mail("sender@public.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.Rcpt(rcpt); err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, sess.(smtp.LMTPSession))
+	}
+
+	blocked := make(chan error)
+	go func() {
+		blocked <- sessions[0].LMTPData(bytes.NewReader(testMsg), make(statusMap))
+	}()
+	<-inData
+
+	err = sessions[1].LMTPData(bytes.NewReader(testMsg), make(statusMap))
+	var serr *smtp.SMTPError
+	if !errors.As(err, &serr) || serr.Code != 451 || serr.EnhancedCode != errDataSaturated.EnhancedCode {
+		t.Errorf("want err: %s, got: %v", errDataSaturated, err)
+	}
+
+	close(release)
+	if err := <-blocked; err != nil {
+		t.Fatal("unexpected err:", err)
+	}
+}
+
+// testTLSConfigs returns a server TLS config with a self-signed
+// certificate for 127.0.0.1, and a client TLS config which trusts it.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ensmail.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	client = &tls.Config{RootCAs: pool}
+	return server, client
+}
+
+// syncBuffer is a concurrency safe bytes.Buffer.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// stageHistogram returns the messageStageSeconds histogram of stage.
+func stageHistogram(t *testing.T, stage string) *dto.Histogram {
+	var m dto.Metric
+	if err := messageStageSeconds.WithLabelValues(stage).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram()
+}
+
+// BenchmarkLMTPServer measures delivery of a message to two
+// recipients, with a resolver and forwarder which respond instantly.
+// Compare with the message_stage_seconds metric of a deployment, to
+// see whether resolution or forwarding dominates delivery time.
+func BenchmarkLMTPServer(b *testing.B) {
+	srv, err := NewLMTPServer(logger, testResolver, func() (ForwarderClient, error) {
+		var rcpts []string
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpts = append(rcpts, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				return Closer{
+					Writer: io.Discard,
+					closeFunc: func() error {
+						for _, rcpt := range rcpts {
+							statusCb(rcpt, nil)
+						}
+						return nil
+					},
+				}, nil
+			},
+			resetFunc: func() error {
+				rcpts = nil
+				return nil
+			},
+		}, nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	sock := filepath.Join(b.TempDir(), "lmtp.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	go srv.Serve(l)
+	defer srv.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sendMail(sock, "sender@public.com", []string{"rcpt1@ensmail.org", "rcpt2@ensmail.org"}, testMsg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// statusMap is a StatusCollector which records each recipient's
+// status.
+type statusMap map[string]error
+
+func (m statusMap) SetStatus(rcpt string, err error) {
+	m[rcpt] = err
+}
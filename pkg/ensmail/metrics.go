@@ -0,0 +1,78 @@
+package ensmail
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are registered with the default prometheus registry, and
+// are exposed by promhttp.Handler().
+var (
+	activeSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ensmail",
+		Name:      "lmtp_sessions_active",
+		Help:      "Number of active inbound LMTP sessions.",
+	})
+	openForwarders = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ensmail",
+		Name:      "forwarder_connections_open",
+		Help:      "Number of open forwarder connections.",
+	})
+	sessionsByClient = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ensmail",
+		Name:      "lmtp_sessions_total",
+		Help:      "Number of inbound LMTP sessions, by hash bucket of the client's LHLO hostname.",
+	}, []string{"client_bucket"})
+	fanInAnomalies = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ensmail",
+		Name:      "resolved_fanin_anomalies_total",
+		Help:      "Number of times a resolved address became the target of more distinct ENS names than the fan-in threshold.",
+	})
+	messageStageSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ensmail",
+		Name:      "message_stage_seconds",
+		Help:      "Time spent per message in each delivery stage: resolving recipients, forwarding the message, and waiting for forwarder statuses.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"stage"})
+	resolveSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ensmail",
+		Name:      "resolve_seconds",
+		Help:      "Time taken to resolve a name, by resolver backend: ens-onchain, contract, subgraph, static, or cache (hits only, misses are observed by the cached backend).",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"backend"})
+)
+
+func init() {
+	prometheus.MustRegister(activeSessions, openForwarders, sessionsByClient, fanInAnomalies, messageStageSeconds, resolveSeconds)
+}
+
+// Resolver backend labels of resolveSeconds.
+const (
+	backendENS      = "ens-onchain"
+	backendContract = "contract"
+	backendSubgraph = "subgraph"
+	backendStatic   = "static"
+	backendCache    = "cache"
+)
+
+// observeResolve records the time since start, at which backend
+// began resolving a name, in resolveSeconds.
+func observeResolve(backend string, start time.Time) {
+	resolveSeconds.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+}
+
+// clientBuckets bounds the client_bucket label values.
+const clientBuckets = 32
+
+// clientBucket hashes a client-chosen hostname into one of
+// clientBuckets label values, so clients can't grow metric
+// cardinality by varying their LHLO hostname.
+func clientBucket(hostname string) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(hostname)))
+	return strconv.Itoa(int(h.Sum32() % clientBuckets))
+}
@@ -0,0 +1,88 @@
+package ensmail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"sync"
+)
+
+// ErrNameRejected is returned for names overridden with
+// OverrideReject.
+var ErrNameRejected = errors.New("name rejected by override")
+
+// OverrideReject is the override which rejects a name's mail, rather
+// than forwarding it anywhere.
+const OverrideReject = "reject"
+
+// Overrides are operator set resolutions of names, which take
+// precedence over the chain (and any cache), for emergencies such as
+// a compromised or misconfigured email record.  Overrides may be
+// reloaded while in use.
+type Overrides struct {
+	mu    sync.RWMutex
+	names map[string]string // by normalized name
+}
+
+// Load replaces the overrides with the JSON object read from r,
+// which maps names to their email address, or to OverrideReject:
+//
+//	{
+//		"alice": "alice@example.com",
+//		"compromised": "reject"
+//	}
+//
+// If r is invalid, the current overrides are kept.
+func (o *Overrides) Load(r io.Reader) error {
+	var overrides map[string]string
+	if err := json.NewDecoder(r).Decode(&overrides); err != nil {
+		return err
+	}
+	names := make(map[string]string, len(overrides))
+	for name, email := range overrides {
+		key, err := nameKey(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w: %v", name, ErrInvalidLabel, err)
+		}
+		if email != OverrideReject {
+			if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+				return fmt.Errorf("%s: %w: %s", name, ErrInvalidResolved, email)
+			}
+		}
+		names[key] = email
+	}
+
+	o.mu.Lock()
+	o.names = names
+	o.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of overridden names.
+func (o *Overrides) Len() int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return len(o.names)
+}
+
+// Resolve returns a ResolveFunc which resolves overridden names from
+// o, failing names overridden with OverrideReject with
+// ErrNameRejected, and other names with resolve.
+func (o *Overrides) Resolve(resolve ResolveFunc) ResolveFunc {
+	return func(ctx context.Context, name string) (string, error) {
+		if key, err := nameKey(name); err == nil {
+			o.mu.RLock()
+			email, ok := o.names[key]
+			o.mu.RUnlock()
+			if ok && email == OverrideReject {
+				return "", ErrNameRejected
+			} else if ok {
+				return email, nil
+			}
+		}
+		return resolve(ctx, name)
+	}
+}
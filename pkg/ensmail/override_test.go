@@ -0,0 +1,74 @@
+package ensmail
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestOverrides(t *testing.T) {
+	var calls int
+	resolve := func(ctx context.Context, name string) (string, error) {
+		calls++
+		return name + "@chain.test", nil
+	}
+
+	var o Overrides
+	if err := o.Load(strings.NewReader(`{
+		"Alice": "alice@override.test",
+		"Under_Score": "underscore@override.test",
+		"compromised": "reject"
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	r := o.Resolve(resolve)
+
+	for _, test := range []struct {
+		name, email string
+		err         error
+	}{
+		// Overrides are matched by normalized name.
+		{"alice", "alice@override.test", nil},
+		{"ALICE", "alice@override.test", nil},
+		{"under_score", "underscore@override.test", nil},
+		{"compromised", "", ErrNameRejected},
+		{"bob", "bob@chain.test", nil},
+	} {
+		if got, err := r(context.Background(), test.name); err != test.err || got != test.email {
+			t.Errorf("%s: want: %s, %v, got: %s, %v", test.name, test.email, test.err, got, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("want calls: 1, got: %d", calls)
+	}
+
+	// Invalid overrides are rejected, and the current overrides
+	// kept.
+	for _, bad := range []string{`{"⒈x": "x@override.test"}`, `{"alice": "not an address"}`, `{"alice": "Alice <alice@override.test>"}`, `[`} {
+		if err := o.Load(strings.NewReader(bad)); err == nil {
+			t.Errorf("%s: want err", bad)
+		}
+	}
+	if o.Len() != 3 {
+		t.Errorf("want overrides: 3, got: %d", o.Len())
+	}
+
+	// Reloaded overrides replace the current overrides.
+	if err := o.Load(strings.NewReader(`{"compromised": "fixed@override.test"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r(context.Background(), "compromised"); err != nil || got != "fixed@override.test" {
+		t.Errorf("want: fixed@override.test, got: %s, %v", got, err)
+	}
+	if got, err := r(context.Background(), "alice"); err != nil || got != "alice@chain.test" {
+		t.Errorf("want: alice@chain.test, got: %s, %v", got, err)
+	}
+
+	if reply := DefaultErrorCodes.reply(ErrNameRejected); !errors.Is(reply, DefaultErrorCodes[ErrNameRejected]) {
+		t.Errorf("want reply: %v, got: %v", DefaultErrorCodes[ErrNameRejected], reply)
+	}
+	if !IsUserFault(ErrNameRejected) {
+		t.Error("want ErrNameRejected user fault")
+	}
+}
@@ -0,0 +1,311 @@
+package ensmail
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	errPolicyDomain = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Forwarding to this domain is not permitted",
+	}
+	errPolicyDomainRate = &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Too many forwards to this domain, try again later",
+	}
+	errPolicySourceNames = &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Too many distinct recipients from this sender, try again later",
+	}
+	errPolicySourceRcpts = &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Too many recipients from this sender, try again later",
+	}
+)
+
+// RelayPolicy limits how ensmail may be used to forward mail, to
+// prevent its use as an open relay to arbitrary addresses (as anyone
+// can register an ENS name which resolves to any email address).
+// Zero valued fields are not enforced.
+type RelayPolicy struct {
+	// AllowedDomains restricts resolved addresses to these domains.
+	AllowedDomains []string
+
+	// DomainRateLimit is the maximum number of recipients forwarded
+	// to a single resolved domain per DomainRateWindow.
+	DomainRateLimit  int
+	DomainRateWindow time.Duration
+
+	// SourceNameLimit is the maximum number of distinct ENS names a
+	// single sender (MAIL FROM address) may send to per
+	// SourceNameWindow.
+	SourceNameLimit  int
+	SourceNameWindow time.Duration
+
+	// SourceRcptLimit is the maximum number of recipients a single
+	// sender may be forwarded to (across its messages and sessions,
+	// counting repeated names) in any SourceRcptWindow, which caps
+	// its total fan-out.  Unlike the other limits, the window is
+	// rolling.  The limit is advisory, as senders can forge any MAIL
+	// FROM address, and isn't applied to the null sender ("<>", of
+	// bounces), which is shared by every sender's bounces.
+	SourceRcptLimit  int
+	SourceRcptWindow time.Duration
+
+	now func() time.Time
+
+	mu          sync.Mutex
+	pruned      time.Time
+	domainRates map[string]*rateWindow
+	sourceNames map[string]*nameWindow
+	sourceRcpts map[string][]time.Time // times of each sender's forwards, oldest first
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+type nameWindow struct {
+	start time.Time
+	names map[string]bool
+}
+
+// check returns an error if forwarding from source to resolved (the
+// resolution of ENS name) violates the policy.  check doesn't count
+// the forward against the policy's limits: record does, once it's
+// forwarded, so recipients the forwarder rejects aren't counted.
+// Forwards checked concurrently may each pass before either is
+// recorded, so limits may be exceeded by as many.
+func (p *RelayPolicy) check(source, name, resolved string) error {
+	domain := resolvedDomain(resolved)
+
+	if len(p.AllowedDomains) > 0 {
+		allowed := false
+		for _, d := range p.AllowedDomains {
+			if strings.EqualFold(d, domain) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errPolicyDomain
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.time()
+	p.prune(now)
+	source = strings.ToLower(source)
+
+	if p.DomainRateLimit > 0 {
+		if p.domainRate(domain, now).count >= p.DomainRateLimit {
+			return errPolicyDomainRate
+		}
+	}
+	if p.SourceNameLimit > 0 {
+		names := p.sourceNameWindow(source, now)
+		if !names.names[name] && len(names.names) >= p.SourceNameLimit {
+			return errPolicySourceNames
+		}
+	}
+	if p.limitRcpts(source) {
+		if len(p.sourceRcptWindow(source, now)) >= p.SourceRcptLimit {
+			return errPolicySourceRcpts
+		}
+	}
+	return nil
+}
+
+// record counts a forward from source to resolved (the resolution of
+// ENS name), which passed check, against the policy's limits.
+func (p *RelayPolicy) record(source, name, resolved string) {
+	domain := resolvedDomain(resolved)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.time()
+	source = strings.ToLower(source)
+
+	if p.DomainRateLimit > 0 {
+		p.domainRate(domain, now).count++
+	}
+	if p.SourceNameLimit > 0 {
+		p.sourceNameWindow(source, now).names[name] = true
+	}
+	if p.limitRcpts(source) {
+		p.sourceRcpts[source] = append(p.sourceRcptWindow(source, now), now)
+	}
+}
+
+func (p *RelayPolicy) time() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// resolvedDomain returns the lowercased domain of resolved.
+func resolvedDomain(resolved string) string {
+	return strings.ToLower(resolved[strings.LastIndex(resolved, "@")+1:])
+}
+
+// domainRate returns the current window of domain's forwards, starting
+// a new one if it has expired.  p.mu must be held.
+func (p *RelayPolicy) domainRate(domain string, now time.Time) *rateWindow {
+	if p.domainRates == nil {
+		p.domainRates = make(map[string]*rateWindow)
+	}
+	rate := p.domainRates[domain]
+	if rate == nil || now.Sub(rate.start) >= p.DomainRateWindow {
+		rate = &rateWindow{start: now}
+		p.domainRates[domain] = rate
+	}
+	return rate
+}
+
+// sourceNameWindow returns the current window of the names source
+// sent to, starting a new one if it has expired.  p.mu must be held.
+func (p *RelayPolicy) sourceNameWindow(source string, now time.Time) *nameWindow {
+	if p.sourceNames == nil {
+		p.sourceNames = make(map[string]*nameWindow)
+	}
+	names := p.sourceNames[source]
+	if names == nil || now.Sub(names.start) >= p.SourceNameWindow {
+		names = &nameWindow{start: now, names: make(map[string]bool)}
+		p.sourceNames[source] = names
+	}
+	return names
+}
+
+// limitRcpts reports whether source's recipients are limited: the null
+// sender of bounces is exempt.
+func (p *RelayPolicy) limitRcpts(source string) bool {
+	return p.SourceRcptLimit > 0 && source != ""
+}
+
+// sourceRcptWindow returns the times of source's forwards within the
+// rolling window, dropping older ones.  p.mu must be held.
+func (p *RelayPolicy) sourceRcptWindow(source string, now time.Time) []time.Time {
+	if p.sourceRcpts == nil {
+		p.sourceRcpts = make(map[string][]time.Time)
+	}
+	rcpts := p.sourceRcpts[source]
+	for len(rcpts) > 0 && now.Sub(rcpts[0]) >= p.SourceRcptWindow {
+		rcpts = rcpts[1:]
+	}
+	p.sourceRcpts[source] = rcpts
+	return rcpts
+}
+
+// prune removes expired windows, at most once per minute.
+func (p *RelayPolicy) prune(now time.Time) {
+	if now.Sub(p.pruned) < time.Minute {
+		return
+	}
+	p.pruned = now
+
+	for domain, rate := range p.domainRates {
+		if now.Sub(rate.start) >= p.DomainRateWindow {
+			delete(p.domainRates, domain)
+		}
+	}
+	for source, names := range p.sourceNames {
+		if now.Sub(names.start) >= p.SourceNameWindow {
+			delete(p.sourceNames, source)
+		}
+	}
+	for source, rcpts := range p.sourceRcpts {
+		if len(rcpts) == 0 || now.Sub(rcpts[len(rcpts)-1]) >= p.SourceRcptWindow {
+			delete(p.sourceRcpts, source)
+		}
+	}
+}
+
+var (
+	errNamePolicySender = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender not permitted by recipient's policy",
+	}
+	errNamePolicySize = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Message too big for recipient's policy",
+	}
+)
+
+// NamePolicy is an ENS name owner's forwarding preferences, set as
+// JSON in the name's "ensmail.policy" text record.  Zero valued
+// fields are not enforced.
+type NamePolicy struct {
+	// MaxSize is the maximum message size, in bytes.  It's enforced
+	// against the size declared by the sender (the MAIL SIZE
+	// parameter) at RCPT, and against the message received at DATA,
+	// where only the recipients whose MaxSize it exceeds are
+	// rejected.
+	MaxSize int `json:"maxSize,omitempty"`
+
+	// AllowedSenders restricts senders (MAIL FROM addresses) to
+	// these addresses, or to any address of domains given as
+	// "@domain".
+	AllowedSenders []string `json:"allowedSenders,omitempty"`
+}
+
+// NamePolicyFunc returns the NamePolicy of name.  Names without a
+// policy return the zero NamePolicy.
+type NamePolicyFunc func(ctx context.Context, name string) (NamePolicy, error)
+
+// CachePolicies caches the successful lookups of fn for a fixed ttl,
+// by normalized name, as CachingResolver does.  Names which can't be
+// normalized are looked up uncached.
+func CachePolicies(fn NamePolicyFunc, ttl time.Duration) NamePolicyFunc {
+	cache := newTTLCache(ttl)
+	return func(ctx context.Context, name string) (NamePolicy, error) {
+		key, err := nameKey(name)
+		if err != nil {
+			return fn(ctx, name)
+		}
+		if cached, ok := cache.get(key); ok {
+			return cached.(NamePolicy), nil
+		}
+		p, err := fn(ctx, name)
+		if err != nil {
+			return NamePolicy{}, err
+		}
+		cache.set(key, p)
+		return p, nil
+	}
+}
+
+// check returns an error if a message from source, of the declared
+// size (or 0 if undeclared), violates p.
+func (p NamePolicy) check(source string, size int) error {
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return errNamePolicySize
+	}
+
+	if len(p.AllowedSenders) == 0 {
+		return nil
+	}
+	source = strings.ToLower(source)
+	for _, allowed := range p.AllowedSenders {
+		allowed = strings.ToLower(allowed)
+		if source == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(source, allowed)) {
+			return nil
+		}
+	}
+	return errNamePolicySender
+}
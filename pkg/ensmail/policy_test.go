@@ -0,0 +1,206 @@
+package ensmail
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRelayPolicy(t *testing.T) {
+	// forward checks, then records, a forward, as sessions do once
+	// the forwarder accepts its recipient.
+	forward := func(p *RelayPolicy, source, name, resolved string) error {
+		if err := p.check(source, name, resolved); err != nil {
+			return err
+		}
+		p.record(source, name, resolved)
+		return nil
+	}
+
+	t.Run("allowedDomains", func(t *testing.T) {
+		p := RelayPolicy{AllowedDomains: []string{"allowed.test"}}
+
+		if err := forward(&p, "sender@public.test", "name", "rcpt@ALLOWED.test"); err != nil {
+			t.Error("unexpected err:", err)
+		}
+		if err := forward(&p, "sender@public.test", "name", "rcpt@denied.test"); err != errPolicyDomain {
+			t.Errorf("want err: %s, got: %v", errPolicyDomain, err)
+		}
+	})
+
+	t.Run("domainRate", func(t *testing.T) {
+		now := time.Now()
+		p := RelayPolicy{
+			DomainRateLimit:  2,
+			DomainRateWindow: time.Minute,
+			now:              func() time.Time { return now },
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := forward(&p, "sender@public.test", "name", "rcpt@limited.test"); err != nil {
+				t.Fatal("unexpected err:", err)
+			}
+		}
+		if err := forward(&p, "sender@public.test", "name", "rcpt@limited.test"); err != errPolicyDomainRate {
+			t.Errorf("want err: %s, got: %v", errPolicyDomainRate, err)
+		}
+		// Other domains have their own limit.
+		if err := forward(&p, "sender@public.test", "name", "rcpt@other.test"); err != nil {
+			t.Error("unexpected err:", err)
+		}
+
+		now = now.Add(time.Minute)
+		if err := forward(&p, "sender@public.test", "name", "rcpt@limited.test"); err != nil {
+			t.Error("unexpected err after window:", err)
+		}
+	})
+
+	t.Run("sourceNames", func(t *testing.T) {
+		now := time.Now()
+		p := RelayPolicy{
+			SourceNameLimit:  2,
+			SourceNameWindow: time.Hour,
+			now:              func() time.Time { return now },
+		}
+
+		for _, name := range []string{"name1", "name2", "name1"} {
+			if err := forward(&p, "flooder@public.test", name, "rcpt@resolved.test"); err != nil {
+				t.Fatalf("%s: unexpected err: %s", name, err)
+			}
+		}
+		if err := forward(&p, "Flooder@public.test", "name3", "rcpt@resolved.test"); err != errPolicySourceNames {
+			t.Errorf("want err: %s, got: %v", errPolicySourceNames, err)
+		}
+		// Other senders have their own limit.
+		if err := forward(&p, "sender@public.test", "name3", "rcpt@resolved.test"); err != nil {
+			t.Error("unexpected err:", err)
+		}
+
+		now = now.Add(time.Hour)
+		if err := forward(&p, "flooder@public.test", "name3", "rcpt@resolved.test"); err != nil {
+			t.Error("unexpected err after window:", err)
+		}
+	})
+
+	t.Run("sourceRcpts", func(t *testing.T) {
+		start := time.Now()
+		now := start
+		p := RelayPolicy{
+			SourceRcptLimit:  3,
+			SourceRcptWindow: time.Hour,
+			now:              func() time.Time { return now },
+		}
+
+		// Repeated names count, as each is a forward.
+		for _, name := range []string{"name1", "name1"} {
+			if err := forward(&p, "flooder@public.test", name, "rcpt@resolved.test"); err != nil {
+				t.Fatalf("%s: unexpected err: %s", name, err)
+			}
+		}
+		now = start.Add(30 * time.Minute)
+		if err := forward(&p, "flooder@public.test", "name2", "rcpt@resolved.test"); err != nil {
+			t.Fatal("unexpected err:", err)
+		}
+		if err := forward(&p, "Flooder@public.test", "name3", "rcpt@resolved.test"); err != errPolicySourceRcpts {
+			t.Errorf("want err: %s, got: %v", errPolicySourceRcpts, err)
+		}
+		// Other senders have their own limit.
+		if err := forward(&p, "sender@public.test", "name3", "rcpt@resolved.test"); err != nil {
+			t.Error("unexpected err:", err)
+		}
+
+		// The window is rolling: only forwards older than the window
+		// (not the rejected one) are no longer counted.
+		now = start.Add(time.Hour)
+		for _, name := range []string{"name3", "name4"} {
+			if err := forward(&p, "flooder@public.test", name, "rcpt@resolved.test"); err != nil {
+				t.Errorf("%s: unexpected err after window: %s", name, err)
+			}
+		}
+		if err := forward(&p, "flooder@public.test", "name5", "rcpt@resolved.test"); err != errPolicySourceRcpts {
+			t.Errorf("want err: %s, got: %v", errPolicySourceRcpts, err)
+		}
+		// Bounces (from the null sender) aren't limited.
+		for i := 0; i < 5; i++ {
+			if err := forward(&p, "", "name1", "rcpt@resolved.test"); err != nil {
+				t.Fatal("null sender: unexpected err:", err)
+			}
+		}
+	})
+
+	// Checked forwards aren't counted until they're recorded.
+	t.Run("unrecorded", func(t *testing.T) {
+		p := RelayPolicy{
+			DomainRateLimit:  1,
+			DomainRateWindow: time.Minute,
+			SourceNameLimit:  1,
+			SourceNameWindow: time.Minute,
+			SourceRcptLimit:  1,
+			SourceRcptWindow: time.Minute,
+		}
+		for _, name := range []string{"name1", "name2", "name3"} {
+			if err := p.check("sender@public.test", name, "rcpt@resolved.test"); err != nil {
+				t.Fatalf("%s: unexpected err: %s", name, err)
+			}
+		}
+		p.record("sender@public.test", "name1", "rcpt@resolved.test")
+		if err := p.check("sender@public.test", "name2", "rcpt@resolved.test"); err == nil {
+			t.Error("want err once recorded")
+		}
+	})
+}
+
+func TestNamePolicy(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		policy NamePolicy
+		source string
+		size   int
+		err    error
+	}{
+		{"noPolicy", NamePolicy{}, "sender@public.test", 1 << 20, nil},
+		{"underMaxSize", NamePolicy{MaxSize: 100}, "sender@public.test", 100, nil},
+		{"undeclaredSize", NamePolicy{MaxSize: 100}, "sender@public.test", 0, nil},
+		{"overMaxSize", NamePolicy{MaxSize: 100}, "sender@public.test", 101, errNamePolicySize},
+		{"allowedAddr", NamePolicy{AllowedSenders: []string{"Sender@Public.test"}}, "sender@public.test", 0, nil},
+		{"allowedDomain", NamePolicy{AllowedSenders: []string{"@public.test"}}, "sender@public.test", 0, nil},
+		{"deniedDomain", NamePolicy{AllowedSenders: []string{"@public.test"}}, "sender@notpublic.test", 0, errNamePolicySender},
+		{"deniedAddr", NamePolicy{AllowedSenders: []string{"other@public.test"}}, "sender@public.test", 0, errNamePolicySender},
+	} {
+		if err := test.policy.check(test.source, test.size); err != test.err {
+			t.Errorf("%s: want err: %v, got: %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestCachePolicies(t *testing.T) {
+	calls := make(map[string]int)
+	lookupErr := errors.New("lookup failed")
+	fn := CachePolicies(func(ctx context.Context, name string) (NamePolicy, error) {
+		calls[name]++
+		if name == "fail.eth" {
+			return NamePolicy{}, lookupErr
+		}
+		return NamePolicy{MaxSize: len(name)}, nil
+	}, time.Minute)
+
+	// Names are cached by their normalized name, and failed lookups
+	// aren't cached.
+	for _, name := range []string{"name.eth", "NAME.eth", "name.eth", "fail.eth", "fail.eth"} {
+		p, err := fn(context.Background(), name)
+		if name == "fail.eth" {
+			if err != lookupErr {
+				t.Errorf("%s: want err: %v, got: %v", name, lookupErr, err)
+			}
+			continue
+		}
+		if err != nil || p.MaxSize != len("name.eth") {
+			t.Errorf("%s: want MaxSize: %d, got: %v, %v", name, len("name.eth"), p, err)
+		}
+	}
+	if exp := map[string]int{"name.eth": 1, "fail.eth": 2}; !reflect.DeepEqual(calls, exp) {
+		t.Errorf("want calls: %v, got: %v", exp, calls)
+	}
+}
@@ -0,0 +1,184 @@
+package ensmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout bounds the wait for a PROXY protocol header.
+	proxyHeaderTimeout = 10 * time.Second
+	// proxyV1MaxLen is the maximum length of a v1 header, including
+	// its CRLF.
+	proxyV1MaxLen = 107
+)
+
+// proxyV2Sig begins every PROXY protocol v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// WithProxyProtocol makes ServeTLS read a PROXY protocol (v1 or v2)
+// header from connections of upstreams (such as HAProxy) in trusted,
+// and use the header's source address as the connection's remote
+// address, so the real client address is logged.  Connections from
+// trusted upstreams without a valid header are closed.  Connections
+// from other addresses are served directly, and their headers are
+// never parsed, so clients can't spoof their address.
+func WithProxyProtocol(trusted ...*net.IPNet) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.proxyTrusted = trusted
+	}
+}
+
+// proxyListener wraps the connections of trusted upstreams accepted
+// by a listener in a proxyConn.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		for _, n := range l.trusted {
+			if n.Contains(addr.IP) {
+				return &proxyConn{Conn: c}, nil
+			}
+		}
+	}
+	return c, nil
+}
+
+// proxyConn is a connection which begins with a PROXY protocol
+// header.  The header is read by the first Read or RemoteAddr call,
+// rather than by Accept, so a slow upstream doesn't delay others.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr // nil if the header has no source address
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		c.r = bufio.NewReader(c.Conn)
+		if c.remote, c.err = readProxyHeader(c.r); c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.readHeader(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r, and
+// returns its source address, or nil if the header has none (a v1
+// "UNKNOWN" or v2 "LOCAL" header, or an unsupported v2 family).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, fmt.Errorf("proxy header: %w", err)
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Sig):
+		return readProxyV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	return nil, errors.New("proxy header: missing")
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLen {
+			return nil, errors.New("proxy header: v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxy header: %w", err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy header: invalid v1 header: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("proxy header: invalid v1 source: %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, len(proxyV2Sig)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("proxy header: %w", err)
+	}
+	verCmd, family := hdr[12], hdr[13]
+	addrs := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, fmt.Errorf("proxy header: %w", err)
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxy header: unsupported version: %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL, such as upstream health checks
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("proxy header: unsupported command: %d", verCmd&0xf)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	// Source and destination addresses, then ports, followed by
+	// optional TLVs, which are ignored.
+	if len(addrs) < 2*ipLen+4 {
+		return nil, errors.New("proxy header: v2 addresses too short")
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(addrs[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(addrs[2*ipLen:])),
+	}, nil
+}
@@ -0,0 +1,63 @@
+package ensmail
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(verCmd, family byte, addrs []byte) string {
+		hdr := append([]byte{}, proxyV2Sig...)
+		hdr = append(hdr, verCmd, family, 0, 0)
+		binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+		return string(append(hdr, addrs...))
+	}
+	tcp4 := []byte{203, 0, 113, 7, 192, 0, 2, 1, 0x15, 0xb3, 0, 25}
+	tcp6 := make([]byte, 36)
+	copy(tcp6, net.ParseIP("2001:db8::7"))
+	copy(tcp6[16:], net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(tcp6[32:], 5555)
+
+	for _, test := range []struct {
+		name   string
+		header string
+		addr   string // empty if none
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 192.0.2.1 5555 25\r\n", "203.0.113.7:5555", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 5555 25\r\n", "[2001:db8::7]:5555", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 family mismatch", "PROXY TCP6 203.0.113.7 192.0.2.1 5555 25\r\n", "", true},
+		{"v1 bad port", "PROXY TCP4 203.0.113.7 192.0.2.1 99999 25\r\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", true},
+		{"v2 tcp4", v2(0x21, 0x11, tcp4), "203.0.113.7:5555", false},
+		{"v2 tcp6 with tlv", v2(0x21, 0x21, append(tcp6, 0x01, 0, 2, 'h', '2')), "[2001:db8::7]:5555", false},
+		{"v2 local", v2(0x20, 0x00, nil), "", false},
+		{"v2 short", v2(0x21, 0x11, tcp4[:8]), "", true},
+		{"v2 bad version", v2(0x11, 0x11, tcp4), "", true},
+		{"missing", "EHLO localhost\r\n", "", true},
+	} {
+		// Data following the header is left unread.
+		r := bufio.NewReader(strings.NewReader(test.header + "LHLO localhost\r\n"))
+		addr, err := readProxyHeader(r)
+		if (err != nil) != test.err {
+			t.Errorf("%s: want err: %v, got: %v", test.name, test.err, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+		if got := ""; addr != nil {
+			if got = addr.String(); got != test.addr {
+				t.Errorf("%s: want addr: %s, got: %s", test.name, test.addr, got)
+			}
+		} else if test.addr != "" {
+			t.Errorf("%s: want addr: %s, got none", test.name, test.addr)
+		}
+		if rest, _ := r.ReadString('\n'); rest != "LHLO localhost\r\n" {
+			t.Errorf("%s: header over-read, rest: %q", test.name, rest)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package ensmail
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/go-kit/log"
+	"github.com/google/uuid"
+)
+
+const (
+	// queueExt is the file extension of queued messages.  Messages
+	// are written to a temporary file (without queueExt), which is
+	// renamed once complete, so a crash never leaves a partial
+	// message in the queue.
+	queueExt = ".json"
+	// queueStatusTimeout bounds the wait for each queued delivery's
+	// statuses.
+	queueStatusTimeout = 30 * time.Second
+)
+
+// queueEntry is a queued message, persisted as JSON in its own file.
+type queueEntry struct {
+	ID       string            `json:"id"`
+	From     string            `json:"from"`
+	MailOpts *smtp.MailOptions `json:"mail_opts,omitempty"` // of the original MAIL
+	Rcpts    []string          `json:"rcpts"`               // resolved recipients awaiting delivery
+	Data     []byte            `json:"data"`
+	Attempts int               `json:"attempts"`
+	Queued   time.Time         `json:"queued"`
+	Next     time.Time         `json:"next"` // time of the next attempt
+}
+
+// RetryQueue is an on-disk queue of messages whose forward failed
+// with a transient status, which are re-forwarded (over a new
+// forwarder) until they're delivered, fail permanently, or expire.
+// Each message is a file in the queue's directory, so the queue
+// survives restarts.
+//
+// Messages which fail permanently or expire are dropped, and logged:
+// as their senders were told they were delivered, and bounces are not
+// supported, the logs are the only record of their loss.
+type RetryQueue struct {
+	dir         string
+	newFwdr     NewForwarderClient
+	logger      log.Logger
+	backoff     time.Duration
+	maxAttempts int
+	expiry      time.Duration
+	interval    time.Duration // between scans of dir
+
+	mu sync.Mutex // serializes scans of dir
+}
+
+// NewRetryQueue returns a RetryQueue of the messages in dir (which is
+// created if it doesn't exist), forwarded over forwarders from nf.
+// Attempts are spaced by backoff, doubled after every attempt.
+// Messages are dropped after maxAttempts attempts, or once they've
+// been queued for longer than expiry.
+func NewRetryQueue(logger log.Logger, dir string, nf NewForwarderClient, backoff time.Duration, maxAttempts int, expiry time.Duration) (*RetryQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Remove temporary files of writes interrupted by a crash.
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil {
+			return nil, err
+		}
+	}
+
+	return &RetryQueue{
+		dir:         dir,
+		newFwdr:     nf,
+		logger:      log.With(logger, "component", "queue"),
+		backoff:     backoff,
+		maxAttempts: maxAttempts,
+		expiry:      expiry,
+		interval:    time.Second,
+	}, nil
+}
+
+// Run re-forwards queued messages as they become due, until done is
+// closed.
+func (q *RetryQueue) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			q.process(now)
+		}
+	}
+}
+
+// Len returns the number of queued messages.
+func (q *RetryQueue) Len() (int, error) {
+	files, err := filepath.Glob(filepath.Join(q.dir, "*"+queueExt))
+	return len(files), err
+}
+
+// enqueue queues the message written by copyMsg for rcpts, whose
+// first retry is due after q.backoff.  Retries are sent with from and
+// opts, so their envelope matches the original.
+func (q *RetryQueue) enqueue(from string, opts *smtp.MailOptions, rcpts []string, copyMsg func(io.Writer) (int64, error)) (string, error) {
+	var data bytes.Buffer
+	if _, err := copyMsg(&data); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	e := &queueEntry{
+		ID:       uuid.New().String(),
+		From:     from,
+		MailOpts: opts,
+		Rcpts:    rcpts,
+		Data:     data.Bytes(),
+		Queued:   now,
+		Next:     now.Add(q.backoff),
+	}
+	return e.ID, q.write(e)
+}
+
+// write atomically writes e to its file: e is written and synced to a
+// temporary file, which is renamed over e's file.
+func (q *RetryQueue) write(e *queueEntry) error {
+	tmp, err := os.CreateTemp(q.dir, e.ID+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // after a successful rename, fails harmlessly
+
+	if err := json.NewEncoder(tmp).Encode(e); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), q.path(e.ID)); err != nil {
+		return err
+	}
+
+	// Persist the rename.
+	dir, err := os.Open(q.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (q *RetryQueue) path(id string) string {
+	return filepath.Join(q.dir, id+queueExt)
+}
+
+// process attempts delivery of every message due at now.
+func (q *RetryQueue) process(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(q.dir, "*"+queueExt))
+	if err != nil {
+		q.logger.Log("call", "filepath.Glob", "err", err)
+		return
+	}
+	for _, file := range files {
+		var e queueEntry
+		if data, err := os.ReadFile(file); err != nil {
+			q.logger.Log("call", "os.ReadFile", "file", file, "err", err)
+			continue
+		} else if err := json.Unmarshal(data, &e); err != nil {
+			q.logger.Log("call", "json.Unmarshal", "file", file, "err", err)
+			continue
+		}
+		if now.Before(e.Next) {
+			continue
+		}
+		q.attempt(now, &e)
+	}
+}
+
+// attempt forwards e, and then removes it from the queue, or
+// reschedules it for its recipients which failed transiently.
+func (q *RetryQueue) attempt(now time.Time, e *queueEntry) {
+	logger := log.With(q.logger, "queueid", e.ID)
+	e.Attempts++
+
+	var retry []string
+	for rcpt, err := range q.deliver(logger, e) {
+		var serr *smtp.SMTPError
+		switch {
+		case err == nil:
+			logger.Log("to", rcpt, "delivered", true, "attempts", e.Attempts)
+		case errors.As(err, &serr) && !serr.Temporary():
+			logger.Log("to", rcpt, "err", err, "dropped", "permanent failure")
+		default:
+			retry = append(retry, rcpt)
+		}
+	}
+
+	if len(retry) > 0 && e.Attempts < q.maxAttempts && now.Sub(e.Queued) < q.expiry {
+		e.Rcpts = retry
+		e.Next = now.Add(q.backoff << e.Attempts)
+		if err := q.write(e); err != nil {
+			logger.Log("call", "q.write", "err", err)
+		}
+		return
+	}
+	for _, rcpt := range retry {
+		logger.Log("to", rcpt, "dropped", "expired", "attempts", e.Attempts)
+	}
+	if err := os.Remove(q.path(e.ID)); err != nil {
+		logger.Log("call", "os.Remove", "err", err)
+	}
+}
+
+// deliver forwards e over a new forwarder, and returns each
+// recipient's status.  If the forward fails, every recipient without
+// a status has the forward's error.
+func (q *RetryQueue) deliver(logger log.Logger, e *queueEntry) map[string]error {
+	statuses := make(map[string]error, len(e.Rcpts))
+	fail := func(err error) map[string]error {
+		for _, rcpt := range e.Rcpts {
+			if _, ok := statuses[rcpt]; !ok {
+				statuses[rcpt] = err
+			}
+		}
+		return statuses
+	}
+
+	fwdr, err := q.newFwdr()
+	if err != nil {
+		logger.Log("call", "q.newFwdr", "err", err)
+		return fail(err)
+	}
+	defer fwdr.Close()
+
+	if err := fwdr.Mail(e.From, e.MailOpts); err != nil {
+		logger.Log("call", "fwdr.Mail", "err", err)
+		return fail(err)
+	}
+	var accepted int
+	for _, rcpt := range e.Rcpts {
+		if err := fwdr.Rcpt(rcpt); err != nil {
+			statuses[rcpt] = err
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return statuses
+	}
+
+	type statusRsp struct {
+		rcpt string
+		err  error
+	}
+	dataRsps := make(chan statusRsp, accepted)
+	w, err := fwdr.LMTPData(func(rcpt string, serr *smtp.SMTPError) {
+		dataRsps <- statusRsp{rcpt, forwardStatus(logger, rcpt, serr)}
+	})
+	if err != nil {
+		logger.Log("call", "fwdr.LMTPData", "err", err)
+		return fail(err)
+	}
+	_, err = w.Write(e.Data)
+	if closeErr := w.Close(); err == nil && closeErr != nil {
+		// Statuses returned before Close failed are kept.
+		for len(dataRsps) > 0 {
+			rsp := <-dataRsps
+			statuses[rsp.rcpt] = rsp.err
+		}
+		return fail(errForwardIncomplete)
+	}
+	if err != nil {
+		logger.Log("call", "w.Write", "err", err)
+		return fail(err)
+	}
+
+	timeout := time.After(queueStatusTimeout)
+	for len(statuses) < len(e.Rcpts) {
+		select {
+		case rsp := <-dataRsps:
+			statuses[rsp.rcpt] = rsp.err
+		case <-timeout:
+			return fail(fmt.Errorf("timeout waiting for forward LMTP status: %s", strings.Join(e.Rcpts, ", ")))
+		}
+	}
+	return statuses
+}
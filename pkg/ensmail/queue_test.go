@@ -0,0 +1,152 @@
+package ensmail
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// queueForwarder returns forwarders which reply to each recipient
+// with its entry of replies (or success), and records the recipients
+// each message was forwarded to.
+func queueForwarder(replies map[string]*smtp.SMTPError, delivered *[][]string) NewForwarderClient {
+	return func() (ForwarderClient, error) {
+		var rcpts []string
+		return mockForwarder{
+			rcptFunc: func(to string) error {
+				rcpts = append(rcpts, to)
+				return nil
+			},
+			dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+				var data bytes.Buffer
+				return Closer{
+					Writer: &data,
+					closeFunc: func() error {
+						sort.Strings(rcpts)
+						*delivered = append(*delivered, rcpts)
+						for _, rcpt := range rcpts {
+							statusCb(rcpt, replies[rcpt])
+						}
+						return nil
+					},
+				}, nil
+			},
+		}, nil
+	}
+}
+
+func TestRetryQueue(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "queue")
+	transient := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 2, 1}, Message: "Mailbox busy"}
+	permanent := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	replies := map[string]*smtp.SMTPError{
+		"b@resolved.test": permanent,
+		"c@resolved.test": transient,
+	}
+	var delivered [][]string
+
+	const backoff = time.Minute
+	q, err := NewRetryQueue(logger, dir, queueForwarder(replies, &delivered), backoff, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copyMsg := func(w io.Writer) (int64, error) {
+		n, err := w.Write(testMsg)
+		return int64(n), err
+	}
+	auth := "sender@public.com"
+	opts := &smtp.MailOptions{Body: smtp.Body8BitMIME, UTF8: true, Auth: &auth}
+	id, err := q.enqueue("sender@public.com", opts, []string{"a@resolved.test", "b@resolved.test", "c@resolved.test"}, copyMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued messages survive restarts, and temporary files of
+	// interrupted writes are removed.
+	if err := os.WriteFile(filepath.Join(dir, "partial.tmp"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if q, err = NewRetryQueue(logger, dir, queueForwarder(replies, &delivered), backoff, 3, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Len(); err != nil || n != 1 {
+		t.Fatalf("want queued: 1, got: %d, %v", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partial.tmp")); !os.IsNotExist(err) {
+		t.Error("temporary file not removed:", err)
+	}
+
+	// Messages aren't retried before they're due.
+	now := time.Now()
+	q.process(now)
+	if len(delivered) != 0 {
+		t.Fatalf("forwarded before due: %v", delivered)
+	}
+
+	// Delivered and permanently failed recipients are removed.
+	now = now.Add(backoff)
+	q.process(now)
+	if exp := [][]string{{"a@resolved.test", "b@resolved.test", "c@resolved.test"}}; !reflect.DeepEqual(delivered, exp) {
+		t.Errorf("want forwarded: %v, got: %v", exp, delivered)
+	}
+	e := readQueueEntry(t, q, id)
+	if !reflect.DeepEqual(e.Rcpts, []string{"c@resolved.test"}) || e.Attempts != 1 || !e.Next.Equal(now.Add(2*backoff)) {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+	if !bytes.Equal(e.Data, testMsg) || e.From != "sender@public.com" || !reflect.DeepEqual(e.MailOpts, opts) {
+		t.Errorf("unexpected entry message: %s, %+v, %s", e.From, e.MailOpts, e.Data)
+	}
+
+	// Once delivered, the message is removed.
+	delete(replies, "c@resolved.test")
+	q.process(now.Add(2 * backoff))
+	if n, err := q.Len(); err != nil || n != 0 {
+		t.Errorf("want queued: 0, got: %d, %v", n, err)
+	}
+
+	// Messages are dropped after maxAttempts...
+	replies["c@resolved.test"] = transient
+	if _, err := q.enqueue("sender@public.com", nil, []string{"c@resolved.test"}, copyMsg); err != nil {
+		t.Fatal(err)
+	}
+	delivered = nil
+	for i := 0; i < 3; i++ {
+		now = now.Add(10 * backoff)
+		q.process(now)
+	}
+	if n, err := q.Len(); err != nil || n != 0 || len(delivered) != 3 {
+		t.Errorf("want queued: 0 after 3 attempts, got: %d after %d, %v", n, len(delivered), err)
+	}
+
+	// ...or once expired.
+	if _, err := q.enqueue("sender@public.com", nil, []string{"c@resolved.test"}, copyMsg); err != nil {
+		t.Fatal(err)
+	}
+	delivered = nil
+	q.process(time.Now().Add(2 * time.Hour))
+	if n, err := q.Len(); err != nil || n != 0 || len(delivered) != 1 {
+		t.Errorf("want queued: 0 after expiry, got: %d after %d, %v", n, len(delivered), err)
+	}
+}
+
+func readQueueEntry(t *testing.T, q *RetryQueue, id string) queueEntry {
+	t.Helper()
+	data, err := os.ReadFile(q.path(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e queueEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
@@ -0,0 +1,101 @@
+package ensmail
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	nodeHeader     = ensmailHeaderPrefix + "Node"
+	resolverHeader = ensmailHeaderPrefix + "Resolver"
+	chainIDHeader  = ensmailHeaderPrefix + "Chain-Id"
+)
+
+// ResolveResult is a resolved email address, and the ENS state it was
+// resolved from.  Resolutions which weren't made on-chain (such as
+// by a StaticResolver or Overrides) have a zero Node and Resolver.
+type ResolveResult struct {
+	Email    string
+	Node     [32]byte       // namehash of the name (or alias) resolved
+	Resolver common.Address // resolver of Node
+	ChainID  *big.Int       // nil if unknown, see WithChainID
+}
+
+// onChain reports whether res was resolved on-chain.
+func (res ResolveResult) onChain() bool {
+	return res.Resolver != (common.Address{})
+}
+
+type resolveResultKey struct{}
+
+// ResolveDetailed resolves name with resolve, and returns its
+// ResolveResult.  Resolvers report the metadata of their resolutions
+// through ctx, so it passes through wrapping ResolveFuncs (such as
+// Deduplicate, or a CachingResolver, which caches it) unchanged.
+func ResolveDetailed(ctx context.Context, resolve ResolveFunc, name string) (ResolveResult, error) {
+	res := new(ResolveResult)
+	email, err := resolve(context.WithValue(ctx, resolveResultKey{}, res), name)
+	if err != nil {
+		return ResolveResult{}, err
+	}
+	res.Email = email
+	return *res, nil
+}
+
+// reportResult reports res to the ResolveDetailed call of ctx, if
+// any.
+func reportResult(ctx context.Context, res ResolveResult) {
+	if p, ok := ctx.Value(resolveResultKey{}).(*ResolveResult); ok {
+		*p = res
+	}
+}
+
+// WithResolutionHeaders adds the ENS state each recipient was
+// resolved from to forwarded messages, for downstream routing and
+// analytics:
+//
+//	X-ENSMail-Chain-Id: 1
+//	X-ENSMail-Node: 0x787192fc...; resolved=alice@example.com
+//	X-ENSMail-Resolver: 0x231b0ee1...; resolved=alice@example.com
+//
+// Node and Resolver headers are added for each on-chain resolution
+// (see ResolveResult), and Chain-Id once if known.  As each
+// recipient's headers would disclose its resolution (and so its
+// forward address) to every other recipient, they're only added to
+// messages forwarded to a single recipient: transactions with one
+// recipient, or each recipient's copy with WithVERP.  The headers are
+// diagnostic, and unsigned (see WithResolutionSigning).
+func WithResolutionHeaders() LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		l.resolutionHeaders = true
+	}
+}
+
+// resolutionHeader returns the resolution headers of the recipients
+// resolved, from s.resolutions.
+func (s *session) resolutionHeader(resolved ...string) string {
+	sort.Strings(resolved)
+
+	var hdr strings.Builder
+	var chainID *big.Int
+	for _, rcpt := range resolved {
+		res, ok := s.resolutions[rcpt]
+		if !ok || !res.onChain() {
+			continue
+		}
+		if chainID == nil {
+			chainID = res.ChainID
+		}
+		fmt.Fprintf(&hdr, "%s: %s; resolved=%s\r\n", nodeHeader, common.Hash(res.Node).Hex(), rcpt)
+		fmt.Fprintf(&hdr, "%s: %s; resolved=%s\r\n", resolverHeader, res.Resolver.Hex(), rcpt)
+	}
+	if chainID != nil {
+		return fmt.Sprintf("%s: %s\r\n", chainIDHeader, chainID) + hdr.String()
+	}
+	return hdr.String()
+}
@@ -0,0 +1,80 @@
+package ensmail
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ResolverCallSpec describes the resolver method which returns a
+// name's email, for resolvers which don't implement ENSIP-5 text
+// records (see WithResolverCallSpec).
+type ResolverCallSpec struct {
+	contract abi.ABI // of the single method
+	method   string
+	args     []interface{} // following the node
+}
+
+// NewResolverCallSpec returns a ResolverCallSpec of the view method
+// with signature (such as "emailOf(bytes32)"), which determines the
+// method's selector and argument encoding.  The first parameter must
+// be the name's bytes32 node, and the following parameters are args.
+// Parameters must be elementary types (not tuples), and the method
+// must return a single string.  The standard text record call is:
+//
+//	NewResolverCallSpec("text(bytes32,string)", "email")
+func NewResolverCallSpec(signature string, args ...interface{}) (*ResolverCallSpec, error) {
+	open := strings.Index(signature, "(")
+	if open < 1 || !strings.HasSuffix(signature, ")") {
+		return nil, fmt.Errorf("invalid method signature: %s", signature)
+	}
+	name := signature[:open]
+
+	var inputs abi.Arguments
+	if params := signature[open+1 : len(signature)-1]; params != "" {
+		for _, param := range strings.Split(params, ",") {
+			typ, err := abi.NewType(strings.TrimSpace(param), "", nil)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", signature, err)
+			}
+			inputs = append(inputs, abi.Argument{Type: typ})
+		}
+	}
+	if len(inputs) == 0 || inputs[0].Type.String() != "bytes32" {
+		return nil, fmt.Errorf("%s: first parameter must be the bytes32 node", signature)
+	} else if len(inputs) != len(args)+1 {
+		return nil, fmt.Errorf("%s: want %d args, got %d", signature, len(inputs)-1, len(args))
+	}
+	if _, err := inputs.Pack(append([]interface{}{[32]byte{}}, args...)...); err != nil {
+		return nil, fmt.Errorf("%s: %w", signature, err)
+	}
+
+	stringType, err := abi.NewType("string", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	method := abi.NewMethod(name, name, abi.Function, "view", false, false, inputs, abi.Arguments{{Type: stringType}})
+	return &ResolverCallSpec{
+		contract: abi.ABI{Methods: map[string]abi.Method{name: method}},
+		method:   name,
+		args:     args,
+	}, nil
+}
+
+// String returns the spec's method signature.
+func (s *ResolverCallSpec) String() string {
+	return s.contract.Methods[s.method].Sig
+}
+
+// call calls the spec's method of the resolver at addr for node.
+func (s *ResolverCallSpec) call(callOpts *bind.CallOpts, caller bind.ContractCaller, addr common.Address, node [32]byte) (string, error) {
+	contract := bind.NewBoundContract(addr, s.contract, caller, nil, nil)
+	var out []interface{}
+	if err := contract.Call(callOpts, &out, s.method, append([]interface{}{node}, s.args...)...); err != nil {
+		return "", err
+	}
+	return *abi.ConvertType(out[0], new(string)).(*string), nil
+}
@@ -0,0 +1,263 @@
+package ensmail
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// RouteByDomain returns a NewForwarderClient whose clients forward
+// each recipient over a forwarder selected by the recipient's domain:
+// routes' forwarder for the domain (matched case-insensitively), or
+// def for domains without a route.  For example, resolved Gmail
+// recipients may be forwarded through a separate smarthost, for its
+// reputation.
+//
+// Each client dials def immediately, and a route's forwarder when its
+// first recipient is added, then keeps it for later transactions.
+// Extension reports def's extensions, so a route whose forwarder
+// doesn't support a message's extensions (SMTPUTF8 or 8BITMIME)
+// rejects its recipients (at RCPT).  The message is sent to the forwarder of each route with
+// recipients, and a route whose forward fails only fails its own
+// recipients.
+func RouteByDomain(routes map[string]NewForwarderClient, def NewForwarderClient) NewForwarderClient {
+	lower := make(map[string]NewForwarderClient, len(routes))
+	for domain, nf := range routes {
+		lower[strings.ToLower(domain)] = nf
+	}
+	return func() (ForwarderClient, error) {
+		fc, err := def()
+		if err != nil {
+			return nil, err
+		}
+		return &routeClient{
+			routes:  lower,
+			def:     &route{fc: fc},
+			clients: make(map[string]*route),
+		}, nil
+	}
+}
+
+// route is a forwarder client of a routeClient.
+type route struct {
+	fc    ForwarderClient
+	inTx  bool     // if MAIL was sent for the current transaction
+	rcpts []string // of the current transaction
+}
+
+// routeClient is a ForwarderClient of RouteByDomain.
+type routeClient struct {
+	routes  map[string]NewForwarderClient
+	def     *route
+	clients map[string]*route // k: domain with a route
+	order   []*route          // routes with recipients, in order of their first
+
+	from string
+	opts *smtp.MailOptions
+}
+
+func (c *routeClient) Mail(from string, opts *smtp.MailOptions) error {
+	c.from, c.opts = from, opts
+	if err := c.def.fc.Mail(from, opts); err != nil {
+		return err
+	}
+	c.def.inTx = true
+	return nil
+}
+
+func (c *routeClient) Rcpt(to string) error {
+	r, err := c.route(strings.ToLower(to[strings.LastIndex(to, "@")+1:]))
+	if err != nil {
+		return err
+	}
+	if !r.inTx {
+		if err := checkExtensions(r.fc, c.opts); err != nil {
+			return err
+		}
+		if err := r.fc.Mail(c.from, c.opts); err != nil {
+			return err
+		}
+		r.inTx = true
+	}
+	if err := r.fc.Rcpt(to); err != nil {
+		return err
+	}
+	if len(r.rcpts) == 0 {
+		c.order = append(c.order, r)
+	}
+	r.rcpts = append(r.rcpts, to)
+	return nil
+}
+
+// checkExtensions returns an error if fc doesn't support the
+// extensions required by a message sent with opts.
+func checkExtensions(fc ForwarderClient, opts *smtp.MailOptions) error {
+	if opts == nil {
+		return nil
+	}
+	if opts.UTF8 {
+		if ok, _ := fc.Extension("SMTPUTF8"); !ok {
+			return errForwardNoSMTPUTF8
+		}
+	}
+	if opts.Body == smtp.Body8BitMIME {
+		if ok, _ := fc.Extension("8BITMIME"); !ok {
+			return errForwardNo8BitMIME
+		}
+	}
+	return nil
+}
+
+// route returns the route of domain, dialing its forwarder if it's the
+// domain's first recipient.
+func (c *routeClient) route(domain string) (*route, error) {
+	nf, ok := c.routes[domain]
+	if !ok {
+		return c.def, nil
+	}
+	if r, ok := c.clients[domain]; ok {
+		return r, nil
+	}
+	fc, err := nf()
+	if err != nil {
+		return nil, err
+	}
+	r := &route{fc: fc}
+	c.clients[domain] = r
+	return r, nil
+}
+
+// LMTPData starts DATA on the forwarder of each route with recipients.
+// If it fails for every route, the first route's error is returned.
+// Otherwise, the recipients of routes which failed have their route's
+// error as their status.
+func (c *routeClient) LMTPData(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+	w := &routeWriter{statusCb: statusCb}
+	var firstErr error
+	for _, r := range c.order {
+		rw := &routeData{rcpts: r.rcpts, reported: make(map[string]bool)}
+		rw.w, rw.err = r.fc.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+			rw.reported[rcpt] = true
+			statusCb(rcpt, status)
+		})
+		if rw.err != nil && firstErr == nil {
+			firstErr = rw.err
+		}
+		w.routes = append(w.routes, rw)
+	}
+	if w.failed() {
+		if firstErr == nil {
+			return nil, errors.New("no recipients")
+		}
+		return nil, firstErr
+	}
+	return w, nil
+}
+
+func (c *routeClient) Reset() error {
+	var err error
+	for _, r := range c.all() {
+		if r.inTx {
+			if rerr := r.fc.Reset(); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+		r.inTx, r.rcpts = false, nil
+	}
+	c.order = nil
+	c.from, c.opts = "", nil
+	return err
+}
+
+func (c *routeClient) Close() error {
+	var err error
+	for _, r := range c.all() {
+		if cerr := r.fc.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (c *routeClient) Extension(ext string) (bool, string) {
+	return c.def.fc.Extension(ext)
+}
+
+// all returns the default route, and every route dialed.
+func (c *routeClient) all() []*route {
+	all := []*route{c.def}
+	for _, r := range c.clients {
+		all = append(all, r)
+	}
+	return all
+}
+
+// routeData is the DATA of a route.
+type routeData struct {
+	w        io.WriteCloser
+	err      error // of the route's forward, once failed
+	rcpts    []string
+	reported map[string]bool // rcpts whose status was reported
+}
+
+// routeWriter writes a message to the DATA of each route.  Writes to
+// routes which failed are skipped.
+type routeWriter struct {
+	routes   []*routeData
+	statusCb func(rcpt string, status *smtp.SMTPError)
+}
+
+// failed reports whether the forward failed for every route.
+func (w *routeWriter) failed() bool {
+	for _, r := range w.routes {
+		if r.err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *routeWriter) Write(p []byte) (int, error) {
+	for _, r := range w.routes {
+		if r.err == nil {
+			_, r.err = r.w.Write(p)
+		}
+	}
+	if w.failed() {
+		return 0, w.routes[0].err
+	}
+	return len(p), nil
+}
+
+// Close ends the message on each route, and reports the error of each
+// route which failed as the status of its recipients which have none.
+// Close only returns an error if every route failed.
+func (w *routeWriter) Close() error {
+	for _, r := range w.routes {
+		if r.w != nil {
+			if err := r.w.Close(); err != nil && r.err == nil {
+				r.err = err
+			}
+		}
+	}
+	if w.failed() {
+		return w.routes[0].err
+	}
+	for _, r := range w.routes {
+		if r.err == nil {
+			continue
+		}
+		status, ok := r.err.(*smtp.SMTPError)
+		if !ok {
+			status = errForwardUnavailable
+		}
+		for _, rcpt := range r.rcpts {
+			if !r.reported[rcpt] {
+				w.statusCb(rcpt, status)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package ensmail
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestRouteByDomain(t *testing.T) {
+	resolver := func(ctx context.Context, in string) (string, error) {
+		switch in {
+		case "alice":
+			return "alice@GMAIL.com", nil
+		case "bob":
+			return "bob@example.com", nil
+		}
+		return testResolver(ctx, in)
+	}
+
+	// Each recipient is forwarded over its domain's route, or the
+	// default, and the message is sent to both.
+	t.Run("routes", func(t *testing.T) {
+		var gmail, def sessionRecorder
+		nf := RouteByDomain(map[string]NewForwarderClient{"gmail.com": gmail.Forwarder}, def.Forwarder)
+		srv, err := NewLMTPServer(logger, resolver, nf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sock := serveTest(t, srv)
+		defer srv.Close()
+
+		if err := sendMail(sock, "sender@public.com", []string{"alice@ensmail.org", "bob@ensmail.org"}, testMsg); err != nil {
+			t.Fatal("unexpected err:", err)
+		}
+
+		expGmail := &testSession{
+			From: "sender@public.com",
+			To:   []string{"alice@GMAIL.com"},
+		}
+		expGmail.Data.Write(testMsg)
+		gmail.check(t, []*testSession{expGmail})
+
+		expDef := &testSession{
+			From: "sender@public.com",
+			To:   []string{"bob@example.com"},
+		}
+		expDef.Data.Write(testMsg)
+		def.check(t, []*testSession{expDef})
+	})
+
+	// A route whose forward fails only fails its own recipients.
+	t.Run("routeFailed", func(t *testing.T) {
+		unavailable := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 1}, Message: "Smarthost unavailable"}
+		failing := func() (ForwarderClient, error) {
+			return mockForwarder{
+				dataFunc: func(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
+					return nil, unavailable
+				},
+			}, nil
+		}
+		var def sessionRecorder
+		nf := RouteByDomain(map[string]NewForwarderClient{"gmail.com": failing}, def.Forwarder)
+		srv, err := NewLMTPServer(logger, resolver, nf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sess, err := srv.NewSession(smtp.ConnectionState{}, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Logout()
+		if err := sess.Mail("sender@public.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, to := range []string{"alice@ensmail.org", "bob@ensmail.org"} {
+			if err := sess.Rcpt(to); err != nil {
+				t.Fatalf("%s: unexpected err: %v", to, err)
+			}
+		}
+		statuses := make(statusMap)
+		if err := sess.(smtp.LMTPSession).LMTPData(bytes.NewReader(testMsg), statuses); err != nil {
+			t.Fatal("unexpected err:", err)
+		}
+		if err := statuses["alice@ensmail.org"]; err != unavailable {
+			t.Errorf("alice: want status: %v, got: %v", unavailable, err)
+		}
+		if err, ok := statuses["bob@ensmail.org"]; !ok || err != nil {
+			t.Errorf("bob: want success, got: %v", err)
+		}
+	})
+	// A route whose forwarder doesn't support the message's
+	// extensions rejects its recipients, while the default route
+	// accepts its own.
+	t.Run("routeExtensions", func(t *testing.T) {
+		var called bool
+		ascii := func() (ForwarderClient, error) {
+			return mockForwarder{
+				mailFunc: func(from string, opts *smtp.MailOptions) error {
+					called = true
+					return nil
+				},
+				extFunc: func(ext string) (bool, string) {
+					return false, ""
+				},
+			}, nil
+		}
+		var def sessionRecorder
+		nf := RouteByDomain(map[string]NewForwarderClient{"gmail.com": ascii}, def.Forwarder)
+		srv, err := NewLMTPServer(logger, resolver, nf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			name string
+			opts *smtp.MailOptions
+			err  error
+		}{
+			{"utf8", &smtp.MailOptions{UTF8: true}, errForwardNoSMTPUTF8},
+			{"8bit", &smtp.MailOptions{Body: smtp.Body8BitMIME}, errForwardNo8BitMIME},
+			{"plain", nil, nil},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				called = false
+				sess, err := srv.NewSession(smtp.ConnectionState{}, "localhost")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer sess.Logout()
+				if err := sess.Mail("sender@public.com", test.opts); err != nil {
+					t.Fatal(err)
+				}
+				if err := sess.Rcpt("alice@ensmail.org"); err != test.err {
+					t.Errorf("alice: want err: %v, got: %v", test.err, err)
+				}
+				if called != (test.err == nil) {
+					t.Errorf("want route MAIL: %t, got: %t", test.err == nil, called)
+				}
+				if err := sess.Rcpt("bob@ensmail.org"); err != nil {
+					t.Errorf("bob: unexpected err: %v", err)
+				}
+			})
+		}
+	})
+}
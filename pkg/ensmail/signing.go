@@ -0,0 +1,79 @@
+package ensmail
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	resolvedHeader  = ensmailHeaderPrefix + "Resolved"
+	signatureHeader = ensmailHeaderPrefix + "Signature"
+)
+
+var ErrInvalidSignature = errors.New("invalid resolution signature")
+
+// Resolution is a signed resolution of an original recipient to its
+// resolved forward address.
+type Resolution struct {
+	Original string
+	Resolved string
+	Time     time.Time
+}
+
+// headerValue returns the X-ENSMail-Resolved header value of res,
+// which is what's signed.
+func (res Resolution) headerValue() string {
+	return fmt.Sprintf("original=%s; resolved=%s; t=%d", res.Original, res.Resolved, res.Time.Unix())
+}
+
+// signResolution returns the X-ENSMail-Resolved and
+// X-ENSMail-Signature header fields of res, signed with key.
+func signResolution(key ed25519.PrivateKey, res Resolution) string {
+	val := res.headerValue()
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(val)))
+	return resolvedHeader + ": " + val + "\r\n" + signatureHeader + ": " + sig + "\r\n"
+}
+
+// VerifyResolution verifies that the X-ENSMail-Resolved header value
+// resolved is signed by pub's key, with the X-ENSMail-Signature header
+// value signature which follows it, and returns the signed
+// Resolution.  Invalid signatures fail with ErrInvalidSignature.
+// Callers should also check that the Resolution's Time is recent, and
+// its Resolved address is the message's recipient.
+func VerifyResolution(pub ed25519.PublicKey, resolved, signature string) (Resolution, error) {
+	resolved = strings.TrimSpace(resolved)
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || !ed25519.Verify(pub, []byte(resolved), sig) {
+		return Resolution{}, ErrInvalidSignature
+	}
+
+	var (
+		res Resolution
+		ts  string
+	)
+	for _, param := range strings.Split(resolved, "; ") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return Resolution{}, fmt.Errorf("invalid resolution: %s", resolved)
+		}
+		switch kv[0] {
+		case "original":
+			res.Original = kv[1]
+		case "resolved":
+			res.Resolved = kv[1]
+		case "t":
+			ts = kv[1]
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return Resolution{}, fmt.Errorf("invalid resolution time: %s", resolved)
+	}
+	res.Time = time.Unix(unix, 0)
+	return res, nil
+}
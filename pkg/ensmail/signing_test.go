@@ -0,0 +1,48 @@
+package ensmail
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyResolution(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := Resolution{Original: "alice@ensmail.org", Resolved: "alice@example.com", Time: time.Unix(1700000000, 0)}
+	fields := strings.Split(strings.TrimSuffix(signResolution(key, exp), "\r\n"), "\r\n")
+	if len(fields) != 2 || !strings.HasPrefix(fields[0], resolvedHeader+": ") || !strings.HasPrefix(fields[1], signatureHeader+": ") {
+		t.Fatalf("unexpected header: %q", fields)
+	}
+	resolved := strings.TrimPrefix(fields[0], resolvedHeader+":")
+	sig := strings.TrimPrefix(fields[1], signatureHeader+":")
+
+	if got, err := VerifyResolution(pub, resolved, sig); err != nil {
+		t.Error("unexpected err:", err)
+	} else if got != exp {
+		t.Errorf("want: %+v, got: %+v", exp, got)
+	}
+
+	forged := strings.Replace(resolved, "alice@example.com", "mallory@example.com", 1)
+	for _, test := range []struct {
+		name          string
+		pub           ed25519.PublicKey
+		resolved, sig string
+	}{
+		{"otherKey", otherPub, resolved, sig},
+		{"forged", pub, forged, sig},
+		{"malformedSig", pub, resolved, "!"},
+	} {
+		if _, err := VerifyResolution(test.pub, test.resolved, test.sig); err != ErrInvalidSignature {
+			t.Errorf("%s: want err: %v, got: %v", test.name, ErrInvalidSignature, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package ensmail
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// spool holds a message which must be read more than once.  Up to max
+// bytes are held in memory; larger messages are held in a temporary
+// file, which is removed by Close.  If max is 0, messages are always
+// held in memory.
+type spool struct {
+	max  int64
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (sp *spool) Write(p []byte) (int, error) {
+	if sp.file == nil && sp.max > 0 && sp.size+int64(len(p)) > sp.max {
+		// os.CreateTemp creates files only readable by their owner.
+		f, err := os.CreateTemp("", "ensmail-*.eml")
+		if err != nil {
+			return 0, err
+		}
+		sp.file = f
+		if _, err := sp.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if sp.file != nil {
+		n, err = sp.file.Write(p)
+	} else {
+		n, err = sp.buf.Write(p)
+	}
+	sp.size += int64(n)
+	return n, err
+}
+
+// Len returns the number of bytes held.
+func (sp *spool) Len() int64 {
+	return sp.size
+}
+
+// reader returns a reader of the held message, from its start.
+// Readers are independent, and may be read concurrently.
+func (sp *spool) reader() io.Reader {
+	if sp.file != nil {
+		return io.NewSectionReader(sp.file, 0, sp.size)
+	}
+	return bytes.NewReader(sp.buf.Bytes())
+}
+
+// Close releases the held message, and removes its temporary file,
+// if any.
+func (sp *spool) Close() error {
+	sp.buf = bytes.Buffer{}
+	if sp.file == nil {
+		return nil
+	}
+	sp.file.Close()
+	err := os.Remove(sp.file.Name())
+	sp.file = nil
+	return err
+}
@@ -0,0 +1,59 @@
+package ensmail
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	const msg = "Subject: hi\r\n\r\nThis body is longer than the threshold.\r\n"
+
+	for _, test := range []struct {
+		name   string
+		max    int64
+		onDisk bool
+	}{
+		{"unlimited", 0, false},
+		{"underMax", int64(len(msg)), false},
+		{"overMax", 16, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("TMPDIR", dir)
+
+			sp := &spool{max: test.max}
+			// Write in parts, so the threshold is crossed mid-message.
+			for _, part := range []string{msg[:10], msg[10:20], msg[20:]} {
+				if _, err := io.WriteString(sp, part); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if sp.Len() != int64(len(msg)) {
+				t.Errorf("want len: %d, got: %d", len(msg), sp.Len())
+			}
+			if onDisk := sp.file != nil; onDisk != test.onDisk {
+				t.Errorf("want on disk: %t, got: %t", test.onDisk, onDisk)
+			}
+
+			// Every reader reads the whole message.
+			for i := 0; i < 2; i++ {
+				var got strings.Builder
+				if _, err := io.Copy(&got, sp.reader()); err != nil {
+					t.Fatal(err)
+				}
+				if got.String() != msg {
+					t.Errorf("want: %q, got: %q", msg, got.String())
+				}
+			}
+
+			if err := sp.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if files, err := os.ReadDir(dir); err != nil || len(files) != 0 {
+				t.Errorf("temporary files not removed: %v (%v)", files, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package ensmail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"time"
+)
+
+// StaticName is the ENS state of a name in a StaticENSResolver.
+type StaticName struct {
+	// Email is the name's email text record.
+	Email string `json:"email"`
+	// NoResolver is set if the name has no resolver.
+	NoResolver bool `json:"noResolver"`
+}
+
+// StaticENSResolver resolves names from a fixed snapshot of ENS
+// state, rather than from a chain, for testing or offline use.
+type StaticENSResolver struct {
+	names map[string]StaticName // k: normalized name
+}
+
+// NewStaticENSResolver reads a JSON object from r, which maps names
+// (without the ".eth" suffix) to their StaticName, for example:
+//
+//	{
+//		"alice": {"email": "alice@example.com"},
+//		"noemail": {},
+//		"noresolver": {"noResolver": true}
+//	}
+//
+// Names are normalized, so names which only differ in case are the
+// same name.  Snapshots with names which can't be normalized (or
+// which are given more than once), or with emails which aren't valid
+// addresses (ErrInvalidResolved), are rejected.
+func NewStaticENSResolver(r io.Reader) (*StaticENSResolver, error) {
+	var names map[string]StaticName
+	if err := json.NewDecoder(r).Decode(&names); err != nil {
+		return nil, err
+	}
+
+	normalized := make(map[string]StaticName, len(names))
+	for name, n := range names {
+		if _, err := nameHash(name); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		key, err := nameKey(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if _, ok := normalized[key]; ok {
+			return nil, fmt.Errorf("%s: duplicate name", name)
+		}
+		if n.Email != "" {
+			if addr, err := mail.ParseAddress(n.Email); err != nil || addr.Address != n.Email {
+				return nil, fmt.Errorf("%s: %w: %s", name, ErrInvalidResolved, n.Email)
+			}
+		}
+		normalized[key] = n
+	}
+	return &StaticENSResolver{names: normalized}, nil
+}
+
+// Email returns the email record of name, with the same semantics as
+// ENSResolver.Email: names which aren't in the snapshot, or have no
+// resolver, fail with ErrNoResolver, and names without an email
+// record fail with ErrNoEmail.
+func (r *StaticENSResolver) Email(ctx context.Context, name string) (string, error) {
+	defer observeResolve(backendStatic, time.Now())
+
+	if _, err := nameHash(name); err != nil {
+		return "", err
+	}
+	key, err := nameKey(name)
+	if err != nil {
+		return "", err
+	}
+
+	n, ok := r.names[key]
+	if !ok || n.NoResolver {
+		return "", ErrNoResolver
+	} else if n.Email == "" {
+		return "", ErrNoEmail
+	}
+	return n.Email, nil
+}
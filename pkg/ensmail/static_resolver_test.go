@@ -0,0 +1,54 @@
+package ensmail
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStaticENSResolver(t *testing.T) {
+	r, err := NewStaticENSResolver(strings.NewReader(`{
+		"Alice": {"email": "alice@example.com"},
+		"noemail": {},
+		"noresolver": {"noResolver": true, "email": "ignored@example.com"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		email string
+		err   error
+	}{
+		{"alice", "alice@example.com", nil},
+		{"ALICE", "alice@example.com", nil},
+		{"noemail", "", ErrNoEmail},
+		{"noresolver", "", ErrNoResolver},
+		{"noexist", "", ErrNoResolver},
+		{"bad_label", "", ErrInvalidLabel},
+	} {
+		if got, err := r.Email(context.Background(), test.name); !errors.Is(err, test.err) {
+			t.Errorf("%s: want err: %v, got: %v", test.name, test.err, err)
+		} else if got != test.email {
+			t.Errorf("%s: want email: %s, got: %s", test.name, test.email, got)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		snapshot string
+		err      error
+	}{
+		{"malformed", `{"alice": `, nil},
+		{"invalidEmail", `{"alice": {"email": "Alice <alice@example.com>"}}`, ErrInvalidResolved},
+		{"invalidName", `{"bad_label": {"email": "alice@example.com"}}`, ErrInvalidLabel},
+		{"duplicate", `{"alice": {}, "ALICE": {}}`, nil},
+	} {
+		_, err := NewStaticENSResolver(strings.NewReader(test.snapshot))
+		if err == nil || (test.err != nil && !errors.Is(err, test.err)) {
+			t.Errorf("%s: want err: %v, got: %v", test.name, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package ensmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SubgraphResolver resolves names from an ENS subgraph (a GraphQL
+// indexer of ENS events), which may answer faster than a rate
+// limited web3 provider.  As an indexer, it may lag the chain.
+type SubgraphResolver struct {
+	url    string
+	client *http.Client
+}
+
+// NewSubgraphResolver returns a SubgraphResolver which queries the
+// GraphQL endpoint at url with client (or http.DefaultClient, if
+// nil).
+func NewSubgraphResolver(url string, client *http.Client) *SubgraphResolver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &SubgraphResolver{url: url, client: client}
+}
+
+const (
+	subgraphResolverQuery = `query($node: String!) {
+	domain(id: $node) { resolver { id } }
+}`
+	subgraphEmailQuery = `query($resolver: String!) {
+	textChangeds(where: {resolver: $resolver, key: "email"}, orderBy: blockNumber, orderDirection: desc, first: 1) { value }
+}`
+)
+
+// Email returns the email text record of name, with the same
+// semantics as ENSResolver.Email: names which aren't indexed, or have
+// no resolver, fail with ErrNoResolver, and names without an email
+// record fail with ErrNoEmail.
+func (r *SubgraphResolver) Email(ctx context.Context, name string) (string, error) {
+	defer observeResolve(backendSubgraph, time.Now())
+
+	node, err := nameHash(name)
+	if err != nil {
+		return "", err
+	}
+
+	var domain struct {
+		Domain *struct {
+			Resolver *struct {
+				ID string `json:"id"`
+			} `json:"resolver"`
+		} `json:"domain"`
+	}
+	if err := r.query(ctx, subgraphResolverQuery, map[string]string{"node": common.Hash(node).Hex()}, &domain); err != nil {
+		return "", err
+	}
+	if domain.Domain == nil || domain.Domain.Resolver == nil {
+		return "", ErrNoResolver
+	}
+
+	var texts struct {
+		TextChangeds []struct {
+			Value *string `json:"value"`
+		} `json:"textChangeds"`
+	}
+	if err := r.query(ctx, subgraphEmailQuery, map[string]string{"resolver": domain.Domain.Resolver.ID}, &texts); err != nil {
+		return "", err
+	}
+	if len(texts.TextChangeds) == 0 || texts.TextChangeds[0].Value == nil || *texts.TextChangeds[0].Value == "" {
+		return "", ErrNoEmail
+	}
+
+	email := *texts.TextChangeds[0].Value
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return "", ErrInvalidResolved
+	}
+	return email, nil
+}
+
+// query posts a GraphQL query with vars, and decodes the response's
+// data into data.
+func (r *SubgraphResolver) query(ctx context.Context, query string, vars map[string]string, data interface{}) error {
+	body, err := json.Marshal(struct {
+		Query     string            `json:"query"`
+		Variables map[string]string `json:"variables"`
+	}{query, vars})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("subgraph: unexpected status: %s", rsp.Status)
+	}
+
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("subgraph: %s", result.Errors[0].Message)
+	}
+	if len(result.Data) == 0 {
+		return errors.New("subgraph: no data")
+	}
+	return json.Unmarshal(result.Data, data)
+}
@@ -0,0 +1,92 @@
+package ensmail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestSubgraphResolver(t *testing.T) {
+	resolvers := make(map[string]string) // k: node, v: resolver id ("" if none)
+	emails := map[string]string{         // k: resolver id, v: email record
+		"alice":   "alice@example.com",
+		"invalid": "Alice <alice@example.com>",
+	}
+	for _, name := range []string{"alice", "invalid", "noemail"} {
+		resolvers[subgraphNode(t, name)] = name
+	}
+	resolvers[subgraphNode(t, "noresolver")] = ""
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Variables map[string]string `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if node, ok := req.Variables["node"]; ok {
+			if node == subgraphNode(t, "broken") {
+				fmt.Fprint(w, `{"errors": [{"message": "indexing error"}]}`)
+				return
+			}
+			switch id, ok := resolvers[node]; {
+			case !ok:
+				fmt.Fprint(w, `{"data": {"domain": null}}`)
+			case id == "":
+				fmt.Fprint(w, `{"data": {"domain": {"resolver": null}}}`)
+			default:
+				fmt.Fprintf(w, `{"data": {"domain": {"resolver": {"id": %q}}}}`, id)
+			}
+			return
+		}
+
+		if email, ok := emails[req.Variables["resolver"]]; ok {
+			fmt.Fprintf(w, `{"data": {"textChangeds": [{"value": %q}]}}`, email)
+		} else {
+			fmt.Fprint(w, `{"data": {"textChangeds": []}}`)
+		}
+	}))
+	defer srv.Close()
+
+	r := NewSubgraphResolver(srv.URL, srv.Client())
+	for _, test := range []struct {
+		name  string
+		email string
+		err   error
+	}{
+		{"alice", "alice@example.com", nil},
+		{"ALICE", "alice@example.com", nil},
+		{"noemail", "", ErrNoEmail},
+		{"noresolver", "", ErrNoResolver},
+		{"noexist", "", ErrNoResolver},
+		{"invalid", "", ErrInvalidResolved},
+		{"bad_label", "", ErrInvalidLabel},
+	} {
+		if got, err := r.Email(context.Background(), test.name); !errors.Is(err, test.err) {
+			t.Errorf("%s: want err: %v, got: %v", test.name, test.err, err)
+		} else if got != test.email {
+			t.Errorf("%s: want email: %s, got: %s", test.name, test.email, got)
+		}
+	}
+
+	if _, err := r.Email(context.Background(), "broken"); err == nil || errors.Is(err, ErrNoResolver) {
+		t.Errorf("want subgraph err, got: %v", err)
+	}
+}
+
+// subgraphNode returns the subgraph domain id (namehash) of name.
+func subgraphNode(t *testing.T, name string) string {
+	node, err := nameHash(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return common.Hash(node).Hex()
+}
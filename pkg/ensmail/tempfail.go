@@ -0,0 +1,54 @@
+package ensmail
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// TempfailScenario is a cause of temporary failure replies, which
+// senders should back off from rather than retry immediately.
+type TempfailScenario int
+
+const (
+	// TempfailRateLimit replies reject recipients over a RelayPolicy
+	// rate limit (4.7.1).
+	TempfailRateLimit TempfailScenario = iota
+	// TempfailBackpressure replies reject mail while forward DATA
+	// concurrency is saturated (4.3.2, see WithDataConcurrency).
+	TempfailBackpressure
+	// TempfailForwarderDown replies reject sessions while the
+	// forwarding server is unavailable (4.4.1).
+	TempfailForwarderDown
+)
+
+// WithRetryAfter suggests that senders retry replies of scenario
+// after d, by appending the interval to the replies' text (such as
+// "try again later (retry after 60 seconds)").  SMTP has no retry
+// field, so the hint is advisory, but spreading out senders' retries
+// avoids a retry storm once the condition clears.
+func WithRetryAfter(scenario TempfailScenario, d time.Duration) LMTPServerOption {
+	return func(l *LMTPResolveForwarder) {
+		if l.retryAfter == nil {
+			l.retryAfter = make(retryHints)
+		}
+		l.retryAfter[scenario] = d
+	}
+}
+
+// retryHints are the retry intervals suggested for each scenario.
+type retryHints map[TempfailScenario]time.Duration
+
+// reply returns err, with the retry interval of scenario appended to
+// its text if one is set, and err is a temporary SMTP reply.
+func (h retryHints) reply(scenario TempfailScenario, err error) error {
+	d := h[scenario]
+	serr, ok := err.(*smtp.SMTPError)
+	if d <= 0 || !ok || !serr.Temporary() {
+		return err
+	}
+	hinted := *serr
+	hinted.Message = fmt.Sprintf("%s (retry after %d seconds)", serr.Message, int64((d+time.Second-1)/time.Second))
+	return &hinted
+}
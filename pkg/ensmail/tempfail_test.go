@@ -0,0 +1,40 @@
+package ensmail
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestRetryHints(t *testing.T) {
+	hints := retryHints{TempfailRateLimit: 90 * time.Second, TempfailBackpressure: 1500 * time.Millisecond}
+	errOther := errors.New("other")
+	for _, test := range []struct {
+		scenario TempfailScenario
+		err      error
+		exp      string
+	}{
+		{TempfailRateLimit, errPolicyDomainRate, "Too many forwards to this domain, try again later (retry after 90 seconds)"},
+		{TempfailBackpressure, errDataSaturated, "System not accepting messages, try again later (retry after 2 seconds)"},
+		{TempfailForwarderDown, errForwardUnavailable, errForwardUnavailable.Message},
+		{TempfailRateLimit, errPolicyDomain, errPolicyDomain.Message},
+		{TempfailRateLimit, errOther, "other"},
+	} {
+		got := hints.reply(test.scenario, test.err)
+		var serr *smtp.SMTPError
+		if errors.As(got, &serr) {
+			if serr.Message != test.exp || serr.Code != test.err.(*smtp.SMTPError).Code {
+				t.Errorf("%v: want reply: %s, got: %v", test.err, test.exp, serr)
+			}
+		} else if got != test.err {
+			t.Errorf("%v: want err unchanged, got: %v", test.err, got)
+		}
+	}
+
+	// Hints don't modify the shared reply.
+	if errPolicyDomainRate.Message != "Too many forwards to this domain, try again later" {
+		t.Errorf("reply modified: %s", errPolicyDomainRate.Message)
+	}
+}
@@ -0,0 +1,35 @@
+package ensmail
+
+import (
+	"strings"
+)
+
+// VERPEncode returns the VERP (variable envelope return path) address
+// which encodes rcpt into returnPath, so bounces sent to it identify
+// the failed recipient.  For example, rcpt "alice@ensmail.org" is
+// encoded into returnPath "bounces@example.com" as
+// "bounces+alice=ensmail.org@example.com".  returnPath's local-part
+// must not contain "+".
+func VERPEncode(returnPath, rcpt string) string {
+	at := strings.LastIndex(returnPath, "@")
+	rcptAt := strings.LastIndex(rcpt, "@")
+	if at < 0 || rcptAt < 0 {
+		return returnPath
+	}
+	return returnPath[:at] + "+" + rcpt[:rcptAt] + "=" + rcpt[rcptAt+1:] + returnPath[at:]
+}
+
+// VERPDecode returns the return path and recipient encoded in addr by
+// VERPEncode.  ok is false if addr isn't a VERP address.
+func VERPDecode(addr string) (returnPath, rcpt string, ok bool) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return "", "", false
+	}
+	plus := strings.Index(addr[:at], "+")
+	eq := strings.LastIndex(addr[:at], "=")
+	if plus < 0 || eq < plus+2 || eq == at-1 {
+		return "", "", false
+	}
+	return addr[:plus] + addr[at:], addr[plus+1:eq] + "@" + addr[eq+1:at], true
+}
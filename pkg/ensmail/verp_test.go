@@ -0,0 +1,30 @@
+package ensmail
+
+import (
+	"testing"
+)
+
+func TestVERP(t *testing.T) {
+	for _, test := range []struct {
+		returnPath, rcpt, exp string
+	}{
+		{"bounces@example.com", "alice@ensmail.org", "bounces+alice=ensmail.org@example.com"},
+		{"bounces@example.com", "al+ice=x@ensmail.org", "bounces+al+ice=x=ensmail.org@example.com"},
+	} {
+		got := VERPEncode(test.returnPath, test.rcpt)
+		if got != test.exp {
+			t.Errorf("%s: want: %s, got: %s", test.rcpt, test.exp, got)
+		}
+
+		returnPath, rcpt, ok := VERPDecode(got)
+		if !ok || returnPath != test.returnPath || rcpt != test.rcpt {
+			t.Errorf("%s: decoded: %s, %s, %t", got, returnPath, rcpt, ok)
+		}
+	}
+
+	for _, addr := range []string{"bounces@example.com", "bounces+alice@example.com", "bounces+=ensmail.org@example.com", "bounces+alice=@example.com", "bounces"} {
+		if _, _, ok := VERPDecode(addr); ok {
+			t.Errorf("%s: want !ok", addr)
+		}
+	}
+}